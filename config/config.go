@@ -1,12 +1,52 @@
 package config
 
 import (
+	"bytes"
+	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 )
 
+// defaultsJSON is the bottom configuration layer. Its values match the
+// defaults the generator falls back to, so they only make them visible in
+// oxen config show.
+//
+//go:embed defaults.json
+var defaultsJSON []byte
+
+// Names of the configuration layers, as reported by oxen config show. The
+// environment layer is named after each variable.
+const (
+	SourceDefault    = "default"
+	SourceFile       = ".oxen.json"
+	SourceConfigFile = "--config-file"
+	SourceFlag       = "--config"
+)
+
+// envPrefix starts the name of every environment variable that sets a
+// configuration key: OXEN_SITE_NAME sets site_name.
+const envPrefix = "OXEN_"
+
+// envIgnored are OXEN_ variables that are not configuration keys.
+var envIgnored = map[string]bool{"OXEN_DEBUG": true}
+
+// subKeys are the keys objects may have, for objects whose keys are fixed.
+var subKeys = map[string][]string{
+	"related_weights":    {"tags", "links", "text"},
+	"social_card_colors": {"background", "text", "accent"},
+}
+
 type Config struct {
 	SiteName     string `json:"site_name"`
 	BaseURL      string `json:"base_url"`
@@ -14,27 +54,488 @@ type Config struct {
 	Author       string `json:"author"`
 	LicenseName  string `json:"license_name"`
 	LicenseURL   string `json:"license_url"`
+	AttachIDDir  string `json:"attach_id_dir"`
+	ImageWidths  []int  `json:"image_widths"`
+
+	HighlightTheme       string `json:"highlight_theme"`
+	HighlightLineNumbers bool   `json:"highlight_line_numbers"`
+
+	Bibliography     []string `json:"bibliography"`
+	CitationStyle    string   `json:"citation_style"`
+	BibliographyPage bool     `json:"bibliography_page"`
+
+	RelatedWeights map[string]float64 `json:"related_weights"`
+	RelatedCount   int                `json:"related_count"`
+
+	Macros map[string]string `json:"macros"`
+
+	SocialCards      *bool             `json:"social_cards"`
+	SocialCardLayout string            `json:"social_card_layout"`
+	SocialCardColors map[string]string `json:"social_card_colors"`
+
+	PrivateTags       []string `json:"private_tags"`
+	PrivateProperties []string `json:"private_properties"`
+
+	PublishTags          []string `json:"publish_tags"`
+	PublishPaths         []string `json:"publish_paths"`
+	UnpublishedLinks     string   `json:"unpublished_links"`
+	UnpublishedLinkTitle string   `json:"unpublished_link_title"`
+
+	SafeMode bool `json:"safe_mode"`
+
+	SuppressDiagnostics []string `json:"suppress_diagnostics"`
 }
 
-func LoadConfig(configDir string, configJSON string) (*Config, error) {
-	config := &Config{}
+// Options are the configuration layers to merge, besides the defaults and
+// .oxen.json.
+type Options struct {
+	// Dir is the source directory, which holds .oxen.json.
+	Dir string
+	// File is the path given with --config-file, if any.
+	File string
+	// JSON is the JSON given with --config, if any.
+	JSON string
+	// Env is the environment, as from os.Environ.
+	Env []string
+	// Warnings receives warnings about the layers, such as a misspelt
+	// environment variable. It defaults to os.Stderr.
+	Warnings io.Writer
+}
 
-	if configJSON != "" {
-		if err := json.Unmarshal([]byte(configJSON), config); err != nil {
-			return nil, fmt.Errorf("error parsing config JSON: %w", err)
-		}
-		return config, nil
+// Effective is a merged configuration and the layer each value came from.
+type Effective struct {
+	Config *Config
+
+	values  map[string]json.RawMessage
+	sources map[string]string
+}
+
+// LoadConfig merges the configuration for the site in configDir from the
+// defaults, .oxen.json, configFile, OXEN_* environment variables and
+// configJSON, in that order, and validates it.
+func LoadConfig(configDir, configFile, configJSON string) (*Config, error) {
+	effective, err := Load(Options{Dir: configDir, File: configFile, JSON: configJSON, Env: os.Environ()})
+	if err != nil {
+		return nil, err
 	}
+	return effective.Config, nil
+}
+
+// Load merges the layers in opts over the defaults and validates the result.
+// Each layer replaces the values of the keys it sets, except that objects,
+// such as macros, are merged key by key. A null value unsets a key.
+func Load(opts Options) (*Effective, error) {
+	e := &Effective{values: map[string]json.RawMessage{}, sources: map[string]string{}}
 
-	configPath := filepath.Join(configDir, ".oxen.json")
-	if data, err := os.ReadFile(configPath); err == nil {
-		if err := json.Unmarshal(data, config); err != nil {
-			return nil, fmt.Errorf("error parsing .oxen.json: %w", err)
+	if err := e.mergeJSON(SourceDefault, defaultsJSON); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(opts.Dir, ".oxen.json")
+	if data, err := os.ReadFile(path); err == nil {
+		if err := e.mergeJSON(SourceFile, data); err != nil {
+			return nil, err
 		}
-		return config, nil
 	} else if !os.IsNotExist(err) {
 		return nil, fmt.Errorf("error reading .oxen.json: %w", err)
 	}
 
-	return config, nil
+	if opts.File != "" {
+		data, err := os.ReadFile(opts.File)
+		if err != nil {
+			return nil, fmt.Errorf("error reading config file: %w", err)
+		}
+		if err := e.mergeJSON(SourceConfigFile+" "+opts.File, data); err != nil {
+			return nil, err
+		}
+	}
+
+	warnings := opts.Warnings
+	if warnings == nil {
+		warnings = os.Stderr
+	}
+	if err := e.mergeEnv(opts.Env, warnings); err != nil {
+		return nil, err
+	}
+
+	if opts.JSON != "" {
+		if err := e.mergeJSON(SourceFlag, []byte(opts.JSON)); err != nil {
+			return nil, err
+		}
+	}
+
+	merged, err := json.Marshal(e.values)
+	if err != nil {
+		return nil, err
+	}
+	e.Config = &Config{}
+	if err := json.Unmarshal(merged, e.Config); err != nil {
+		return nil, fmt.Errorf("error decoding config: %w", err)
+	}
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// field is a configuration key and the type of its Config field.
+type field struct {
+	key string
+	typ reflect.Type
+}
+
+// fields returns the configuration keys, in the order of Config's fields.
+func fields() []field {
+	t := reflect.TypeFor[Config]()
+	var fs []field
+	for i := range t.NumField() {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fs = append(fs, field{key, t.Field(i).Type})
+	}
+	return fs
+}
+
+func fieldType(key string) (reflect.Type, bool) {
+	for _, f := range fields() {
+		if f.key == key {
+			return f.typ, true
+		}
+	}
+	return nil, false
+}
+
+func keys() []string {
+	var ks []string
+	for _, f := range fields() {
+		ks = append(ks, f.key)
+	}
+	return ks
+}
+
+// mergeJSON merges the JSON object data, from the layer source, over e.
+func (e *Effective) mergeJSON(source string, data []byte) error {
+	var layer map[string]json.RawMessage
+	if err := json.Unmarshal(data, &layer); err != nil {
+		return fmt.Errorf("error parsing %s: %w", source, err)
+	}
+	for _, key := range slices.Sorted(maps.Keys(layer)) {
+		if err := e.merge(source, key, layer[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeEnv merges the OXEN_* variables in env over e. Variables that are
+// not configuration keys are ignored, with a warning to warnings when they
+// look like a misspelt key.
+func (e *Effective) mergeEnv(env []string, warnings io.Writer) error {
+	known := map[string]string{}
+	for _, key := range keys() {
+		known[envPrefix+strings.ToUpper(key)] = key
+	}
+	slices.Sort(env)
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, envPrefix) || envIgnored[name] {
+			continue
+		}
+		key, ok := known[name]
+		if !ok {
+			// Other tools may share the prefix, so unknown variables are
+			// ignored, with a warning only when they look like a typo.
+			if suggestion := suggest(name, slices.Sorted(maps.Keys(known))); suggestion != "" {
+				fmt.Fprintf(warnings, "warning: ignoring unknown environment variable %s; did you mean %s?\n", name, suggestion)
+			}
+			continue
+		}
+		raw, err := envValue(key, value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := e.merge(name, key, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envValue converts the value of an environment variable to JSON for key.
+// Lists are separated by commas, and objects are written as JSON.
+func envValue(key, value string) (json.RawMessage, error) {
+	typ, _ := fieldType(key)
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	var v any
+	switch typ.Kind() {
+	case reflect.String:
+		v = value
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", value)
+		}
+		v = b
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", value)
+		}
+		v = n
+	case reflect.Slice:
+		var items []any
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if typ.Elem().Kind() != reflect.Int {
+				items = append(items, item)
+				continue
+			}
+			n, err := strconv.Atoi(item)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a comma-separated list of integers", value)
+			}
+			items = append(items, n)
+		}
+		v = items
+	default:
+		return json.RawMessage(value), nil
+	}
+	return json.Marshal(v)
+}
+
+// merge sets key to raw, from the layer source, after checking that raw
+// decodes into key's field.
+func (e *Effective) merge(source, key string, raw json.RawMessage) error {
+	typ, ok := fieldType(key)
+	if !ok {
+		return unknownKey(key, source, keys())
+	}
+	if string(bytes.TrimSpace(raw)) == "null" {
+		delete(e.values, key)
+		for name := range e.sources {
+			if name == key || strings.HasPrefix(name, key+".") {
+				delete(e.sources, name)
+			}
+		}
+		return nil
+	}
+	if err := json.Unmarshal(raw, reflect.New(typ).Interface()); err != nil {
+		return fmt.Errorf("%s in %s: %w", key, source, typeError(err))
+	}
+	if typ.Kind() != reflect.Map {
+		e.values[key] = raw
+		e.sources[key] = source
+		return nil
+	}
+
+	// Objects are merged key by key.
+	var object, existing map[string]json.RawMessage
+	json.Unmarshal(raw, &object)
+	json.Unmarshal(e.values[key], &existing)
+	if existing == nil {
+		existing = map[string]json.RawMessage{}
+	}
+	for _, sub := range slices.Sorted(maps.Keys(object)) {
+		if known, ok := subKeys[key]; ok && !slices.Contains(known, sub) {
+			return unknownKey(key+"."+sub, source, prefixed(key+".", known))
+		}
+		existing[sub] = object[sub]
+		e.sources[key+"."+sub] = source
+	}
+	merged, err := json.Marshal(existing)
+	if err != nil {
+		return err
+	}
+	e.values[key] = merged
+	return nil
+}
+
+func prefixed(prefix string, names []string) []string {
+	var out []string
+	for _, name := range names {
+		out = append(out, prefix+name)
+	}
+	return out
+}
+
+// typeError shortens the errors of decoding a value of the wrong type.
+func typeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf("expected %s, got %s", typeName(typeErr.Type), typeErr.Value)
+	}
+	return err
+}
+
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Slice:
+		return "a list of " + typeName(t.Elem()) + "s"
+	case reflect.Map:
+		return "an object of " + typeName(t.Elem()) + "s"
+	case reflect.Int:
+		return "integer"
+	case reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	default:
+		return t.Kind().String()
+	}
+}
+
+// unknownKey returns the error for a key, from source, that isn't one of
+// known, suggesting the closest known key.
+func unknownKey(key, source string, known []string) error {
+	if suggestion := suggest(key, known); suggestion != "" {
+		return fmt.Errorf("unknown key %q in %s; did you mean %q?", key, source, suggestion)
+	}
+	return fmt.Errorf("unknown key %q in %s", key, source)
+}
+
+// suggest returns the name in known closest to name, if it is close enough
+// to be a likely typo, or "".
+func suggest(name string, known []string) string {
+	normalize := func(s string) string {
+		return strings.NewReplacer("_", "", "-", "", ".", "").Replace(strings.ToLower(s))
+	}
+	best, bestDistance := "", len(name)/3+1
+	for _, candidate := range known {
+		if normalize(candidate) == normalize(name) {
+			return candidate
+		}
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// validate checks the merged values that can be checked without building
+// the site, reporting every problem at once, in the order of the keys.
+func (e *Effective) validate() error {
+	c := e.Config
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s (from %s): %s", key, e.Source(key), fmt.Sprintf(format, args...)))
+	}
+	oneOf := func(key, value string, allowed ...string) {
+		if value != "" && !slices.Contains(allowed, value) {
+			fail(key, "%q is not one of %s", value, strings.Join(allowed, ", "))
+		}
+	}
+
+	if c.BaseURL != "" && !isWebURL(c.BaseURL) {
+		fail("base_url", "%q is not an absolute http or https URL", c.BaseURL)
+	}
+	if strings.Contains(c.DefaultImage, "://") && !isWebURL(c.DefaultImage) {
+		fail("default_image", "%q is neither a path nor an http or https URL", c.DefaultImage)
+	}
+	if c.LicenseURL != "" && !isWebURL(c.LicenseURL) {
+		fail("license_url", "%q is not an absolute http or https URL", c.LicenseURL)
+	}
+	if filepath.IsAbs(c.AttachIDDir) {
+		fail("attach_id_dir", "%q must be relative to each org file", c.AttachIDDir)
+	}
+	for _, width := range c.ImageWidths {
+		if width <= 0 {
+			fail("image_widths", "%d is not a positive width", width)
+		}
+	}
+	for _, path := range c.Bibliography {
+		if !filepath.IsLocal(path) {
+			fail("bibliography", "%q is not a path inside the source directory", path)
+		}
+	}
+	oneOf("citation_style", c.CitationStyle, "author-year", "numeric")
+	for _, signal := range slices.Sorted(maps.Keys(c.RelatedWeights)) {
+		if c.RelatedWeights[signal] < 0 {
+			fail("related_weights."+signal, "%v is negative; use 0 to turn the signal off", c.RelatedWeights[signal])
+		}
+	}
+	oneOf("social_card_layout", c.SocialCardLayout, "left", "center")
+	for _, path := range c.PublishPaths {
+		if filepath.IsAbs(path) {
+			fail("publish_paths", "%q must be relative to the source directory", path)
+		}
+	}
+	oneOf("unpublished_links", c.UnpublishedLinks, "text", "span")
+	return errors.Join(errs...)
+}
+
+func isWebURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Source returns the layer key was set by, or "" if it is unset. key may
+// name one key of an object, as in related_weights.text.
+func (e *Effective) Source(key string) string {
+	if source, ok := e.sources[key]; ok {
+		return source
+	}
+	var sources []string
+	for _, name := range slices.Sorted(maps.Keys(e.sources)) {
+		if strings.HasPrefix(name, key+".") && !slices.Contains(sources, e.sources[name]) {
+			sources = append(sources, e.sources[name])
+		}
+	}
+	return strings.Join(sources, ", ")
+}
+
+// Show writes every key of the effective configuration to w, with its value
+// as JSON and the layer it came from. Objects are listed key by key.
+func (e *Effective) Show(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, f := range fields() {
+		raw, ok := e.values[f.key]
+		if !ok {
+			fmt.Fprintf(tw, "%s\t-\t(unset)\n", f.key)
+			continue
+		}
+		if f.typ.Kind() != reflect.Map {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", f.key, compact(raw), e.sources[f.key])
+			continue
+		}
+		var object map[string]json.RawMessage
+		json.Unmarshal(raw, &object)
+		for _, sub := range slices.Sorted(maps.Keys(object)) {
+			name := f.key + "." + sub
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", name, compact(object[sub]), e.sources[name])
+		}
+	}
+	return tw.Flush()
+}
+
+func compact(raw json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return string(raw)
+	}
+	return buf.String()
 }
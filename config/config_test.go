@@ -0,0 +1,111 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadLayers(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, ".oxen.json"), []byte(`{"site_name": "File", "author": "File", "macros": {"a": "A"}, "related_weights": {"text": 0}}`), 0644)
+	extra := filepath.Join(dir, "extra.json")
+	os.WriteFile(extra, []byte(`{"author": "Extra", "license_name": "Extra", "private_tags": null}`), 0644)
+
+	e, err := Load(Options{
+		Dir:  dir,
+		File: extra,
+		Env:  []string{"OXEN_LICENSE_NAME=Env", "OXEN_IMAGE_WIDTHS=320, 640", "OXEN_SAFE_MODE=true", "OXEN_DEBUG=1", "HOME=/root"},
+		JSON: `{"license_name": "Flag", "macros": {"b": "B"}}`,
+	})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	c := e.Config
+	if c.SiteName != "File" || c.Author != "Extra" || c.LicenseName != "Flag" || !c.SafeMode {
+		t.Errorf("later layers should override earlier ones: %+v", c)
+	}
+	if len(c.ImageWidths) != 2 || c.ImageWidths[1] != 640 {
+		t.Errorf("ImageWidths = %v", c.ImageWidths)
+	}
+	if c.Macros["a"] != "A" || c.Macros["b"] != "B" {
+		t.Errorf("objects should merge key by key: %v", c.Macros)
+	}
+	if c.RelatedWeights["text"] != 0 || c.RelatedWeights["tags"] != 1 {
+		t.Errorf("RelatedWeights = %v", c.RelatedWeights)
+	}
+	if c.PrivateTags != nil {
+		t.Errorf("null should unset the default private_tags: %v", c.PrivateTags)
+	}
+	if c.SocialCards == nil || !*c.SocialCards || c.AttachIDDir != "data" {
+		t.Error("unset keys should keep their defaults")
+	}
+
+	for key, want := range map[string]string{
+		"site_name":            SourceFile,
+		"author":               SourceConfigFile + " " + extra,
+		"license_name":         SourceFlag,
+		"image_widths":         "OXEN_IMAGE_WIDTHS",
+		"related_weights.text": SourceFile,
+		"related_weights.tags": SourceDefault,
+		"macros":               SourceFile + ", " + SourceFlag,
+		"private_tags":         "",
+	} {
+		if got := e.Source(key); got != want {
+			t.Errorf("Source(%s) = %q, want %q", key, got, want)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := e.Show(&out); err != nil {
+		t.Fatalf("Show() error = %v", err)
+	}
+	for _, want := range []string{"license_name", `"Flag"`, "macros.b", "private_tags", "(unset)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Show() is missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLoadUnknownVariables(t *testing.T) {
+	var warnings bytes.Buffer
+	e, err := Load(Options{Dir: t.TempDir(), Env: []string{"OXEN_BASEURL=x", "OXEN_HOME=/opt/oxen"}, Warnings: &warnings})
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if e.Config.BaseURL != "" {
+		t.Errorf("BaseURL = %q, want unknown variables ignored", e.Config.BaseURL)
+	}
+	if want := "warning: ignoring unknown environment variable OXEN_BASEURL; did you mean OXEN_BASE_URL?\n"; warnings.String() != want {
+		t.Errorf("warnings = %q, want %q", warnings.String(), want)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"unknown key", Options{JSON: `{"site_nmae": "x"}`}, `unknown key "site_nmae" in --config; did you mean "site_name"?`},
+		{"other spelling", Options{JSON: `{"baseURL": "x"}`}, `did you mean "base_url"?`},
+		{"unknown object key", Options{JSON: `{"related_weights": {"txt": 1}}`}, `did you mean "related_weights.text"?`},
+		{"wrong type", Options{JSON: `{"related_count": "5"}`}, "related_count in --config: expected integer, got string"},
+		{"bad variable", Options{Env: []string{"OXEN_SAFE_MODE=maybe"}}, `OXEN_SAFE_MODE: "maybe" is not true or false`},
+		{"missing file", Options{File: "/nonexistent/oxen.json"}, "error reading config file"},
+		{"url", Options{JSON: `{"base_url": "example.com"}`}, `base_url (from --config): "example.com" is not an absolute http or https URL`},
+		{"path", Options{Env: []string{"OXEN_BIBLIOGRAPHY=../refs.bib"}}, `bibliography (from OXEN_BIBLIOGRAPHY): "../refs.bib" is not a path inside the source directory`},
+		{"enum", Options{JSON: `{"citation_style": "apa"}`}, `"apa" is not one of author-year, numeric`},
+		{"weight", Options{JSON: `{"related_weights": {"links": -1}}`}, "related_weights.links (from --config): -1 is negative"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Dir = t.TempDir()
+			_, err := Load(tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package generator
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// defaultAttachIDDir mirrors org-attach-id-dir: the directory, relative to the
+// org file, under which ID-based attachment directories live.
+const defaultAttachIDDir = "data"
+
+func attachIDDir(ctx BuildContext) string {
+	if ctx.AttachIDDir != "" {
+		return ctx.AttachIDDir
+	}
+	return defaultAttachIDDir
+}
+
+// attachmentDirOf returns the org-attach directory declared by a property
+// drawer, relative to the org file's directory, or inherited if the drawer
+// declares none. :DIR: (or the older :ATTACH_DIR:) wins over :ID:, which is
+// mapped onto org-attach's default layout: <idDir>/ab/cdef-...
+func attachmentDirOf(props *org.PropertyDrawer, inherited, idDir string) string {
+	if dir, ok := props.Get("DIR"); ok && dir != "" {
+		return dir
+	}
+	if dir, ok := props.Get("ATTACH_DIR"); ok && dir != "" {
+		return dir
+	}
+	if id, ok := props.Get("ID"); ok && len(id) > 2 {
+		return filepath.Join(idDir, id[:2], id[2:])
+	}
+	return inherited
+}
+
+// fileAttachmentDir returns the attachment directory declared by the
+// file-level property drawer, if any.
+func fileAttachmentDir(doc *org.Document, idDir string) string {
+	if doc == nil {
+		return ""
+	}
+	for _, node := range doc.Nodes {
+		switch n := node.(type) {
+		case org.PropertyDrawer:
+			return attachmentDirOf(&n, "", idDir)
+		case org.Headline:
+			return ""
+		}
+	}
+	return ""
+}
+
+// resolveAttachment maps the URL of an attachment: link, found in filePath
+// under attachDir, to a path relative to the source root.
+func resolveAttachment(root, filePath, attachDir, url string) (string, error) {
+	name := strings.TrimPrefix(url, "attachment:")
+	if i := strings.Index(name, "::"); i >= 0 {
+		name = name[:i]
+	}
+	if attachDir == "" {
+		return "", fmt.Errorf("no :ID:, :DIR: or :ATTACH_DIR: property owns %s", url)
+	}
+
+	var absPath string
+	if filepath.IsAbs(attachDir) {
+		absPath = filepath.Join(attachDir, name)
+	} else {
+		absPath = filepath.Join(root, filepath.Dir(filePath), attachDir, name)
+	}
+	relPath, err := filepath.Rel(root, absPath)
+	if err != nil || !filepath.IsLocal(relPath) {
+		return "", fmt.Errorf("attachment %s is outside the source root", absPath)
+	}
+	return relPath, nil
+}
+
+// extractAttachmentsFromAST returns the root-relative paths of every file
+// referenced by an attachment: link in doc, resolved against the owning
+// headline's attachment directory.
+func extractAttachmentsFromAST(doc *org.Document, filePath, root, idDir string, diagnostics *Diagnostics) []string {
+	found := map[string]bool{}
+
+	var walk func(nodes []org.Node, attachDir string)
+	walk = func(nodes []org.Node, attachDir string) {
+		walkOrgNodes(nodes, func(node org.Node) bool {
+			switch n := node.(type) {
+			case org.Headline:
+				walk(orgNodeChildren(n), attachmentDirOf(n.Properties, attachDir, idDir))
+				return false
+			case org.RegularLink:
+				if n.Protocol == "attachment" {
+					if relPath, err := resolveAttachment(root, filePath, attachDir, n.URL); err == nil {
+						found[relPath] = true
+					} else {
+						diagnostics.Warn("attachment-unresolved", filePath, diagnostics.Line(filePath, n.URL), "unresolvable attachment link %s: %v", n.URL, err)
+					}
+				}
+			}
+			return true
+		})
+	}
+	walk(doc.Nodes, fileAttachmentDir(doc, idDir))
+
+	if len(found) == 0 {
+		return nil
+	}
+	attachments := make([]string, 0, len(found))
+	for relPath := range found {
+		attachments = append(attachments, relPath)
+	}
+	sort.Strings(attachments)
+	return attachments
+}
@@ -0,0 +1,77 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentLinks(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-attach-")
+	defer CleanupTempDir(tmpDir)
+	destDir := filepath.Join(tmpDir, "public")
+
+	CreateTestDirStructure(tmpDir, []string{
+		"notes/data/55/0e8400-e29b-41d4-a716-446655440000",
+		"notes/files/manual",
+	})
+	CreateTestOrgFile(tmpDir, "notes/data/55/0e8400-e29b-41d4-a716-446655440000/paper.pdf", "pdf")
+	CreateTestOrgFile(tmpDir, "notes/data/55/0e8400-e29b-41d4-a716-446655440000/figure.png", "png")
+	CreateTestOrgFile(tmpDir, "notes/files/manual/guide.txt", "guide")
+	CreateTestOrgFile(tmpDir, "notes/papers.org", `* Paper
+:PROPERTIES:
+:ID:       550e8400-e29b-41d4-a716-446655440000
+:END:
+Read [[attachment:paper.pdf][the paper]].
+** Figures
+[[attachment:figure.png]]
+* Manual
+:PROPERTIES:
+:DIR:      files/manual
+:END:
+See [[attachment:guide.txt][the guide]].
+* Orphan
+[[attachment:missing.pdf][nothing owns this]]
+`)
+
+	ctx := BuildContext{Root: tmpDir, DestDir: destDir, ForceRebuild: true}
+	fi, err := processFile("notes/papers.org", ctx)
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+
+	expected := []string{
+		"notes/data/55/0e8400-e29b-41d4-a716-446655440000/figure.png",
+		"notes/data/55/0e8400-e29b-41d4-a716-446655440000/paper.pdf",
+		"notes/files/manual/guide.txt",
+	}
+	if !reflect.DeepEqual(fi.Attachments, expected) {
+		t.Errorf("Attachments = %v, want %v", fi.Attachments, expected)
+	}
+
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, *fi, ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	for _, want := range []string{
+		`<a href="data/55/0e8400-e29b-41d4-a716-446655440000/paper.pdf">the paper</a>`,
+		`<img src="data/55/0e8400-e29b-41d4-a716-446655440000/figure.png"`,
+		`<a href="files/manual/guide.txt">the guide</a>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML missing %q", want)
+		}
+	}
+
+	result := CopyAttachments(&ProcessedFiles{Files: []FileInfo{*fi}}, ctx)
+	if result.AttachmentsCopied != 3 || result.Errors != 0 {
+		t.Errorf("CopyAttachments() copied %d with %d errors, want 3 and 0", result.AttachmentsCopied, result.Errors)
+	}
+	for _, relPath := range expected {
+		if _, err := os.Stat(filepath.Join(destDir, relPath)); err != nil {
+			t.Errorf("attachment %s not copied: %v", relPath, err)
+		}
+	}
+}
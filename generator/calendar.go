@@ -0,0 +1,371 @@
+package generator
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+const (
+	calendarFile = "calendar.ics"
+	eventsPage   = "events.html"
+)
+
+// Event kinds.
+const (
+	EventScheduled = "scheduled"
+	EventDeadline  = "deadline"
+	EventTimestamp = "timestamp"
+)
+
+var (
+	// rePlanningKeyword matches the planning keyword before a timestamp.
+	rePlanningKeyword = regexp.MustCompile(`(SCHEDULED|DEADLINE):\s*$`)
+	rePlanningLine    = regexp.MustCompile(`^\s*(SCHEDULED|DEADLINE|CLOSED):`)
+	// reTimeRange matches an active timestamp with a time range, which
+	// go-org leaves as text: <2024-06-01 Sat 18:00-20:00>.
+	reTimeRange = regexp.MustCompile(`<(\d{4}-\d{2}-\d{2})(?: [A-Za-z]+)? (\d{2}:\d{2})-(\d{2}:\d{2})>`)
+	reRepeater  = regexp.MustCompile(`^\+(\d+)([dwmy])$`)
+)
+
+// headlineProperties returns the property drawer of h. go-org only attaches
+// a drawer directly below the headline, so one following a planning line
+// (SCHEDULED:, DEADLINE:) is found among the headline's children instead.
+func headlineProperties(h org.Headline) *org.PropertyDrawer {
+	if h.Properties != nil {
+		return h.Properties
+	}
+	if len(h.Children) >= 2 {
+		if p, ok := h.Children[0].(org.Paragraph); ok && isPlanningLine(p) {
+			if drawer, ok := h.Children[1].(org.PropertyDrawer); ok {
+				return &drawer
+			}
+		}
+	}
+	return nil
+}
+
+func isPlanningLine(p org.Paragraph) bool {
+	if len(p.Children) == 0 {
+		return false
+	}
+	text, ok := p.Children[0].(org.Text)
+	return ok && rePlanningLine.MatchString(text.Content)
+}
+
+// extractEventsFromAST collects the SCHEDULED:, DEADLINE: and active
+// timestamps of doc. Each event belongs to its nearest enclosing headline;
+// timestamps above the first headline are titled after the document.
+func extractEventsFromAST(doc *org.Document, title string) []Event {
+	var events []Event
+
+	var walk func(nodes []org.Node, h *org.Headline)
+	walk = func(nodes []org.Node, h *org.Headline) {
+		for _, node := range nodes {
+			switch n := node.(type) {
+			case org.Headline:
+				if n.IsExcluded(doc) {
+					continue
+				}
+				walk(n.Children, &n)
+			case org.Paragraph:
+				events = append(events, paragraphEvents(n, h, title)...)
+			default:
+				walk(orgNodeChildren(node), h)
+			}
+		}
+	}
+	walk(doc.Nodes, nil)
+
+	// Number the timestamps of each headline so their UIDs stay distinct.
+	counts := map[string]int{}
+	for i := range events {
+		if events[i].Kind == EventTimestamp {
+			key := events[i].UID
+			if n := counts[key]; n > 0 {
+				events[i].UID = fmt.Sprintf("TS%d-%s", n, strings.TrimPrefix(key, "TS-"))
+			}
+			counts[key]++
+		}
+	}
+	return events
+}
+
+// paragraphEvents returns the events in the timestamps of one paragraph.
+func paragraphEvents(p org.Paragraph, h *org.Headline, title string) []Event {
+	base := Event{Summary: title}
+	id := ""
+	if h != nil {
+		base.Summary = strings.TrimSpace(org.String(h.Title...))
+		base.Anchor = h.ID()
+		if props := headlineProperties(*h); props != nil {
+			id, _ = props.Get("ID")
+		}
+	}
+
+	var events []Event
+	children := p.Children
+	for i := 0; i < len(children); i++ {
+		switch n := children[i].(type) {
+		case org.Timestamp:
+			event := base
+			event.Start, event.AllDay, event.Repeat = n.Time, n.IsDate, n.Interval
+			event.Kind = EventTimestamp
+			if i > 0 {
+				if text, ok := children[i-1].(org.Text); ok {
+					if m := rePlanningKeyword.FindStringSubmatch(text.Content); m != nil {
+						event.Kind = strings.ToLower(m[1])
+					}
+				}
+			}
+			// <start>--<end> is a single ranged event.
+			if i+2 < len(children) {
+				if text, ok := children[i+1].(org.Text); ok && text.Content == "--" {
+					if end, ok := children[i+2].(org.Timestamp); ok {
+						event.End = end.Time
+						i += 2
+					}
+				}
+			}
+			event.UID = eventUID(event, id)
+			events = append(events, event)
+		case org.Text:
+			for _, m := range reTimeRange.FindAllStringSubmatch(n.Content, -1) {
+				start, err1 := time.Parse("2006-01-02 15:04", m[1]+" "+m[2])
+				end, err2 := time.Parse("2006-01-02 15:04", m[1]+" "+m[3])
+				if err1 != nil || err2 != nil {
+					continue
+				}
+				event := base
+				event.Kind, event.Start, event.End = EventTimestamp, start, end
+				event.UID = eventUID(event, id)
+				events = append(events, event)
+			}
+		}
+	}
+	return events
+}
+
+// eventUID derives a stable UID the way org-icalendar does: the headline's
+// :ID: prefixed by the kind of event. Headlines without an ID fall back to
+// a hash of the event.
+func eventUID(e Event, id string) string {
+	prefix := map[string]string{EventScheduled: "SC-", EventDeadline: "DL-", EventTimestamp: "TS-"}[e.Kind]
+	if id == "" {
+		sum := sha1.Sum([]byte(e.Summary + "\x00" + e.Anchor + "\x00" + e.Start.Format(time.RFC3339)))
+		id = hex.EncodeToString(sum[:])
+	}
+	return prefix + id
+}
+
+// icsEscape escapes a TEXT value (RFC 5545 section 3.3.11).
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icsFold writes a content line, folded so no line is longer than 75 octets
+// without splitting a UTF-8 sequence (RFC 5545 section 3.1). Continuation
+// lines start with a space, which counts towards their 75.
+func icsFold(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// icsRepeat converts an org repeater (+1w) to an RRULE value.
+func icsRepeat(repeat string) string {
+	m := reRepeater.FindStringSubmatch(repeat)
+	if m == nil {
+		return ""
+	}
+	freq := map[string]string{"d": "DAILY", "w": "WEEKLY", "m": "MONTHLY", "y": "YEARLY"}[m[2]]
+	return "FREQ=" + freq + ";INTERVAL=" + m[1]
+}
+
+// renderICS renders events as an iCalendar file. Org timestamps carry no
+// time zone, so times are written as floating local times.
+func renderICS(name string, events []Event, ctx BuildContext) []byte {
+	var b strings.Builder
+	icsFold(&b, "BEGIN:VCALENDAR")
+	icsFold(&b, "VERSION:2.0")
+	icsFold(&b, "PRODID:-//Oxen//Oxen static site generator//EN")
+	icsFold(&b, "CALSCALE:GREGORIAN")
+	icsFold(&b, "X-WR-CALNAME:"+icsEscape(name))
+	for _, e := range events {
+		icsFold(&b, "BEGIN:VEVENT")
+		icsFold(&b, "UID:"+icsEscape(e.UID))
+		icsFold(&b, "DTSTAMP:"+e.ModTime.UTC().Format("20060102T150405Z"))
+		if e.AllDay {
+			end := e.Start
+			if !e.End.IsZero() {
+				end = e.End
+			}
+			icsFold(&b, "DTSTART;VALUE=DATE:"+e.Start.Format("20060102"))
+			icsFold(&b, "DTEND;VALUE=DATE:"+end.AddDate(0, 0, 1).Format("20060102"))
+		} else {
+			icsFold(&b, "DTSTART:"+e.Start.Format("20060102T150405"))
+			if !e.End.IsZero() {
+				icsFold(&b, "DTEND:"+e.End.Format("20060102T150405"))
+			}
+		}
+		if rule := icsRepeat(e.Repeat); rule != "" {
+			icsFold(&b, "RRULE:"+rule)
+		}
+		summary := e.Summary
+		switch e.Kind {
+		case EventScheduled:
+			summary = "S: " + summary
+		case EventDeadline:
+			summary = "DL: " + summary
+		}
+		icsFold(&b, "SUMMARY:"+icsEscape(summary))
+		if ctx.BaseURL != "" {
+			icsFold(&b, "URL:"+strings.TrimSuffix(ctx.BaseURL, "/")+e.Href())
+		}
+		if len(e.Tags) > 0 {
+			categories := make([]string, len(e.Tags))
+			for i, tag := range e.Tags {
+				categories[i] = icsEscape(tag)
+			}
+			icsFold(&b, "CATEGORIES:"+strings.Join(categories, ","))
+		}
+		icsFold(&b, "END:VEVENT")
+	}
+	icsFold(&b, "END:VCALENDAR")
+	return []byte(b.String())
+}
+
+// fileEvents returns the events of files, stamped with their file, sorted by
+// start time.
+func fileEvents(files []FileInfo) []Event {
+	var events []Event
+	for _, fi := range files {
+		for _, e := range fi.Events {
+			e.Path, e.Tags, e.ModTime = fi.Path, fi.Tags, fi.ModTime
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].Start.Equal(events[j].Start) {
+			return events[i].Start.Before(events[j].Start)
+		}
+		return events[i].UID < events[j].UID
+	})
+	return events
+}
+
+// writeIfChanged writes data to path unless the file already holds it.
+// Reports whether it wrote. A dry run always records the data.
+func writeIfChanged(ctx BuildContext, path string, data []byte) (bool, error) {
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, data) && ctx.DryRun == nil {
+		skipOutput(ctx, path)
+		return false, nil
+	}
+	return true, writeOutput(ctx, path, data)
+}
+
+// GenerateCalendars writes calendar.ics with every event on the site, and a
+// tag-<tag>.ics next to each tag page. Returns a GenerationResult.
+func GenerateCalendars(procFiles *ProcessedFiles, ctx BuildContext) (result GenerationResult) {
+	slog.Debug("Starting Phase 3i: generating calendars")
+
+	feeds := map[string][]FileInfo{calendarFile: procFiles.Files}
+	names := map[string]string{calendarFile: ctx.SiteName}
+	for _, tag := range procFiles.Index.Tags() {
+		feeds["tag-"+tag+".ics"] = procFiles.Index.FilesWithTag(tag)
+		names["tag-"+tag+".ics"] = strings.TrimSpace(ctx.SiteName + " " + tag)
+	}
+
+	for name, files := range feeds {
+		events := fileEvents(files)
+		if len(events) == 0 && name != calendarFile {
+			continue
+		}
+		wrote, err := writeIfChanged(ctx, filepath.Join(ctx.DestDir, name), renderICS(names[name], events, ctx))
+		if err != nil {
+			ctx.Diagnostics.Error("output", "", 0, "failed to write %s: %v", name, err)
+			result.Errors++
+		} else if wrote {
+			result.FilesGenerated++
+		} else {
+			result.FilesSkipped++
+		}
+	}
+
+	slog.Debug("Phase 3i complete", "calendars", len(feeds))
+	return
+}
+
+// GenerateEventsPage writes events.html, listing events that have not yet
+// ended, soonest first, with the events template. Returns a GenerationResult.
+func GenerateEventsPage(procFiles *ProcessedFiles, ctx BuildContext, tmpl *template.Template) (result GenerationResult) {
+	slog.Debug("Starting Phase 3j: generating the events page")
+
+	now := buildTime(ctx)
+	// Org times are floating, so compare them as wall-clock times.
+	today := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, time.UTC)
+	var upcoming []Event
+	for _, e := range fileEvents(procFiles.Files) {
+		end := e.Start
+		if !e.End.IsZero() {
+			end = e.End
+		}
+		if e.AllDay {
+			end = end.AddDate(0, 0, 1)
+		}
+		if end.After(today) || e.Repeat != "" {
+			upcoming = append(upcoming, e)
+		}
+	}
+
+	eventsData := EventsPageData{
+		Upcoming:     upcoming,
+		SiteName:     ctx.SiteName,
+		BaseURL:      ctx.BaseURL,
+		DefaultImage: ctx.DefaultImage,
+		Author:       ctx.Author,
+		LicenseName:  ctx.LicenseName,
+		LicenseURL:   ctx.LicenseURL,
+		Data:         procFiles.Data,
+	}
+
+	var outputBuf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&outputBuf, "events-template.html", eventsData); err != nil {
+		ctx.Diagnostics.Error("template", "", 0, "failed to execute events-template.html: %v", err)
+		result.Errors = 1
+		return
+	}
+
+	wrote, err := writeIfChanged(ctx, filepath.Join(ctx.DestDir, eventsPage), outputBuf.Bytes())
+	if err != nil {
+		ctx.Diagnostics.Error("output", "", 0, "failed to write %s: %v", eventsPage, err)
+		result.Errors = 1
+		return
+	}
+	if wrote {
+		result.FilesGenerated = 1
+	} else {
+		result.FilesSkipped = 1
+	}
+	slog.Debug("Phase 3j complete", "upcoming", len(upcoming))
+	return
+}
@@ -0,0 +1,208 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractEvents(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-calendar-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "events.org", `#+title: Events
+Launch party <2030-01-05 Sat>.
+
+* Weekly review
+SCHEDULED: <2030-01-07 Mon 09:30 +1w>
+:PROPERTIES:
+:ID: 22222222-2222-4222-8222-222222222222
+:END:
+* Taxes
+DEADLINE: <2030-04-15 Mon>
+* Conference
+<2030-03-01 Fri>--<2030-03-03 Sun>
+* Dinner
+<2030-02-14 Thu 18:00-20:00> and again <2030-02-15 Fri>.
+* COMMENT Hidden
+<2030-05-01 Wed>
+`)
+	fi, err := processFile("events.org", BuildContext{Root: tmpDir})
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+
+	events := fi.Events
+	if len(events) != 6 {
+		t.Fatalf("Events = %+v, want 6", events)
+	}
+	if e := events[0]; e.Kind != EventTimestamp || e.Summary != "Events" || !e.AllDay || e.Anchor != "" {
+		t.Errorf("document timestamp = %+v", e)
+	}
+	if e := events[1]; e.Kind != EventScheduled || e.UID != "SC-22222222-2222-4222-8222-222222222222" ||
+		e.Repeat != "+1w" || e.AllDay || e.Start.Format("2006-01-02 15:04") != "2030-01-07 09:30" {
+		t.Errorf("scheduled event = %+v", e)
+	}
+	if e := events[2]; e.Kind != EventDeadline || !strings.HasPrefix(e.UID, "DL-") || e.Summary != "Taxes" {
+		t.Errorf("deadline event = %+v", e)
+	}
+	if e := events[3]; e.End.Format("2006-01-02") != "2030-03-03" || !e.AllDay {
+		t.Errorf("ranged event = %+v", e)
+	}
+	if e := events[4]; e.AllDay || e.Start.Format("15:04") != "18:00" || e.End.Format("15:04") != "20:00" {
+		t.Errorf("time range event = %+v", e)
+	}
+	if events[4].UID == events[5].UID {
+		t.Errorf("timestamps under one headline share UID %s", events[4].UID)
+	}
+}
+
+func TestRenderICS(t *testing.T) {
+	events := []Event{
+		{
+			UID: "SC-abc", Kind: EventScheduled, Summary: "Review; notes, " + strings.Repeat("ü", 40),
+			Start: time.Date(2030, 1, 7, 9, 30, 0, 0, time.UTC), Repeat: "+2w",
+			Path: "dir/page.org", Anchor: "headline-1", Tags: []string{"work"},
+			ModTime: time.Date(2029, 12, 1, 12, 0, 0, 0, time.UTC),
+		},
+		{UID: "TS-def", Kind: EventTimestamp, Summary: "Holiday", AllDay: true,
+			Start: time.Date(2030, 3, 1, 0, 0, 0, 0, time.UTC), End: time.Date(2030, 3, 3, 0, 0, 0, 0, time.UTC),
+			Path: "page.org"},
+	}
+	ics := string(renderICS("Site", events, BuildContext{BaseURL: "https://example.com/"}))
+
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\nVERSION:2.0\r\n",
+		"UID:SC-abc\r\n",
+		"DTSTAMP:20291201T120000Z\r\n",
+		"DTSTART:20300107T093000\r\n",
+		"RRULE:FREQ=WEEKLY;INTERVAL=2\r\n",
+		`SUMMARY:S: Review\; notes\, `,
+		"URL:https://example.com/dir/page.html#headline-1\r\n",
+		"CATEGORIES:work\r\n",
+		"DTSTART;VALUE=DATE:20300301\r\nDTEND;VALUE=DATE:20300304\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(ics, want) {
+			t.Errorf("calendar missing %q:\n%s", want, ics)
+		}
+	}
+	for _, line := range strings.Split(ics, "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line longer than 75 octets: %q", line)
+		}
+	}
+}
+
+func TestICSFold(t *testing.T) {
+	for _, line := range []string{
+		"DESCRIPTION:" + strings.Repeat("a", 300),
+		"SUMMARY:" + strings.Repeat("ü", 100),
+		"SUMMARY:" + strings.Repeat("a€", 80),
+	} {
+		var b strings.Builder
+		icsFold(&b, line)
+		folded := b.String()
+		for i, part := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+			if len(part) > 75 {
+				t.Errorf("line %d is %d octets: %q", i, len(part), part)
+			}
+			if i > 0 && !strings.HasPrefix(part, " ") {
+				t.Errorf("continuation line %d doesn't start with a space: %q", i, part)
+			}
+		}
+		if unfolded := strings.ReplaceAll(folded, "\r\n ", ""); unfolded != line+"\r\n" {
+			t.Errorf("unfolding gives %q, want %q", unfolded, line)
+		}
+	}
+}
+
+func TestGenerateCalendars(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-calendar-")
+	defer CleanupTempDir(tmpDir)
+
+	work := FileInfo{Path: "work.org", Tags: []string{"work"}, Events: []Event{
+		{UID: "DL-1", Kind: EventDeadline, Summary: "Report", AllDay: true, Start: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}}
+	misc := FileInfo{Path: "misc.org", Tags: []string{"misc"}}
+	procFiles := &ProcessedFiles{Files: []FileInfo{work, misc}, Index: NewSiteIndex([]FileInfo{work, misc})}
+	ctx := BuildContext{DestDir: filepath.Join(tmpDir, "public"), SiteName: "Test"}
+
+	if result := GenerateCalendars(procFiles, ctx); result.FilesGenerated != 2 || result.Errors != 0 {
+		t.Fatalf("GenerateCalendars() = %+v", result)
+	}
+	data, err := os.ReadFile(filepath.Join(ctx.DestDir, "tag-work.ics"))
+	if err != nil {
+		t.Fatalf("Failed to read tag-work.ics: %v", err)
+	}
+	if !strings.Contains(string(data), "SUMMARY:DL: Report") {
+		t.Errorf("tag-work.ics missing the deadline:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(ctx.DestDir, "tag-misc.ics")); !os.IsNotExist(err) {
+		t.Errorf("tag-misc.ics written for a tag without events")
+	}
+
+	if result := GenerateCalendars(procFiles, ctx); result.FilesSkipped != 2 {
+		t.Errorf("GenerateCalendars() rewrote unchanged calendars: %+v", result)
+	}
+}
+
+func TestGenerateEventsPage(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-calendar-")
+	defer CleanupTempDir(tmpDir)
+
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+
+	next := time.Now().AddDate(1, 0, 0)
+	procFiles := &ProcessedFiles{Files: []FileInfo{{Path: "a.org", Events: []Event{
+		{UID: "TS-old", Kind: EventTimestamp, Summary: "Past", AllDay: true, Start: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{UID: "TS-new", Kind: EventTimestamp, Summary: "Future", Anchor: "headline-1",
+			Start: time.Date(next.Year(), 6, 1, 18, 0, 0, 0, time.UTC)},
+	}}}}
+	ctx := BuildContext{DestDir: filepath.Join(tmpDir, "public"), SiteName: "Test"}
+
+	if result := GenerateEventsPage(procFiles, ctx, tmpls.Events); result.FilesGenerated != 1 || result.Errors != 0 {
+		t.Fatalf("GenerateEventsPage() = %+v", result)
+	}
+	data, err := os.ReadFile(filepath.Join(ctx.DestDir, "events.html"))
+	if err != nil {
+		t.Fatalf("Failed to read events.html: %v", err)
+	}
+	html := string(data)
+	if !strings.Contains(html, `<a href="/a.html#headline-1">Future</a>`) ||
+		!strings.Contains(html, `datetime="`+next.Format("2006")+`-06-01T18:00"`) {
+		t.Errorf("events.html missing the upcoming event:\n%s", html)
+	}
+	if strings.Contains(html, "Past") {
+		t.Errorf("events.html lists a past event:\n%s", html)
+	}
+}
+
+func TestTimestampMarkup(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-calendar-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "page.org", "#+title: Page\n* Task\nSCHEDULED: <2030-01-07 Mon 09:30 +1w>\n\nMeet <2030-02-14 Thu 18:00-20:00>.\n")
+	ctx := BuildContext{Root: tmpDir}
+	fi, err := processFile("page.org", ctx)
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, *fi, ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	for _, want := range []string{
+		`<time class="timestamp" datetime="2030-01-07T09:30">&lt;2030-01-07 Mon 09:30 +1w&gt;</time>`,
+		`<time class="timestamp" datetime="2030-02-14T18:00">&lt;2030-02-14 Thu 18:00-20:00&gt;</time>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML missing %s:\n%s", want, html)
+		}
+	}
+}
@@ -0,0 +1,788 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+const (
+	citationStyleAuthorYear = "author-year"
+	citationStyleNumeric    = "numeric"
+)
+
+var (
+	// reCitation matches an org-cite citation: [cite/style:prefix @key suffix; ...].
+	reCitation = regexp.MustCompile(`\[cite(?:/([\w/-]+))?:([^\]]*@[^\]]*)\]`)
+	// reCiteKey matches a cite key inside a citation or a ROAM_REFS property.
+	reCiteKey = regexp.MustCompile(`(?:@|\bcite:)([\w:.#$%&+?<>~/-]*\w)`)
+)
+
+// BibEntry is one parsed BibTeX entry. Field names are lower case and values
+// have been stripped of TeX markup.
+type BibEntry struct {
+	Key    string
+	Type   string
+	Fields map[string]string
+}
+
+// citationReference is one cited work within a citation, with the text
+// around it.
+type citationReference struct {
+	key    string
+	prefix string
+	suffix string
+}
+
+// citation is a parsed [cite:...] object.
+type citation struct {
+	style        string
+	globalPrefix string
+	globalSuffix string
+	references   []citationReference
+}
+
+// parseCitation splits the body of a [cite:...] into its references. Segments
+// without a key before the first or after the last reference are the global
+// prefix and suffix.
+func parseCitation(style, body string) citation {
+	c := citation{style: style}
+	segments := strings.Split(body, ";")
+	for i, segment := range segments {
+		m := reCiteKey.FindStringSubmatchIndex(segment)
+		if m == nil || !strings.HasPrefix(segment[m[0]:], "@") {
+			if len(c.references) == 0 && i == 0 {
+				c.globalPrefix = strings.TrimSpace(segment)
+			} else if i == len(segments)-1 {
+				c.globalSuffix = strings.TrimSpace(segment)
+			}
+			continue
+		}
+		c.references = append(c.references, citationReference{
+			key:    segment[m[2]:m[3]],
+			prefix: strings.TrimSpace(segment[:m[0]]),
+			suffix: strings.TrimSpace(segment[m[1]:]),
+		})
+	}
+	return c
+}
+
+// extractCitationsFromAST returns the keys cited in doc, in order of first
+// citation.
+func extractCitationsFromAST(doc *org.Document) []string {
+	var keys []string
+	seen := map[string]bool{}
+	walkOrgNodes(doc.Nodes, func(node org.Node) bool {
+		if text, ok := node.(org.Text); ok && !text.IsRaw {
+			for _, m := range reCitation.FindAllStringSubmatch(text.Content, -1) {
+				for _, ref := range parseCitation(m[1], m[2]).references {
+					if !seen[ref.key] {
+						seen[ref.key] = true
+						keys = append(keys, ref.key)
+					}
+				}
+			}
+		}
+		return true
+	})
+	return keys
+}
+
+// extractCiteRefsFromAST returns the keys listed in the file-level
+// :ROAM_REFS: property, which marks the note as the reference page for
+// those works.
+func extractCiteRefsFromAST(doc *org.Document) []string {
+	for _, node := range doc.Nodes {
+		switch n := node.(type) {
+		case org.PropertyDrawer:
+			refs, _ := n.Get("ROAM_REFS")
+			var keys []string
+			for _, m := range reCiteKey.FindAllStringSubmatch(refs, -1) {
+				keys = append(keys, m[1])
+			}
+			return keys
+		case org.Headline:
+			return nil
+		}
+	}
+	return nil
+}
+
+// bibliographyFiles returns the root-relative paths of the BibTeX files a
+// document draws on: its own #+BIBLIOGRAPHY: keywords, plus the configured
+// site-wide files if it cites anything.
+func bibliographyFiles(doc *org.Document, filePath string, ctx BuildContext, cites bool) []string {
+	var files []string
+	for _, path := range strings.Split(doc.BufferSettings["BIBLIOGRAPHY"], "\n") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		relPath := filepath.Join(filepath.Dir(filePath), path)
+		if filepath.IsAbs(path) || !filepath.IsLocal(relPath) {
+			ctx.Diagnostics.Warn("bibliography-outside-root", filePath, ctx.Diagnostics.Line(filePath, path), "ignoring bibliography %s outside the source root", path)
+			continue
+		}
+		files = append(files, relPath)
+	}
+	if cites {
+		for _, path := range ctx.Bibliography {
+			files = append(files, filepath.Clean(path))
+		}
+	}
+	return files
+}
+
+// ProcessCitations parses every BibTeX file referenced by an org file or by
+// the config and indexes which notes cite each work. Populates
+// procFiles.Bibliographies, CitedBy and ReferencePages.
+func ProcessCitations(procFiles *ProcessedFiles, ctx BuildContext) (*ProcessedFiles, GenerationResult) {
+	slog.Debug("Starting citation phase: parsing bibliographies")
+
+	var result GenerationResult
+	procFiles.Bibliographies = map[string]map[string]BibEntry{}
+	procFiles.CitedBy = map[string][]FileInfo{}
+	procFiles.ReferencePages = map[string]string{}
+
+	for _, fi := range procFiles.Files {
+		for _, relPath := range fi.Bibliographies {
+			if _, ok := procFiles.Bibliographies[relPath]; ok {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(ctx.Root, relPath))
+			if err != nil {
+				ctx.Diagnostics.Error("bibliography-read", relPath, 0, "failed to read bibliography: %v", err)
+				procFiles.Bibliographies[relPath] = nil
+				result.Errors++
+				continue
+			}
+			entries, err := parseBibTeX(string(data))
+			if err != nil {
+				ctx.Diagnostics.Error("bibliography-parse", relPath, 0, "failed to parse bibliography: %v", err)
+				result.Errors++
+			}
+			procFiles.Bibliographies[relPath] = entries
+		}
+		for _, key := range fi.Citations {
+			procFiles.CitedBy[key] = append(procFiles.CitedBy[key], fi)
+		}
+		for _, key := range fi.CiteRefs {
+			procFiles.ReferencePages[key] = fi.Path
+		}
+	}
+
+	slog.Debug("Citation phase complete", "bibliographies", len(procFiles.Bibliographies), "cited_works", len(procFiles.CitedBy))
+	return procFiles, result
+}
+
+// citedBy returns the notes citing the works fi is the reference page for.
+func citedBy(fi FileInfo, procFiles *ProcessedFiles) []FileInfo {
+	var citing []FileInfo
+	for _, key := range fi.CiteRefs {
+		citing = append(citing, procFiles.CitedBy[key]...)
+	}
+	return citing
+}
+
+// citedByStale reports whether the cited-by list of fi's page at outputPath,
+// fingerprinted in its data-cited-by attribute, no longer matches the notes
+// citing it: one was added, changed or deleted, or stopped citing it.
+func citedByStale(fi FileInfo, procFiles *ProcessedFiles, outputPath string) bool {
+	if len(fi.CiteRefs) == 0 || procFiles == nil {
+		return false
+	}
+	existing, err := os.ReadFile(outputPath)
+	if err != nil {
+		return true
+	}
+	return listingStale(existing, "data-cited-by", citedBy(fi, procFiles))
+}
+
+// lookupBibEntry finds key in the first of files that defines it.
+func lookupBibEntry(procFiles *ProcessedFiles, files []string, key string) (BibEntry, bool) {
+	if procFiles == nil {
+		return BibEntry{}, false
+	}
+	for _, relPath := range files {
+		if entry, ok := procFiles.Bibliographies[relPath][key]; ok {
+			return entry, true
+		}
+	}
+	return BibEntry{}, false
+}
+
+// bibMonths are the month macros BibTeX predefines.
+var bibMonths = map[string]string{
+	"jan": "January", "feb": "February", "mar": "March", "apr": "April", "may": "May", "jun": "June",
+	"jul": "July", "aug": "August", "sep": "September", "oct": "October", "nov": "November", "dec": "December",
+}
+
+// bibParser reads BibTeX source. It accepts the syntax real-world .bib files
+// use: braced or quoted values, @string macros and # concatenation.
+type bibParser struct {
+	src    string
+	pos    int
+	macros map[string]string
+}
+
+func (p *bibParser) errorf(format string, args ...any) error {
+	line := strings.Count(p.src[:min(p.pos, len(p.src))], "\n") + 1
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *bibParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *bibParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) && !strings.ContainsRune(" \t\r\n{}(),=#\"", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// delimited returns the text up to the delimiter closing the one at p.pos,
+// honouring nested braces.
+func (p *bibParser) delimited() (string, error) {
+	open := p.src[p.pos]
+	close := map[byte]byte{'{': '}', '(': ')', '"': '"'}[open]
+	start := p.pos + 1
+	depth := 0
+	for i := start; i < len(p.src); i++ {
+		switch c := p.src[i]; {
+		case c == '\\':
+			i++
+		case c == close && depth == 0:
+			p.pos = i + 1
+			return p.src[start:i], nil
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		}
+	}
+	return "", p.errorf("unterminated %c", open)
+}
+
+// value parses a field value: pieces joined with #.
+func (p *bibParser) value() (string, error) {
+	var b strings.Builder
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			return "", p.errorf("missing value")
+		}
+		switch c := p.src[p.pos]; {
+		case c == '{' || c == '"':
+			s, err := p.delimited()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+		default:
+			name := p.ident()
+			if name == "" {
+				return "", p.errorf("unexpected %q", c)
+			}
+			if macro, ok := p.macros[strings.ToLower(name)]; ok {
+				b.WriteString(macro)
+			} else if month, ok := bibMonths[strings.ToLower(name)]; ok {
+				b.WriteString(month)
+			} else {
+				b.WriteString(name)
+			}
+		}
+		p.skipSpace()
+		if p.pos < len(p.src) && p.src[p.pos] == '#' {
+			p.pos++
+			continue
+		}
+		return b.String(), nil
+	}
+}
+
+// parseBibTeX parses a .bib file into entries keyed by cite key. Parsing
+// stops at the first malformed entry; the entries before it are returned
+// along with the error.
+func parseBibTeX(src string) (map[string]BibEntry, error) {
+	p := &bibParser{src: src, macros: map[string]string{}}
+	entries := map[string]BibEntry{}
+	for {
+		at := strings.IndexByte(p.src[p.pos:], '@')
+		if at < 0 {
+			return entries, nil
+		}
+		p.pos += at + 1
+		kind := strings.ToLower(p.ident())
+		p.skipSpace()
+		if p.pos >= len(p.src) || (p.src[p.pos] != '{' && p.src[p.pos] != '(') {
+			return entries, p.errorf("expected { after @%s", kind)
+		}
+
+		switch kind {
+		case "comment", "preamble":
+			if _, err := p.delimited(); err != nil {
+				return entries, err
+			}
+			continue
+		case "string":
+			p.pos++
+			name := strings.ToLower(p.ident())
+			p.skipSpace()
+			if p.pos >= len(p.src) || p.src[p.pos] != '=' {
+				return entries, p.errorf("expected = in @string")
+			}
+			p.pos++
+			value, err := p.value()
+			if err != nil {
+				return entries, err
+			}
+			p.macros[name] = value
+			p.skipSpace()
+			if p.pos < len(p.src) && (p.src[p.pos] == '}' || p.src[p.pos] == ')') {
+				p.pos++
+			}
+			continue
+		}
+
+		p.pos++
+		entry := BibEntry{Type: kind, Key: p.ident(), Fields: map[string]string{}}
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.src) {
+				return entries, p.errorf("unterminated entry %s", entry.Key)
+			}
+			if c := p.src[p.pos]; c == '}' || c == ')' {
+				p.pos++
+				break
+			}
+			if p.src[p.pos] == ',' {
+				p.pos++
+				continue
+			}
+			name := strings.ToLower(p.ident())
+			p.skipSpace()
+			if name == "" || p.pos >= len(p.src) || p.src[p.pos] != '=' {
+				return entries, p.errorf("expected field in entry %s", entry.Key)
+			}
+			p.pos++
+			value, err := p.value()
+			if err != nil {
+				return entries, err
+			}
+			entry.Fields[name] = cleanBibValue(value)
+		}
+		entries[entry.Key] = entry
+	}
+}
+
+var (
+	reBibAccent = regexp.MustCompile(`\{?\\([` + "`" + `'^"~=.uvHc])\s*\{?(\\?[A-Za-z])\}?\}?`)
+	// bibAccents maps each TeX accent command to its base letters and their
+	// precomposed forms. Other letters get a combining character instead.
+	bibAccents = map[string][3]string{
+		"`": {"aeiouAEIOU", "àèìòùÀÈÌÒÙ", "\u0300"},
+		"'": {"aeiouyncszAEIOUYNCSZ", "áéíóúýńćśźÁÉÍÓÚÝŃĆŚŹ", "\u0301"},
+		"^": {"aeiouAEIOU", "âêîôûÂÊÎÔÛ", "\u0302"},
+		"~": {"anoANO", "ãñõÃÑÕ", "\u0303"},
+		"=": {"aeiouAEIOU", "āēīōūĀĒĪŌŪ", "\u0304"},
+		"u": {"agAG", "ăğĂĞ", "\u0306"},
+		".": {"zeZEI", "żėŻĖİ", "\u0307"},
+		`"`: {"aeiouyAEIOUY", "äëïöüÿÄËÏÖÜŸ", "\u0308"},
+		"H": {"ouOU", "őűŐŰ", "\u030b"},
+		"v": {"csznreCSZNRE", "čšžňřěČŠŽŇŘĚ", "\u030c"},
+		"c": {"cstCST", "çşţÇŞŢ", "\u0327"},
+	}
+	reBibStyling = regexp.MustCompile(`\\(?:emph|text[a-z]+|mathrm|mkbibquote)\s*`)
+	reBibCommand = regexp.MustCompile(`\\([A-Za-z]+)\s*`)
+	bibReplacer  = strings.NewReplacer(`\&`, "&", `\%`, "%", `\$`, "$", `\_`, "_", `\#`, "#",
+		"---", "—", "--", "–", "~", " ", "{", "", "}", "")
+	bibLetters = map[string]string{
+		"i": "ı", "ss": "ß", "o": "ø", "O": "Ø", "aa": "å", "AA": "Å",
+		"ae": "æ", "AE": "Æ", "oe": "œ", "OE": "Œ", "l": "ł", "L": "Ł",
+	}
+)
+
+// cleanBibValue turns the TeX in a field value into plain text.
+func cleanBibValue(value string) string {
+	value = reBibAccent.ReplaceAllStringFunc(value, func(s string) string {
+		m := reBibAccent.FindStringSubmatch(s)
+		letter := strings.TrimPrefix(m[2], `\`)
+		accent := bibAccents[m[1]]
+		if i := strings.Index(accent[0], letter); i >= 0 {
+			return string([]rune(accent[1])[i])
+		}
+		return letter + accent[2]
+	})
+	value = reBibCommand.ReplaceAllStringFunc(reBibStyling.ReplaceAllString(value, ""), func(s string) string {
+		name := reBibCommand.FindStringSubmatch(s)[1]
+		if letter, ok := bibLetters[name]; ok {
+			return letter
+		}
+		return name
+	})
+	value = bibReplacer.Replace(value)
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// authors returns the entry's authors, or editors if it has none, as
+// (family, full) name pairs.
+func (e BibEntry) authors() [][2]string {
+	names := e.Fields["author"]
+	if names == "" {
+		names = e.Fields["editor"]
+	}
+	if names == "" {
+		return nil
+	}
+	var authors [][2]string
+	for _, name := range regexp.MustCompile(`\s+and\s+`).Split(names, -1) {
+		if family, given, ok := strings.Cut(name, ","); ok {
+			family, given = strings.TrimSpace(family), strings.TrimSpace(given)
+			authors = append(authors, [2]string{family, strings.TrimSpace(given + " " + family)})
+		} else {
+			fields := strings.Fields(name)
+			if len(fields) == 0 {
+				continue
+			}
+			authors = append(authors, [2]string{fields[len(fields)-1], strings.Join(fields, " ")})
+		}
+	}
+	return authors
+}
+
+// shortAuthor is the author part of an author-year citation.
+func (e BibEntry) shortAuthor() string {
+	authors := e.authors()
+	switch len(authors) {
+	case 0:
+		if title := e.Fields["title"]; title != "" {
+			return title
+		}
+		return e.Key
+	case 1:
+		return authors[0][0]
+	case 2:
+		return authors[0][0] + " and " + authors[1][0]
+	}
+	return authors[0][0] + " et al."
+}
+
+func (e BibEntry) year() string {
+	if year := e.Fields["year"]; year != "" {
+		return year
+	}
+	if date := e.Fields["date"]; len(date) >= 4 {
+		return date[:4]
+	}
+	return "n.d."
+}
+
+// formatBibEntry renders a bibliography entry as HTML.
+func formatBibEntry(e BibEntry) string {
+	var b strings.Builder
+	var names []string
+	for _, author := range e.authors() {
+		names = append(names, author[1])
+	}
+	switch len(names) {
+	case 0:
+	case 1:
+		b.WriteString(html.EscapeString(names[0]))
+	default:
+		b.WriteString(html.EscapeString(strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]))
+	}
+	if len(names) > 0 {
+		b.WriteString(" ")
+	}
+	fmt.Fprintf(&b, "(%s). ", html.EscapeString(e.year()))
+
+	title := e.Fields["title"]
+	container := e.Fields["journal"]
+	if container == "" {
+		container = e.Fields["journaltitle"]
+	}
+	if container == "" {
+		container = e.Fields["booktitle"]
+	}
+	if container != "" {
+		fmt.Fprintf(&b, "“%s.” <cite>%s</cite>", html.EscapeString(title), html.EscapeString(container))
+		if volume := e.Fields["volume"]; volume != "" {
+			b.WriteString(" " + html.EscapeString(volume))
+			if number := e.Fields["number"]; number != "" {
+				b.WriteString("(" + html.EscapeString(number) + ")")
+			}
+		}
+		if pages := e.Fields["pages"]; pages != "" {
+			b.WriteString(": " + html.EscapeString(pages))
+		}
+		b.WriteString(".")
+	} else if title != "" {
+		fmt.Fprintf(&b, "<cite>%s</cite>.", html.EscapeString(title))
+	}
+	if publisher := e.Fields["publisher"]; publisher != "" {
+		b.WriteString(" " + html.EscapeString(publisher) + ".")
+	}
+	if doi := e.Fields["doi"]; doi != "" {
+		fmt.Fprintf(&b, ` <a href="https://doi.org/%s">doi:%s</a>`, html.EscapeString(doi), html.EscapeString(doi))
+	} else if url := e.Fields["url"]; url != "" {
+		fmt.Fprintf(&b, ` <a href="%s">%s</a>`, html.EscapeString(url), html.EscapeString(url))
+	}
+	return b.String()
+}
+
+// sortBibEntries orders entries by author, then year, then key.
+func sortBibEntries(entries []BibEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := strings.ToLower(entries[i].shortAuthor()), strings.ToLower(entries[j].shortAuthor())
+		if a != b {
+			return a < b
+		}
+		if entries[i].year() != entries[j].year() {
+			return entries[i].year() < entries[j].year()
+		}
+		return entries[i].Key < entries[j].Key
+	})
+}
+
+func citationAnchor(key string) string {
+	return "ref-" + key
+}
+
+// citationRenderer renders the citations and bibliography of one page.
+type citationRenderer struct {
+	style     string
+	pagePath  string
+	entries   map[string]BibEntry
+	numbers   map[string]int
+	refPages  map[string]string
+	cited     []string
+	printed   bool
+	warnedFor map[string]bool
+
+	diagnostics *Diagnostics
+	position    *sourcePosition
+}
+
+func newCitationRenderer(fi FileInfo, ctx BuildContext, procFiles *ProcessedFiles) *citationRenderer {
+	r := &citationRenderer{
+		style:     ctx.CitationStyle,
+		pagePath:  fi.Path,
+		entries:   map[string]BibEntry{},
+		numbers:   map[string]int{},
+		cited:     fi.Citations,
+		warnedFor: map[string]bool{},
+
+		diagnostics: ctx.Diagnostics,
+	}
+	if r.style == "" {
+		r.style = citationStyleAuthorYear
+	}
+	for i, key := range fi.Citations {
+		r.numbers[key] = i + 1
+		if entry, ok := lookupBibEntry(procFiles, fi.Bibliographies, key); ok {
+			r.entries[key] = entry
+		}
+	}
+	if procFiles != nil {
+		r.refPages = procFiles.ReferencePages
+	}
+	return r
+}
+
+// renderText writes text, replacing each citation in it with its rendering.
+// Plain runs are passed to writeText.
+func (r *citationRenderer) renderText(content string, writeText func(string), writeHTML func(string)) {
+	last := 0
+	for _, m := range reCitation.FindAllStringSubmatchIndex(content, -1) {
+		if m[0] > last {
+			writeText(content[last:m[0]])
+		}
+		style := ""
+		if m[2] >= 0 {
+			style = content[m[2]:m[3]]
+		}
+		writeHTML(r.render(parseCitation(style, content[m[4]:m[5]])))
+		last = m[1]
+	}
+	if last < len(content) {
+		writeText(content[last:])
+	}
+}
+
+// render formats a citation. The style variant after cite/ selects textual
+// (t), author-less (na) or invisible (nocite) output.
+func (r *citationRenderer) render(c citation) string {
+	variant, _, _ := strings.Cut(c.style, "/")
+	if variant == "nocite" {
+		return ""
+	}
+	textual := variant == "t" || variant == "text"
+	noAuthor := variant == "na" || variant == "noauthor"
+
+	parts := make([]string, 0, len(c.references))
+	for _, ref := range c.references {
+		entry, ok := r.entries[ref.key]
+		if !ok {
+			if !r.warnedFor[ref.key] {
+				r.diagnostics.Warn("citation-unknown-key", r.pagePath, r.position.line("@"+ref.key), "citation of unknown key %s", ref.key)
+				r.warnedFor[ref.key] = true
+			}
+			parts = append(parts, fmt.Sprintf(`<span class="citation missing">%s</span>`, html.EscapeString(ref.key)))
+			continue
+		}
+
+		href := "#" + html.EscapeString(citationAnchor(ref.key))
+		locator := ""
+		if ref.suffix != "" {
+			if strings.IndexAny(ref.suffix[:1], ",.;:") == 0 {
+				locator = html.EscapeString(ref.suffix)
+			} else {
+				locator = ", " + html.EscapeString(ref.suffix)
+			}
+		}
+		var part string
+		switch {
+		case r.style == citationStyleNumeric && textual:
+			part = fmt.Sprintf(`%s [<a class="citation" href="%s">%d</a>%s]`, html.EscapeString(entry.shortAuthor()), href, r.numbers[ref.key], locator)
+		case r.style == citationStyleNumeric:
+			part = fmt.Sprintf(`<a class="citation" href="%s">%d</a>%s`, href, r.numbers[ref.key], locator)
+		case textual:
+			part = fmt.Sprintf(`<a class="citation" href="%s">%s</a> (%s%s)`, href, html.EscapeString(entry.shortAuthor()), html.EscapeString(entry.year()), locator)
+		case noAuthor:
+			part = fmt.Sprintf(`<a class="citation" href="%s">%s</a>%s`, href, html.EscapeString(entry.year()), locator)
+		default:
+			part = fmt.Sprintf(`<a class="citation" href="%s">%s %s</a>%s`, href, html.EscapeString(entry.shortAuthor()), html.EscapeString(entry.year()), locator)
+		}
+		if ref.prefix != "" {
+			part = html.EscapeString(ref.prefix) + " " + part
+		}
+		parts = append(parts, part)
+	}
+
+	body := strings.Join(parts, "; ")
+	if c.globalPrefix != "" {
+		body = html.EscapeString(c.globalPrefix) + " " + body
+	}
+	if c.globalSuffix != "" {
+		body += ", " + html.EscapeString(c.globalSuffix)
+	}
+	switch {
+	case textual:
+		return `<span class="citation-group">` + body + "</span>"
+	case r.style == citationStyleNumeric:
+		return `<span class="citation-group">[` + body + "]</span>"
+	}
+	return `<span class="citation-group">(` + body + ")</span>"
+}
+
+// bibliography renders the page's reference list: numbered in citation
+// order for the numeric style, otherwise sorted by author and year.
+func (r *citationRenderer) bibliography() string {
+	r.printed = true
+	var entries []BibEntry
+	for _, key := range r.cited {
+		if entry, ok := r.entries[key]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+
+	list := "ul"
+	if r.style == citationStyleNumeric {
+		list = "ol"
+	} else {
+		sortBibEntries(entries)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<section class=\"bibliography\">\n<h2>References</h2>\n<%s class=\"references\">\n", list)
+	for _, entry := range entries {
+		fmt.Fprintf(&b, `<li id="%s">%s`, html.EscapeString(citationAnchor(entry.Key)), formatBibEntry(entry))
+		if refPage, ok := r.refPages[entry.Key]; ok && refPage != r.pagePath {
+			if rel, err := filepath.Rel(filepath.Dir(r.pagePath), strings.TrimSuffix(refPage, ".org")+".html"); err == nil {
+				fmt.Fprintf(&b, ` <a class="reference-note" href="%s">Notes</a>`, html.EscapeString(filepath.ToSlash(rel)))
+			}
+		}
+		b.WriteString("</li>\n")
+	}
+	fmt.Fprintf(&b, "</%s>\n</section>\n", list)
+	return b.String()
+}
+
+// GenerateBibliographyPage writes bibliography.html, listing every cited
+// work along with the notes that cite it. It is only generated when
+// ctx.BibliographyPage is set, and is rendered with the page template.
+func GenerateBibliographyPage(procFiles *ProcessedFiles, ctx BuildContext, tmpl *template.Template) GenerationResult {
+	if !ctx.BibliographyPage {
+		return GenerationResult{}
+	}
+	slog.Debug("Starting Phase 3g: generating bibliography page")
+
+	var entries []BibEntry
+	for key, citing := range procFiles.CitedBy {
+		var files []string
+		for _, fi := range citing {
+			files = append(files, fi.Bibliographies...)
+		}
+		if entry, ok := lookupBibEntry(procFiles, files, key); ok {
+			entries = append(entries, entry)
+		}
+	}
+	sortBibEntries(entries)
+
+	var content strings.Builder
+	content.WriteString("<ul class=\"references\">\n")
+	for _, entry := range entries {
+		fmt.Fprintf(&content, `<li id="%s">%s`, html.EscapeString(citationAnchor(entry.Key)), formatBibEntry(entry))
+		if refPage, ok := procFiles.ReferencePages[entry.Key]; ok {
+			fmt.Fprintf(&content, ` <a class="reference-note" href="/%s.html">Notes</a>`, html.EscapeString(strings.TrimSuffix(refPage, ".org")))
+		}
+		content.WriteString("\n<ul class=\"cited-by\">\n")
+		for _, fi := range procFiles.CitedBy[entry.Key] {
+			fmt.Fprintf(&content, "<li><a href=\"/%s.html\">%s</a></li>\n", html.EscapeString(strings.TrimSuffix(fi.Path, ".org")), html.EscapeString(fi.Title))
+		}
+		content.WriteString("</ul>\n</li>\n")
+	}
+	content.WriteString("</ul>\n")
+
+	pageData := PageData{
+		FileInfo:     FileInfo{Path: "bibliography.org", Title: "Bibliography"},
+		Content:      template.HTML(content.String()),
+		SiteName:     ctx.SiteName,
+		BaseURL:      ctx.BaseURL,
+		DefaultImage: ctx.DefaultImage,
+		Author:       ctx.Author,
+		LicenseName:  ctx.LicenseName,
+		LicenseURL:   ctx.LicenseURL,
+		Data:         procFiles.Data,
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "page-template.html", pageData); err != nil {
+		ctx.Diagnostics.Error("template", "", 0, "failed to execute page-template.html for bibliography.html: %v", err)
+		return GenerationResult{Errors: 1}
+	}
+	outputPath := filepath.Join(ctx.DestDir, "bibliography.html")
+	if err := writeOutput(ctx, outputPath, buf.Bytes()); err != nil {
+		ctx.Diagnostics.Error("output", "", 0, "failed to write %s: %v", outputPath, err)
+		return GenerationResult{Errors: 1}
+	}
+	slog.Debug("Phase 3g complete: generated bibliography page", "path", outputPath, "entries", len(entries))
+	return GenerationResult{FilesGenerated: 1}
+}
@@ -0,0 +1,270 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testBib = `% A comment line
+@string{acm = "Communications of the {ACM}"}
+
+@comment{ignored @article{nope, title = {No}} }
+
+@article{dijkstra1968,
+  author  = {Dijkstra, Edsger W.},
+  title   = {Go To Statement Considered Harmful},
+  journal = acm,
+  volume  = 11,
+  number  = {3},
+  pages   = {147--148},
+  month   = mar,
+  year    = 1968,
+}
+
+@book{knuth1984,
+  author    = "Donald E. Knuth",
+  title     = "The {\TeX}book",
+  publisher = {Addison-Wesley},
+  year      = {1984},
+}
+
+@inproceedings{erdos1950,
+  author    = {Paul Erd{\H o}s and R{\'e}nyi, Alfr\'ed and {\O}rsted, Hans},
+  title     = {On \emph{Random} Graphs},
+  booktitle = {Proc. } # acm,
+  year      = {1950},
+  doi       = {10.1000/xyz},
+}
+`
+
+func TestParseBibTeX(t *testing.T) {
+	entries, err := parseBibTeX(testBib)
+	if err != nil {
+		t.Fatalf("parseBibTeX() error = %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3: %v", len(entries), entries)
+	}
+
+	d := entries["dijkstra1968"]
+	if d.Type != "article" || d.Fields["journal"] != "Communications of the ACM" || d.Fields["pages"] != "147–148" || d.Fields["month"] != "March" {
+		t.Errorf("dijkstra1968 = %+v", d)
+	}
+	if got := d.shortAuthor(); got != "Dijkstra" {
+		t.Errorf("shortAuthor() = %q, want Dijkstra", got)
+	}
+
+	k := entries["knuth1984"]
+	if k.Fields["title"] != "The TeXbook" {
+		t.Errorf("knuth1984 title = %q", k.Fields["title"])
+	}
+	if got := k.shortAuthor(); got != "Knuth" {
+		t.Errorf("shortAuthor() = %q, want Knuth", got)
+	}
+
+	e := entries["erdos1950"]
+	if e.Fields["title"] != "On Random Graphs" {
+		t.Errorf("styling command not stripped: %q", e.Fields["title"])
+	}
+	if e.Fields["booktitle"] != "Proc. Communications of the ACM" {
+		t.Errorf("concatenation not applied: %q", e.Fields["booktitle"])
+	}
+	if got := e.shortAuthor(); got != "Erdős et al." {
+		t.Errorf("shortAuthor() = %q, want Erdős et al.", got)
+	}
+	if authors := e.authors(); authors[1][1] != "Alfréd Rényi" || authors[2][0] != "Ørsted" {
+		t.Errorf("authors() = %v", authors)
+	}
+
+	if _, err := parseBibTeX(testBib + "@misc{broken, title = {unclosed}"); err == nil {
+		t.Error("parseBibTeX() accepted an unterminated entry")
+	}
+}
+
+func TestParseCitation(t *testing.T) {
+	c := parseCitation("t", "See ; pre @a_b-c pp. 1--2; @d;  and more")
+	if c.style != "t" || c.globalPrefix != "See" || c.globalSuffix != "and more" {
+		t.Errorf("parseCitation() = %+v", c)
+	}
+	if len(c.references) != 2 || c.references[0] != (citationReference{key: "a_b-c", prefix: "pre", suffix: "pp. 1--2"}) || c.references[1].key != "d" {
+		t.Errorf("references = %+v", c.references)
+	}
+}
+
+func setupCitationSite(t *testing.T, style string) (string, *ProcessedFiles, BuildContext) {
+	t.Helper()
+	tmpDir := MustCreateTempDir(t, "test-cite-")
+	if err := os.WriteFile(filepath.Join(tmpDir, "refs.bib"), []byte(testBib), 0644); err != nil {
+		t.Fatalf("Failed to write bibliography: %v", err)
+	}
+	CreateTestDirStructure(tmpDir, []string{"notes"})
+	CreateTestOrgFile(tmpDir, "notes/essay.org", `#+title: Essay
+#+bibliography: ../refs.bib
+
+* Argument
+As argued [cite:see @dijkstra1968 p. 147; @knuth1984], and [cite/t:@knuth1984].
+Also [cite:@missing] and =[cite:@verbatim]=.
+
+* Sources
+#+print_bibliography:
+
+* Afterword
+The end.
+`)
+	CreateTestOrgFile(tmpDir, "dijkstra.org", `:PROPERTIES:
+:ID: 6a1e2c2e-0000-4000-8000-000000000001
+:ROAM_REFS: @dijkstra1968
+:END:
+#+title: Dijkstra 1968
+`)
+
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public"), CitationStyle: style, BibliographyPage: true}
+	procFiles, result := FindAndProcessOrgFiles(nil, ctx)
+	if result.Errors != 0 {
+		t.Fatalf("FindAndProcessOrgFiles() errors = %d", result.Errors)
+	}
+	procFiles, result = ProcessCitations(procFiles, ctx)
+	if result.Errors != 0 {
+		t.Fatalf("ProcessCitations() errors = %d", result.Errors)
+	}
+	return tmpDir, procFiles, ctx
+}
+
+func findFile(t *testing.T, procFiles *ProcessedFiles, path string) FileInfo {
+	t.Helper()
+	for _, fi := range procFiles.Files {
+		if fi.Path == path {
+			return fi
+		}
+	}
+	t.Fatalf("%s not processed", path)
+	return FileInfo{}
+}
+
+func TestCitations_AuthorYear(t *testing.T) {
+	tmpDir, procFiles, ctx := setupCitationSite(t, "")
+	defer CleanupTempDir(tmpDir)
+
+	fi := findFile(t, procFiles, "notes/essay.org")
+	if strings.Join(fi.Citations, ",") != "dijkstra1968,knuth1984,missing" {
+		t.Errorf("Citations = %v", fi.Citations)
+	}
+	if len(fi.Bibliographies) != 1 || fi.Bibliographies[0] != "refs.bib" {
+		t.Errorf("Bibliographies = %v", fi.Bibliographies)
+	}
+
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, fi, ctx, nil, procFiles)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	for _, want := range []string{
+		`<span class="citation-group">(see <a class="citation" href="#ref-dijkstra1968">Dijkstra 1968</a>, p. 147; <a class="citation" href="#ref-knuth1984">Knuth 1984</a>)</span>`,
+		`<span class="citation-group"><a class="citation" href="#ref-knuth1984">Knuth</a> (1984)</span>`,
+		`<span class="citation missing">missing</span>`,
+		`[cite:@verbatim]`,
+		`<ul class="references">`,
+		`<li id="ref-dijkstra1968">Edsger W. Dijkstra (1968). “Go To Statement Considered Harmful.” <cite>Communications of the ACM</cite> 11(3): 147–148. <a class="reference-note" href="../dijkstra.html">Notes</a></li>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML missing %s:\n%s", want, html)
+		}
+	}
+	if strings.Count(html, `class="bibliography"`) != 1 {
+		t.Errorf("bibliography not rendered exactly once:\n%s", html)
+	}
+	if strings.Index(html, `class="bibliography"`) > strings.Index(html, "The end.") {
+		t.Error("bibliography not placed at #+print_bibliography:")
+	}
+}
+
+func TestCitations_Numeric(t *testing.T) {
+	tmpDir, procFiles, ctx := setupCitationSite(t, citationStyleNumeric)
+	defer CleanupTempDir(tmpDir)
+
+	fi := findFile(t, procFiles, "notes/essay.org")
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, fi, ctx, nil, procFiles)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	for _, want := range []string{
+		`[see <a class="citation" href="#ref-dijkstra1968">1</a>, p. 147; <a class="citation" href="#ref-knuth1984">2</a>]`,
+		`<ol class="references">`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML missing %s:\n%s", want, html)
+		}
+	}
+}
+
+func TestCitations_CitedByAndBibliographyPage(t *testing.T) {
+	tmpDir, procFiles, ctx := setupCitationSite(t, "")
+	defer CleanupTempDir(tmpDir)
+
+	if got := procFiles.ReferencePages["dijkstra1968"]; got != "dijkstra.org" {
+		t.Errorf("ReferencePages[dijkstra1968] = %q", got)
+	}
+	if citing := procFiles.CitedBy["dijkstra1968"]; len(citing) != 1 || citing[0].Path != "notes/essay.org" {
+		t.Errorf("CitedBy[dijkstra1968] = %v", citing)
+	}
+
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	if result := GenerateHtmlPages(procFiles, ctx, tmpls.Page); result.Errors != 0 {
+		t.Fatalf("GenerateHtmlPages() errors = %d", result.Errors)
+	}
+	refPage, err := os.ReadFile(filepath.Join(ctx.DestDir, "dijkstra.html"))
+	if err != nil {
+		t.Fatalf("Failed to read reference page: %v", err)
+	}
+	if !strings.Contains(string(refPage), `<aside class="cited-by" data-cited-by="`) || !strings.Contains(string(refPage), `<a href="/notes/essay.html">Essay</a>`) {
+		t.Errorf("reference page does not list citing notes:\n%s", refPage)
+	}
+
+	if result := GenerateBibliographyPage(procFiles, ctx, tmpls.Page); result.FilesGenerated != 1 {
+		t.Fatalf("GenerateBibliographyPage() = %+v", result)
+	}
+	bib, err := os.ReadFile(filepath.Join(ctx.DestDir, "bibliography.html"))
+	if err != nil {
+		t.Fatalf("Failed to read bibliography page: %v", err)
+	}
+	page := string(bib)
+	if strings.Index(page, `id="ref-dijkstra1968"`) > strings.Index(page, `id="ref-knuth1984"`) {
+		t.Error("bibliography page not sorted by author")
+	}
+	if strings.Count(page, `<a href="/notes/essay.html">Essay</a>`) != 2 {
+		t.Errorf("bibliography page does not list citing notes per work:\n%s", page)
+	}
+}
+
+func TestCitedByStale(t *testing.T) {
+	tmpDir, procFiles, ctx := setupCitationSite(t, "")
+	defer CleanupTempDir(tmpDir)
+
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	refPath := filepath.Join(ctx.DestDir, "dijkstra.html")
+	GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+	if citedByStale(findFile(t, procFiles, "dijkstra.org"), procFiles, refPath) {
+		t.Error("dijkstra.html stale right after a build")
+	}
+
+	// Deleting the citing note rebuilds the reference page, though
+	// dijkstra.org is unchanged.
+	os.Remove(filepath.Join(tmpDir, "notes/essay.org"))
+	procFiles, _ = FindAndProcessOrgFiles(nil, ctx)
+	procFiles, _ = ProcessCitations(procFiles, ctx)
+	GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+	refPage, err := os.ReadFile(refPath)
+	if err != nil {
+		t.Fatalf("Failed to read reference page: %v", err)
+	}
+	if strings.Contains(string(refPage), `class="cited-by"`) {
+		t.Errorf("reference page still lists the deleted note:\n%s", refPage)
+	}
+}
@@ -0,0 +1,137 @@
+package generator
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dataDir is the directory under Root holding data files for templates.
+const dataDir = "data"
+
+// LoadData reads every data/**/*.json file under Root into procFiles.Data,
+// nested by directory and keyed by file name without extension:
+// data/people/authors.json is .Data.people.authors in templates. It also
+// records the latest modification time of the data files in
+// procFiles.DataModTime, so pages are rebuilt when data changes.
+//
+// data is also org-attach's default ID directory, so the attachment
+// directories of files at the root may live in it. Those are skipped, and
+// only .json files and the directories holding them, whose times change
+// when one is removed or renamed, count towards DataModTime: adding an
+// attachment doesn't rebuild every page.
+func LoadData(procFiles *ProcessedFiles, ctx BuildContext) (*ProcessedFiles, GenerationResult) {
+	slog.Debug("Starting data phase: loading data files")
+
+	var result GenerationResult
+	procFiles.Data = map[string]any{}
+	procFiles.DataModTime = time.Time{}
+
+	root := filepath.Join(ctx.Root, dataDir)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return procFiles, result
+	}
+
+	count := 0
+	// Directories count if they hold .json files, or nothing at all, as
+	// when the last one was removed.
+	dirTimes := map[string]time.Time{}
+	countedDirs := map[string]bool{}
+	emptyDirs := map[string]bool{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		delete(emptyDirs, filepath.Dir(path))
+		if d.IsDir() && isAttachIDDir(root, path) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				dirTimes[path] = info.ModTime()
+				emptyDirs[path] = true
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".json" {
+			return nil
+		}
+		countedDirs[filepath.Dir(path)] = true
+		if info, err := d.Info(); err == nil && info.ModTime().After(procFiles.DataModTime) {
+			procFiles.DataModTime = info.ModTime()
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			ctx.Diagnostics.Error("data-read", ctx.Diagnostics.relative(path), 0, "failed to read data file: %v", err)
+			result.Errors++
+			return nil
+		}
+		var value any
+		if err := json.Unmarshal(raw, &value); err != nil {
+			ctx.Diagnostics.Error("data-parse", ctx.Diagnostics.relative(path), 0, "failed to parse data file: %v", err)
+			result.Errors++
+			return nil
+		}
+
+		rel, _ := filepath.Rel(root, strings.TrimSuffix(path, ".json"))
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		node := procFiles.Data
+		for _, dir := range parts[:len(parts)-1] {
+			child, ok := node[dir].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				node[dir] = child
+			}
+			node = child
+		}
+		name := parts[len(parts)-1]
+		if existing, ok := node[name].(map[string]any); ok {
+			// A directory and a file share the name: merge the file's
+			// object into the directory's entries.
+			if object, ok := value.(map[string]any); ok {
+				for k, v := range object {
+					existing[k] = v
+				}
+				count++
+				return nil
+			}
+			ctx.Diagnostics.Warn("data-shadowed", ctx.Diagnostics.relative(path), 0, "data file holds no object, so it replaces the directory of the same name")
+		}
+		node[name] = value
+		count++
+		return nil
+	})
+	if err != nil {
+		ctx.Diagnostics.Error("data-read", ctx.Diagnostics.relative(root), 0, "failed to walk data directory: %v", err)
+		result.Errors++
+	}
+	for dir, modTime := range dirTimes {
+		if (countedDirs[dir] || emptyDirs[dir]) && modTime.After(procFiles.DataModTime) {
+			procFiles.DataModTime = modTime
+		}
+	}
+
+	slog.Debug("Data phase complete", "files", count)
+	return procFiles, result
+}
+
+// isAttachIDDir reports whether path, a directory under the data directory
+// root, is an org-attach ID directory: root/ab/cdef-... for the ID abcdef-...
+func isAttachIDDir(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	return len(parts) == 2 && len(parts[0]) == 2 && isValidUUID(parts[0]+parts[1])
+}
+
+// dataModifiedSince reports whether the data files have changed since t.
+func dataModifiedSince(procFiles *ProcessedFiles, t time.Time) bool {
+	return procFiles != nil && procFiles.DataModTime.After(t)
+}
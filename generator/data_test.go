@@ -0,0 +1,140 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadData(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-data-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestDirStructure(tmpDir, []string{"data/people"})
+	os.WriteFile(filepath.Join(tmpDir, "data", "nav.json"), []byte(`[{"title": "Home", "url": "/"}]`), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "data", "people", "authors.json"), []byte(`{"ada": {"name": "Ada"}}`), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "data", "people", "notes.txt"), []byte(`ignored`), 0644)
+	os.WriteFile(filepath.Join(tmpDir, "data", "broken.json"), []byte(`{`), 0644)
+	// org-attach's ID directories hold attachments, not template data.
+	CreateTestDirStructure(tmpDir, []string{"data/55/0e8400-e29b-41d4-a716-446655440000"})
+	os.WriteFile(filepath.Join(tmpDir, "data", "55", "0e8400-e29b-41d4-a716-446655440000", "export.json"), []byte(`{`), 0644)
+
+	procFiles, result := LoadData(&ProcessedFiles{}, BuildContext{Root: tmpDir})
+	if result.Errors != 1 {
+		t.Errorf("LoadData() errors = %d, want 1 for broken.json", result.Errors)
+	}
+	if nav, ok := procFiles.Data["nav"].([]any); !ok || len(nav) != 1 {
+		t.Errorf("Data[nav] = %#v", procFiles.Data["nav"])
+	}
+	people, ok := procFiles.Data["people"].(map[string]any)
+	if !ok {
+		t.Fatalf("Data[people] = %#v", procFiles.Data["people"])
+	}
+	if _, ok := people["authors"].(map[string]any)["ada"]; !ok {
+		t.Errorf("Data[people][authors] = %#v", people["authors"])
+	}
+	if _, ok := people["notes"]; ok {
+		t.Error("non-JSON file loaded")
+	}
+	if _, ok := procFiles.Data["55"]; ok {
+		t.Error("attachment loaded as data")
+	}
+	if procFiles.DataModTime.IsZero() {
+		t.Error("DataModTime not set")
+	}
+
+	procFiles, result = LoadData(&ProcessedFiles{}, BuildContext{Root: filepath.Join(tmpDir, "data", "people")})
+	if result.Errors != 0 || len(procFiles.Data) != 0 {
+		t.Errorf("LoadData() without a data directory = %+v, %v", result, procFiles.Data)
+	}
+}
+
+func TestLoadData_ModTime(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-data-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestDirStructure(tmpDir, []string{"data/people", "data/55/0e8400-e29b-41d4-a716-446655440000"})
+	authors := filepath.Join(tmpDir, "data", "people", "authors.json")
+	os.WriteFile(authors, []byte(`{}`), 0644)
+	past := time.Now().Add(-time.Hour)
+	for _, path := range []string{authors, "data/people", "data/55/0e8400-e29b-41d4-a716-446655440000", "data/55", "data"} {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(tmpDir, path)
+		}
+		os.Chtimes(path, past, past)
+	}
+	modTime := func() time.Time {
+		procFiles, _ := LoadData(&ProcessedFiles{}, BuildContext{Root: tmpDir})
+		return procFiles.DataModTime
+	}
+	if got := modTime(); !got.Equal(past) {
+		t.Fatalf("DataModTime = %v, want %v", got, past)
+	}
+
+	// Attachments, in new ID directories or not, are not data.
+	os.WriteFile(filepath.Join(tmpDir, "data", "55", "0e8400-e29b-41d4-a716-446655440000", "photo.jpg"), []byte("jpg"), 0644)
+	CreateTestDirStructure(tmpDir, []string{"data/55/1e8400-e29b-41d4-a716-446655440000"})
+	if got := modTime(); !got.Equal(past) {
+		t.Errorf("DataModTime after adding an attachment = %v, want %v", got, past)
+	}
+
+	// Removing the last data file of a directory is a change.
+	os.Remove(authors)
+	if got := modTime(); !got.After(past) {
+		t.Errorf("DataModTime after removing a data file = %v, want later than %v", got, past)
+	}
+}
+
+func TestDataInTemplates(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-data-")
+	defer CleanupTempDir(tmpDir)
+
+	templatesDir := filepath.Join(tmpDir, "templates")
+	CreateTestDirStructure(tmpDir, []string{"templates", "data"})
+	os.WriteFile(filepath.Join(templatesDir, "base-template.html"), []byte(`{{range .Data.nav}}[{{.title}}]{{end}}`), 0644)
+	for _, name := range []string{"page-template.html", "tag-page-template.html", "index-page-template.html"} {
+		os.WriteFile(filepath.Join(templatesDir, name), []byte(`{{template "base-template.html" .}}`), 0644)
+	}
+	os.WriteFile(filepath.Join(templatesDir, "atom-template.xml"), []byte(`<feed/>`), 0644)
+	dataFile := filepath.Join(tmpDir, "data", "nav.json")
+	os.WriteFile(dataFile, []byte(`[{"title": "Home"}]`), 0644)
+	CreateTestOrgFile(tmpDir, "page.org", "#+title: Page\n* Heading :tagged:\nText.\n")
+
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public")}
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	build := func() {
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		procFiles, _ = LoadData(procFiles, ctx)
+		os.MkdirAll(ctx.DestDir, 0755)
+		GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+		GenerateTagPages(procFiles, ctx, tmpls.Tag)
+		GenerateIndexPage(procFiles, ctx, tmpls.Index)
+	}
+	check := func(want string) {
+		t.Helper()
+		for _, name := range []string{"page.html", "tag-tagged.html", "index.html"} {
+			data, err := os.ReadFile(filepath.Join(ctx.DestDir, name))
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", name, err)
+			}
+			if strings.TrimSpace(string(data)) != want {
+				t.Errorf("%s = %q, want %q", name, data, want)
+			}
+		}
+	}
+
+	build()
+	check("[Home]")
+
+	// Changing a data file rebuilds the pages using it.
+	os.WriteFile(dataFile, []byte(`[{"title": "Home"}, {"title": "About"}]`), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(dataFile, future, future)
+	build()
+	check("[Home][About]")
+}
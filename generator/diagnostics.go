@@ -0,0 +1,289 @@
+package generator
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// Severity is how serious a diagnostic is.
+type Severity int
+
+const (
+	// SeverityWarning marks something the build worked around, such as a
+	// missing title or an undefined macro.
+	SeverityWarning Severity = iota
+	// SeverityError marks output that could not be produced.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic is a problem found during a build.
+type Diagnostic struct {
+	Severity Severity
+	Code     string
+	File     string // relative to the source root, or "" for the whole site
+	Line     int    // 1-based, or 0 if unknown
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	position := d.File
+	if d.Line > 0 {
+		position += fmt.Sprintf(":%d", d.Line)
+	}
+	if position != "" {
+		position += ": "
+	}
+	return fmt.Sprintf("%s%s: %s [%s]", position, d.Severity, d.Message, d.Code)
+}
+
+// Diagnostics collects the diagnostics of a build for PrintSummary, logging
+// each at debug level as it comes. It is safe for concurrent use, and a nil
+// *Diagnostics logs them at their own level instead.
+type Diagnostics struct {
+	root       string
+	suppressed map[string]bool
+
+	// recording is set on a recorder, which passes what is reported to it
+	// on to parent, which may be nil.
+	parent    *Diagnostics
+	recording bool
+
+	mu      sync.Mutex
+	entries []Diagnostic
+	seen    map[Diagnostic]bool
+	sources map[string][]string
+}
+
+// NewDiagnostics returns a collector for a build of the files under root,
+// which drops diagnostics whose code is in suppress.
+func NewDiagnostics(root string, suppress []string) *Diagnostics {
+	d := &Diagnostics{root: root, suppressed: map[string]bool{}, seen: map[Diagnostic]bool{}, sources: map[string][]string{}}
+	for _, code := range suppress {
+		d.suppressed[code] = true
+	}
+	return d
+}
+
+// recorder returns a collector that passes everything reported to it on to
+// d, and keeps it too, suppressed or not, so that it can be reported again
+// later under the settings of that build.
+func (d *Diagnostics) recorder() *Diagnostics {
+	return &Diagnostics{parent: d, recording: true}
+}
+
+// Warn reports a warning about file, at line if it is known.
+func (d *Diagnostics) Warn(code, file string, line int, format string, args ...any) {
+	d.report(Diagnostic{SeverityWarning, code, file, line, fmt.Sprintf(format, args...)})
+}
+
+// Error reports an error about file, at line if it is known.
+func (d *Diagnostics) Error(code, file string, line int, format string, args ...any) {
+	d.report(Diagnostic{SeverityError, code, file, line, fmt.Sprintf(format, args...)})
+}
+
+func (d *Diagnostics) report(diag Diagnostic) {
+	if d != nil && d.recording {
+		d.mu.Lock()
+		d.entries = append(d.entries, diag)
+		d.mu.Unlock()
+		d.parent.report(diag)
+		return
+	}
+	attrs := []any{"code", diag.Code, "file", diag.File, "line", diag.Line}
+	switch {
+	case d == nil && diag.Severity == SeverityError:
+		slog.Error(diag.Message, attrs...)
+		return
+	case d == nil:
+		slog.Warn(diag.Message, attrs...)
+		return
+	case d.suppressed[diag.Code]:
+		slog.Debug("Suppressed: "+diag.Message, attrs...)
+		return
+	}
+	slog.Debug(diag.Message, attrs...)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.seen[diag] {
+		d.seen[diag] = true
+		d.entries = append(d.entries, diag)
+	}
+}
+
+// Line returns the 1-based number of the first line of file, relative to
+// the source root, that contains text, or 0 if none does. go-org doesn't
+// record where nodes come from, so diagnostics find their line this way.
+func (d *Diagnostics) Line(file, text string) int {
+	if text == "" {
+		return 0
+	}
+	return d.lineFrom(file, 1, func(line string) bool { return strings.Contains(line, text) })
+}
+
+// lineFrom returns the 1-based number of the first line of file, at or after
+// line from, that match accepts, or 0 if none does.
+func (d *Diagnostics) lineFrom(file string, from int, match func(line string) bool) int {
+	if d == nil || file == "" {
+		return 0
+	}
+	if d.recording {
+		return d.parent.lineFrom(file, from, match)
+	}
+	d.mu.Lock()
+	lines, ok := d.sources[file]
+	d.mu.Unlock()
+	if !ok {
+		if data, err := os.ReadFile(filepath.Join(d.root, file)); err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		d.mu.Lock()
+		d.sources[file] = lines
+		d.mu.Unlock()
+	}
+	for i := max(from, 1) - 1; i < len(lines); i++ {
+		if match(lines[i]) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// sourcePosition follows a writer through a source file, so that the
+// diagnostics found while rendering it have a line. go-org keeps no source
+// positions, so it tracks the line of the headline being written, found by
+// its title below the line of its parent, and the last line found in it.
+type sourcePosition struct {
+	diagnostics *Diagnostics
+	file        string
+	headlines   []int
+	found       int
+}
+
+func newSourcePosition(diagnostics *Diagnostics, file string) *sourcePosition {
+	return &sourcePosition{diagnostics: diagnostics, file: file}
+}
+
+// enter moves into h. Headlines that aren't in the file, such as those of an
+// #+INCLUDE:d file, stay at their parent's line.
+func (p *sourcePosition) enter(h org.Headline) {
+	from := p.headline()
+	title := strings.TrimSpace(org.String(h.Title...))
+	line := p.diagnostics.lineFrom(p.file, from, func(line string) bool {
+		return strings.HasPrefix(line, "*") && strings.Contains(line, title)
+	})
+	if line == 0 {
+		line = from
+	}
+	p.headlines = append(p.headlines, line)
+	p.found = 0
+}
+
+// leave moves back out of the headline last entered.
+func (p *sourcePosition) leave() {
+	p.headlines = p.headlines[:len(p.headlines)-1]
+	p.found = 0
+}
+
+// headline returns the line of the headline being written, or 0 above the
+// first one.
+func (p *sourcePosition) headline() int {
+	if len(p.headlines) == 0 {
+		return 0
+	}
+	return p.headlines[len(p.headlines)-1]
+}
+
+// line returns the line of the first occurrence of text in the headline
+// being written, or the headline's own line if text isn't found there.
+func (p *sourcePosition) line(text string) int {
+	if text == "" {
+		return p.find(nil)
+	}
+	return p.find(func(line string) bool { return strings.Contains(line, text) })
+}
+
+// lineMatching returns the line of the first line in the headline being
+// written that re matches, or the headline's own line if none does.
+func (p *sourcePosition) lineMatching(re *regexp.Regexp) int {
+	return p.find(re.MatchString)
+}
+
+// find returns the first line in the headline being written that match
+// accepts. Nodes are written in order, so it looks from the last line found
+// first, which tells repeated text apart; nodes written out of order, like
+// footnotes, are looked for from the headline again.
+func (p *sourcePosition) find(match func(line string) bool) int {
+	if p == nil {
+		return 0
+	}
+	if match != nil {
+		for _, from := range []int{max(p.found, p.headline()), p.headline()} {
+			if line := p.diagnostics.lineFrom(p.file, from, match); line != 0 {
+				p.found = line
+				return line
+			}
+		}
+	}
+	return p.headline()
+}
+
+// relative returns path relative to the source root, if it is under it.
+func (d *Diagnostics) relative(path string) string {
+	if d == nil {
+		return path
+	}
+	if d.recording {
+		return d.parent.relative(path)
+	}
+	if rel, err := filepath.Rel(d.root, path); err == nil && filepath.IsLocal(rel) {
+		return rel
+	}
+	return path
+}
+
+// Entries returns the diagnostics reported so far, ordered by file, line
+// and code. Diagnostics about the whole site come first.
+func (d *Diagnostics) Entries() []Diagnostic {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	entries := slices.Clone(d.entries)
+	d.mu.Unlock()
+	slices.SortStableFunc(entries, func(a, b Diagnostic) int {
+		return cmp.Or(cmp.Compare(a.File, b.File), cmp.Compare(a.Line, b.Line), cmp.Compare(a.Code, b.Code), cmp.Compare(a.Message, b.Message))
+	})
+	return entries
+}
+
+// Count returns the number of diagnostics of severity reported so far.
+func (d *Diagnostics) Count(severity Severity) int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	count := 0
+	for _, diag := range d.entries {
+		if diag.Severity == severity {
+			count++
+		}
+	}
+	return count
+}
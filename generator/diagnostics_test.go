@@ -0,0 +1,98 @@
+package generator
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-diagnostics-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: A\n\nSee {{{missing}}}.\n")
+	d := NewDiagnostics(tmpDir, []string{"no-title"})
+	d.Warn("macro-undefined", "a.org", d.Line("a.org", "{{{missing}}}"), "undefined macro %s", "{{{missing}}}")
+	d.Warn("macro-undefined", "a.org", 3, "undefined macro %s", "{{{missing}}}")
+	d.Error("output", "", 0, "failed to write %s", "index.html")
+	d.Warn("no-title", "b.org", 0, "no title")
+
+	entries := d.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("Entries() = %v, want the repeated warning and the suppressed one dropped", entries)
+	}
+	if got := fmt.Sprint(entries[0]); got != "error: failed to write index.html [output]" {
+		t.Errorf("entries[0] = %s", got)
+	}
+	if got := fmt.Sprint(entries[1]); got != "a.org:3: warning: undefined macro {{{missing}}} [macro-undefined]" {
+		t.Errorf("entries[1] = %s", got)
+	}
+	if d.Count(SeverityWarning) != 1 || d.Count(SeverityError) != 1 {
+		t.Errorf("Count() = %d warnings, %d errors", d.Count(SeverityWarning), d.Count(SeverityError))
+	}
+	if line := d.Line("a.org", "not there"); line != 0 {
+		t.Errorf("Line() of missing text = %d", line)
+	}
+
+	var none *Diagnostics
+	none.Warn("no-title", "a.org", 0, "no title")
+	if none.Entries() != nil || none.Count(SeverityWarning) != 0 || none.Line("a.org", "A") != 0 {
+		t.Error("a nil collector should collect nothing")
+	}
+}
+
+func TestDiagnosticsFromBuild(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-diagnostics-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "note.org", "#+title: Note\n\n* One\nText.\n\n#+INCLUDE: \"missing.org\"\n")
+	CreateTestOrgFile(tmpDir, "untitled.org", "Just text.\n")
+	ctx := BuildContext{Root: tmpDir, Diagnostics: NewDiagnostics(tmpDir, nil)}
+	FindAndProcessOrgFiles(nil, ctx)
+
+	var got []string
+	for _, diag := range ctx.Diagnostics.Entries() {
+		got = append(got, fmt.Sprintf("%s:%d %s %s", diag.File, diag.Line, diag.Severity, diag.Code))
+	}
+	if fmt.Sprint(got) != "[note.org:6 warning include-refused untitled.org:0 warning no-title]" {
+		t.Errorf("Entries() = %v", got)
+	}
+}
+
+func TestRenderDiagnosticsOnCachedBuild(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-diagnostics-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "note.org", `#+title: Note
+
+* Formulas
+Inline $\weird{}$ math.
+* Raw
+#+BEGIN_EXPORT html
+<b>raw</b>
+#+END_EXPORT
+`)
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	build := func() []string {
+		ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public"), SafeMode: true, Diagnostics: NewDiagnostics(tmpDir, nil)}
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+		var got []string
+		for _, diag := range ctx.Diagnostics.Entries() {
+			got = append(got, fmt.Sprintf("%s:%d %s", diag.File, diag.Line, diag.Code))
+		}
+		return got
+	}
+
+	// The export block is placed at its own line, whatever its case.
+	want := "[note.org:4 math-fallback note.org:6 unsafe-content]"
+	if got := build(); fmt.Sprint(got) != want {
+		t.Errorf("first build Entries() = %v, want %s", got, want)
+	}
+	if got := build(); fmt.Sprint(got) != want {
+		t.Errorf("cached build Entries() = %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,644 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// highlightStylesheet is the file, relative to DestDir, holding the CSS for
+// the configured highlight theme.
+const highlightStylesheet = "highlight.css"
+
+// defaultHighlightTheme is used when the config does not set highlight_theme.
+const defaultHighlightTheme = "github"
+
+// hlToken is a run of source text sharing one highlight class. An empty class
+// is plain text.
+type hlToken struct {
+	class string
+	text  string
+}
+
+// highlightLang describes the lexical structure of a C-like or Lisp-like
+// language closely enough to colour it; it is not a parser.
+type highlightLang struct {
+	lineComments     []string
+	blockComment     [2]string
+	strings          []string // opening delimiters, longest first; each is closed by itself
+	rawStrings       string   // delimiters in which a backslash does not escape
+	multilineStrings bool     // whether single-character delimiters may span lines
+	keywords         map[string]bool
+	builtins         map[string]bool
+	types            map[string]bool
+	constants        map[string]bool
+	identExtra       string // punctuation allowed in identifiers
+	varPrefix        byte   // introduces a variable, as in shell's $HOME
+	symbolPrefix     byte   // introduces a self-evaluating symbol, as in elisp's :key
+	charPrefix       byte   // introduces a character literal, as in elisp's ?a
+	preprocessor     bool   // lines starting with # are directives
+	keys             bool   // words and strings followed by ':' are mapping keys
+	calls            bool   // words followed by '(' are function calls
+}
+
+func words(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(s) {
+		set[w] = true
+	}
+	return set
+}
+
+var (
+	goLang = &highlightLang{
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		strings:      []string{"`", `"`, "'"},
+		rawStrings:   "`",
+		keywords: words(`break case chan const continue default defer else fallthrough for func go goto if
+			import interface map package range return select struct switch type var`),
+		builtins:  words("append cap clear close complex copy delete imag len make max min new panic print println real recover"),
+		types:     words("any bool byte comparable complex64 complex128 error float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr"),
+		constants: words("true false nil iota"),
+		calls:     true,
+	}
+
+	elispLang = &highlightLang{
+		lineComments:     []string{";"},
+		strings:          []string{`"`},
+		multilineStrings: true,
+		keywords: words(`defun defmacro defvar defvar-local defcustom defconst defgroup defface defsubst defalias
+			lambda let let* if when unless cond and or not progn prog1 while dolist dotimes setq setq-local setf
+			condition-case unwind-protect catch throw interactive require provide save-excursion
+			save-restriction with-current-buffer pcase cl-defun cl-loop use-package`),
+		builtins: words(`car cdr cons list append mapcar mapc funcall apply message format concat length nth
+			assoc member eq equal null insert point goto-char buffer-string add-hook`),
+		constants:    words("t nil"),
+		identExtra:   "-+*/<>=!?&%$._",
+		symbolPrefix: ':',
+		charPrefix:   '?',
+	}
+
+	shellLang = &highlightLang{
+		lineComments:     []string{"#"},
+		strings:          []string{`"`, "'"},
+		rawStrings:       "'",
+		multilineStrings: true,
+		keywords: words(`if then else elif fi for while until do done case esac in function select return
+			break continue local export readonly declare unset shift time`),
+		builtins:   words("echo printf cd pwd read source exit eval exec set test trap alias cat grep sed awk ls mkdir rm cp mv"),
+		constants:  words("true false"),
+		identExtra: "-",
+		varPrefix:  '$',
+	}
+
+	pythonLang = &highlightLang{
+		lineComments: []string{"#"},
+		strings:      []string{`"""`, "'''", `"`, "'"},
+		keywords: words(`and as assert async await break class continue def del elif else except finally for
+			from global if import in is lambda nonlocal not or pass raise return try while with yield match case`),
+		builtins:  words("print len range open str int float list dict set tuple bool type isinstance super enumerate zip map filter sorted min max sum abs any all repr self"),
+		constants: words("True False None"),
+		calls:     true,
+	}
+
+	jsLang = &highlightLang{
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		strings:      []string{"`", `"`, "'"},
+		keywords: words(`async await break case catch class const continue debugger default delete do else
+			export extends finally for function if import in instanceof let new of return static super switch
+			this throw try typeof var void while with yield`),
+		builtins:   words("console Object Array String Number Boolean Promise Map Set JSON Math Date Error Symbol window document require module"),
+		constants:  words("true false null undefined NaN Infinity"),
+		identExtra: "$",
+		calls:      true,
+	}
+
+	jsonLang = &highlightLang{
+		strings:   []string{`"`},
+		constants: words("true false null"),
+		keys:      true,
+	}
+
+	yamlLang = &highlightLang{
+		lineComments: []string{"#"},
+		strings:      []string{`"`, "'"},
+		rawStrings:   "'",
+		constants:    words("true false null yes no on off True False Null"),
+		identExtra:   "-.",
+		keys:         true,
+	}
+
+	cLang = &highlightLang{
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		strings:      []string{`"`, "'"},
+		keywords: words(`auto break case const continue default do else enum extern for goto if inline register
+			restrict return sizeof static struct switch typedef union volatile while`),
+		types: words(`char double float int long short signed unsigned void bool size_t ssize_t
+			int8_t int16_t int32_t int64_t uint8_t uint16_t uint32_t uint64_t FILE`),
+		builtins:     words("printf fprintf sprintf snprintf malloc calloc realloc free memcpy memset strlen strcmp strcpy"),
+		constants:    words("NULL true false"),
+		preprocessor: true,
+		calls:        true,
+	}
+)
+
+// highlightLexers maps canonical language names to their tokenizers.
+var highlightLexers = map[string]func(string) []hlToken{
+	"go":     goLang.tokenize,
+	"elisp":  elispLang.tokenize,
+	"shell":  shellLang.tokenize,
+	"python": pythonLang.tokenize,
+	"js":     jsLang.tokenize,
+	"json":   jsonLang.tokenize,
+	"yaml":   yamlLang.tokenize,
+	"c":      cLang.tokenize,
+	"html":   tokenizeHTML,
+}
+
+// highlightAliases maps the other names org files use for a language to its
+// canonical name.
+var highlightAliases = map[string]string{
+	"golang":     "go",
+	"emacs-lisp": "elisp",
+	"sh":         "shell",
+	"bash":       "shell",
+	"zsh":        "shell",
+	"py":         "python",
+	"python3":    "python",
+	"javascript": "js",
+	"yml":        "yaml",
+	"h":          "c",
+	"xml":        "html",
+}
+
+func isIdentRune(r rune, extra string) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(extra, r)
+}
+
+// identEnd returns the index just past the identifier starting at i.
+func identEnd(src string, i int, extra string) int {
+	for i < len(src) {
+		r, size := utf8.DecodeRuneInString(src[i:])
+		if !isIdentRune(r, extra) {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+// nextNonBlank returns the first byte after i that is not a space or tab.
+func nextNonBlank(src string, i int) byte {
+	for i < len(src) && (src[i] == ' ' || src[i] == '\t') {
+		i++
+	}
+	if i < len(src) {
+		return src[i]
+	}
+	return 0
+}
+
+// stringEnd returns the index just past the string literal opened by delim at
+// i. Unterminated literals run to the end of the line, or of the source if
+// they may span lines.
+func (l *highlightLang) stringEnd(src string, i int, delim string) int {
+	escapes := !strings.Contains(l.rawStrings, delim)
+	stopAtNewline := len(delim) == 1 && delim != "`" && !l.multilineStrings
+	j := i + len(delim)
+	for j < len(src) {
+		switch {
+		case escapes && src[j] == '\\':
+			j += 2
+		case strings.HasPrefix(src[j:], delim):
+			return j + len(delim)
+		case stopAtNewline && src[j] == '\n':
+			return j
+		default:
+			j++
+		}
+	}
+	return len(src)
+}
+
+// tokenize splits src into highlight tokens, merging adjacent tokens of the
+// same class.
+func (l *highlightLang) tokenize(src string) []hlToken {
+	var tokens []hlToken
+	emit := func(class, text string) {
+		if n := len(tokens); n > 0 && tokens[n-1].class == class {
+			tokens[n-1].text += text
+			return
+		}
+		tokens = append(tokens, hlToken{class: class, text: text})
+	}
+
+	lineStart := true
+	for i := 0; i < len(src); {
+		end, class := l.next(src, i, lineStart)
+		if end > i {
+			emit(class, src[i:end])
+			i = end
+			lineStart = false
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(src[i:])
+		emit("", src[i:i+size])
+		i += size
+		if r == '\n' {
+			lineStart = true
+		} else if !unicode.IsSpace(r) {
+			lineStart = false
+		}
+	}
+	return tokens
+}
+
+// next recognises the token starting at i, returning its end and class, or i
+// itself if the next rune is plain text.
+func (l *highlightLang) next(src string, i int, lineStart bool) (int, string) {
+	rest := src[i:]
+	c := src[i]
+	prev := rune(' ')
+	if i > 0 {
+		prev, _ = utf8.DecodeLastRuneInString(src[:i])
+	}
+	lineEnd := func() int {
+		if j := strings.IndexByte(rest, '\n'); j >= 0 {
+			return i + j
+		}
+		return len(src)
+	}
+
+	if l.preprocessor && lineStart && c == '#' {
+		return lineEnd(), "hl-meta"
+	}
+	if l.varPrefix != 0 && c == l.varPrefix && i+1 < len(src) {
+		if src[i+1] == '{' {
+			if j := strings.IndexByte(rest, '}'); j >= 0 {
+				return i + j + 1, "hl-var"
+			}
+		}
+		if end := identEnd(src, i+1, ""); end > i+1 {
+			return end, "hl-var"
+		}
+		if strings.IndexByte("?#@*!$-0123456789", src[i+1]) >= 0 {
+			return i + 2, "hl-var"
+		}
+	}
+	for _, comment := range l.lineComments {
+		if strings.HasPrefix(rest, comment) && (comment != "#" || unicode.IsSpace(prev)) {
+			return lineEnd(), "hl-com"
+		}
+	}
+	if open, close := l.blockComment[0], l.blockComment[1]; open != "" && strings.HasPrefix(rest, open) {
+		if j := strings.Index(rest[len(open):], close); j >= 0 {
+			return i + len(open) + j + len(close), "hl-com"
+		}
+		return len(src), "hl-com"
+	}
+	for _, delim := range l.strings {
+		if strings.HasPrefix(rest, delim) {
+			end := l.stringEnd(src, i, delim)
+			if l.keys && nextNonBlank(src, end) == ':' {
+				return end, "hl-key"
+			}
+			return end, "hl-str"
+		}
+	}
+	if l.charPrefix != 0 && c == l.charPrefix && i+1 < len(src) && !isIdentRune(prev, l.identExtra) {
+		if src[i+1] == '\\' && i+2 < len(src) {
+			return i + 3, "hl-str"
+		}
+		return i + 2, "hl-str"
+	}
+	if l.symbolPrefix != 0 && c == l.symbolPrefix && !isIdentRune(prev, l.identExtra) {
+		if end := identEnd(src, i+1, l.identExtra); end > i+1 {
+			return end, "hl-const"
+		}
+	}
+	if c >= '0' && c <= '9' {
+		end := i + 1
+		for end < len(src) && (isIdentRune(rune(src[end]), "") || src[end] == '.') {
+			end++
+		}
+		return end, "hl-num"
+	}
+
+	if r, _ := utf8.DecodeRuneInString(rest); !isIdentRune(r, l.identExtra) {
+		return i, ""
+	}
+	end := identEnd(src, i, l.identExtra)
+	word := src[i:end]
+	switch {
+	case l.keys && nextNonBlank(src, end) == ':':
+		return end, "hl-key"
+	case l.keywords[word]:
+		return end, "hl-kw"
+	case l.types[word]:
+		return end, "hl-ty"
+	case l.builtins[word]:
+		return end, "hl-bi"
+	case l.constants[word]:
+		return end, "hl-const"
+	case l.calls && nextNonBlank(src, end) == '(':
+		return end, "hl-fn"
+	}
+	return end, ""
+}
+
+// tokenizeHTML splits HTML (or XML) into comments, tag names, attribute names
+// and values, and entities.
+func tokenizeHTML(src string) []hlToken {
+	var tokens []hlToken
+	emit := func(class, text string) {
+		if text == "" {
+			return
+		}
+		if n := len(tokens); n > 0 && tokens[n-1].class == class {
+			tokens[n-1].text += text
+			return
+		}
+		tokens = append(tokens, hlToken{class: class, text: text})
+	}
+
+	for i := 0; i < len(src); {
+		rest := src[i:]
+		switch {
+		case strings.HasPrefix(rest, "<!--"):
+			end := len(src)
+			if j := strings.Index(rest, "-->"); j >= 0 {
+				end = i + j + len("-->")
+			}
+			emit("hl-com", src[i:end])
+			i = end
+
+		case rest[0] == '<' && len(rest) > 1 && (rest[1] == '/' || rest[1] == '!' || rest[1] == '?' || unicode.IsLetter(rune(rest[1]))):
+			open := 1
+			if rest[1] == '/' {
+				open = 2
+			}
+			emit("", rest[:open])
+			i += open
+			end := identEnd(src, i, "-:!?")
+			emit("hl-tag", src[i:end])
+			i = end
+			for i < len(src) && src[i] != '>' {
+				switch c := src[i]; {
+				case c == '"' || c == '\'':
+					end := len(src)
+					if j := strings.IndexByte(src[i+1:], c); j >= 0 {
+						end = i + j + 2
+					}
+					emit("hl-str", src[i:end])
+					i = end
+				case isIdentRune(rune(c), "-:.@"):
+					end := identEnd(src, i, "-:.@")
+					emit("hl-attr", src[i:end])
+					i = end
+				default:
+					emit("", src[i:i+1])
+					i++
+				}
+			}
+			if i < len(src) {
+				emit("", ">")
+				i++
+			}
+
+		case rest[0] == '&':
+			if j := strings.IndexByte(rest, ';'); j > 1 && identEnd(rest, 1, "#") == j {
+				emit("hl-const", rest[:j+1])
+				i += j + 1
+				continue
+			}
+			emit("", "&")
+			i++
+
+		default:
+			end := len(src)
+			if j := strings.IndexAny(rest, "<&"); j > 0 {
+				end = i + j
+			} else if j == 0 {
+				end = i + 1
+			}
+			emit("", src[i:end])
+			i = end
+		}
+	}
+	return tokens
+}
+
+// writeHighlightSpan writes text, escaped, wrapped in a span of class.
+func writeHighlightSpan(b *strings.Builder, class, text string) {
+	if text == "" {
+		return
+	}
+	if class == "" {
+		b.WriteString(html.EscapeString(text))
+		return
+	}
+	fmt.Fprintf(b, `<span class="%s">%s</span>`, class, html.EscapeString(text))
+}
+
+// highlightCode renders source as HTML with a class-annotated span per token.
+// Unknown languages are only escaped. With lineNumbers, each line is wrapped
+// in an hl-line span that starts with its hl-ln number.
+func highlightCode(source, lang string, lineNumbers bool) string {
+	source = strings.TrimSuffix(source, "\n")
+	lang = strings.ToLower(lang)
+	if alias, ok := highlightAliases[lang]; ok {
+		lang = alias
+	}
+	tokens := []hlToken{{text: source}}
+	if lex, ok := highlightLexers[lang]; ok {
+		tokens = lex(source)
+	}
+
+	var b strings.Builder
+	if !lineNumbers {
+		for _, token := range tokens {
+			writeHighlightSpan(&b, token.class, token.text)
+		}
+		return b.String()
+	}
+
+	line := 1
+	fmt.Fprintf(&b, `<span class="hl-line"><span class="hl-ln">%d</span>`, line)
+	for _, token := range tokens {
+		for j, part := range strings.Split(token.text, "\n") {
+			if j > 0 {
+				line++
+				fmt.Fprintf(&b, "</span>\n"+`<span class="hl-line"><span class="hl-ln">%d</span>`, line)
+			}
+			writeHighlightSpan(&b, token.class, part)
+		}
+	}
+	b.WriteString("</span>")
+	return b.String()
+}
+
+// codeHighlighter returns the HTMLWriter.HighlightCodeBlock implementation for
+// ctx. Blocks keep go-org's default markup around the highlighted code; inline
+// blocks return the bare spans for WriteInlineBlock to wrap.
+func codeHighlighter(ctx BuildContext) func(source, lang string, inline bool, params map[string]string) string {
+	return func(source, lang string, inline bool, params map[string]string) string {
+		if inline {
+			return highlightCode(source, lang, false)
+		}
+		return fmt.Sprintf("<div class=\"highlight\">\n<pre>\n%s\n</pre>\n</div>", highlightCode(source, lang, ctx.HighlightLineNumbers))
+	}
+}
+
+// highlightTheme holds the CSS declarations for code blocks and each token
+// class.
+type highlightTheme struct {
+	background string
+	foreground string
+	lineNumber string
+	classes    map[string]string
+}
+
+// highlightClasses lists every token class in the order it is written to the
+// stylesheet.
+var highlightClasses = []string{"hl-kw", "hl-ty", "hl-bi", "hl-fn", "hl-const", "hl-str", "hl-num", "hl-com", "hl-var", "hl-key", "hl-meta", "hl-tag", "hl-attr"}
+
+var highlightThemes = map[string]highlightTheme{
+	"github": {
+		background: "#f6f8fa",
+		foreground: "#24292e",
+		lineNumber: "#959da5",
+		classes: map[string]string{
+			"hl-kw":    "color: #d73a49",
+			"hl-ty":    "color: #6f42c1",
+			"hl-bi":    "color: #005cc5",
+			"hl-fn":    "color: #6f42c1",
+			"hl-const": "color: #005cc5",
+			"hl-str":   "color: #032f62",
+			"hl-num":   "color: #005cc5",
+			"hl-com":   "color: #6a737d; font-style: italic",
+			"hl-var":   "color: #e36209",
+			"hl-key":   "color: #22863a",
+			"hl-meta":  "color: #d73a49",
+			"hl-tag":   "color: #22863a",
+			"hl-attr":  "color: #6f42c1",
+		},
+	},
+	"monokai": {
+		background: "#272822",
+		foreground: "#f8f8f2",
+		lineNumber: "#75715e",
+		classes: map[string]string{
+			"hl-kw":    "color: #f92672",
+			"hl-ty":    "color: #66d9ef; font-style: italic",
+			"hl-bi":    "color: #66d9ef",
+			"hl-fn":    "color: #a6e22e",
+			"hl-const": "color: #ae81ff",
+			"hl-str":   "color: #e6db74",
+			"hl-num":   "color: #ae81ff",
+			"hl-com":   "color: #75715e; font-style: italic",
+			"hl-var":   "color: #fd971f",
+			"hl-key":   "color: #a6e22e",
+			"hl-meta":  "color: #f92672",
+			"hl-tag":   "color: #f92672",
+			"hl-attr":  "color: #a6e22e",
+		},
+	},
+	"solarized-light": {
+		background: "#fdf6e3",
+		foreground: "#657b83",
+		lineNumber: "#93a1a1",
+		classes: map[string]string{
+			"hl-kw":    "color: #859900",
+			"hl-ty":    "color: #b58900",
+			"hl-bi":    "color: #268bd2",
+			"hl-fn":    "color: #268bd2",
+			"hl-const": "color: #cb4b16",
+			"hl-str":   "color: #2aa198",
+			"hl-num":   "color: #d33682",
+			"hl-com":   "color: #93a1a1; font-style: italic",
+			"hl-var":   "color: #b58900",
+			"hl-key":   "color: #268bd2",
+			"hl-meta":  "color: #cb4b16",
+			"hl-tag":   "color: #268bd2",
+			"hl-attr":  "color: #b58900",
+		},
+	},
+	"solarized-dark": {
+		background: "#002b36",
+		foreground: "#839496",
+		lineNumber: "#586e75",
+		classes: map[string]string{
+			"hl-kw":    "color: #859900",
+			"hl-ty":    "color: #b58900",
+			"hl-bi":    "color: #268bd2",
+			"hl-fn":    "color: #268bd2",
+			"hl-const": "color: #cb4b16",
+			"hl-str":   "color: #2aa198",
+			"hl-num":   "color: #d33682",
+			"hl-com":   "color: #586e75; font-style: italic",
+			"hl-var":   "color: #b58900",
+			"hl-key":   "color: #268bd2",
+			"hl-meta":  "color: #cb4b16",
+			"hl-tag":   "color: #268bd2",
+			"hl-attr":  "color: #b58900",
+		},
+	},
+}
+
+// highlightCSS renders the stylesheet for the named theme.
+func highlightCSS(name string) (string, error) {
+	theme, ok := highlightThemes[name]
+	if !ok {
+		return "", fmt.Errorf("unknown highlight theme %q", name)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "/* Generated by oxen: highlight theme %q */\n", name)
+	fmt.Fprintf(&b, ".highlight pre, code.src-inline { background: %s; color: %s; }\n", theme.background, theme.foreground)
+	fmt.Fprintf(&b, ".hl-ln { display: inline-block; min-width: 2.5em; padding-right: 1em; text-align: right; color: %s; user-select: none; }\n", theme.lineNumber)
+	for _, class := range highlightClasses {
+		fmt.Fprintf(&b, ".%s { %s; }\n", class, theme.classes[class])
+	}
+	return b.String(), nil
+}
+
+// WriteHighlightStylesheet writes the CSS for ctx's highlight theme to
+// DestDir/highlight.css. The file is left untouched if it is already current,
+// so watchers are not woken for nothing.
+func WriteHighlightStylesheet(_ *ProcessedFiles, ctx BuildContext) (result GenerationResult) {
+	slog.Debug("Starting Phase 3f: writing highlight stylesheet")
+
+	name := ctx.HighlightTheme
+	if name == "" {
+		name = defaultHighlightTheme
+	}
+	css, err := highlightCSS(name)
+	if err != nil {
+		ctx.Diagnostics.Warn("config", "", 0, "%v; using the default highlight theme", err)
+		css, _ = highlightCSS(defaultHighlightTheme)
+	}
+
+	path := filepath.Join(ctx.DestDir, highlightStylesheet)
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, []byte(css)) && ctx.DryRun == nil {
+		slog.Debug("Highlight stylesheet up to date", "path", path)
+		skipOutput(ctx, path)
+		return
+	}
+	if err := writeOutput(ctx, path, []byte(css)); err != nil {
+		ctx.Diagnostics.Error("output", "", 0, "failed to write %s: %v", path, err)
+		result.Errors = 1
+		return
+	}
+	slog.Debug("Phase 3f complete", "theme", name)
+	return
+}
@@ -0,0 +1,154 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHighlightCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     string
+		source   string
+		expected []string
+	}{
+		{
+			name:   "go",
+			lang:   "go",
+			source: "// Greet says hi\nfunc Greet(n int) string {\n\treturn fmt.Sprintf(\"hi %d\", n)\n}",
+			expected: []string{
+				`<span class="hl-com">// Greet says hi</span>`,
+				`<span class="hl-kw">func</span> <span class="hl-fn">Greet</span>`,
+				`<span class="hl-ty">int</span>`,
+				`<span class="hl-str">&#34;hi %d&#34;</span>`,
+			},
+		},
+		{
+			name:     "elisp",
+			lang:     "emacs-lisp",
+			source:   `(defun my-fn (x) "Doc." (message ":not-a-key %s" :key ?\"))`,
+			expected: []string{`<span class="hl-kw">defun</span> my-fn`, `<span class="hl-str">&#34;Doc.&#34;</span>`, `<span class="hl-const">:key</span>`},
+		},
+		{
+			name:     "shell",
+			lang:     "bash",
+			source:   "echo \"$HOME\" ${PATH} # trailing\nls a#b",
+			expected: []string{`<span class="hl-bi">echo</span>`, `<span class="hl-var">${PATH}</span>`, `<span class="hl-com"># trailing</span>`, "a#b"},
+		},
+		{
+			name:     "python",
+			lang:     "python",
+			source:   "def f():\n    \"\"\"Doc\n    string\"\"\"\n    return None",
+			expected: []string{`<span class="hl-kw">def</span>`, "<span class=\"hl-str\">&#34;&#34;&#34;Doc\n    string&#34;&#34;&#34;</span>", `<span class="hl-const">None</span>`},
+		},
+		{
+			name:     "json",
+			lang:     "json",
+			source:   `{"name": "oxen", "draft": false, "count": 3}`,
+			expected: []string{`<span class="hl-key">&#34;name&#34;</span>`, `<span class="hl-str">&#34;oxen&#34;</span>`, `<span class="hl-const">false</span>`, `<span class="hl-num">3</span>`},
+		},
+		{
+			name:     "yaml",
+			lang:     "yml",
+			source:   "site-name: Oxen # name\nenabled: yes",
+			expected: []string{`<span class="hl-key">site-name</span>`, `<span class="hl-com"># name</span>`, `<span class="hl-const">yes</span>`},
+		},
+		{
+			name:     "c",
+			lang:     "c",
+			source:   "#include <stdio.h>\nint main(void) { return 0; }",
+			expected: []string{`<span class="hl-meta">#include &lt;stdio.h&gt;</span>`, `<span class="hl-ty">int</span> <span class="hl-fn">main</span>`},
+		},
+		{
+			name:     "html",
+			lang:     "html",
+			source:   `<!-- c --><a href="/x">&amp;</a>`,
+			expected: []string{`<span class="hl-com">&lt;!-- c --&gt;</span>`, `&lt;<span class="hl-tag">a</span> <span class="hl-attr">href</span>=<span class="hl-str">&#34;/x&#34;</span>&gt;`, `<span class="hl-const">&amp;amp;</span>`},
+		},
+		{
+			name:     "unknown language is only escaped",
+			lang:     "brainfuck",
+			source:   "<+>",
+			expected: []string{"&lt;+&gt;"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := highlightCode(tt.source, tt.lang, false)
+			for _, want := range tt.expected {
+				if !strings.Contains(got, want) {
+					t.Errorf("highlightCode() = %s\nwant it to contain %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHighlightCode_LineNumbers(t *testing.T) {
+	got := highlightCode("/* one\ntwo */\nthree\n", "c", true)
+	if n := strings.Count(got, `<span class="hl-line">`); n != 3 {
+		t.Errorf("got %d lines, want 3: %s", n, got)
+	}
+	if !strings.Contains(got, `<span class="hl-ln">2</span><span class="hl-com">two */</span></span>`) {
+		t.Errorf("multi-line comment not split per line: %s", got)
+	}
+}
+
+func TestHighlightInSrcBlocks(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-highlight-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "code.org", `* Code
+Call src_go{len(x)} inline.
+#+begin_src go
+var x = 1
+#+end_src
+`)
+	ctx := BuildContext{Root: tmpDir, HighlightLineNumbers: true}
+	fi, err := processFile("code.org", ctx)
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, *fi, ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	if !strings.Contains(html, `<code class="src src-inline src-go"><span class="hl-bi">len</span>(x)</code>`) {
+		t.Errorf("inline src block not highlighted inline: %s", html)
+	}
+	if !strings.Contains(html, `<span class="hl-ln">1</span><span class="hl-kw">var</span>`) {
+		t.Errorf("src block not highlighted with line numbers: %s", html)
+	}
+}
+
+func TestWriteHighlightStylesheet(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-highlight-")
+	defer CleanupTempDir(tmpDir)
+
+	result := WriteHighlightStylesheet(nil, BuildContext{DestDir: tmpDir, HighlightTheme: "monokai"})
+	if result.Errors != 0 {
+		t.Fatalf("WriteHighlightStylesheet() errors = %d", result.Errors)
+	}
+	data, err := os.ReadFile(filepath.Join(tmpDir, highlightStylesheet))
+	if err != nil {
+		t.Fatalf("Failed to read stylesheet: %v", err)
+	}
+	css := string(data)
+	for _, class := range highlightClasses {
+		if !strings.Contains(css, "."+class+" {") {
+			t.Errorf("stylesheet has no rule for %s", class)
+		}
+	}
+	if !strings.Contains(css, "#272822") {
+		t.Error("stylesheet does not use the monokai background")
+	}
+
+	WriteHighlightStylesheet(nil, BuildContext{DestDir: tmpDir, HighlightTheme: "no-such-theme"})
+	data, _ = os.ReadFile(filepath.Join(tmpDir, highlightStylesheet))
+	if !strings.Contains(string(data), `"github"`) {
+		t.Error("unknown theme did not fall back to the default")
+	}
+}
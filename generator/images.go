@@ -0,0 +1,369 @@
+package generator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// imageOutputDir is the directory under DestDir holding processed images and
+// their resized variants.
+const imageOutputDir = "_img"
+
+// defaultImageWidths are the variant widths generated when the config does not
+// set image_widths.
+var defaultImageWidths = []int{480, 960, 1600}
+
+// ImageVariant is one encoded rendition of a source image.
+type ImageVariant struct {
+	Width int
+	Path  string // relative to DestDir
+}
+
+// ImageInfo describes a processed source image: its intrinsic size and every
+// rendition written to DestDir, narrowest first. The last variant is always
+// the original at full size.
+type ImageInfo struct {
+	Width    int
+	Height   int
+	Variants []ImageVariant
+}
+
+// imageWidths returns the configured variant widths in ascending order.
+func imageWidths(ctx BuildContext) []int {
+	if len(ctx.ImageWidths) > 0 {
+		widths := slices.Clone(ctx.ImageWidths)
+		slices.Sort(widths)
+		return slices.Compact(widths)
+	}
+	return defaultImageWidths
+}
+
+// isProcessableImage reports whether path has an extension the standard
+// library can decode.
+func isProcessableImage(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
+}
+
+// localLinkTarget returns the root-relative path a file link in filePath points
+// at, if it is a local file inside the source root.
+func localLinkTarget(link org.RegularLink, filePath string) (string, bool) {
+	var target string
+	switch link.Protocol {
+	case "file":
+		target = strings.TrimPrefix(link.URL, "file:")
+	case "":
+		target = link.URL
+	default:
+		return "", false
+	}
+	if i := strings.Index(target, "::"); i >= 0 {
+		target = target[:i]
+	}
+	if target == "" || filepath.IsAbs(target) {
+		return "", false
+	}
+	relPath := filepath.Join(filepath.Dir(filePath), target)
+	if !filepath.IsLocal(relPath) {
+		return "", false
+	}
+	return relPath, true
+}
+
+// extractImagesFromAST returns the root-relative paths of every local image
+// embedded in doc, including image attachments and the page's #+IMAGE:
+// cover, sorted. cover is the page image as extractImageFromAST returns it.
+func extractImagesFromAST(doc *org.Document, filePath string, attachments []string, cover string) []string {
+	found := map[string]bool{}
+	walkOrgNodes(doc.Nodes, func(node org.Node) bool {
+		if link, ok := node.(org.RegularLink); ok {
+			if relPath, ok := localLinkTarget(link, filePath); ok && isProcessableImage(relPath) {
+				found[relPath] = true
+			}
+		}
+		return true
+	})
+	for _, relPath := range attachments {
+		if isProcessableImage(relPath) {
+			found[relPath] = true
+		}
+	}
+	if relPath := filepath.FromSlash(cover); cover != "" && !strings.Contains(cover, "://") &&
+		filepath.IsLocal(relPath) && isProcessableImage(relPath) {
+		found[relPath] = true
+	}
+
+	if len(found) == 0 {
+		return nil
+	}
+	images := make([]string, 0, len(found))
+	for relPath := range found {
+		images = append(images, relPath)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// ProcessImages decodes every image referenced from an org file and writes
+// resized width variants into ctx.DestDir/_img. Variants are named after the
+// source's content hash, so unchanged images are never decoded twice; only
+// their header is read to recover the dimensions. Populates procFiles.Images.
+func ProcessImages(procFiles *ProcessedFiles, ctx BuildContext) (*ProcessedFiles, GenerationResult) {
+	slog.Debug("Starting image phase: generating responsive image variants")
+
+	sources := map[string]bool{}
+	for _, fi := range procFiles.Files {
+		for _, relPath := range fi.Images {
+			sources[relPath] = true
+		}
+	}
+
+	procFiles.Images = make(map[string]ImageInfo, len(sources))
+	var mu sync.Mutex
+	var variantsGenerated int64
+	var errors int64
+
+	paths := slices.Sorted(maps.Keys(sources))
+	ctx.Pool.Run(len(paths), func(i int) {
+		relPath := paths[i]
+		start := time.Now()
+		info, generated, err := processImage(relPath, ctx)
+		ctx.Timings.File("image", relPath, time.Since(start))
+		if err != nil {
+			ctx.Diagnostics.Error("image", relPath, 0, "failed to process image: %v", err)
+			atomic.AddInt64(&errors, 1)
+			return
+		}
+		atomic.AddInt64(&variantsGenerated, int64(generated))
+		mu.Lock()
+		procFiles.Images[relPath] = info
+		mu.Unlock()
+	})
+
+	slog.Debug("Image phase complete", "images", len(procFiles.Images), "variants_generated", variantsGenerated, "errors", errors)
+
+	return procFiles, GenerationResult{
+		ImageVariantsGenerated: int(variantsGenerated),
+		Errors:                 int(errors),
+	}
+}
+
+// processImage writes the variants of a single source image that are not
+// already present and returns its ImageInfo along with the number of files
+// written.
+func processImage(relPath string, ctx BuildContext) (ImageInfo, int, error) {
+	data, err := os.ReadFile(filepath.Join(ctx.Root, relPath))
+	if err != nil {
+		return ImageInfo{}, 0, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ImageInfo{}, 0, fmt.Errorf("failed to decode image header: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:8])
+	ext := strings.ToLower(filepath.Ext(relPath))
+
+	info := ImageInfo{Width: cfg.Width, Height: cfg.Height}
+	generated := 0
+
+	// Animated GIFs would lose their frames if resized, so they are only
+	// copied.
+	if format != "gif" {
+		var src image.Image
+		for _, width := range imageWidths(ctx) {
+			if width <= 0 || width >= cfg.Width {
+				continue
+			}
+			variant := ImageVariant{Width: width, Path: filepath.Join(imageOutputDir, fmt.Sprintf("%s-%d%s", hash, width, ext))}
+			info.Variants = append(info.Variants, variant)
+
+			dstPath := filepath.Join(ctx.DestDir, variant.Path)
+			if outputExists(ctx, dstPath) {
+				continue
+			}
+			if src == nil {
+				if src, _, err = image.Decode(bytes.NewReader(data)); err != nil {
+					return ImageInfo{}, generated, fmt.Errorf("failed to decode image: %w", err)
+				}
+			}
+			height := max(1, cfg.Height*width/cfg.Width)
+			if err := writeImage(ctx, dstPath, format, resizeImage(src, width, height)); err != nil {
+				return ImageInfo{}, generated, err
+			}
+			generated++
+		}
+	}
+
+	original := ImageVariant{Width: cfg.Width, Path: filepath.Join(imageOutputDir, hash+ext)}
+	info.Variants = append(info.Variants, original)
+	if originalPath := filepath.Join(ctx.DestDir, original.Path); !outputExists(ctx, originalPath) {
+		if err := writeOutput(ctx, originalPath, data); err != nil {
+			return ImageInfo{}, generated, err
+		}
+		generated++
+	}
+
+	return info, generated, nil
+}
+
+func writeImage(ctx BuildContext, path, format string, img image.Image) error {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode image: %w", err)
+	}
+	return writeOutput(ctx, path, buf.Bytes())
+}
+
+// resizeImage downscales src to width x height by averaging the block of
+// source pixels that maps onto each destination pixel.
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	srcW, srcH := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := max(y0+1, (y+1)*srcH/height)
+		for x := 0; x < width; x++ {
+			x0 := x * srcW / width
+			x1 := max(x0+1, (x+1)*srcW/width)
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// imageWidthHint parses the :width of an #+ATTR_HTML: line into pixels.
+// Relative widths such as "50%" are not hints and yield 0.
+func imageWidthHint(meta org.Metadata) int {
+	for _, attributes := range meta.HTMLAttributes {
+		for i := 0; i+1 < len(attributes); i += 2 {
+			if attributes[i] == ":width" {
+				if width, err := strconv.Atoi(strings.TrimSuffix(attributes[i+1], "px")); err == nil && width > 0 {
+					return width
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// htmlSizeAttributes rewrites the :width and :height of meta's #+ATTR_HTML:
+// lines into what HTML accepts: 300px becomes 300, and other lengths, such as
+// 50% or 20em, move into a style attribute. go-org copies the attributes onto
+// the element unchanged.
+func htmlSizeAttributes(meta org.Metadata) org.Metadata {
+	rewritten := make([][]string, len(meta.HTMLAttributes))
+	for i, attributes := range meta.HTMLAttributes {
+		var style []string
+		kept := make([]string, 0, len(attributes))
+		for j := 0; j+1 < len(attributes); j += 2 {
+			key, value := attributes[j], attributes[j+1]
+			if key == ":width" || key == ":height" {
+				if n, err := strconv.Atoi(strings.TrimSuffix(value, "px")); err == nil && n >= 0 {
+					value = strconv.Itoa(n)
+				} else {
+					style = append(style, strings.TrimPrefix(key, ":")+": "+value)
+					continue
+				}
+			}
+			kept = append(kept, key, value)
+		}
+		if len(style) > 0 {
+			kept = appendStyle(kept, strings.Join(style, "; "))
+		}
+		rewritten[i] = kept
+	}
+	meta.HTMLAttributes = rewritten
+	return meta
+}
+
+// appendStyle adds declarations to the :style in attributes, or adds one.
+func appendStyle(attributes []string, declarations string) []string {
+	for j := 0; j+1 < len(attributes); j += 2 {
+		if attributes[j] == ":style" {
+			attributes[j+1] = strings.TrimSuffix(strings.TrimSpace(attributes[j+1]), ";") + "; " + declarations
+			return attributes
+		}
+	}
+	return append(attributes, ":style", declarations)
+}
+
+// responsiveImageTag renders an <img> for a processed image, linking every
+// variant in srcset. pageDir is the page's directory relative to DestDir, and
+// displayWidth (if non-zero) is the width the author asked for.
+func responsiveImageTag(info ImageInfo, pageDir, alt string, displayWidth int) string {
+	relative := func(path string) string {
+		rel, err := filepath.Rel(pageDir, path)
+		if err != nil {
+			rel = path
+		}
+		return filepath.ToSlash(rel)
+	}
+
+	srcset := make([]string, len(info.Variants))
+	for i, variant := range info.Variants {
+		srcset[i] = fmt.Sprintf("%s %dw", relative(variant.Path), variant.Width)
+	}
+
+	width, height := info.Width, info.Height
+	if displayWidth > 0 && info.Width > 0 {
+		width, height = displayWidth, max(1, info.Height*displayWidth/info.Width)
+	}
+	original := info.Variants[len(info.Variants)-1]
+
+	return fmt.Sprintf(`<img src="%s" srcset="%s" sizes="(max-width: %dpx) 100vw, %dpx" width="%d" height="%d" alt="%s" loading="lazy" />`,
+		html.EscapeString(relative(original.Path)), html.EscapeString(strings.Join(srcset, ", ")), width, width, width, height, html.EscapeString(alt))
+}
@@ -0,0 +1,166 @@
+package generator
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+func createTestPNG(t *testing.T, path string, width, height int) {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", path, err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatalf("Failed to encode %s: %v", path, err)
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		src.Set(x, 0, color.RGBA{200, 0, 0, 255})
+		src.Set(x, 1, color.RGBA{0, 0, 100, 255})
+	}
+
+	dst := resizeImage(src, 2, 1)
+	if dst.Bounds().Dx() != 2 || dst.Bounds().Dy() != 1 {
+		t.Fatalf("resizeImage() size = %v, want 2x1", dst.Bounds())
+	}
+	if got := dst.RGBAAt(0, 0); got != (color.RGBA{100, 0, 50, 255}) {
+		t.Errorf("resizeImage() pixel = %v, want the block average", got)
+	}
+}
+
+func TestImageWidthHint(t *testing.T) {
+	tests := []struct {
+		attributes []string
+		expected   int
+	}{
+		{[]string{":width", "300"}, 300},
+		{[]string{":class", "wide", ":width", "250px"}, 250},
+		{[]string{":width", "50%"}, 0},
+		{[]string{":alt", "no width"}, 0},
+	}
+	for _, tt := range tests {
+		meta := org.Metadata{HTMLAttributes: [][]string{tt.attributes}}
+		if got := imageWidthHint(meta); got != tt.expected {
+			t.Errorf("imageWidthHint(%v) = %d, want %d", tt.attributes, got, tt.expected)
+		}
+	}
+}
+
+func TestHTMLSizeAttributes(t *testing.T) {
+	tests := []struct {
+		attributes []string
+		expected   string
+	}{
+		{[]string{":width", "300px"}, "[:width 300]"},
+		{[]string{":width", "300", ":height", "150px"}, "[:width 300 :height 150]"},
+		{[]string{":width", "50%", ":alt", "half"}, "[:alt half :style width: 50%]"},
+		{[]string{":style", "border: 0;", ":height", "10em"}, "[:style border: 0; height: 10em]"},
+	}
+	for _, tt := range tests {
+		meta := htmlSizeAttributes(org.Metadata{HTMLAttributes: [][]string{tt.attributes}})
+		if got := fmt.Sprint(meta.HTMLAttributes[0]); got != tt.expected {
+			t.Errorf("htmlSizeAttributes(%v) = %s, want %s", tt.attributes, got, tt.expected)
+		}
+	}
+
+	doc := org.New().Parse(strings.NewReader("#+ATTR_HTML: :width 300px\n[[file:diagram.svg]]\n"), "page.org")
+	html, err := convertOrgToHTMLWithLinkReplacement(doc, FileInfo{Path: "page.org"}, BuildContext{}, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	if !strings.Contains(html, `width="300"`) {
+		t.Errorf("HTML has no integer width:\n%s", html)
+	}
+}
+
+func TestProcessImages(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-images-")
+	defer CleanupTempDir(tmpDir)
+	destDir := filepath.Join(tmpDir, "public")
+
+	CreateTestDirStructure(tmpDir, []string{"posts/img"})
+	createTestPNG(t, filepath.Join(tmpDir, "posts/img/photo.png"), 1000, 500)
+	CreateTestOrgFile(tmpDir, "posts/photo.org", `* Photo
+[[file:img/photo.png]]
+
+#+ATTR_HTML: :width 300
+[[./img/photo.png]]
+`)
+
+	ctx := BuildContext{Root: tmpDir, DestDir: destDir, ForceRebuild: true, ImageWidths: []int{960, 480, 2000}}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	procFiles, result := ProcessImages(procFiles, ctx)
+	if result.Errors != 0 {
+		t.Fatalf("ProcessImages() errors = %d", result.Errors)
+	}
+	// Two variants narrower than the original, plus the original itself.
+	if result.ImageVariantsGenerated != 3 {
+		t.Errorf("ImageVariantsGenerated = %d, want 3", result.ImageVariantsGenerated)
+	}
+
+	info, ok := procFiles.Images["posts/img/photo.png"]
+	if !ok {
+		t.Fatal("posts/img/photo.png missing from procFiles.Images")
+	}
+	if info.Width != 1000 || info.Height != 500 || len(info.Variants) != 3 {
+		t.Fatalf("ImageInfo = %+v, want 1000x500 with 3 variants", info)
+	}
+	for _, variant := range info.Variants {
+		if _, err := os.Stat(filepath.Join(destDir, variant.Path)); err != nil {
+			t.Errorf("variant %s not written: %v", variant.Path, err)
+		}
+	}
+	f, err := os.Open(filepath.Join(destDir, info.Variants[0].Path))
+	if err != nil {
+		t.Fatalf("Failed to open variant: %v", err)
+	}
+	cfg, err := png.DecodeConfig(f)
+	f.Close()
+	if err != nil || cfg.Width != 480 || cfg.Height != 240 {
+		t.Errorf("narrowest variant is %dx%d (%v), want 480x240", cfg.Width, cfg.Height, err)
+	}
+
+	// A second build finds every variant cached.
+	_, result = ProcessImages(procFiles, ctx)
+	if result.ImageVariantsGenerated != 0 {
+		t.Errorf("cached rebuild generated %d variants, want 0", result.ImageVariantsGenerated)
+	}
+
+	fi := procFiles.Files[0]
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, fi, ctx, nil, procFiles)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	for _, want := range []string{
+		`srcset="../_img/`,
+		` 480w, `,
+		` 1000w"`,
+		`width="1000" height="500"`,
+		`loading="lazy"`,
+		`width="300" height="150"`,
+		`sizes="(max-width: 300px) 100vw, 300px"`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML missing %q:\n%s", want, html)
+		}
+	}
+}
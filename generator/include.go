@@ -0,0 +1,233 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// reIncludeKeyword matches the value of an #+INCLUDE: keyword: a quoted path,
+// optionally followed by a block kind (src, example, export) and its language.
+var reIncludeKeyword = regexp.MustCompile(`^"([^"]+)"(?:\s+(\w+))?(?:\s+([^\s:]\S*))?`)
+
+// reSetupFileKeyword matches a #+SETUPFILE: line and captures its path.
+var reSetupFileKeyword = regexp.MustCompile(`(?mi)^[ \t]*#\+SETUPFILE:[ \t]*(\S.*?)[ \t]*$`)
+
+// includeResolver reads the files a single document pulls in through
+// #+INCLUDE: and #+SETUPFILE:. Reads are confined to the source root, include
+// cycles are broken, and every file read is recorded so that the including
+// document can be rebuilt whenever one of them changes.
+type includeResolver struct {
+	root     string
+	realRoot string
+	chain    []string // the document, then the files being included or read as setup files
+	setups   map[string]bool
+	deps     map[string]bool
+
+	diagnostics *Diagnostics
+}
+
+func newIncludeResolver(root, docPath string) *includeResolver {
+	realRoot := root
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		realRoot = resolved
+	}
+	docPath = filepath.Clean(docPath)
+	return &includeResolver{
+		root:     root,
+		realRoot: realRoot,
+		chain:    []string{docPath},
+		setups:   map[string]bool{docPath: true},
+		deps:     map[string]bool{},
+	}
+}
+
+// ReadFile is installed as the org.Configuration's ReadFile. go-org only calls
+// it for #+SETUPFILE: while parsing, because includes are resolved by
+// expandIncludes instead.
+func (r *includeResolver) ReadFile(path string) ([]byte, error) {
+	return r.readSetupFile(filepath.Clean(path))
+}
+
+// readSetupFile returns the contents of the setup file path with the setup
+// files it names inlined, so that the chain of setup files being read is
+// known: a setup file that is already in the chain is a cycle, while one
+// reached a second time through another setup file is simply not loaded again.
+func (r *includeResolver) readSetupFile(path string) ([]byte, error) {
+	if slices.Contains(r.chain, path) {
+		return nil, fmt.Errorf("setup file cycle: %s is already loaded", path)
+	}
+	if r.setups[path] {
+		return nil, nil
+	}
+	r.setups[path] = true
+	data, err := r.read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.chain = append(r.chain, path)
+	defer func() { r.chain = r.chain[:len(r.chain)-1] }()
+	return reSetupFileKeyword.ReplaceAllFunc(data, func(line []byte) []byte {
+		value := string(reSetupFileKeyword.FindSubmatch(line)[1])
+		nested := value
+		if !filepath.IsAbs(nested) {
+			nested = filepath.Join(filepath.Dir(path), nested)
+		}
+		nested = filepath.Clean(nested)
+		if slices.Contains(r.chain, nested) {
+			r.warn("include-cycle", path, value, "#+SETUPFILE: cycle through %s", r.diagnostics.relative(nested))
+			return nil
+		}
+		inlined, err := r.readSetupFile(nested)
+		if err != nil {
+			r.warn("include-refused", path, value, "refusing #+SETUPFILE: %v", err)
+			return nil
+		}
+		return inlined
+	}), nil
+}
+
+// read returns the contents of path if it lies inside the source root and
+// records it as a dependency of the document.
+func (r *includeResolver) read(path string) ([]byte, error) {
+	relPath, err := filepath.Rel(r.root, path)
+	if err != nil || !filepath.IsLocal(relPath) {
+		return nil, fmt.Errorf("%s is outside the source root", path)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		if realRel, err := filepath.Rel(r.realRoot, resolved); err != nil || !filepath.IsLocal(realRel) {
+			return nil, fmt.Errorf("%s links outside the source root", path)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r.deps[relPath] = true
+	return data, nil
+}
+
+// expandIncludes resolves every #+INCLUDE: in nodes in place, so the included
+// files are read (and recorded as dependencies) during phase 1 rather than
+// lazily while writing HTML.
+func (r *includeResolver) expandIncludes(conf *org.Configuration, docPath string, nodes []org.Node) {
+	for i, node := range nodes {
+		switch n := node.(type) {
+		case org.Include:
+			resolved := r.resolveInclude(conf, docPath, n.Keyword)
+			nodes[i] = org.Include{Keyword: n.Keyword, Resolve: func() org.Node { return resolved }}
+		case org.Headline:
+			r.expandIncludes(conf, docPath, n.Children)
+		case org.Block:
+			r.expandIncludes(conf, docPath, n.Children)
+		case org.Drawer:
+			r.expandIncludes(conf, docPath, n.Children)
+		case org.List:
+			r.expandIncludes(conf, docPath, n.Items)
+		case org.ListItem:
+			r.expandIncludes(conf, docPath, n.Children)
+		case org.DescriptiveListItem:
+			r.expandIncludes(conf, docPath, n.Details)
+		case org.FootnoteDefinition:
+			r.expandIncludes(conf, docPath, n.Children)
+		}
+	}
+}
+
+// resolveInclude reads the file named by an #+INCLUDE: keyword. Source,
+// example and export includes become the matching block; includes without a
+// kind are parsed as org and spliced in. Refused includes resolve to the
+// keyword itself, which the HTML writer drops.
+func (r *includeResolver) resolveInclude(conf *org.Configuration, docPath string, k org.Keyword) org.Node {
+	m := reIncludeKeyword.FindStringSubmatch(k.Value)
+	if m == nil {
+		r.warn("include-malformed", docPath, k.Value, "malformed #+INCLUDE: %s", k.Value)
+		return k
+	}
+	path, kind, lang := m[1], strings.ToUpper(m[2]), m[3]
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(docPath), path)
+	}
+	path = filepath.Clean(path)
+
+	if slices.Contains(r.chain, path) {
+		r.warn("include-cycle", docPath, k.Value, "#+INCLUDE: cycle through %s", r.diagnostics.relative(path))
+		return k
+	}
+
+	data, err := r.read(path)
+	if err != nil {
+		r.warn("include-refused", docPath, k.Value, "refusing #+INCLUDE: %v", err)
+		return k
+	}
+
+	switch kind {
+	case "SRC", "EXAMPLE", "EXPORT":
+		var params []string
+		if lang != "" {
+			params = []string{lang}
+		}
+		return org.Block{
+			Name:       kind,
+			Parameters: params,
+			Children:   []org.Node{org.Text{Content: string(data), IsRaw: true}},
+		}
+	case "", "ORG":
+		r.chain = append(r.chain, path)
+		defer func() { r.chain = r.chain[:len(r.chain)-1] }()
+
+		doc := conf.Parse(bytes.NewReader(data), path)
+		if doc.Error != nil {
+			r.warn("include-parse", docPath, k.Value, "failed to parse included file %s: %v", r.diagnostics.relative(path), doc.Error)
+			return k
+		}
+		r.expandIncludes(conf, path, doc.Nodes)
+		return org.Drawer{Name: "INCLUDE", Children: doc.Nodes}
+	default:
+		r.warn("include-kind", docPath, k.Value, "unsupported #+INCLUDE: kind %s", m[2])
+		return k
+	}
+}
+
+// warn reports a problem with the #+INCLUDE: or #+SETUPFILE: keyword whose
+// value is value in docPath.
+func (r *includeResolver) warn(code, docPath, value, format string, args ...any) {
+	file := r.diagnostics.relative(docPath)
+	r.diagnostics.Warn(code, file, r.diagnostics.Line(file, value), format, args...)
+}
+
+// dependencies returns the root-relative paths of every file read on behalf of
+// the document, sorted.
+func (r *includeResolver) dependencies() []string {
+	if len(r.deps) == 0 {
+		return nil
+	}
+	deps := make([]string, 0, len(r.deps))
+	for dep := range r.deps {
+		deps = append(deps, dep)
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// dependenciesModifiedSince reports whether any file included or embedded by
+// fi has changed (or disappeared) since t.
+func dependenciesModifiedSince(fi FileInfo, root string, t time.Time) bool {
+	for _, dep := range slices.Concat(fi.Includes, fi.Images, fi.Bibliographies) {
+		info, err := os.Stat(filepath.Join(root, dep))
+		if err != nil || info.ModTime().After(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package generator
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+func TestProcessFile_Includes(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-include-")
+	defer CleanupTempDir(tmpDir)
+
+	os.MkdirAll(filepath.Join(tmpDir, "snippets"), 0755)
+	CreateTestOrgFile(tmpDir, "snippets/shared.org", `Shared paragraph from an include.
+`)
+	CreateTestOrgFile(tmpDir, "snippets/hello.go", `package main
+`)
+	CreateTestOrgFile(tmpDir, "main.org", `#+title: Main
+* Main
+#+INCLUDE: "snippets/shared.org"
+#+INCLUDE: "snippets/hello.go" src go
+`)
+
+	fi, err := processFile("main.org", BuildContext{Root: tmpDir})
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+
+	expected := []string{"snippets/hello.go", "snippets/shared.org"}
+	if !reflect.DeepEqual(fi.Includes, expected) {
+		t.Errorf("Includes = %v, want %v", fi.Includes, expected)
+	}
+
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, *fi, BuildContext{Root: tmpDir}, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	if !strings.Contains(html, "Shared paragraph from an include.") {
+		t.Error("org include was not rendered")
+	}
+	if !strings.Contains(html, `src-go`) || !strings.Contains(html, `<span class="hl-kw">package</span> main`) {
+		t.Error("src include was not rendered as a source block")
+	}
+}
+
+func TestProcessFile_IncludeSandbox(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-include-")
+	defer CleanupTempDir(tmpDir)
+
+	root := filepath.Join(tmpDir, "site")
+	os.MkdirAll(root, 0755)
+	CreateTestOrgFile(tmpDir, "secret.org", "Top secret text\n")
+	CreateTestOrgFile(root, "leak.org", `* Leak
+#+INCLUDE: "../secret.org"
+#+SETUPFILE: ../secret.org
+`)
+
+	fi, err := processFile("leak.org", BuildContext{Root: root})
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	if len(fi.Includes) != 0 {
+		t.Errorf("Includes = %v, want none", fi.Includes)
+	}
+
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, *fi, BuildContext{Root: root}, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	if strings.Contains(html, "Top secret") {
+		t.Error("include outside the source root was rendered")
+	}
+}
+
+func TestProcessFile_IncludeCycles(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-include-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", `* A
+Text from A.
+#+INCLUDE: "b.org"
+`)
+	CreateTestOrgFile(tmpDir, "b.org", `Text from B.
+#+INCLUDE: "a.org"
+`)
+	CreateTestOrgFile(tmpDir, "setup-a.org", `#+SETUPFILE: setup-b.org
+#+TODO: WAIT | DONE
+`)
+	CreateTestOrgFile(tmpDir, "setup-b.org", `#+SETUPFILE: setup-a.org
+`)
+	CreateTestOrgFile(tmpDir, "c.org", `#+SETUPFILE: setup-a.org
+* WAIT Something
+`)
+
+	fi, err := processFile("a.org", BuildContext{Root: tmpDir})
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, *fi, BuildContext{Root: tmpDir}, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	if strings.Count(html, "Text from A.") != 1 || strings.Count(html, "Text from B.") != 1 {
+		t.Errorf("include cycle not broken after one level: %s", html)
+	}
+
+	fi, err = processFile("c.org", BuildContext{Root: tmpDir})
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	if fi.ParsedOrg.Get("TODO") != "WAIT | DONE" {
+		t.Errorf("TODO setting = %q, want setup file value", fi.ParsedOrg.Get("TODO"))
+	}
+	expected := []string{"setup-a.org", "setup-b.org"}
+	if !reflect.DeepEqual(fi.Includes, expected) {
+		t.Errorf("Includes = %v, want %v", fi.Includes, expected)
+	}
+}
+
+func TestIncludeResolver_SetupFileDiamond(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-include-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestDirStructure(tmpDir, []string{"setup"})
+	CreateTestOrgFile(tmpDir, "setup/common.org", "#+TODO: WAIT | DONE\n")
+	CreateTestOrgFile(tmpDir, "setup/a.org", "#+SETUPFILE: common.org\n#+AUTHOR: Ada\n")
+	CreateTestOrgFile(tmpDir, "setup/b.org", "#+SETUPFILE: common.org\n#+LANGUAGE: en\n")
+
+	// go-org logs the setup files ReadFile refuses.
+	var logged bytes.Buffer
+	conf := org.New()
+	conf.Log = log.New(&logged, "", 0)
+	docPath := filepath.Join(tmpDir, "page.org")
+	resolver := newIncludeResolver(tmpDir, docPath)
+	conf.ReadFile = resolver.ReadFile
+	doc := conf.Parse(strings.NewReader("#+SETUPFILE: setup/a.org\n#+SETUPFILE: setup/b.org\n* WAIT Something\n"), docPath)
+
+	if logged.Len() != 0 {
+		t.Errorf("go-org logged %q, want a setup file reached twice loaded once without complaint", logged.String())
+	}
+	for key, want := range map[string]string{"TODO": "WAIT | DONE", "AUTHOR": "Ada", "LANGUAGE": "en"} {
+		if got := doc.Get(key); got != want {
+			t.Errorf("%s setting = %q, want %q from the setup files", key, got, want)
+		}
+	}
+	expected := []string{filepath.Join("setup", "a.org"), filepath.Join("setup", "b.org"), filepath.Join("setup", "common.org")}
+	if deps := resolver.dependencies(); !reflect.DeepEqual(deps, expected) {
+		t.Errorf("dependencies() = %v, want %v", deps, expected)
+	}
+}
+
+func TestGenerateHtmlPages_RebuildsIncluders(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-include-")
+	defer CleanupTempDir(tmpDir)
+
+	destDir := filepath.Join(tmpDir, "public")
+	past := time.Now().Add(-time.Hour)
+	CreateTestFileWithModTime(tmpDir, "shared.txt", []byte("old text"), past)
+	CreateTestFileWithModTime(tmpDir, "page.org", []byte("* Page\n#+INCLUDE: \"shared.txt\" example\n"), past)
+
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	ctx := CreateTestBuildContext(tmpDir, destDir, "Test Site", true)
+	procFiles, _ := FindAndProcessOrgFiles(nil, *ctx)
+	GenerateHtmlPages(procFiles, *ctx, tmpls.Page)
+
+	htmlPath := filepath.Join(destDir, "page.html")
+	os.Chtimes(htmlPath, past.Add(time.Minute), past.Add(time.Minute))
+	CreateTestOrgFile(tmpDir, "shared.txt", "new text")
+	ctx.ForceRebuild = false
+	procFiles, _ = FindAndProcessOrgFiles(nil, *ctx)
+	GenerateHtmlPages(procFiles, *ctx, tmpls.Page)
+
+	data, err := os.ReadFile(htmlPath)
+	if err != nil {
+		t.Fatalf("Failed to read page.html: %v", err)
+	}
+	if !strings.Contains(string(data), "new text") {
+		t.Error("page.html was not rebuilt after its include changed")
+	}
+}
@@ -0,0 +1,366 @@
+package generator
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// maxMacroDepth bounds the expansion of macros that expand to other macros.
+const maxMacroDepth = 16
+
+var (
+	// reMacroCall matches a macro call in text. go-org only parses calls with
+	// arguments, {{{name(args)}}}, and greedily, so {{{title}}} and several
+	// calls on one line reach the writer as text.
+	reMacroCall = regexp.MustCompile(`\{\{\{([A-Za-z][\w-]*)(?:\((.*?)\))?\}\}\}`)
+	reMacroName = regexp.MustCompile(`^[A-Za-z][\w-]*$`)
+	// reOrgDate matches the date, and optional time, of an org timestamp or a
+	// plain date.
+	reOrgDate = regexp.MustCompile(`^[<\[]?(\d{4}-\d{2}-\d{2})(?: [A-Za-z]+)?(?: (\d{1,2}:\d{2}))?`)
+)
+
+// macroExpander expands org macros for one page: the document's #+MACRO:
+// definitions, then the site-wide macros from the config, then org's
+// built-in macros.
+type macroExpander struct {
+	doc        *org.Document
+	fi         FileInfo
+	ctx        BuildContext
+	uuidToPath map[UUID]HeaderLocation
+	procFiles  *ProcessedFiles
+	counters   map[string]int
+	headlines  []org.Headline
+	depth      int
+	position   *sourcePosition
+}
+
+func newMacroExpander(doc *org.Document, fi FileInfo, ctx BuildContext, uuidToPath map[UUID]HeaderLocation, procFiles *ProcessedFiles) *macroExpander {
+	return &macroExpander{doc: doc, fi: fi, ctx: ctx, uuidToPath: uuidToPath, procFiles: procFiles, counters: map[string]int{}}
+}
+
+// splitMacroArgs splits a macro's argument string on commas. A comma escaped
+// with a backslash is kept in its argument.
+func splitMacroArgs(s string) []string {
+	var args []string
+	var current strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == ',':
+			current.WriteByte(',')
+			i++
+		case s[i] == ',':
+			args = append(args, strings.TrimSpace(current.String()))
+			current.Reset()
+		default:
+			current.WriteByte(s[i])
+		}
+	}
+	return append(args, strings.TrimSpace(current.String()))
+}
+
+// expand returns the org markup a macro call expands to, and whether the
+// macro is defined.
+func (e *macroExpander) expand(name string, args []string) (string, bool) {
+	body, ok := e.doc.Macros[name]
+	if !ok {
+		body, ok = e.ctx.Macros[name]
+	}
+	if ok {
+		for i := len(args); i > 0; i-- {
+			body = strings.ReplaceAll(body, fmt.Sprintf("$%d", i), args[i-1])
+		}
+		return body, true
+	}
+
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	switch strings.ToLower(name) {
+	case "title":
+		return e.fi.Title, true
+	case "author":
+		if author := e.doc.Get("AUTHOR"); author != "" {
+			return author, true
+		}
+		return e.ctx.Author, true
+	case "date":
+		date := e.doc.Get("DATE")
+		if format := arg(0); format != "" {
+			if t, ok := parseOrgDate(date); ok {
+				return formatTimeString(t, format), true
+			}
+		}
+		return date, true
+	case "modification-time":
+		format := arg(0)
+		if format == "" {
+			format = "%Y-%m-%d"
+		}
+		// As in org, this is the file's time, not the page's #+DATE:.
+		return formatTimeString(sourceModTime(e.ctx, e.fi.fileModTime), format), true
+	case "input-file":
+		return filepath.Base(e.fi.Path), true
+	case "keyword":
+		return e.doc.Get(strings.ToUpper(arg(0))), true
+	case "n":
+		return e.counter(arg(0), arg(1)), true
+	case "property":
+		return e.property(arg(0), arg(1)), true
+	}
+	return "", false
+}
+
+// counter implements {{{n(NAME,ACTION)}}}: increment the counter NAME and
+// return it, or with ACTION "-" return it unchanged, or with a number set it.
+func (e *macroExpander) counter(name, action string) string {
+	switch {
+	case action == "-":
+	case action != "":
+		if n, err := strconv.Atoi(action); err == nil {
+			e.counters[name] = n
+			break
+		}
+		e.counters[name]++
+	default:
+		e.counters[name]++
+	}
+	return strconv.Itoa(e.counters[name])
+}
+
+// property implements {{{property(NAME,SEARCH)}}}: the property NAME of the
+// headline being written, or of the headline SEARCH finds: #custom-id,
+// id:UUID or *Heading.
+func (e *macroExpander) property(name, search string) string {
+	var h *org.Headline
+	if search == "" {
+		if len(e.headlines) > 0 {
+			h = &e.headlines[len(e.headlines)-1]
+		}
+	} else {
+		h = e.findHeadline(search)
+	}
+	if h == nil {
+		return ""
+	}
+
+	switch strings.ToUpper(name) {
+	case "ITEM":
+		return strings.TrimSpace(org.String(h.Title...))
+	case "TODO":
+		return h.Status
+	case "PRIORITY":
+		return h.Priority
+	case "TAGS":
+		if len(h.Tags) == 0 {
+			return ""
+		}
+		return ":" + strings.Join(h.Tags, ":") + ":"
+	}
+	if props := headlineProperties(*h); props != nil {
+		value, _ := props.Get(strings.ToUpper(name))
+		return value
+	}
+	return ""
+}
+
+// findHeadline resolves a property search: #custom-id and *Heading look in
+// this document, id:UUID anywhere on the site.
+func (e *macroExpander) findHeadline(search string) *org.Headline {
+	doc := e.doc
+	var match func(org.Headline) bool
+	switch {
+	case strings.HasPrefix(search, "#"):
+		match = func(h org.Headline) bool {
+			id, _ := headlinePropertyValue(h, "CUSTOM_ID")
+			return id == search[1:]
+		}
+	case strings.HasPrefix(search, "*"):
+		title := strings.TrimSpace(search[1:])
+		match = func(h org.Headline) bool {
+			return strings.TrimSpace(org.String(h.Title...)) == title
+		}
+	case strings.HasPrefix(search, "id:"):
+		id := UUID(strings.TrimPrefix(search, "id:"))
+		loc, ok := e.uuidToPath[id]
+		if !ok {
+			return nil
+		}
+		if loc.FilePath != e.fi.Path {
+			doc = nil
+			if e.procFiles != nil {
+				for _, fi := range e.procFiles.Files {
+					if fi.Path == loc.FilePath {
+						doc = fi.ParsedOrg
+						break
+					}
+				}
+			}
+			if doc == nil {
+				return nil
+			}
+		}
+		match = func(h org.Headline) bool {
+			value, _ := headlinePropertyValue(h, "ID")
+			return UUID(value) == id
+		}
+	default:
+		return nil
+	}
+
+	var found *org.Headline
+	walkOrgNodes(doc.Nodes, func(node org.Node) bool {
+		if h, ok := node.(org.Headline); ok && found == nil && match(h) {
+			found = &h
+		}
+		return found == nil
+	})
+	return found
+}
+
+func headlinePropertyValue(h org.Headline, name string) (string, bool) {
+	if props := headlineProperties(h); props != nil {
+		return props.Get(name)
+	}
+	return "", false
+}
+
+// parseOrgDate parses the date of an org timestamp, [2024-01-02 Tue 10:00],
+// or a plain date.
+func parseOrgDate(s string) (time.Time, bool) {
+	m := reOrgDate.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return time.Time{}, false
+	}
+	if m[2] != "" {
+		t, err := time.Parse("2006-01-02 15:04", m[1]+" "+m[2])
+		return t, err == nil
+	}
+	t, err := time.Parse("2006-01-02", m[1])
+	return t, err == nil
+}
+
+// strftimeLayouts maps the format-time-string directives org users write to
+// Go layouts.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'e': "_2",
+	'H': "15", 'I': "03", 'M': "04", 'S': "05", 'p': "PM",
+	'b': "Jan", 'h': "Jan", 'B': "January", 'a': "Mon", 'A': "Monday",
+	'F': "2006-01-02", 'T': "15:04:05", 'R': "15:04", 'D': "01/02/06",
+	'Z': "MST", 'z': "-0700",
+}
+
+// formatTimeString formats t with an Emacs format-time-string format, such
+// as "%Y-%m-%d %H:%M". Unknown directives are kept as they are.
+func formatTimeString(t time.Time, format string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch c := format[i]; c {
+		case '%':
+			b.WriteByte('%')
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		default:
+			if layout, ok := strftimeLayouts[c]; ok {
+				b.WriteString(t.Format(layout))
+			} else {
+				b.WriteByte('%')
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// WriteMacro expands a {{{name(args)}}} macro call. A name that isn't a
+// valid macro name means go-org's greedy match spanned several calls on one
+// line; that source is split into its calls again, non-greedily.
+func (w *uuidReplacingWriter) WriteMacro(m org.Macro) {
+	source := "{{{" + m.Name + "(" + strings.Join(m.Parameters, ",") + ")}}}"
+	if !reMacroName.MatchString(m.Name) {
+		if w.macros.depth >= maxMacroDepth {
+			w.HTMLWriter.WriteText(org.Text{Content: source})
+			return
+		}
+		w.macros.depth++
+		w.writeMacroText(source, w.writeOrgInline)
+		w.macros.depth--
+		return
+	}
+	w.writeMacro(m.Name, strings.Join(m.Parameters, ","), source)
+}
+
+// writeMacro writes the expansion of macro name called with the argument
+// string args. Undefined macros are dropped with a warning.
+func (w *uuidReplacingWriter) writeMacro(name, args, source string) {
+	e := w.macros
+	if e.depth >= maxMacroDepth {
+		e.ctx.Diagnostics.Warn("macro-depth", e.fi.Path, e.ctx.Diagnostics.Line(e.fi.Path, source), "macro expansion too deep: %s", source)
+		return
+	}
+	var parsed []string
+	if args != "" {
+		parsed = splitMacroArgs(args)
+	}
+	expansion, ok := e.expand(name, parsed)
+	if !ok {
+		e.ctx.Diagnostics.Warn("macro-undefined", e.fi.Path, e.position.line(source), "undefined macro %s", source)
+		return
+	}
+	e.depth++
+	w.writeOrgInline(expansion)
+	e.depth--
+}
+
+// writeOrgInline writes s as inline org markup, without the paragraph
+// go-org would wrap it in. Surrounding whitespace, which parsing drops, is
+// kept.
+func (w *uuidReplacingWriter) writeOrgInline(s string) {
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		w.HTMLWriter.WriteText(org.Text{Content: s})
+		return
+	}
+	start := strings.Index(s, trimmed)
+	w.HTMLWriter.WriteText(org.Text{Content: s[:start]})
+	defer w.HTMLWriter.WriteText(org.Text{Content: s[start+len(trimmed):]})
+
+	doc := w.macros.doc.Parse(strings.NewReader(trimmed), w.macros.doc.Path)
+	doc.Macros = w.macros.doc.Macros
+	for _, node := range doc.Nodes {
+		if p, ok := node.(org.Paragraph); ok && len(doc.Nodes) == 1 {
+			org.WriteNodes(w, p.Children...)
+			continue
+		}
+		org.WriteNodes(w, node)
+	}
+}
+
+// writeMacroText writes text, expanding the macro calls in it; the text in
+// between goes to write.
+func (w *uuidReplacingWriter) writeMacroText(s string, write func(string)) {
+	last := 0
+	for _, m := range reMacroCall.FindAllStringSubmatchIndex(s, -1) {
+		write(s[last:m[0]])
+		args := ""
+		if m[4] >= 0 {
+			args = s[m[4]:m[5]]
+		}
+		w.writeMacro(s[m[2]:m[3]], args, s[m[0]:m[1]])
+		last = m[1]
+	}
+	write(s[last:])
+}
@@ -0,0 +1,80 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMacros(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-macros-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "page.org", `#+title: Macro Page
+#+author: Ada
+#+date: <2024-03-05 Tue>
+#+subtitle: A subtitle
+#+MACRO: greet Hello, *$1*
+
+Title {{{title}}} by {{{author}}} on {{{date}}} ({{{date(%d %B %Y)}}}).
+Changed {{{modification-time(%Y)}}} in {{{input-file}}}; subtitle {{{keyword(subtitle)}}}.
+{{{greet(world)}}} and {{{site}}} and {{{sig(Ada\, Countess)}}}.
+Figure {{{n}}}, figure {{{n}}}, still {{{n(,-)}}}; table {{{n(tab,5)}}}.
+Missing: [{{{nope}}}]
+
+* Task
+:PROPERTIES:
+:CUSTOM_ID: task
+:OWNER: Grace
+:END:
+Owned by {{{property(OWNER)}}}, item {{{property(ITEM)}}}.
+* Other
+From elsewhere: {{{property(OWNER,#task)}}}.
+`)
+	modTime := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(tmpDir, "page.org"), modTime, modTime)
+
+	ctx := BuildContext{Root: tmpDir, Macros: map[string]string{
+		"site":  "/the site/",
+		"sig":   "-- $1",
+		"greet": "overridden by the document",
+	}}
+	fi, err := processFile("page.org", ctx)
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, *fi, ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+
+	for _, want := range []string{
+		"Title Macro Page by Ada on <time class=\"timestamp\" datetime=\"2024-03-05\">&lt;2024-03-05 Tue&gt;</time> (05 March 2024).",
+		"Changed 2023 in page.org; subtitle A subtitle.",
+		"Hello, <strong>world</strong> and <em>the site</em> and – Ada, Countess.",
+		"Figure 1, figure 2, still 2; table 5.",
+		"Missing: []",
+		"Owned by Grace, item Task.",
+		"From elsewhere: Grace.",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML missing %q:\n%s", want, html)
+		}
+	}
+}
+
+func TestFormatTimeString(t *testing.T) {
+	ts := time.Date(2024, 3, 5, 14, 7, 9, 0, time.UTC)
+	for format, want := range map[string]string{
+		"%Y-%m-%d %H:%M:%S": "2024-03-05 14:07:09",
+		"%F %R":             "2024-03-05 14:07",
+		"%a %e %b, %j":      "Tue  5 Mar, 065",
+		"100%% %q":          "100% %q",
+	} {
+		if got := formatTimeString(ts, format); got != want {
+			t.Errorf("formatTimeString(%q) = %q, want %q", format, got, want)
+		}
+	}
+}
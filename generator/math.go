@@ -0,0 +1,884 @@
+package generator
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// This file converts the subset of TeX math found in notes into MathML, so
+// pages render equations without client-side MathJax. Anything outside the
+// subset is reported as an error and the caller falls back to the raw TeX.
+
+const (
+	texEOF = iota
+	texCommand
+	texNumber
+	texLetter
+	texOther
+	texOpen
+	texClose
+	texSup
+	texSub
+	texAlign
+)
+
+type texToken struct {
+	kind int
+	text string
+}
+
+// texRow is one row of an environment, or the whole of a fragment that is not
+// an environment, along with the numbering commands found in it.
+type texRow struct {
+	cells    []string
+	label    string
+	tag      string
+	noNumber bool
+}
+
+type texParser struct {
+	src     string
+	pos     int
+	err     error
+	display bool
+	variant string // math alphabet set by \mathbf and friends
+	bracket int    // depth of optional [...] arguments being parsed
+	row     *texRow
+}
+
+var greekLetters = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε",
+	"zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ",
+	"lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ", "omicron": "ο", "pi": "π", "varpi": "ϖ",
+	"rho": "ρ", "varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ", "upsilon": "υ",
+	"phi": "ϕ", "varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+}
+
+var upperGreekLetters = map[string]string{
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+}
+
+// texOperators are written as <mo>.
+var texOperators = map[string]string{
+	"times": "×", "cdot": "⋅", "pm": "±", "mp": "∓", "div": "÷", "ast": "∗", "star": "⋆",
+	"circ": "∘", "bullet": "∙", "oplus": "⊕", "ominus": "⊖", "otimes": "⊗", "odot": "⊙",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "ll": "≪", "gg": "≫",
+	"approx": "≈", "equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅", "propto": "∝",
+	"in": "∈", "notin": "∉", "ni": "∋", "subset": "⊂", "subseteq": "⊆", "supset": "⊃",
+	"supseteq": "⊇", "cup": "∪", "cap": "∩", "setminus": "∖", "wedge": "∧", "land": "∧",
+	"vee": "∨", "lor": "∨", "neg": "¬", "lnot": "¬", "forall": "∀", "exists": "∃", "nexists": "∄",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←", "leftrightarrow": "↔",
+	"Rightarrow": "⇒", "Leftarrow": "⇐", "Leftrightarrow": "⇔", "implies": "⟹", "impliedby": "⟸",
+	"iff": "⟺", "mapsto": "↦", "longrightarrow": "⟶", "longmapsto": "⟼", "uparrow": "↑",
+	"downarrow": "↓", "mid": "∣", "parallel": "∥", "perp": "⊥", "vdash": "⊢", "models": "⊨",
+	"ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮", "ddots": "⋱",
+	"langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉",
+	"lvert": "|", "rvert": "|", "vert": "|", "lVert": "‖", "rVert": "‖", "Vert": "‖",
+	"prime": "′", "colon": ":", "angle": "∠", "triangle": "△",
+	"{": "{", "}": "}", "|": "‖", "%": "%", "#": "#", "&": "&", "$": "$",
+}
+
+// texIdentifiers are written as <mi>.
+var texIdentifiers = map[string]string{
+	"infty": "∞", "partial": "∂", "nabla": "∇", "emptyset": "∅", "varnothing": "∅", "ell": "ℓ",
+	"hbar": "ℏ", "aleph": "ℵ", "Re": "ℜ", "Im": "ℑ", "wp": "℘", "top": "⊤", "bot": "⊥", "_": "_",
+}
+
+// texLargeOperators maps big operators to their symbol and whether their
+// limits go above and below in display style.
+var texLargeOperators = map[string]struct {
+	symbol string
+	limits bool
+}{
+	"sum": {"∑", true}, "prod": {"∏", true}, "coprod": {"∐", true}, "bigcup": {"⋃", true},
+	"bigcap": {"⋂", true}, "bigoplus": {"⨁", true}, "bigotimes": {"⨂", true}, "bigvee": {"⋁", true},
+	"bigwedge": {"⋀", true}, "int": {"∫", false}, "iint": {"∬", false}, "iiint": {"∭", false},
+	"oint": {"∮", false},
+}
+
+// texFunctions are upright operator names; those marked true take limits.
+var texFunctions = map[string]bool{
+	"sin": false, "cos": false, "tan": false, "cot": false, "sec": false, "csc": false,
+	"arcsin": false, "arccos": false, "arctan": false, "sinh": false, "cosh": false, "tanh": false,
+	"log": false, "ln": false, "lg": false, "exp": false, "deg": false, "dim": false, "ker": false,
+	"hom": false, "arg": false, "lim": true, "liminf": true, "limsup": true, "max": true,
+	"min": true, "sup": true, "inf": true, "det": true, "gcd": true, "Pr": true,
+}
+
+var texSpaces = map[string]string{
+	",": "0.1667em", "thinspace": "0.1667em", ":": "0.2222em", ">": "0.2222em", "medspace": "0.2222em",
+	";": "0.2778em", "thickspace": "0.2778em", "!": "-0.1667em", " ": "0.3333em", "enspace": "0.5em",
+	"quad": "1em", "qquad": "2em",
+}
+
+// texAccents maps accent commands to the mark placed over (or under) their
+// argument and whether the mark stretches.
+var texAccents = map[string]struct {
+	mark    string
+	stretch bool
+	under   bool
+}{
+	"hat": {"^", false, false}, "widehat": {"^", true, false}, "check": {"ˇ", false, false},
+	"tilde": {"~", false, false}, "widetilde": {"~", true, false}, "bar": {"¯", false, false},
+	"overline": {"‾", true, false}, "underline": {"_", true, true}, "vec": {"→", false, false},
+	"overrightarrow": {"→", true, false}, "overleftarrow": {"←", true, false},
+	"dot": {"˙", false, false}, "ddot": {"¨", false, false}, "breve": {"˘", false, false},
+	"acute": {"´", false, false}, "grave": {"`", false, false},
+}
+
+var texAlphabetCommands = map[string]string{
+	"mathbf": "bold", "mathbb": "double-struck", "mathcal": "script", "mathscr": "script",
+	"mathfrak": "fraktur", "mathsf": "sans-serif", "mathtt": "monospace", "mathrm": "normal",
+	"mathit": "italic", "boldsymbol": "bold-italic", "bm": "bold-italic",
+}
+
+// mathAlphabets locate each alphabet in Unicode's Mathematical Alphanumeric
+// Symbols block. Letters that were encoded earlier, in Letterlike Symbols,
+// are listed as exceptions.
+var mathAlphabets = map[string]struct {
+	capital, small rune
+	exceptions     map[rune]rune
+}{
+	"bold":          {0x1D400, 0x1D41A, nil},
+	"bold-italic":   {0x1D468, 0x1D482, nil},
+	"double-struck": {0x1D538, 0x1D552, map[rune]rune{'C': 'ℂ', 'H': 'ℍ', 'N': 'ℕ', 'P': 'ℙ', 'Q': 'ℚ', 'R': 'ℝ', 'Z': 'ℤ'}},
+	"script":        {0x1D49C, 0x1D4B6, map[rune]rune{'B': 'ℬ', 'E': 'ℰ', 'F': 'ℱ', 'H': 'ℋ', 'I': 'ℐ', 'L': 'ℒ', 'M': 'ℳ', 'R': 'ℛ', 'e': 'ℯ', 'g': 'ℊ', 'o': 'ℴ'}},
+	"fraktur":       {0x1D504, 0x1D51E, map[rune]rune{'C': 'ℭ', 'H': 'ℌ', 'I': 'ℑ', 'R': 'ℜ', 'Z': 'ℨ'}},
+	"sans-serif":    {0x1D5A0, 0x1D5BA, nil},
+	"monospace":     {0x1D670, 0x1D68A, nil},
+}
+
+var texBigSizes = map[string]string{
+	"big": "1.2em", "bigl": "1.2em", "bigr": "1.2em", "bigm": "1.2em",
+	"Big": "1.623em", "Bigl": "1.623em", "Bigr": "1.623em", "Bigm": "1.623em",
+	"bigg": "2.047em", "biggl": "2.047em", "biggr": "2.047em", "biggm": "2.047em",
+	"Bigg": "2.470em", "Biggl": "2.470em", "Biggr": "2.470em", "Biggm": "2.470em",
+}
+
+// texMatrixFences maps matrix environments to their delimiters.
+var texMatrixFences = map[string][2]string{
+	"matrix": {"", ""}, "smallmatrix": {"", ""}, "pmatrix": {"(", ")"}, "bmatrix": {"[", "]"},
+	"Bmatrix": {"{", "}"}, "vmatrix": {"|", "|"}, "Vmatrix": {"‖", "‖"},
+}
+
+// texDisplayEnvironments may only appear at the top of a display fragment.
+// Their rows are numbered unless starred.
+var texDisplayEnvironments = map[string]bool{
+	"equation": true, "displaymath": true, "align": true, "eqnarray": true, "gather": true, "multline": true,
+}
+
+// renderMath converts a TeX fragment to a MathML <math> element. Display
+// fragments are laid out as blocks; their numbered equations take their
+// numbers from eqno, which counts the equations on the page so far.
+func renderMath(tex string, display bool, eqno *int) (string, error) {
+	tex = strings.TrimSpace(tex)
+	p := &texParser{src: tex, display: display, row: &texRow{}}
+
+	if display {
+		if name, ok := p.displayEnvironment(); ok {
+			return p.renderDisplayEnvironment(tex, name, eqno)
+		}
+	}
+
+	items := p.parseList()
+	if t := p.peek(); p.err == nil && t.kind != texEOF {
+		p.fail("unexpected %s", t.text)
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+
+	math := mathElement(strings.Join(items, ""), tex, display)
+	if !display || (p.row.tag == "" && p.row.label == "") {
+		return math, nil
+	}
+	return numberedMath(math, p.row.label, p.row.tag), nil
+}
+
+// displayEnvironment consumes a leading \begin{name} if name is a display
+// environment.
+func (p *texParser) displayEnvironment() (string, bool) {
+	start := p.pos
+	if t := p.next(); t.kind == texCommand && t.text == "begin" {
+		name := p.readBraced()
+		if texDisplayEnvironments[strings.TrimSuffix(name, "*")] && p.err == nil {
+			return name, true
+		}
+	}
+	p.pos, p.err = start, nil
+	return "", false
+}
+
+func (p *texParser) renderDisplayEnvironment(tex, name string, eqno *int) (string, error) {
+	base, starred := strings.CutSuffix(name, "*")
+	rows := p.parseRows(name)
+	if t := p.peek(); p.err == nil && t.kind != texEOF {
+		p.fail("unexpected %s after \\end{%s}", t.text, name)
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+	numbered := !starred && base != "displaymath"
+
+	if base == "equation" || base == "displaymath" {
+		if len(rows) != 1 || len(rows[0].cells) != 1 {
+			return "", fmt.Errorf("line breaks and alignment are not allowed in %s", name)
+		}
+		row := rows[0]
+		math := mathElement(row.cells[0], tex, true)
+		number := equationNumber(row, numbered, eqno)
+		if number == "" && row.label == "" {
+			return math, nil
+		}
+		return numberedMath(math, row.label, number), nil
+	}
+
+	numbers := make([]string, len(rows))
+	for i, row := range rows {
+		numbers[i] = equationNumber(row, numbered, eqno)
+	}
+	align := alignedColumn
+	if base == "gather" || base == "multline" {
+		align = nil
+	}
+	return mathElement(texTable(rows, align, numbers), tex, true), nil
+}
+
+// equationNumber returns the number shown beside row: its \tag, or the next
+// number on the page if it is numbered.
+func equationNumber(row texRow, numbered bool, eqno *int) string {
+	if row.tag != "" {
+		return row.tag
+	}
+	if !numbered || row.noNumber {
+		return ""
+	}
+	*eqno++
+	return strconv.Itoa(*eqno)
+}
+
+func mathElement(content, tex string, display bool) string {
+	attrs := ""
+	if display {
+		attrs = ` display="block"`
+	}
+	return fmt.Sprintf(`<math xmlns="http://www.w3.org/1998/Math/MathML"%s><semantics><mrow>%s</mrow><annotation encoding="application/x-tex">%s</annotation></semantics></math>`,
+		attrs, content, html.EscapeString(tex))
+}
+
+func numberedMath(math, label, number string) string {
+	eqno := ""
+	if number != "" {
+		eqno = fmt.Sprintf(`<span class="eqno">(%s)</span>`, html.EscapeString(number))
+	}
+	return fmt.Sprintf(`<span class="equation"%s>%s%s</span>`, idAttr(label), math, eqno)
+}
+
+func idAttr(label string) string {
+	if label == "" {
+		return ""
+	}
+	return fmt.Sprintf(` id="%s"`, html.EscapeString(label))
+}
+
+// emptyMrow is the MathML for an empty group, such as {} or an empty cell.
+const emptyMrow = "<mrow></mrow>"
+
+// mrow joins items, wrapping them in an <mrow> unless there is exactly one.
+func mrow(items []string) string {
+	nonEmpty := items[:0:0]
+	for _, item := range items {
+		if item != "" {
+			nonEmpty = append(nonEmpty, item)
+		}
+	}
+	if len(nonEmpty) == 1 {
+		return nonEmpty[0]
+	}
+	return "<mrow>" + strings.Join(nonEmpty, "") + "</mrow>"
+}
+
+// alignedColumn lays out align-style columns as right/left pairs that meet
+// without a gap, as amsmath does.
+func alignedColumn(col int) string {
+	if col%2 == 0 {
+		return "text-align: right; padding-right: 0"
+	}
+	return "text-align: left; padding-left: 0"
+}
+
+// texTable renders rows as an <mtable>. align gives the style of each column,
+// and numbers, if non-nil, adds a column of equation numbers.
+func texTable(rows []texRow, align func(col int) string, numbers []string) string {
+	var b strings.Builder
+	b.WriteString("<mtable>")
+	for i, row := range rows {
+		fmt.Fprintf(&b, "<mtr%s>", idAttr(row.label))
+		for j, cell := range row.cells {
+			if align != nil {
+				fmt.Fprintf(&b, `<mtd style="%s">%s</mtd>`, align(j), cell)
+			} else {
+				fmt.Fprintf(&b, "<mtd>%s</mtd>", cell)
+			}
+		}
+		if numbers != nil {
+			if numbers[i] != "" {
+				fmt.Fprintf(&b, `<mtd class="eqno"><mtext>(%s)</mtext></mtd>`, html.EscapeString(numbers[i]))
+			} else {
+				b.WriteString("<mtd></mtd>")
+			}
+		}
+		b.WriteString("</mtr>")
+	}
+	b.WriteString("</mtable>")
+	return b.String()
+}
+
+func (p *texParser) fail(format string, args ...any) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, args...)
+	}
+}
+
+// scan returns the token at p.pos and the position just past it, skipping
+// whitespace and % comments.
+func (p *texParser) scan() (texToken, int) {
+	i := p.pos
+	for i < len(p.src) {
+		if p.src[i] == '%' {
+			for i < len(p.src) && p.src[i] != '\n' {
+				i++
+			}
+		} else if unicode.IsSpace(rune(p.src[i])) {
+			i++
+		} else {
+			break
+		}
+	}
+	if i >= len(p.src) {
+		return texToken{kind: texEOF, text: "end of input"}, i
+	}
+
+	switch c := p.src[i]; {
+	case c == '\\':
+		j := i + 1
+		for j < len(p.src) && isASCIILetter(p.src[j]) {
+			j++
+		}
+		if j == i+1 && j < len(p.src) {
+			_, size := utf8.DecodeRuneInString(p.src[j:])
+			j += size
+		}
+		return texToken{kind: texCommand, text: p.src[i+1 : j]}, j
+	case c >= '0' && c <= '9':
+		j := i + 1
+		for j < len(p.src) && (p.src[j] >= '0' && p.src[j] <= '9' || p.src[j] == '.' && j+1 < len(p.src) && p.src[j+1] >= '0' && p.src[j+1] <= '9') {
+			j++
+		}
+		return texToken{kind: texNumber, text: p.src[i:j]}, j
+	case c == '{':
+		return texToken{kind: texOpen, text: "{"}, i + 1
+	case c == '}':
+		return texToken{kind: texClose, text: "}"}, i + 1
+	case c == '^':
+		return texToken{kind: texSup, text: "^"}, i + 1
+	case c == '_':
+		return texToken{kind: texSub, text: "_"}, i + 1
+	case c == '&':
+		return texToken{kind: texAlign, text: "&"}, i + 1
+	}
+
+	r, size := utf8.DecodeRuneInString(p.src[i:])
+	if unicode.IsLetter(r) {
+		return texToken{kind: texLetter, text: string(r)}, i + size
+	}
+	return texToken{kind: texOther, text: string(r)}, i + size
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func (p *texParser) peek() texToken {
+	t, _ := p.scan()
+	return t
+}
+
+func (p *texParser) next() texToken {
+	t, end := p.scan()
+	p.pos = end
+	return t
+}
+
+// readBraced returns the raw text of a {...} argument, which may nest braces.
+func (p *texParser) readBraced() string {
+	if t := p.peek(); t.kind != texOpen {
+		p.fail("expected { but found %s", t.text)
+		return ""
+	}
+	_, start := p.scan()
+	depth := 1
+	for i := start; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				p.pos = i + 1
+				return p.src[start:i]
+			}
+		}
+	}
+	p.fail("unbalanced braces")
+	p.pos = len(p.src)
+	return ""
+}
+
+// skipOptional skips an optional [...] argument such as the spacing after \\.
+func (p *texParser) skipOptional() {
+	if t, start := p.scan(); t.kind == texOther && t.text == "[" {
+		if end := strings.IndexByte(p.src[start:], ']'); end >= 0 {
+			p.pos = start + end + 1
+		}
+	}
+}
+
+// parseList parses atoms up to the end of the current group, cell or row.
+func (p *texParser) parseList() []string {
+	var items []string
+	for p.err == nil {
+		t := p.peek()
+		switch {
+		case t.kind == texEOF, t.kind == texClose, t.kind == texAlign:
+			return items
+		case t.kind == texOther && t.text == "]" && p.bracket > 0:
+			return items
+		case t.kind == texCommand && (t.text == `\` || t.text == "cr" || t.text == "end" || t.text == "right" || t.text == "middle"):
+			if t.text != "middle" {
+				return items
+			}
+			p.next()
+			items = append(items, p.parseDelimiter(`stretchy="true"`))
+			continue
+		}
+		if item := p.parseAtom(); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseAtom parses a base and any sub- and superscripts attached to it.
+func (p *texParser) parseAtom() string {
+	base, limits, function := p.parseBase()
+	var sub, sup []string
+	for p.err == nil {
+		switch t := p.peek(); {
+		case t.kind == texSup:
+			p.next()
+			if sup != nil && !strings.HasSuffix(sup[len(sup)-1], "′</mo>") {
+				p.fail("double superscript")
+			}
+			sup = append(sup, p.parseArg())
+			continue
+		case t.kind == texSub:
+			p.next()
+			if sub != nil {
+				p.fail("double subscript")
+			}
+			sub = append(sub, p.parseArg())
+			continue
+		case t.kind == texOther && t.text == "'":
+			p.next()
+			sup = append(sup, "<mo>′</mo>")
+			continue
+		}
+		break
+	}
+	if sub == nil && sup == nil {
+		if function {
+			return base + `<mspace width="0.1667em"/>`
+		}
+		return base
+	}
+
+	if base == "" {
+		base = emptyMrow
+	}
+	under, over := "msub", "msup"
+	both := "msubsup"
+	if limits && p.display {
+		under, over, both = "munder", "mover", "munderover"
+	}
+	var out string
+	switch {
+	case sub != nil && sup != nil:
+		out = fmt.Sprintf("<%s>%s%s%s</%s>", both, base, mrow(sub), mrow(sup), both)
+	case sub != nil:
+		out = fmt.Sprintf("<%s>%s%s</%s>", under, base, mrow(sub), under)
+	default:
+		out = fmt.Sprintf("<%s>%s%s</%s>", over, base, mrow(sup), over)
+	}
+	if function {
+		out += `<mspace width="0.1667em"/>`
+	}
+	return out
+}
+
+// parseArg parses a command argument or script: a group, or a single token.
+// As in TeX, only the first digit of a number is taken, so x^12 is x¹2.
+func (p *texParser) parseArg() string {
+	t, end := p.scan()
+	switch t.kind {
+	case texOpen:
+		p.pos = end
+		items := p.parseList()
+		p.expectClose()
+		return mrow(items)
+	case texNumber:
+		p.pos = end - len(t.text) + 1
+		return "<mn>" + t.text[:1] + "</mn>"
+	case texEOF, texClose, texAlign, texSup, texSub:
+		p.fail("missing argument before %s", t.text)
+		return ""
+	}
+	base, _, _ := p.parseBase()
+	return base
+}
+
+func (p *texParser) expectClose() {
+	if t := p.next(); t.kind != texClose && p.err == nil {
+		p.fail("expected } but found %s", t.text)
+	}
+}
+
+// parseBase parses one nucleus: a group, symbol or command. It reports
+// whether scripts on it are limits and whether it names a function.
+func (p *texParser) parseBase() (ml string, limits, function bool) {
+	t := p.peek()
+	switch t.kind {
+	case texSup, texSub:
+		return "", false, false
+	case texOpen:
+		p.next()
+		items := p.parseList()
+		p.expectClose()
+		return "<mrow>" + strings.Join(items, "") + "</mrow>", false, false
+	case texNumber:
+		p.next()
+		return "<mn>" + t.text + "</mn>", false, false
+	case texLetter:
+		p.next()
+		return p.identifier(t.text), false, false
+	case texOther:
+		p.next()
+		switch t.text {
+		case "-":
+			return "<mo>−</mo>", false, false
+		case "*":
+			return "<mo>∗</mo>", false, false
+		case "'":
+			return "<mo>′</mo>", false, false
+		case "~":
+			return `<mspace width="0.3333em"/>`, false, false
+		}
+		return "<mo>" + html.EscapeString(t.text) + "</mo>", false, false
+	case texCommand:
+		p.next()
+		return p.parseCommand(t.text)
+	}
+	p.next()
+	p.fail("unexpected %s", t.text)
+	return "", false, false
+}
+
+// identifier renders a letter in the current math alphabet.
+func (p *texParser) identifier(letter string) string {
+	switch p.variant {
+	case "", "italic":
+		return "<mi>" + html.EscapeString(letter) + "</mi>"
+	case "normal":
+		return `<mi mathvariant="normal">` + html.EscapeString(letter) + "</mi>"
+	}
+	r, _ := utf8.DecodeRuneInString(letter)
+	alphabet := mathAlphabets[p.variant]
+	if mapped, ok := alphabet.exceptions[r]; ok {
+		r = mapped
+	} else if r >= 'A' && r <= 'Z' {
+		r = alphabet.capital + r - 'A'
+	} else if r >= 'a' && r <= 'z' {
+		r = alphabet.small + r - 'a'
+	}
+	return "<mi>" + string(r) + "</mi>"
+}
+
+func (p *texParser) parseCommand(name string) (ml string, limits, function bool) {
+	if s, ok := greekLetters[name]; ok {
+		return "<mi>" + s + "</mi>", false, false
+	}
+	if s, ok := upperGreekLetters[name]; ok {
+		return `<mi mathvariant="normal">` + s + "</mi>", false, false
+	}
+	if s, ok := texOperators[name]; ok {
+		return "<mo>" + html.EscapeString(s) + "</mo>", false, false
+	}
+	if s, ok := texIdentifiers[name]; ok {
+		return "<mi>" + s + "</mi>", false, false
+	}
+	if op, ok := texLargeOperators[name]; ok {
+		return "<mo>" + op.symbol + "</mo>", op.limits, false
+	}
+	if takesLimits, ok := texFunctions[name]; ok {
+		return "<mi>" + name + "</mi>", takesLimits, true
+	}
+	if width, ok := texSpaces[name]; ok {
+		return fmt.Sprintf(`<mspace width="%s"/>`, width), false, false
+	}
+	if accent, ok := texAccents[name]; ok {
+		arg := p.parseArg()
+		stretchy := "false"
+		if accent.stretch {
+			stretchy = "true"
+		}
+		if accent.under {
+			return fmt.Sprintf(`<munder accentunder="true">%s<mo stretchy="%s">%s</mo></munder>`, arg, stretchy, accent.mark), false, false
+		}
+		return fmt.Sprintf(`<mover accent="true">%s<mo stretchy="%s">%s</mo></mover>`, arg, stretchy, accent.mark), false, false
+	}
+	if variant, ok := texAlphabetCommands[name]; ok {
+		saved := p.variant
+		p.variant = variant
+		arg := p.parseArg()
+		p.variant = saved
+		return arg, false, false
+	}
+	if size, ok := texBigSizes[name]; ok {
+		return p.parseDelimiter(fmt.Sprintf(`stretchy="true" symmetric="true" minsize="%s" maxsize="%s"`, size, size)), false, false
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num := p.parseArg()
+		den := p.parseArg()
+		frac := fmt.Sprintf("<mfrac>%s%s</mfrac>", num, den)
+		switch name {
+		case "dfrac", "cfrac":
+			frac = `<mstyle displaystyle="true">` + frac + "</mstyle>"
+		case "tfrac":
+			frac = `<mstyle displaystyle="false">` + frac + "</mstyle>"
+		}
+		return frac, false, false
+	case "binom":
+		top := p.parseArg()
+		bottom := p.parseArg()
+		return fmt.Sprintf(`<mrow><mo>(</mo><mfrac linethickness="0">%s%s</mfrac><mo>)</mo></mrow>`, top, bottom), false, false
+	case "sqrt":
+		var index string
+		if t, end := p.scan(); t.kind == texOther && t.text == "[" {
+			p.pos = end
+			p.bracket++
+			index = mrow(p.parseList())
+			p.bracket--
+			if t := p.next(); t.text != "]" {
+				p.fail("expected ] but found %s", t.text)
+			}
+		}
+		arg := p.parseArg()
+		if index != "" {
+			return fmt.Sprintf("<mroot>%s%s</mroot>", arg, index), false, false
+		}
+		return "<msqrt>" + arg + "</msqrt>", false, false
+	case "overset", "stackrel", "underset":
+		script := p.parseArg()
+		base := p.parseArg()
+		if name == "underset" {
+			return fmt.Sprintf("<munder>%s%s</munder>", base, script), false, false
+		}
+		return fmt.Sprintf("<mover>%s%s</mover>", base, script), false, false
+	case "overbrace":
+		return fmt.Sprintf(`<mover>%s<mo stretchy="true">⏞</mo></mover>`, p.parseArg()), true, false
+	case "underbrace":
+		return fmt.Sprintf(`<munder>%s<mo stretchy="true">⏟</mo></munder>`, p.parseArg()), true, false
+	case "text", "textrm", "textit", "textbf", "mbox", "hbox":
+		text := p.readBraced()
+		return "<mtext>" + html.EscapeString(text) + "</mtext>", false, false
+	case "operatorname":
+		starred := p.pos < len(p.src) && p.src[p.pos] == '*'
+		if starred {
+			p.pos++
+		}
+		return "<mi>" + html.EscapeString(p.readBraced()) + "</mi>", starred, true
+	case "bmod":
+		return "<mo>mod</mo>", false, false
+	case "pmod":
+		return fmt.Sprintf(`<mspace width="1em"/><mo>(</mo><mi>mod</mi><mspace width="0.3333em"/>%s<mo>)</mo>`, p.parseArg()), false, false
+	case "not":
+		rel, _, _ := p.parseBase()
+		if !strings.HasPrefix(rel, "<mo>") {
+			p.fail("\\not must precede a relation")
+			return "", false, false
+		}
+		return strings.TrimSuffix(rel, "</mo>") + "̸</mo>", false, false
+	case "left":
+		open := p.parseDelimiter(`fence="true" stretchy="true"`)
+		items := p.parseList()
+		if t := p.next(); t.kind != texCommand || t.text != "right" {
+			p.fail("\\left without matching \\right")
+			return "", false, false
+		}
+		close := p.parseDelimiter(`fence="true" stretchy="true"`)
+		return "<mrow>" + open + strings.Join(items, "") + close + "</mrow>", false, false
+	case "begin":
+		return p.parseEnvironment(p.readBraced()), false, false
+	case "label":
+		p.row.label = p.readBraced()
+		return "", false, false
+	case "tag":
+		p.row.tag = p.readBraced()
+		return "", false, false
+	case "nonumber", "notag":
+		p.row.noNumber = true
+		return "", false, false
+	case "displaystyle", "textstyle", "limits", "nolimits":
+		return "", false, false
+	}
+
+	p.fail("unsupported command \\%s", name)
+	return "", false, false
+}
+
+// parseDelimiter parses the delimiter after \left, \right, \middle or \big,
+// returning it as an <mo> with attrs. A "." delimiter is invisible.
+func (p *texParser) parseDelimiter(attrs string) string {
+	t := p.next()
+	var symbol string
+	switch t.kind {
+	case texOther:
+		symbol = t.text
+	case texCommand:
+		switch t.text {
+		case "{", "lbrace":
+			symbol = "{"
+		case "}", "rbrace":
+			symbol = "}"
+		default:
+			symbol = texOperators[t.text]
+		}
+	}
+	if symbol == "." {
+		return ""
+	}
+	if symbol == "" {
+		p.fail("invalid delimiter %s", t.text)
+		return ""
+	}
+	return fmt.Sprintf("<mo %s>%s</mo>", attrs, html.EscapeString(symbol))
+}
+
+// parseEnvironment parses the body of an environment nested inside a
+// formula, after its \begin{name}.
+func (p *texParser) parseEnvironment(name string) string {
+	if texDisplayEnvironments[strings.TrimSuffix(name, "*")] {
+		p.fail("\\begin{%s} must enclose the whole display", name)
+		return ""
+	}
+
+	if fences, ok := texMatrixFences[name]; ok {
+		return fenced(fences[0], texTable(p.parseRows(name), nil, nil), fences[1])
+	}
+
+	switch name {
+	case "cases", "dcases":
+		left := func(int) string { return "text-align: left" }
+		return fenced("{", texTable(p.parseRows(name), left, nil), "")
+	case "array":
+		spec := strings.Map(func(r rune) rune {
+			if r == 'l' || r == 'c' || r == 'r' {
+				return r
+			}
+			return -1
+		}, p.readBraced())
+		align := func(col int) string {
+			if col < len(spec) {
+				switch spec[col] {
+				case 'l':
+					return "text-align: left"
+				case 'r':
+					return "text-align: right"
+				}
+			}
+			return "text-align: center"
+		}
+		return texTable(p.parseRows(name), align, nil)
+	case "aligned", "split", "alignedat":
+		if name == "alignedat" {
+			p.readBraced()
+		}
+		return texTable(p.parseRows(name), alignedColumn, nil)
+	case "gathered":
+		return texTable(p.parseRows(name), nil, nil)
+	}
+
+	p.fail("unsupported environment %s", name)
+	return ""
+}
+
+func fenced(open, body, close string) string {
+	if open == "" && close == "" {
+		return body
+	}
+	var b strings.Builder
+	b.WriteString("<mrow>")
+	if open != "" {
+		fmt.Fprintf(&b, "<mo>%s</mo>", html.EscapeString(open))
+	}
+	b.WriteString(body)
+	if close != "" {
+		fmt.Fprintf(&b, "<mo>%s</mo>", html.EscapeString(close))
+	}
+	b.WriteString("</mrow>")
+	return b.String()
+}
+
+// parseRows parses the cells of an environment up to its \end{name}. The
+// \label, \tag and \nonumber commands in each row are recorded on that row.
+func (p *texParser) parseRows(name string) []texRow {
+	saved := p.row
+	defer func() { p.row = saved }()
+
+	var rows []texRow
+	row := &texRow{}
+	p.row = row
+	for p.err == nil {
+		row.cells = append(row.cells, mrow(p.parseList()))
+		switch t := p.next(); {
+		case t.kind == texAlign:
+		case t.kind == texCommand && (t.text == `\` || t.text == "cr"):
+			p.skipOptional()
+			rows = append(rows, *row)
+			row = &texRow{}
+			p.row = row
+		case t.kind == texCommand && t.text == "end":
+			if end := p.readBraced(); end != name {
+				p.fail("\\begin{%s} ended by \\end{%s}", name, end)
+			}
+			// A trailing \\ leaves an empty row behind.
+			if len(row.cells) > 1 || row.cells[0] != emptyMrow || row.label != "" || row.tag != "" {
+				rows = append(rows, *row)
+			}
+			return rows
+		case t.kind == texEOF:
+			p.fail("missing \\end{%s}", name)
+		default:
+			p.fail("unexpected %s in %s", t.text, name)
+		}
+	}
+	return rows
+}
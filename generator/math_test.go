@@ -0,0 +1,150 @@
+package generator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMath(t *testing.T) {
+	tests := []struct {
+		name     string
+		tex      string
+		display  bool
+		expected []string
+	}{
+		{
+			name:     "fraction",
+			tex:      `\frac{a+1}{b}`,
+			expected: []string{`<mfrac><mrow><mi>a</mi><mo>+</mo><mn>1</mn></mrow><mi>b</mi></mfrac>`},
+		},
+		{
+			name:     "scripts",
+			tex:      `x_i^2 + y^12`,
+			expected: []string{`<msubsup><mi>x</mi><mi>i</mi><mn>2</mn></msubsup>`, `<msup><mi>y</mi><mn>1</mn></msup><mn>2</mn>`},
+		},
+		{
+			name:     "greek and operators",
+			tex:      `\alpha \leq \Omega \cdot 2`,
+			expected: []string{`<mi>α</mi><mo>≤</mo><mi mathvariant="normal">Ω</mi><mo>⋅</mo><mn>2</mn>`},
+		},
+		{
+			name:     "inline limits",
+			tex:      `\sum_{i=1}^n i`,
+			expected: []string{`<msubsup><mo>∑</mo>`},
+		},
+		{
+			name:     "display limits",
+			tex:      `\sum_{i=1}^n i`,
+			display:  true,
+			expected: []string{`<math xmlns="http://www.w3.org/1998/Math/MathML" display="block">`, `<munderover><mo>∑</mo>`},
+		},
+		{
+			name:     "functions, fences and alphabets",
+			tex:      `\sin\left(x \in \mathbb{R}\right)`,
+			expected: []string{`<mi>sin</mi><mspace width="0.1667em"/>`, `<mo fence="true" stretchy="true">(</mo>`, `<mi>ℝ</mi>`},
+		},
+		{
+			name:     "matrix",
+			tex:      `\begin{pmatrix} a & b \\ c & d \end{pmatrix}`,
+			expected: []string{`<mrow><mo>(</mo><mtable><mtr><mtd><mi>a</mi></mtd><mtd><mi>b</mi></mtd></mtr><mtr><mtd><mi>c</mi></mtd><mtd><mi>d</mi></mtd></mtr></mtable><mo>)</mo></mrow>`},
+		},
+		{
+			name:     "annotation keeps the source",
+			tex:      `a<b`,
+			expected: []string{`<annotation encoding="application/x-tex">a&lt;b</annotation>`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var eqno int
+			got, err := renderMath(tt.tex, tt.display, &eqno)
+			if err != nil {
+				t.Fatalf("renderMath() error = %v", err)
+			}
+			for _, want := range tt.expected {
+				if !strings.Contains(got, want) {
+					t.Errorf("renderMath() = %s\nwant it to contain %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderMath_Numbering(t *testing.T) {
+	var eqno int
+
+	got, err := renderMath(`\begin{equation}\label{eq:euler} e^{i\pi} = -1 \end{equation}`, true, &eqno)
+	if err != nil {
+		t.Fatalf("renderMath() error = %v", err)
+	}
+	if !strings.Contains(got, `<span class="equation" id="eq:euler">`) || !strings.Contains(got, `<span class="eqno">(1)</span>`) {
+		t.Errorf("equation not numbered: %s", got)
+	}
+
+	got, err = renderMath(`\begin{align}
+a &= b \\
+  &= c \nonumber \\
+  &= d \tag{*}
+\end{align}`, true, &eqno)
+	if err != nil {
+		t.Fatalf("renderMath() error = %v", err)
+	}
+	if n := strings.Count(got, "<mtr>"); n != 3 {
+		t.Errorf("align has %d rows, want 3: %s", n, got)
+	}
+	for _, want := range []string{`<mtext>(2)</mtext>`, `<mtd></mtd></mtr>`, `<mtext>(*)</mtext>`, `<mtd style="text-align: left; padding-left: 0"><mrow><mo>=</mo><mi>b</mi></mrow></mtd>`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("align output missing %s: %s", want, got)
+		}
+	}
+	if eqno != 2 {
+		t.Errorf("eqno = %d, want 2", eqno)
+	}
+
+	if _, err := renderMath(`\begin{equation*} x \end{equation*}`, true, &eqno); err != nil || eqno != 2 {
+		t.Errorf("starred environment was numbered (eqno = %d, err = %v)", eqno, err)
+	}
+}
+
+func TestRenderMath_Unsupported(t *testing.T) {
+	tests := []string{`\unknowncommand{x}`, `x^a^b`, `\frac{a}`, `\left( x`, `\begin{pmatrix} a \end{bmatrix}`, `\begin{tikzcd} a \end{tikzcd}`}
+	for _, tex := range tests {
+		var eqno int
+		if got, err := renderMath(tex, true, &eqno); err == nil {
+			t.Errorf("renderMath(%q) = %s, want an error", tex, got)
+		}
+	}
+}
+
+func TestLatexToMathML(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-math-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "math.org", `* Math
+Inline $x^2$ and \(y\) and $\weird$.
+
+\begin{equation}
+a = b
+\end{equation}
+`)
+	ctx := BuildContext{Root: tmpDir}
+	fi, err := processFile("math.org", ctx)
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, *fi, ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	for _, want := range []string{
+		`<msup><mi>x</mi><mn>2</mn></msup>`,
+		`<mrow><mi>y</mi></mrow>`,
+		`<span class="math-fallback">$\weird$</span>`,
+		`<span class="eqno">(1)</span>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML missing %s:\n%s", want, html)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package generator
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// extractDescriptionFromAST returns the #+DESCRIPTION: of doc. Several
+// description lines are joined into one.
+func extractDescriptionFromAST(doc *org.Document) string {
+	return strings.Join(strings.Fields(doc.Get("DESCRIPTION")), " ")
+}
+
+// extractKeywordsFromAST returns the comma-separated #+KEYWORDS: of doc. A
+// line without commas is one keyword per word.
+func extractKeywordsFromAST(doc *org.Document) []string {
+	raw := strings.ReplaceAll(doc.Get("KEYWORDS"), "\n", ",")
+	sep := func(r rune) bool { return r == ',' }
+	if !strings.Contains(raw, ",") {
+		sep = func(r rune) bool { return r == ' ' || r == '\t' }
+	}
+	var keywords []string
+	for _, keyword := range strings.FieldsFunc(raw, sep) {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	return keywords
+}
+
+// extractImageFromAST returns the page's image: #+IMAGE:, or else the first
+// image linked in the document. Local images are returned root-relative,
+// remote ones as URLs.
+func extractImageFromAST(doc *org.Document, filePath string) string {
+	if image := strings.TrimSpace(doc.Get("IMAGE")); image != "" {
+		image = strings.TrimSuffix(strings.TrimPrefix(image, "[["), "]]")
+		if strings.Contains(image, "://") {
+			return image
+		}
+		image = strings.TrimPrefix(image, "file:")
+		if strings.HasPrefix(image, "/") {
+			return strings.TrimPrefix(image, "/")
+		}
+		return filepath.ToSlash(filepath.Join(filepath.Dir(filePath), image))
+	}
+
+	var image string
+	walkOrgNodes(doc.Nodes, func(node org.Node) bool {
+		link, ok := node.(org.RegularLink)
+		if !ok || image != "" {
+			return image == ""
+		}
+		if relPath, ok := localLinkTarget(link, filePath); ok && isProcessableImage(relPath) {
+			image = filepath.ToSlash(relPath)
+		} else if (link.Protocol == "http" || link.Protocol == "https") && isProcessableImage(link.URL) {
+			image = link.URL
+		}
+		return image == ""
+	})
+	return image
+}
+
+// pageImageURL returns the absolute URL of fi's image, pointing local images
+// at their full-size variant when one was generated, or of its social card,
+// or of the site's default image.
+func pageImageURL(fi FileInfo, ctx BuildContext, procFiles *ProcessedFiles) string {
+	var images map[string]ImageInfo
+	var card string
+	if procFiles != nil {
+		images, card = procFiles.Images, procFiles.SocialCards[fi.Path]
+	}
+	switch {
+	case strings.Contains(fi.Image, "://"):
+		return fi.Image
+	case fi.Image != "":
+		if info, ok := images[filepath.FromSlash(fi.Image)]; ok && len(info.Variants) > 0 {
+			return ctx.BaseURL + "/" + filepath.ToSlash(info.Variants[len(info.Variants)-1].Path)
+		}
+		return ctx.BaseURL + "/" + fi.Image
+	case card != "":
+		return ctx.BaseURL + "/" + filepath.ToSlash(card)
+	case ctx.DefaultImage != "":
+		return ctx.BaseURL + ctx.DefaultImage
+	}
+	return ""
+}
+
+// pageBreadcrumbs returns the trail from the sitemap to fi: the sitemap, then
+// the index.org of each enclosing directory that has one, then fi itself.
+func pageBreadcrumbs(fi FileInfo, ctx BuildContext, procFiles *ProcessedFiles) []Breadcrumb {
+	crumbs := []Breadcrumb{{Name: ctx.SiteName, Path: "index.html"}}
+	titles := map[string]string{}
+	if procFiles != nil {
+		for _, other := range procFiles.Files {
+			titles[filepath.ToSlash(other.Path)] = other.Title
+		}
+	}
+	dirs := strings.Split(path.Dir(filepath.ToSlash(fi.Path)), "/")
+	for i := range dirs {
+		if dirs[0] == "." {
+			break
+		}
+		index := strings.Join(dirs[:i+1], "/") + "/index.org"
+		if title, ok := titles[index]; ok && index != filepath.ToSlash(fi.Path) {
+			crumbs = append(crumbs, Breadcrumb{Name: title, Path: strings.TrimSuffix(index, ".org") + ".html"})
+		}
+	}
+	return append(crumbs, Breadcrumb{Name: fi.Title, Path: strings.TrimSuffix(filepath.ToSlash(fi.Path), ".org") + ".html"})
+}
+
+// pageImage is the pageImage template function: the og:image of a page, or
+// the default image on other pages.
+func pageImage(data any) string {
+	switch d := data.(type) {
+	case PageData:
+		return d.ImageURL
+	case IndexPageData:
+		return siteImage(d.BaseURL, d.DefaultImage)
+	case TagPageData:
+		return siteImage(d.BaseURL, d.DefaultImage)
+	case IndexTermData:
+		return siteImage(d.BaseURL, d.DefaultImage)
+	case EventsPageData:
+		return siteImage(d.BaseURL, d.DefaultImage)
+	}
+	return ""
+}
+
+func siteImage(baseURL, defaultImage string) string {
+	if defaultImage == "" {
+		return ""
+	}
+	return baseURL + defaultImage
+}
+
+// jsonLD is the jsonLD template function. It renders schema.org metadata as
+// a JSON-LD script: an Article and its BreadcrumbList on pages, and the
+// WebSite everywhere.
+func jsonLD(data any) (template.HTML, error) {
+	var siteName, baseURL, author string
+	switch d := data.(type) {
+	case PageData:
+		siteName, baseURL, author = d.SiteName, d.BaseURL, d.Author
+	case IndexPageData:
+		siteName, baseURL, author = d.SiteName, d.BaseURL, d.Author
+	case TagPageData:
+		siteName, baseURL, author = d.SiteName, d.BaseURL, d.Author
+	case IndexTermData:
+		siteName, baseURL, author = d.SiteName, d.BaseURL, d.Author
+	case EventsPageData:
+		siteName, baseURL, author = d.SiteName, d.BaseURL, d.Author
+	default:
+		return "", nil
+	}
+
+	website := map[string]any{"@type": "WebSite", "name": siteName, "url": baseURL + "/"}
+	graph := []any{website}
+	if page, ok := data.(PageData); ok {
+		url := baseURL + "/" + strings.TrimSuffix(filepath.ToSlash(page.Path), ".org") + ".html"
+		article := map[string]any{
+			"@type":            "Article",
+			"headline":         page.Title,
+			"url":              url,
+			"mainEntityOfPage": url,
+			"dateModified":     page.ModTime.Format(time.RFC3339),
+			"datePublished":    page.ModTime.Format(time.RFC3339),
+			"isPartOf":         map[string]any{"@type": "WebSite", "name": siteName, "url": baseURL + "/"},
+		}
+		if page.ParsedOrg != nil {
+			if published, ok := parseOrgDate(page.ParsedOrg.Get("DATE")); ok {
+				article["datePublished"] = published.Format(time.RFC3339)
+			}
+		}
+		if description := page.Description; description != "" {
+			article["description"] = description
+		} else if page.Preview != "" {
+			article["description"] = page.Preview
+		}
+		if page.ImageURL != "" {
+			article["image"] = page.ImageURL
+		}
+		if len(page.Keywords) > 0 {
+			article["keywords"] = strings.Join(page.Keywords, ", ")
+		}
+		if author != "" {
+			article["author"] = map[string]any{"@type": "Person", "name": author}
+		}
+
+		items := make([]any, len(page.Breadcrumbs))
+		for i, crumb := range page.Breadcrumbs {
+			items[i] = map[string]any{
+				"@type":    "ListItem",
+				"position": i + 1,
+				"name":     crumb.Name,
+				"item":     baseURL + "/" + crumb.Path,
+			}
+		}
+		graph = []any{article, map[string]any{"@type": "BreadcrumbList", "itemListElement": items}, website}
+	}
+
+	// json.Encoder escapes <, > and &, so the script can't be closed early.
+	var buf bytes.Buffer
+	buf.WriteString(`<script type="application/ld+json">`)
+	if err := json.NewEncoder(&buf).Encode(map[string]any{"@context": "https://schema.org", "@graph": graph}); err != nil {
+		return "", err
+	}
+	buf.WriteString(`</script>`)
+	return template.HTML(buf.String()), nil
+}
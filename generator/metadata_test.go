@@ -0,0 +1,192 @@
+package generator
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractPageMetadata(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-metadata-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestDirStructure(tmpDir, []string{"notes"})
+	CreateTestOrgFile(tmpDir, "notes/explicit.org", `#+title: Explicit
+#+description: A page about
+#+description: several things.
+#+keywords: org mode, static sites,go
+#+image: ../img/cover.png
+
+[[file:inline.png]]
+`)
+	CreateTestOrgFile(tmpDir, "notes/inline.org", "#+title: Inline\n#+keywords: org go\n\nSee [[https://example.com][a site]] and [[file:diagram.jpg]], then [[file:later.png]].\n")
+	CreateTestOrgFile(tmpDir, "notes/remote.org", "#+title: Remote\n#+image: https://cdn.example.com/card.png\n")
+	CreateTestOrgFile(tmpDir, "notes/none.org", "#+title: None\n\nNo metadata.\n")
+
+	for _, tc := range []struct {
+		path, description, image string
+		keywords                 []string
+	}{
+		{"notes/explicit.org", "A page about several things.", "img/cover.png", []string{"org mode", "static sites", "go"}},
+		{"notes/inline.org", "", "notes/diagram.jpg", []string{"org", "go"}},
+		{"notes/remote.org", "", "https://cdn.example.com/card.png", nil},
+		{"notes/none.org", "", "", nil},
+	} {
+		fi, err := processFile(tc.path, BuildContext{Root: tmpDir})
+		if err != nil {
+			t.Fatalf("processFile(%s) error = %v", tc.path, err)
+		}
+		if fi.Description != tc.description || fi.Image != tc.image || strings.Join(fi.Keywords, "|") != strings.Join(tc.keywords, "|") {
+			t.Errorf("%s: description %q, image %q, keywords %q; want %q, %q, %q",
+				tc.path, fi.Description, fi.Image, fi.Keywords, tc.description, tc.image, tc.keywords)
+		}
+	}
+}
+
+func TestPageImageURL(t *testing.T) {
+	ctx := BuildContext{BaseURL: "https://example.com", DefaultImage: "/default.png"}
+	images := map[string]ImageInfo{
+		filepath.FromSlash("img/cover.png"): {Variants: []ImageVariant{{Width: 480, Path: "_img/abc-480.png"}, {Width: 1200, Path: "_img/abc-1200.png"}}},
+	}
+	for image, want := range map[string]string{
+		"img/cover.png":                    "https://example.com/_img/abc-1200.png",
+		"img/other.png":                    "https://example.com/img/other.png",
+		"https://cdn.example.com/card.png": "https://cdn.example.com/card.png",
+		"":                                 "https://example.com/default.png",
+	} {
+		if got := pageImageURL(FileInfo{Image: image}, ctx, &ProcessedFiles{Images: images}); got != want {
+			t.Errorf("pageImageURL(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestCoverImageProcessed(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-cover-")
+	defer CleanupTempDir(tmpDir)
+	destDir := filepath.Join(tmpDir, "public")
+
+	CreateTestDirStructure(tmpDir, []string{"notes", "img"})
+	createTestPNG(t, filepath.Join(tmpDir, "img/cover.png"), 600, 300)
+	CreateTestOrgFile(tmpDir, "notes/cover.org", "#+title: Cover\n#+image: ../img/cover.png\n\nThe body doesn't link the cover.\n")
+
+	ctx := BuildContext{Root: tmpDir, DestDir: destDir, BaseURL: "https://example.com", ForceRebuild: true}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	procFiles, result := ProcessImages(procFiles, ctx)
+	if result.Errors != 0 {
+		t.Fatalf("ProcessImages() errors = %d", result.Errors)
+	}
+	if _, ok := procFiles.Images[filepath.FromSlash("img/cover.png")]; !ok {
+		t.Fatalf("img/cover.png missing from procFiles.Images: %v", procFiles.Images)
+	}
+
+	url := pageImageURL(procFiles.Files[0], ctx, procFiles)
+	relPath, ok := strings.CutPrefix(url, "https://example.com/")
+	if !ok {
+		t.Fatalf("pageImageURL() = %q, want a URL under the base URL", url)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, filepath.FromSlash(relPath))); err != nil {
+		t.Errorf("pageImageURL() = %q points at a missing file: %v", url, err)
+	}
+}
+
+func TestPageBreadcrumbs(t *testing.T) {
+	procFiles := &ProcessedFiles{Files: []FileInfo{
+		{Path: "notes/index.org", Title: "Notes"},
+		{Path: "notes/go/page.org", Title: "Page"},
+	}}
+	var got []string
+	for _, crumb := range pageBreadcrumbs(procFiles.Files[1], BuildContext{SiteName: "Site"}, procFiles) {
+		got = append(got, crumb.Name+"="+crumb.Path)
+	}
+	want := "Site=index.html Notes=notes/index.html Page=notes/go/page.html"
+	if strings.Join(got, " ") != want {
+		t.Errorf("pageBreadcrumbs() = %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestJSONLD(t *testing.T) {
+	page := PageData{
+		FileInfo: FileInfo{
+			Path:     "notes/page.org",
+			Title:    "A </script> page",
+			Preview:  "Preview text",
+			Keywords: []string{"org", "go"},
+			ModTime:  time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC),
+		},
+		SiteName:    "Site",
+		BaseURL:     "https://example.com",
+		Author:      "Ada",
+		ImageURL:    "https://example.com/cover.png",
+		Breadcrumbs: []Breadcrumb{{Name: "Site", Path: "index.html"}, {Name: "A </script> page", Path: "notes/page.html"}},
+	}
+	out, err := jsonLD(page)
+	if err != nil {
+		t.Fatalf("jsonLD() error = %v", err)
+	}
+	script := string(out)
+	if strings.Count(script, "</script>") != 1 {
+		t.Fatalf("jsonLD() did not escape the title: %s", script)
+	}
+	var doc struct {
+		Context string           `json:"@context"`
+		Graph   []map[string]any `json:"@graph"`
+	}
+	body := strings.TrimSuffix(strings.TrimPrefix(script, `<script type="application/ld+json">`), `</script>`)
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatalf("jsonLD() is not JSON: %v\n%s", err, script)
+	}
+	if doc.Context != "https://schema.org" || len(doc.Graph) != 3 {
+		t.Fatalf("jsonLD() = %s", script)
+	}
+	article, breadcrumbs, website := doc.Graph[0], doc.Graph[1], doc.Graph[2]
+	if article["@type"] != "Article" || article["headline"] != "A </script> page" || article["description"] != "Preview text" ||
+		article["image"] != "https://example.com/cover.png" || article["keywords"] != "org, go" ||
+		article["url"] != "https://example.com/notes/page.html" || article["dateModified"] != "2024-03-05T10:00:00Z" {
+		t.Errorf("Article = %v", article)
+	}
+	if items, _ := breadcrumbs["itemListElement"].([]any); breadcrumbs["@type"] != "BreadcrumbList" || len(items) != 2 ||
+		items[1].(map[string]any)["item"] != "https://example.com/notes/page.html" {
+		t.Errorf("BreadcrumbList = %v", breadcrumbs)
+	}
+	if website["@type"] != "WebSite" || website["url"] != "https://example.com/" {
+		t.Errorf("WebSite = %v", website)
+	}
+
+	out, err = jsonLD(IndexPageData{SiteName: "Site", BaseURL: "https://example.com"})
+	if err != nil || !strings.Contains(string(out), `"@type":"WebSite"`) || strings.Contains(string(out), "Article") {
+		t.Errorf("jsonLD(IndexPageData) = %s, %v", out, err)
+	}
+}
+
+func TestPageMetadataInTemplates(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-metadata-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "page.org", "#+title: Page\n#+description: Hand-written summary.\n#+keywords: org, go\n#+image: https://cdn.example.com/card.png\n\nBody text.\n")
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public"), BaseURL: "https://example.com", DefaultImage: "/default.png"}
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	os.MkdirAll(ctx.DestDir, 0755)
+	GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+
+	data, err := os.ReadFile(filepath.Join(ctx.DestDir, "page.html"))
+	if err != nil {
+		t.Fatalf("Failed to read page.html: %v", err)
+	}
+	for _, want := range []string{
+		`<meta property="og:description" content="Hand-written summary.">`,
+		`<meta name="keywords" content="org, go">`,
+		`<meta property="og:image" content="https://cdn.example.com/card.png">`,
+		`<script type="application/ld+json">`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("page.html missing %q", want)
+		}
+	}
+}
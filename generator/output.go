@@ -0,0 +1,341 @@
+package generator
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// MemoryOutput collects the files a dry run would write, by slash-separated
+// path relative to DestDir, in place of writing them.
+type MemoryOutput struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	// kept are content-addressed files, such as image variants and social
+	// cards, that already exist in DestDir and would not be rewritten.
+	kept map[string]bool
+}
+
+func NewMemoryOutput() *MemoryOutput {
+	return &MemoryOutput{files: map[string][]byte{}, kept: map[string]bool{}}
+}
+
+// File returns the contents a dry run would write to rel.
+func (m *MemoryOutput) File(rel string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[rel]
+	return data, ok
+}
+
+// Diff compares the dry run's output with destDir. Missing lists the files
+// the build would create, Changed those it would modify, and Extra those in
+// destDir it no longer produces.
+func (m *MemoryOutput) Diff(destDir string) (OutputDiff, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, err := listOutputFiles(destDir)
+	if err != nil && !os.IsNotExist(err) {
+		return OutputDiff{}, err
+	}
+	produced := map[string]bool{}
+	for rel := range m.files {
+		produced[rel] = true
+	}
+	for rel := range m.kept {
+		produced[rel] = true
+	}
+	return diffOutputFiles(produced, existing, func(rel string) (bool, error) {
+		if m.kept[rel] {
+			return true, nil
+		}
+		data, err := os.ReadFile(filepath.Join(destDir, filepath.FromSlash(rel)))
+		return bytes.Equal(m.files[rel], data), err
+	})
+}
+
+// OutputLog records which output files a build generated and which it
+// skipped because they were up to date, by slash-separated path relative to
+// DestDir. It is safe for concurrent use, and a nil *OutputLog records
+// nothing.
+type OutputLog struct {
+	mu        sync.Mutex
+	generated map[string]bool
+	skipped   map[string]bool
+}
+
+func NewOutputLog() *OutputLog {
+	return &OutputLog{generated: map[string]bool{}, skipped: map[string]bool{}}
+}
+
+// Generated returns the files written, sorted. It is never nil.
+func (l *OutputLog) Generated() []string {
+	if l == nil {
+		return []string{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return sortedPaths(l.generated)
+}
+
+// Skipped returns the files left as they were, sorted. It is never nil.
+func (l *OutputLog) Skipped() []string {
+	if l == nil {
+		return []string{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return sortedPaths(l.skipped)
+}
+
+// sortedPaths returns the keys of paths, sorted, and empty rather than nil
+// when there are none.
+func sortedPaths(paths map[string]bool) []string {
+	sorted := slices.AppendSeq([]string{}, maps.Keys(paths))
+	slices.Sort(sorted)
+	return sorted
+}
+
+func (l *OutputLog) record(ctx BuildContext, path string, generated bool) {
+	if l == nil {
+		return
+	}
+	rel, err := outputRel(ctx, path)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if generated {
+		l.generated[rel] = true
+	} else {
+		l.skipped[rel] = true
+	}
+}
+
+// skipOutput records that the file at path, which is under ctx.DestDir, is
+// up to date and was not written.
+func skipOutput(ctx BuildContext, path string) {
+	ctx.Outputs.record(ctx, path, false)
+}
+
+// writeOutput writes data to path, which is under ctx.DestDir, creating its
+// directory. In a dry run, the data is kept in ctx.DryRun instead.
+func writeOutput(ctx BuildContext, path string, data []byte) error {
+	if ctx.DryRun == nil {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		ctx.Outputs.record(ctx, path, true)
+		return nil
+	}
+	ctx.Outputs.record(ctx, path, true)
+	rel, err := outputRel(ctx, path)
+	if err != nil {
+		return err
+	}
+	ctx.DryRun.mu.Lock()
+	defer ctx.DryRun.mu.Unlock()
+	ctx.DryRun.files[rel] = bytes.Clone(data)
+	return nil
+}
+
+// outputExists reports whether the content-addressed file at path, which is
+// under ctx.DestDir, was already written and need not be written again.
+func outputExists(ctx BuildContext, path string) bool {
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	skipOutput(ctx, path)
+	if ctx.DryRun != nil {
+		rel, err := outputRel(ctx, path)
+		if err != nil {
+			return false
+		}
+		ctx.DryRun.mu.Lock()
+		ctx.DryRun.kept[rel] = true
+		ctx.DryRun.mu.Unlock()
+	}
+	return true
+}
+
+func outputRel(ctx BuildContext, path string) (string, error) {
+	rel, err := filepath.Rel(ctx.DestDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the output directory", path)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// readOutputFiles calls fn with the path and contents of every file the
+// build wrote whose extension is in exts: the files under ctx.DestDir, or
+// those in ctx.DryRun.
+func readOutputFiles(ctx BuildContext, exts map[string]bool, fn func(path string, data []byte)) {
+	if ctx.DryRun != nil {
+		ctx.DryRun.mu.Lock()
+		files := maps.Clone(ctx.DryRun.files)
+		ctx.DryRun.mu.Unlock()
+		for _, rel := range slices.Sorted(maps.Keys(files)) {
+			if exts[filepath.Ext(rel)] {
+				fn(filepath.Join(ctx.DestDir, filepath.FromSlash(rel)), files[rel])
+			}
+		}
+		return
+	}
+	filepath.WalkDir(ctx.DestDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !exts[filepath.Ext(path)] {
+			return nil
+		}
+		if data, err := os.ReadFile(path); err == nil {
+			fn(path, data)
+		}
+		return nil
+	})
+}
+
+// diffContext is the number of unchanged lines shown around each change in
+// a unified diff.
+const diffContext = 3
+
+// maxDiffCells bounds the line-by-line table a diff may use. Larger changes
+// are shown as the whole old text replaced by the new.
+const maxDiffCells = 1 << 22
+
+// UnifiedDiff returns a unified diff of the lines of a, named oldName, and b,
+// named newName, or "" if they are equal.
+func UnifiedDiff(oldName, newName string, a, b []byte) string {
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	// Line numbers before each op, in a and in b.
+	oldLine, newLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if op.kind != '+' {
+			oldLine[i+1]++
+		}
+		if op.kind != '-' {
+			newLine[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+		}
+		// Extend the hunk while changes are close enough to share context.
+		last := i
+		for k := i; k < len(ops) && k-last <= 2*diffContext; k++ {
+			if ops[k].kind != ' ' {
+				last = k
+			}
+		}
+		start, end := max(0, i-diffContext), min(len(ops), last+diffContext+1)
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(oldLine[start], oldLine[end]-oldLine[start]),
+			hunkRange(newLine[start], newLine[end]-newLine[start]))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.text)
+		}
+		i = end
+	}
+	return out.String()
+}
+
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprint(before + 1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// diffOp is a line of a diff: ' ' if it is in both texts, '-' if only in the
+// old one and '+' if only in the new one.
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// diffLines returns the shortest edit from a to b, found through their
+// longest common subsequence of lines.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		ops = append(ops, diffOp{' ', a[prefix]})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	x, y := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	if len(x)*len(y) > maxDiffCells {
+		for _, line := range x {
+			ops = append(ops, diffOp{'-', line})
+		}
+		for _, line := range y {
+			ops = append(ops, diffOp{'+', line})
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of
+		// x[i:] and y[j:].
+		lcs := make([][]int32, len(x)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(y)+1)
+		}
+		for i := len(x) - 1; i >= 0; i-- {
+			for j := len(y) - 1; j >= 0; j-- {
+				if x[i] == y[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(x) || j < len(y) {
+			switch {
+			case i < len(x) && j < len(y) && x[i] == y[j]:
+				ops = append(ops, diffOp{' ', x[i]})
+				i++
+				j++
+			case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, diffOp{'-', x[i]})
+				i++
+			default:
+				ops = append(ops, diffOp{'+', y[j]})
+				j++
+			}
+		}
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
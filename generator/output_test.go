@@ -0,0 +1,116 @@
+package generator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-dryrun-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: A\n* One :go:\nHello.\n")
+	CreateTestOrgFile(tmpDir, "b.org", "#+title: B\n* Two :go:\nWorld.\n")
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	destDir := filepath.Join(tmpDir, "public")
+	build := func(dryRun *MemoryOutput) (*ProcessedFiles, GenerationResult) {
+		ctx := BuildContext{Root: tmpDir, DestDir: destDir, SocialCards: true, DryRun: dryRun}
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		procFiles, _ = GenerateSocialCards(procFiles, ctx)
+		ctx.ForceRebuild = true
+		return procFiles, GenerateHtmlPages(procFiles, ctx, tmpls.Page).Add(
+			GenerateTagPages(procFiles, ctx, tmpls.Tag)).Add(
+			WriteHighlightStylesheet(procFiles, ctx))
+	}
+	build(nil)
+	before, _ := listOutputFiles(destDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: A\n* One :go:\nHello there.\n")
+	os.Remove(filepath.Join(tmpDir, "b.org"))
+	CreateTestOrgFile(tmpDir, "c.org", "#+title: C\nNew.\n")
+	output := NewMemoryOutput()
+	procFiles, result := build(output)
+	if result.Errors != 0 {
+		t.Fatalf("dry run had %d errors", result.Errors)
+	}
+
+	after, _ := listOutputFiles(destDir)
+	if fmt.Sprint(before) != fmt.Sprint(after) {
+		t.Errorf("dry run wrote to DestDir: %v, then %v", before, after)
+	}
+	if data, _ := os.ReadFile(filepath.Join(destDir, "a.html")); strings.Contains(string(data), "Hello there.") {
+		t.Error("dry run overwrote a.html")
+	}
+
+	diff, err := output.Diff(destDir)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	if want := fmt.Sprint([]string{filepath.ToSlash(procFiles.SocialCards["c.org"]), "c.html"}); fmt.Sprint(diff.Missing) != want {
+		t.Errorf("Missing = %v, want %v", diff.Missing, want)
+	}
+	if fmt.Sprint(diff.Changed) != "[a.html tag-go.html]" {
+		t.Errorf("Changed = %v", diff.Changed)
+	}
+	if len(diff.Extra) != 2 || diff.Extra[1] != "b.html" {
+		t.Errorf("Extra = %v, want b.org's card and b.html", diff.Extra)
+	}
+	if page, ok := output.File("a.html"); !ok || !strings.Contains(string(page), "Hello there.") {
+		t.Error("File(a.html) should hold the new page")
+	}
+	// a.org's card is unchanged and already in DestDir, so it isn't redrawn.
+	if _, ok := output.File(filepath.ToSlash(procFiles.SocialCards["a.org"])); ok {
+		t.Error("dry run redrew an existing social card")
+	}
+}
+
+func TestDryRunLeakCheck(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-dryrun-")
+	defer CleanupTempDir(tmpDir)
+
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public"), DryRun: NewMemoryOutput()}
+	CreateTestOrgFile(tmpDir, "note.org", "#+title: Note\n* Public\nVisible text.\n* Secret :private:\nThe safe combination is 4512.\n")
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	writeOutput(ctx, filepath.Join(ctx.DestDir, "note.html"), []byte("<p>The safe combination is 4512.</p>"))
+	if result := CheckPrivateLeaks(procFiles, ctx); result.PrivateLeaks != 1 {
+		t.Errorf("PrivateLeaks = %d, want 1", result.PrivateLeaks)
+	}
+	if _, err := os.Stat(ctx.DestDir); !os.IsNotExist(err) {
+		t.Error("dry run created DestDir")
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\ntwelve\n"
+	b := "one\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\ntwelve\nthirteen\n"
+	want := `--- a/x
++++ b/x
+@@ -1,5 +1,5 @@
+ one
+-two
++2
+ three
+ four
+ five
+@@ -10,3 +10,4 @@
+ ten
+ eleven
+ twelve
++thirteen
+`
+	if got := UnifiedDiff("a/x", "b/x", []byte(a), []byte(b)); got != want {
+		t.Errorf("UnifiedDiff() =\n%s\nwant\n%s", got, want)
+	}
+	if got := UnifiedDiff("a/x", "b/x", []byte(a), []byte(a)); got != "" {
+		t.Errorf("UnifiedDiff() of equal texts = %q", got)
+	}
+	if got := UnifiedDiff("a/x", "b/x", nil, []byte("new\n")); got != "--- a/x\n+++ b/x\n@@ -0,0 +1 @@\n+new\n" {
+		t.Errorf("UnifiedDiff() from empty = %q", got)
+	}
+}
@@ -8,8 +8,8 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/niklasfasching/go-org/org"
 )
@@ -17,47 +17,58 @@ import (
 // FindAndProcessOrgFiles walks absPath discovering .org files,
 // then parses each in parallel to extract titles, tags, previews, last
 // modification times, and UUIDs. Returns a ProcessedFiles
-// containing all discovered files along with populated UuidMap
-// and TagMap for cross-reference lookups, plus a GenerationResult.
+// containing all discovered files along with their SiteIndex for
+// cross-reference lookups, plus a GenerationResult.
 func FindAndProcessOrgFiles(_ *ProcessedFiles, ctx BuildContext) (*ProcessedFiles, GenerationResult) {
 	slog.Debug("Starting Phase 1: collecting and processing org files", "root", ctx.Root)
 	files := collectOrgFiles(ctx.Root)
 	slog.Debug("Collected org files", "count", len(files))
 
-	procFiles := &ProcessedFiles{
-		Files:   files,
-		UuidMap: sync.Map{},
-		TagMap:  sync.Map{},
-	}
+	procFiles := &ProcessedFiles{Files: files}
 
 	var filesWithUUIDs int64
-	var wg sync.WaitGroup
-	for i := range files {
-		wg.Add(1)
-		go func(idx int) {
-			defer wg.Done()
-			fi, err := processFile(files[idx].Path, ctx.Root, procFiles)
-			if err != nil {
-				slog.Error("Error processing file", "path", files[idx].Path, "error", err)
-				return
-			}
-			if fi == nil {
-				return
-			}
-			files[idx] = *fi
-			if len(fi.UUIDs) > 0 {
-				atomic.AddInt64(&filesWithUUIDs, 1)
-			}
+	ctx.Pool.Run(len(files), func(idx int) {
+		start := time.Now()
+		fi, err := processFile(files[idx].Path, ctx)
+		ctx.Timings.File("parse", files[idx].Path, time.Since(start))
+		if err != nil {
+			ctx.Diagnostics.Error("source-read", files[idx].Path, 0, "failed to process file: %v", err)
+			return
+		}
+		if fi == nil {
+			return
+		}
+		files[idx] = *fi
+		if len(fi.UUIDs) > 0 && !fi.private {
+			atomic.AddInt64(&filesWithUUIDs, 1)
+		}
+	})
 
-			for _, tag := range fi.Tags {
-				existing, _ := procFiles.TagMap.LoadOrStore(tag, []FileInfo{})
-				if existingSlice, ok := existing.([]FileInfo); ok {
-					procFiles.TagMap.Store(tag, append(existingSlice, *fi))
-				}
-			}
-		}(i)
+	// Private files are dropped; their text, and the private subtrees removed
+	// from the rest, is kept for the leak check, and their IDs for degrading
+	// links to them. Empty and unreadable files were never parsed and have no
+	// page to render, so they go too.
+	public := files[:0]
+	procFiles.privateIDs = map[UUID]bool{}
+	for _, fi := range files {
+		if len(fi.privateSnippets) > 0 {
+			procFiles.privateText = append(procFiles.privateText, privateText{path: fi.Path, snippets: fi.privateSnippets})
+		}
+		for _, id := range fi.privateIDs {
+			procFiles.privateIDs[id] = true
+		}
+		if !fi.private && fi.ParsedOrg != nil {
+			public = append(public, fi)
+		}
+	}
+	procFiles.Files = public
+
+	// The index is built once parsing is done, in file order, so that it
+	// doesn't depend on which file finished first.
+	procFiles.Index = NewSiteIndex(procFiles.Files)
+	for _, dup := range procFiles.Index.duplicates {
+		ctx.Diagnostics.Warn("duplicate-id", dup.path, ctx.Diagnostics.Line(dup.path, string(dup.id)), "ID %s is already used in %s, which keeps it", dup.id, dup.kept)
 	}
-	wg.Wait()
 
 	slog.Debug("Phase 1 complete", "files_processed", len(files), "files_with_uuids", int(filesWithUUIDs))
 
@@ -97,8 +108,8 @@ func collectOrgFiles(root string) []FileInfo {
 	return files
 }
 
-func processFile(filePath, root string, procFiles *ProcessedFiles) (*FileInfo, error) {
-	absPath := filepath.Join(root, filePath)
+func processFile(filePath string, ctx BuildContext) (*FileInfo, error) {
+	absPath := filepath.Join(ctx.Root, filePath)
 	slog.Debug("Processing org file", "path", filePath)
 
 	data, err := os.ReadFile(absPath)
@@ -117,30 +128,62 @@ func processFile(filePath, root string, procFiles *ProcessedFiles) (*FileInfo, e
 	}
 
 	conf := org.New()
+	resolver := newIncludeResolver(ctx.Root, absPath)
+	resolver.diagnostics = ctx.Diagnostics
+	conf.ReadFile = resolver.ReadFile
 	doc := conf.Parse(bytes.NewReader(data), absPath)
+	resolver.expandIncludes(conf, absPath, doc.Nodes)
+
+	rules := newPrivacyRules(doc, ctx)
+	if rules.fileIsPrivate(doc) {
+		slog.Debug("Skipping private file", "path", filePath)
+		return &FileInfo{Path: filePath, ModTime: sourceModTime(ctx, info.ModTime()), fileModTime: info.ModTime(), private: true, privateSnippets: privateSnippets(doc.Nodes), privateIDs: privateIDs(doc.Nodes)}, nil
+	}
+	private, removedIDs := prunePrivate(doc, rules, filePath)
+
+	attachments := extractAttachmentsFromAST(doc, filePath, ctx.Root, attachIDDir(ctx), ctx.Diagnostics)
+	citations := extractCitationsFromAST(doc)
+	image := extractImageFromAST(doc, filePath)
 
 	resultFI := &FileInfo{
-		Path:      filePath,
-		ModTime:   info.ModTime(),
-		Preview:   extractPreviewFromAST(doc, 500),
-		Title:     extractTitleFromAST(doc),
-		Tags:      extractTagsFromAST(doc),
-		UUIDs:     extractUUIDsFromAST(doc),
-		ParsedOrg: doc,
+		Path:        filePath,
+		ModTime:     pageTime(ctx, doc, info.ModTime()),
+		Preview:     extractPreviewFromAST(doc, 500),
+		Title:       extractTitleFromAST(doc),
+		Tags:        extractTagsFromAST(doc),
+		UUIDs:       extractUUIDsFromAST(doc),
+		Includes:    resolver.dependencies(),
+		Attachments: attachments,
+		Images:      extractImagesFromAST(doc, filePath, attachments, image),
+		ParsedOrg:   doc,
+
+		Citations:      citations,
+		Bibliographies: bibliographyFiles(doc, filePath, ctx, len(citations) > 0),
+		CiteRefs:       extractCiteRefsFromAST(doc),
+		IndexEntries:   extractIndexEntriesFromAST(doc),
+		Links:          extractLinksFromAST(doc),
+		Tables:         extractTablesFromAST(doc),
+		Queries:        extractQueriesFromAST(doc, filePath, ctx.Diagnostics),
+		Properties:     extractPropertiesFromAST(doc),
+		Description:    extractDescriptionFromAST(doc),
+		Image:          image,
+		Keywords:       extractKeywordsFromAST(doc),
+
+		privateSnippets: private,
+		privateIDs:      removedIDs,
+		fileModTime:     info.ModTime(),
+	}
+	resultFI.Events = extractEventsFromAST(doc, resultFI.Title)
+	if resultFI.Title == "" {
+		ctx.Diagnostics.Warn("no-title", filePath, 0, "no title: add #+TITLE: or a headline")
 	}
 
 	slog.Debug("Extracted file metadata",
 		"path", filePath,
 		"title", resultFI.Title,
 		"tags", resultFI.Tags,
-		"uuid_count", len(resultFI.UUIDs))
-
-	for uuid, headerIndex := range resultFI.UUIDs {
-		procFiles.UuidMap.Store(uuid, HeaderLocation{
-			FilePath:    filePath,
-			HeaderIndex: headerIndex,
-		})
-	}
+		"uuid_count", len(resultFI.UUIDs),
+		"includes", resultFI.Includes)
 
 	return resultFI, nil
 }
@@ -165,7 +208,6 @@ func extractTitleFromAST(doc *org.Document) string {
 		}
 	}
 
-	slog.Warn("No title found in org file")
 	return ""
 }
 
@@ -187,9 +229,9 @@ func extractUUIDsFromAST(doc *org.Document) UUIDMap {
 	var walkNodes func(node org.Node)
 	walkNodes = func(node org.Node) {
 		if headline, ok := node.(org.Headline); ok {
-			if headline.Properties != nil {
+			if props := headlineProperties(headline); props != nil {
 				// Iterate through all properties to find multiple ID entries
-				for _, prop := range headline.Properties.Properties {
+				for _, prop := range props.Properties {
 					if prop[0] == "ID" && prop[1] != "" {
 						id := UUID(prop[1])
 						if isValidUUID(string(id)) {
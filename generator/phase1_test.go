@@ -6,7 +6,6 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
-	"sync"
 	"testing"
 	"time"
 
@@ -267,13 +266,7 @@ Some code block
 	orgFile := filepath.Join(tmpDir, "test.org")
 	os.WriteFile(orgFile, []byte(testContent), 0644)
 
-	procFiles := &ProcessedFiles{
-		Files:   []FileInfo{},
-		UuidMap: sync.Map{},
-		TagMap:  sync.Map{},
-	}
-
-	result, err := processFile("test.org", tmpDir, procFiles)
+	result, err := processFile("test.org", BuildContext{Root: tmpDir})
 	if err != nil {
 		t.Fatalf("processFile() error = %v", err)
 	}
@@ -314,17 +307,17 @@ Some code block
 		t.Error("Preview doesn't contain expected content")
 	}
 
+	siteIndex := NewSiteIndex([]FileInfo{*result})
 	for uuid, index := range expectedUUIDs {
-		stored, ok := procFiles.UuidMap.Load(UUID(uuid))
+		loc, ok := siteIndex.Lookup(UUID(uuid))
 		if !ok {
-			t.Errorf("UUID %s not found in UuidMap", uuid)
+			t.Errorf("UUID %s not found in Index", uuid)
 		}
-		loc := stored.(HeaderLocation)
 		if loc.FilePath != "test.org" {
-			t.Errorf("UuidMap[%s].FilePath = %v, want test.org", uuid, loc.FilePath)
+			t.Errorf("Lookup(%s).FilePath = %v, want test.org", uuid, loc.FilePath)
 		}
 		if loc.HeaderIndex != index {
-			t.Errorf("UuidMap[%s].HeaderIndex = %v, want %d", uuid, loc.HeaderIndex, index)
+			t.Errorf("Lookup(%s).HeaderIndex = %v, want %d", uuid, loc.HeaderIndex, index)
 		}
 	}
 
@@ -420,10 +413,9 @@ Nested content here.
 		}
 	}
 
-	emacsFiles, _ := procFiles.TagMap.Load("emacs")
-	if emacsFiles == nil {
-		t.Error("emacs tag not found in TagMap")
-	} else if files := emacsFiles.([]FileInfo); len(files) != 2 {
+	if files := procFiles.Index.FilesWithTag("emacs"); len(files) == 0 {
+		t.Error("emacs tag not found in Index")
+	} else if len(files) != 2 {
 		t.Errorf("emacs tag has %d files, want 2", len(files))
 	} else {
 		// Verify the specific files with emacs tag (order may vary)
@@ -439,40 +431,67 @@ Nested content here.
 		}
 	}
 
-	testingFiles, _ := procFiles.TagMap.Load("testing")
-	if testingFiles == nil {
-		t.Error("testing tag not found in TagMap")
-	} else if files := testingFiles.([]FileInfo); len(files) != 1 {
+	if files := procFiles.Index.FilesWithTag("testing"); len(files) == 0 {
+		t.Error("testing tag not found in Index")
+	} else if len(files) != 1 {
 		t.Errorf("testing tag has %d files, want 1", len(files))
 	} else if files[0].Path != "subdir/nested.org" {
 		t.Errorf("testing tag file = %s, want subdir/nested.org", files[0].Path)
 	}
 
-	// Verify UUID paths in UuidMap
-	stored1, ok := procFiles.UuidMap.Load(UUID("550e8400-e29b-41d4-a716-446655440001"))
+	// Verify UUID paths in Index
+	loc1, ok := procFiles.Index.Lookup(UUID("550e8400-e29b-41d4-a716-446655440001"))
 	if !ok {
-		t.Error("UUID from doc1.org not found in UuidMap")
+		t.Error("UUID from doc1.org not found in Index")
 	} else {
-		loc1 := stored1.(HeaderLocation)
 		if loc1.FilePath != "doc1.org" {
-			t.Errorf("UuidMap[doc1 UUID].FilePath = %v, want doc1.org", loc1.FilePath)
+			t.Errorf("Lookup(doc1 UUID).FilePath = %v, want doc1.org", loc1.FilePath)
 		}
 		if loc1.HeaderIndex != 1 {
-			t.Errorf("UuidMap[doc1 UUID].HeaderIndex = %v, want 1", loc1.HeaderIndex)
+			t.Errorf("Lookup(doc1 UUID).HeaderIndex = %v, want 1", loc1.HeaderIndex)
 		}
 	}
 
-	stored2, ok := procFiles.UuidMap.Load(UUID("550e8400-e29b-41d4-a716-446655440002"))
+	loc2, ok := procFiles.Index.Lookup(UUID("550e8400-e29b-41d4-a716-446655440002"))
 	if !ok {
-		t.Error("UUID from nested.org not found in UuidMap")
+		t.Error("UUID from nested.org not found in Index")
 	} else {
-		loc2 := stored2.(HeaderLocation)
 		if loc2.FilePath != "subdir/nested.org" {
-			t.Errorf("UuidMap[nested.org UUID].FilePath = %v, want subdir/nested.org", loc2.FilePath)
+			t.Errorf("Lookup(nested.org UUID).FilePath = %v, want subdir/nested.org", loc2.FilePath)
 		}
 		if loc2.HeaderIndex != 1 {
-			t.Errorf("UuidMap[nested.org UUID].HeaderIndex = %v, want 1", loc2.HeaderIndex)
+			t.Errorf("Lookup(nested.org UUID).HeaderIndex = %v, want 1", loc2.HeaderIndex)
 		}
 	}
 
 }
+
+func TestFindAndProcessOrgFiles_EmptyFile(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-phase1-empty-")
+	defer CleanupTempDir(tmpDir)
+	destDir := filepath.Join(tmpDir, "public")
+
+	CreateTestOrgFile(tmpDir, "empty.org", "")
+	CreateTestOrgFile(tmpDir, "doc.org", "#+title: Document\n\nSome content.\n")
+
+	ctx := CreateTestBuildContext(tmpDir, destDir, "Test Site", true)
+	procFiles, result := FindAndProcessOrgFiles(nil, *ctx)
+	if result.TotalFilesScanned != 2 {
+		t.Errorf("TotalFilesScanned = %d, want 2", result.TotalFilesScanned)
+	}
+	if len(procFiles.Files) != 1 || procFiles.Files[0].Path != "doc.org" {
+		t.Fatalf("Files = %v, want only doc.org", procFiles.Files)
+	}
+
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	gen := GenerateHtmlPages(procFiles, *ctx, tmpls.Page)
+	if gen.FilesGenerated != 1 || gen.Errors != 0 {
+		t.Errorf("GenerateHtmlPages() generated %d with %d errors, want 1 and 0", gen.FilesGenerated, gen.Errors)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "empty.html")); !os.IsNotExist(err) {
+		t.Errorf("empty.html should not be written, stat error = %v", err)
+	}
+}
@@ -3,22 +3,33 @@ package generator
 import (
 	"bytes"
 	"fmt"
+	"html"
 	"html/template"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/niklasfasching/go-org/org"
 )
 
+// Templates are the parsed templates of a site.
+type Templates struct {
+	Page     *template.Template
+	Tag      *template.Template
+	Index    *template.Template
+	Atom     *template.Template
+	TheIndex *template.Template
+	Events   *template.Template
+	// ModTime is the base template's modification time, for cache validation.
+	ModTime time.Time
+}
+
 // SetupTemplates loads and parses HTML templates from the templates directory
-// or from the embedded filesystem. Returns the parsed templates and the base template
-// modification time for cache validation.
-func SetupTemplates(absPath string) (*template.Template, *template.Template, *template.Template, *template.Template, time.Time, error) {
+// or from the embedded filesystem.
+func SetupTemplates(absPath string) (*Templates, error) {
 	funcMap := template.FuncMap{
 		"pathNoExt": func(path string) string {
 			return strings.TrimSuffix(path, ".org")
@@ -29,6 +40,12 @@ func SetupTemplates(absPath string) (*template.Template, *template.Template, *te
 		"sub": func(a, b int) int {
 			return a - b
 		},
+		"jsonLD":    jsonLD,
+		"pageImage": pageImage,
+		// table is replaced by BindTables once the org files are parsed.
+		"table": func(path, name string) (DataTable, error) {
+			return DataTable{}, fmt.Errorf("no table %q in %s: tables not loaded", name, path)
+		},
 	}
 
 	templatesDir := filepath.Join(absPath, "templates")
@@ -40,139 +57,169 @@ func SetupTemplates(absPath string) (*template.Template, *template.Template, *te
 		slog.Debug("Using custom templates from directory", "path", templatesDir)
 	}
 
-	var pageTmpl, tagTmpl, indexTmpl, atomTmpl *template.Template
+	tmpls := &Templates{}
 
 	if useFS {
 		baseTmplPath := filepath.Join(templatesDir, "base-template.html")
 		baseTmpl, err := template.New("base-template.html").Funcs(funcMap).ParseFiles(baseTmplPath)
 		if err != nil {
-			return nil, nil, nil, nil, time.Time{}, fmt.Errorf("failed to parse base template: %w", err)
+			return nil, fmt.Errorf("failed to parse base template: %w", err)
 		}
 
-		pageTmpl, err = template.Must(baseTmpl.Clone()).ParseFiles(
+		tmpls.Page, err = template.Must(baseTmpl.Clone()).ParseFiles(
 			filepath.Join(templatesDir, "page-template.html"),
 		)
 		if err != nil {
-			return nil, nil, nil, nil, time.Time{}, fmt.Errorf("failed to parse page template: %w", err)
+			return nil, fmt.Errorf("failed to parse page template: %w", err)
 		}
 
-		tagTmpl, err = template.Must(baseTmpl.Clone()).ParseFiles(
+		tmpls.Tag, err = template.Must(baseTmpl.Clone()).ParseFiles(
 			filepath.Join(templatesDir, "tag-page-template.html"),
 		)
 		if err != nil {
-			return nil, nil, nil, nil, time.Time{}, fmt.Errorf("failed to parse tag template: %w", err)
+			return nil, fmt.Errorf("failed to parse tag template: %w", err)
 		}
 
-		indexTmpl, err = template.Must(baseTmpl.Clone()).ParseFiles(
+		tmpls.Index, err = template.Must(baseTmpl.Clone()).ParseFiles(
 			filepath.Join(templatesDir, "index-page-template.html"),
 		)
 		if err != nil {
-			return nil, nil, nil, nil, time.Time{}, fmt.Errorf("failed to parse index template: %w", err)
+			return nil, fmt.Errorf("failed to parse index template: %w", err)
 		}
 
-		atomTmpl, err = template.New("atom-template.xml").ParseFiles(
+		tmpls.Atom, err = template.New("atom-template.xml").ParseFiles(
 			filepath.Join(templatesDir, "atom-template.xml"),
 		)
 		if err != nil {
-			return nil, nil, nil, nil, time.Time{}, fmt.Errorf("failed to parse atom template: %w", err)
+			return nil, fmt.Errorf("failed to parse atom template: %w", err)
 		}
 
-		info, err := os.Stat(baseTmplPath)
+		// theindex-template.html and events-template.html are newer than the
+		// other templates, so sites with their own templates may not have
+		// them yet; the embedded copies fill in.
+		parseOptional := func(name string) (*template.Template, error) {
+			path := filepath.Join(templatesDir, name)
+			if _, statErr := os.Stat(path); statErr == nil {
+				return template.Must(baseTmpl.Clone()).ParseFiles(path)
+			}
+			return template.Must(baseTmpl.Clone()).ParseFS(templates, "templates/"+name)
+		}
+
+		tmpls.TheIndex, err = parseOptional("theindex-template.html")
 		if err != nil {
-			return pageTmpl, tagTmpl, indexTmpl, atomTmpl, time.Time{}, nil
+			return nil, fmt.Errorf("failed to parse theindex template: %w", err)
 		}
-		return pageTmpl, tagTmpl, indexTmpl, atomTmpl, info.ModTime(), nil
+
+		tmpls.Events, err = parseOptional("events-template.html")
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse events template: %w", err)
+		}
+
+		if info, err := os.Stat(baseTmplPath); err == nil {
+			tmpls.ModTime = info.ModTime()
+		}
+		return tmpls, nil
 	} else {
 		var err error
-		pageTmpl, err = template.New("page-template.html").Funcs(funcMap).ParseFS(templates,
+		tmpls.Page, err = template.New("page-template.html").Funcs(funcMap).ParseFS(templates,
 			"templates/base-template.html",
 			"templates/page-template.html",
 		)
 		if err != nil {
-			return nil, nil, nil, nil, time.Time{}, fmt.Errorf("failed to parse page template: %w", err)
+			return nil, fmt.Errorf("failed to parse page template: %w", err)
 		}
 
-		tagTmpl, err = template.New("tag-page-template.html").Funcs(funcMap).ParseFS(templates,
+		tmpls.Tag, err = template.New("tag-page-template.html").Funcs(funcMap).ParseFS(templates,
 			"templates/base-template.html",
 			"templates/tag-page-template.html",
 		)
 		if err != nil {
-			return nil, nil, nil, nil, time.Time{}, fmt.Errorf("failed to parse tag template: %w", err)
+			return nil, fmt.Errorf("failed to parse tag template: %w", err)
 		}
 
-		indexTmpl, err = template.New("index-page-template.html").Funcs(funcMap).ParseFS(templates,
+		tmpls.Index, err = template.New("index-page-template.html").Funcs(funcMap).ParseFS(templates,
 			"templates/base-template.html",
 			"templates/index-page-template.html",
 		)
 		if err != nil {
-			return nil, nil, nil, nil, time.Time{}, fmt.Errorf("failed to parse index template: %w", err)
+			return nil, fmt.Errorf("failed to parse index template: %w", err)
 		}
 
-		atomTmpl, err = template.New("atom-template.xml").Funcs(funcMap).ParseFS(templates,
+		tmpls.Atom, err = template.New("atom-template.xml").Funcs(funcMap).ParseFS(templates,
 			"templates/atom-template.xml",
 		)
 		if err != nil {
-			return nil, nil, nil, nil, time.Time{}, fmt.Errorf("failed to parse atom template: %w", err)
+			return nil, fmt.Errorf("failed to parse atom template: %w", err)
 		}
-		return pageTmpl, tagTmpl, indexTmpl, atomTmpl, time.Now(), nil
+
+		tmpls.TheIndex, err = template.New("theindex-template.html").Funcs(funcMap).ParseFS(templates,
+			"templates/base-template.html",
+			"templates/theindex-template.html",
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse theindex template: %w", err)
+		}
+
+		tmpls.Events, err = template.New("events-template.html").Funcs(funcMap).ParseFS(templates,
+			"templates/base-template.html",
+			"templates/events-template.html",
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse events template: %w", err)
+		}
+		tmpls.ModTime = embeddedTemplatesModTime()
+		return tmpls, nil
 	}
 }
 
 // GenerateHtmlPages converts each parsed .org file to HTML and writes the result
-// to ctx.DestDir. Uses UUID map to replace internal links with proper file paths.
+// to ctx.DestDir. Uses the site index to replace internal links with proper file paths.
 // Returns a GenerationResult with counts of generated, skipped, and errored files.
 func GenerateHtmlPages(procFiles *ProcessedFiles, ctx BuildContext, tmpl *template.Template) GenerationResult {
 	slog.Debug("Starting Phase 2: generating HTML pages", "file_count", len(procFiles.Files))
 
-	uuidToPath := make(map[UUID]HeaderLocation)
-	procFiles.UuidMap.Range(func(key, value any) bool {
-		if k, ok := key.(UUID); ok {
-			if v, ok := value.(HeaderLocation); ok {
-				uuidToPath[k] = v
-			} else {
-				slog.Warn("Warning: unexpected type in UuidMap value", "value", value)
-			}
-		} else {
-			slog.Warn("Warning: unexpected type in UuidMap key", "key", key, "type", fmt.Sprintf("%T", key))
-		}
-		return true
-	})
+	uuidToPath := procFiles.Index.Locations()
 
 	slog.Debug("Built UUID lookup map", "uuid_count", len(uuidToPath))
 
-	var wg sync.WaitGroup
 	var filesGenerated int64
+	var filesSkipped int64
 	var errors int64
+	var unsafeStripped int64
 
-	for _, fi := range procFiles.Files {
-		wg.Add(1)
-		go func(fi FileInfo) {
-			defer wg.Done()
-
-			if err := generateHTML(fi, ctx, uuidToPath, tmpl); err != nil {
-				atomic.AddInt64(&errors, 1)
-			} else {
-				atomic.AddInt64(&filesGenerated, 1)
-			}
-		}(fi)
-	}
-
-	wg.Wait()
+	ctx.Pool.Run(len(procFiles.Files), func(i int) {
+		fi := procFiles.Files[i]
+		if fi.Path == "sitemap-preamble.org" {
+			slog.Debug("Skipping sitemap-preamble.org from HTML generation")
+			return
+		}
+		start := time.Now()
+		stripped, generated, err := generateHTML(fi, ctx, uuidToPath, procFiles, tmpl)
+		ctx.Timings.File("render", fi.Path, time.Since(start))
+		if err != nil {
+			atomic.AddInt64(&errors, 1)
+		} else if generated {
+			atomic.AddInt64(&filesGenerated, 1)
+		} else {
+			atomic.AddInt64(&filesSkipped, 1)
+		}
+		atomic.AddInt64(&unsafeStripped, int64(stripped))
+	})
 
-	slog.Debug("Phase 2 complete", "files_generated", filesGenerated, "errors", errors)
+	slog.Debug("Phase 2 complete", "files_generated", filesGenerated, "files_skipped", filesSkipped, "errors", errors)
 
 	return GenerationResult{
 		FilesGenerated: int(filesGenerated),
+		FilesSkipped:   int(filesSkipped),
 		Errors:         int(errors),
+		UnsafeStripped: int(unsafeStripped),
 	}
 }
 
-func generateHTML(fi FileInfo, ctx BuildContext, uuidToPath map[UUID]HeaderLocation, tmpl *template.Template) error {
-	if fi.Path == "sitemap-preamble.org" {
-		slog.Debug("Skipping sitemap-preamble.org from HTML generation")
-		return nil
-	}
-
+// generateHTML writes fi's page unless its cached copy is current, and
+// returns the number of items safe mode stripped from it and whether it
+// wrote the page.
+func generateHTML(fi FileInfo, ctx BuildContext, uuidToPath map[UUID]HeaderLocation, procFiles *ProcessedFiles, tmpl *template.Template) (int, bool, error) {
 	slog.Debug("Generating HTML for file", "path", fi.Path)
 	publicDir := ctx.DestDir
 	htmlRelativePath := strings.TrimSuffix(fi.Path, ".org") + ".html"
@@ -180,17 +227,27 @@ func generateHTML(fi FileInfo, ctx BuildContext, uuidToPath map[UUID]HeaderLocat
 
 	if !ctx.ForceRebuild {
 		if htmlInfo, err := os.Stat(outputPath); err == nil {
-			if !fi.ModTime.After(htmlInfo.ModTime()) && !ctx.TmplModTime.After(htmlInfo.ModTime()) {
+			if !fi.fileModTime.After(htmlInfo.ModTime()) && !ctx.TmplModTime.After(htmlInfo.ModTime()) &&
+				!dependenciesModifiedSince(fi, ctx.Root, htmlInfo.ModTime()) &&
+				!dataModifiedSince(procFiles, htmlInfo.ModTime()) &&
+				!queriesStale(fi, procFiles, outputPath) &&
+				!citedByStale(fi, procFiles, outputPath) &&
+				!relatedStale(fi, procFiles, outputPath) &&
+				!socialCardStale(fi, procFiles, outputPath) &&
+				!publishScopeStale(fi, procFiles, htmlInfo.ModTime()) {
 				slog.Debug("Skipping file: cache valid", "path", fi.Path)
-				return nil
+				skipOutput(ctx, outputPath)
+				return replayRenderDiagnostics(fi, ctx, uuidToPath, procFiles, outputPath, htmlInfo.ModTime()), false, nil
 			}
 		}
 	}
 
-	htmlContent, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, fi, uuidToPath)
+	ctx.Diagnostics = ctx.Diagnostics.recorder()
+	writer := newPageWriter(fi.ParsedOrg, fi, ctx, uuidToPath, procFiles)
+	htmlContent, err := fi.ParsedOrg.Write(writer)
 	if err != nil {
-		slog.Warn("Error converting to HTML", "path", fi.Path, "error", err)
-		return err
+		ctx.Diagnostics.Error("render", fi.Path, 0, "failed to convert to HTML: %v", err)
+		return writer.safe.stripped, false, err
 	}
 
 	title := strings.TrimSuffix(fi.Path, ".org")
@@ -205,40 +262,191 @@ func generateHTML(fi FileInfo, ctx BuildContext, uuidToPath map[UUID]HeaderLocat
 		Author:       ctx.Author,
 		LicenseName:  ctx.LicenseName,
 		LicenseURL:   ctx.LicenseURL,
+		ImageURL:     pageImageURL(fi, ctx, procFiles),
+		Breadcrumbs:  pageBreadcrumbs(fi, ctx, procFiles),
+	}
+	if procFiles != nil {
+		pageData.Data = procFiles.Data
+		pageData.Related = procFiles.Related[fi.Path]
+		pageData.CitedBy = citedBy(fi, procFiles)
 	}
 
 	var outputBuf bytes.Buffer
 	if err := tmpl.ExecuteTemplate(&outputBuf, "page-template.html", pageData); err != nil {
-		slog.Warn("Error executing template", "path", fi.Path, "error", err)
-		return err
+		ctx.Diagnostics.Error("template", fi.Path, 0, "failed to execute page-template.html: %v", err)
+		return writer.safe.stripped, false, err
 	}
 
-	outputDir := filepath.Dir(outputPath)
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		slog.Warn("Error creating directory", "path", fi.Path, "error", err)
-		return err
+	if err := writeOutput(ctx, outputPath, outputBuf.Bytes()); err != nil {
+		ctx.Diagnostics.Error("output", fi.Path, 0, "failed to write %s: %v", outputPath, err)
+		return writer.safe.stripped, false, err
 	}
 
-	if err := os.WriteFile(outputPath, outputBuf.Bytes(), 0644); err != nil {
-		slog.Warn("Error writing file", "path", fi.Path, "error", err)
-		return err
+	if ctx.DryRun == nil {
+		ctx.RenderCache.store(fi.Path, outputPath, writer.safe.stripped, ctx.Diagnostics.Entries())
 	}
-
 	slog.Debug("Wrote HTML file", "path", outputPath)
-	return nil
+	return writer.safe.stripped, true, nil
+}
+
+// listingStale reports whether the page existing lists pages other than
+// pages, going by the fingerprint of the list the page template writes in
+// its attr attribute. An empty list is written without one.
+func listingStale(existing []byte, attr string, pages []FileInfo) bool {
+	if len(pages) == 0 {
+		return bytes.Contains(existing, []byte(attr+`="`))
+	}
+	return !bytes.Contains(existing, []byte(attr+`="`+pagesFingerprint(pages)+`"`))
+}
+
+// replayRenderDiagnostics reports again the diagnostics found while rendering
+// fi's page, such as math-fallback and unsafe-content, for a build that
+// skipped it, so they are reported whether or not the cache skipped the page.
+// They come from ctx.RenderCache if it has them for the output at
+// outputPath, last modified at outputModTime; otherwise the page is rendered
+// without being written, and the cache filled. Returns the number of items
+// safe mode stripped.
+func replayRenderDiagnostics(fi FileInfo, ctx BuildContext, uuidToPath map[UUID]HeaderLocation, procFiles *ProcessedFiles, outputPath string, outputModTime time.Time) int {
+	if entry, ok := ctx.RenderCache.lookup(fi.Path, outputModTime); ok {
+		for _, diag := range entry.Diagnostics {
+			ctx.Diagnostics.report(diag)
+		}
+		return entry.Stripped
+	}
+	ctx.Diagnostics = ctx.Diagnostics.recorder()
+	writer := newPageWriter(fi.ParsedOrg, fi, ctx, uuidToPath, procFiles)
+	if _, err := fi.ParsedOrg.Write(writer); err == nil && ctx.DryRun == nil {
+		ctx.RenderCache.store(fi.Path, outputPath, writer.safe.stripped, ctx.Diagnostics.Entries())
+	}
+	return writer.safe.stripped
 }
 
 type uuidReplacingWriter struct {
 	*org.HTMLWriter
 	uuidToPath  map[UUID]HeaderLocation
 	currentPath string
+	root        string
+	attachIDDir string
+	attachDirs  []string
+	images      map[string]ImageInfo
+	widthHint   int
+	equations   int
+	citations   *citationRenderer
+	timestamps  bool
+	macros      *macroExpander
+	procFiles   *ProcessedFiles
+
+	unpublishedLinks     string
+	unpublishedLinkTitle string
+	safe                 htmlSanitizer
+	diagnostics          *Diagnostics
+	position             *sourcePosition
 }
 
 func (w *uuidReplacingWriter) WriterWithExtensions() org.Writer {
 	return w
 }
 
+// WriteHeadline tracks the attachment directory of the headline being written
+// so that attachment: links in its body resolve against it, and the headline
+// itself for {{{property(...)}}} macros.
+func (w *uuidReplacingWriter) WriteHeadline(h org.Headline) {
+	w.attachDirs = append(w.attachDirs, attachmentDirOf(h.Properties, w.attachDirs[len(w.attachDirs)-1], w.attachIDDir))
+	w.macros.headlines = append(w.macros.headlines, h)
+	w.position.enter(h)
+	w.HTMLWriter.WriteHeadline(h)
+	w.position.leave()
+	w.macros.headlines = w.macros.headlines[:len(w.macros.headlines)-1]
+	w.attachDirs = w.attachDirs[:len(w.attachDirs)-1]
+}
+
+// WriteNodeWithMeta makes an #+ATTR_HTML: :width available to the image it
+// annotates, so the image's height and sizes can be scaled to match, and
+// makes its :width and :height valid HTML.
+func (w *uuidReplacingWriter) WriteNodeWithMeta(n org.NodeWithMeta) {
+	n.Meta = w.safe.sanitizeMeta(htmlSizeAttributes(n.Meta))
+	w.widthHint = imageWidthHint(n.Meta)
+	w.HTMLWriter.WriteNodeWithMeta(n)
+	w.widthHint = 0
+}
+
+// WriteInlineBlock renders src_lang{...} as highlighted inline code. go-org
+// wraps it in a <div>, which would split the surrounding paragraph.
+func (w *uuidReplacingWriter) WriteInlineBlock(b org.InlineBlock) {
+	if w.safe.stripInlineBlock(b) {
+		return
+	}
+	if b.Name != "src" || len(b.Parameters) == 0 {
+		w.HTMLWriter.WriteInlineBlock(b)
+		return
+	}
+	var source strings.Builder
+	for _, child := range b.Children {
+		if text, ok := child.(org.Text); ok {
+			source.WriteString(text.Content)
+		}
+	}
+	lang := strings.ToLower(b.Parameters[0])
+	w.WriteString(fmt.Sprintf(`<code class="src src-inline src-%s">%s</code>`, html.EscapeString(lang), w.HighlightCodeBlock(source.String(), lang, true, nil)))
+}
+
+// WriteLatexFragment renders $...$, \(...\), \[...\] and inline
+// environments as MathML. Fragments outside the supported TeX subset are kept
+// as TeX so that a client-side renderer can still pick them up.
+func (w *uuidReplacingWriter) WriteLatexFragment(l org.LatexFragment) {
+	tex := org.String(l.Content...)
+	if strings.HasPrefix(l.OpeningPair, `\begin{`) {
+		tex = l.OpeningPair + tex + l.ClosingPair
+	}
+	display := l.OpeningPair != "$" && l.OpeningPair != `\(`
+	math, err := renderMath(tex, display, &w.equations)
+	if err == nil {
+		w.WriteString(math)
+		return
+	}
+	w.diagnostics.Warn("math-fallback", w.currentPath, w.position.line(tex), "keeping LaTeX fragment as TeX: %v", err)
+	w.WriteString(`<span class="math-fallback">`)
+	w.HTMLWriter.WriteLatexFragment(l)
+	w.WriteString("</span>")
+}
+
+// WriteLatexBlock renders a \begin{...} block as display MathML, falling back
+// to TeX like WriteLatexFragment.
+func (w *uuidReplacingWriter) WriteLatexBlock(b org.LatexBlock) {
+	tex := org.String(b.Content...)
+	math, err := renderMath(tex, true, &w.equations)
+	if err == nil {
+		w.WriteString(math + "\n")
+		return
+	}
+	w.diagnostics.Warn("math-fallback", w.currentPath, w.position.line(strings.TrimSpace(strings.SplitN(tex, "\n", 2)[0])), "keeping LaTeX block as TeX: %v", err)
+	w.WriteString(`<div class="math-fallback">` + "\n")
+	w.HTMLWriter.WriteLatexBlock(b)
+	w.WriteString("</div>\n")
+}
+
 func (w *uuidReplacingWriter) WriteRegularLink(link org.RegularLink) {
+	if link.Protocol == "attachment" {
+		attachDir := w.attachDirs[len(w.attachDirs)-1]
+		if relPath, err := resolveAttachment(w.root, w.currentPath, attachDir, link.URL); err == nil {
+			if target, err := filepath.Rel(filepath.Dir(w.currentPath), relPath); err == nil {
+				link.Protocol = "file"
+				link.URL = "file:" + filepath.ToSlash(target)
+			}
+		}
+	}
+	if link.Description == nil && link.Kind() == "image" {
+		if relPath, ok := localLinkTarget(link, w.currentPath); ok {
+			if info, ok := w.images[relPath]; ok {
+				w.WriteString(responsiveImageTag(info, filepath.Dir(w.currentPath), filepath.Base(relPath), w.widthHint))
+				return
+			}
+		}
+	}
+	if w.procFiles.linksToUnpublished(link) || w.procFiles.linksToPrivate(link) {
+		w.writeUnpublishedLink(link)
+		return
+	}
 	if link.Protocol == "id" && strings.HasPrefix(link.URL, "id:") {
 		uuidStr := strings.TrimPrefix(link.URL, "id:")
 		if len(uuidStr) >= 36 && isValidUUID(uuidStr) {
@@ -258,16 +466,123 @@ func (w *uuidReplacingWriter) WriteRegularLink(link org.RegularLink) {
 			}
 		}
 	}
-	w.HTMLWriter.WriteRegularLink(link)
+	w.safe.writeRegularLink(w.HTMLWriter, link)
 }
 
-func convertOrgToHTMLWithLinkReplacement(doc *org.Document, fi FileInfo, uuidToPath map[UUID]HeaderLocation) (string, error) {
+// WriteText expands macro calls go-org leaves as text, and renders org-cite
+// citations and timestamps with a time range, which go-org also leaves as
+// text.
+func (w *uuidReplacingWriter) WriteText(t org.Text) {
+	if t.IsRaw {
+		w.HTMLWriter.WriteText(t)
+		return
+	}
+	if reMacroCall.MatchString(t.Content) {
+		w.writeMacroText(t.Content, w.writeText)
+		return
+	}
+	w.writeText(t.Content)
+}
+
+func (w *uuidReplacingWriter) writeText(s string) {
+	if !reCitation.MatchString(s) && !reTimeRange.MatchString(s) {
+		w.HTMLWriter.WriteText(org.Text{Content: s})
+		return
+	}
+	last := 0
+	for _, m := range reTimeRange.FindAllStringSubmatchIndex(s, -1) {
+		w.writeCitations(s[last:m[0]])
+		if w.timestamps {
+			datetime := s[m[2]:m[3]] + "T" + s[m[4]:m[5]]
+			w.WriteString(fmt.Sprintf(`<time class="timestamp" datetime="%s">%s</time>`, datetime, html.EscapeString(s[m[0]:m[1]])))
+		}
+		last = m[1]
+	}
+	w.writeCitations(s[last:])
+}
+
+func (w *uuidReplacingWriter) writeCitations(s string) {
+	if s == "" {
+		return
+	}
+	w.citations.renderText(s,
+		func(s string) { w.HTMLWriter.WriteText(org.Text{Content: s}) },
+		func(s string) { w.WriteString(s) })
+}
+
+// WriteTimestamp wraps timestamps in <time datetime="..."> so their dates
+// are machine-readable.
+func (w *uuidReplacingWriter) WriteTimestamp(t org.Timestamp) {
+	if !w.timestamps {
+		return
+	}
+	datetime, text := t.Time.Format("2006-01-02T15:04"), t.Time.Format("2006-01-02 Mon 15:04")
+	if t.IsDate {
+		datetime, text = t.Time.Format("2006-01-02"), t.Time.Format("2006-01-02 Mon")
+	}
+	if t.Interval != "" {
+		text += " " + t.Interval
+	}
+	w.WriteString(fmt.Sprintf(`<time class="timestamp" datetime="%s">&lt;%s&gt;</time>`, datetime, text))
+}
+
+// WriteKeyword places the bibliography where #+PRINT_BIBLIOGRAPHY: appears.
+func (w *uuidReplacingWriter) WriteKeyword(k org.Keyword) {
+	if w.safe.stripKeyword(k) {
+		return
+	}
+	if k.Key == "PRINT_BIBLIOGRAPHY" {
+		w.WriteString(w.citations.bibliography())
+		return
+	}
+	w.HTMLWriter.WriteKeyword(k)
+}
+
+// After appends the bibliography to pages that cite works but don't place
+// it themselves.
+func (w *uuidReplacingWriter) After(d *org.Document) {
+	if !w.citations.printed {
+		w.WriteString(w.citations.bibliography())
+	}
+	w.HTMLWriter.After(d)
+}
+
+func convertOrgToHTMLWithLinkReplacement(doc *org.Document, fi FileInfo, ctx BuildContext, uuidToPath map[UUID]HeaderLocation, procFiles *ProcessedFiles) (string, error) {
+	return doc.Write(newPageWriter(doc, fi, ctx, uuidToPath, procFiles))
+}
+
+// newPageWriter returns the writer for fi's page, which is doc.
+func newPageWriter(doc *org.Document, fi FileInfo, ctx BuildContext, uuidToPath map[UUID]HeaderLocation, procFiles *ProcessedFiles) *uuidReplacingWriter {
+	var images map[string]ImageInfo
+	if procFiles != nil {
+		images = procFiles.Images
+	}
 	htmlWriter := org.NewHTMLWriter()
+	htmlWriter.HighlightCodeBlock = codeHighlighter(ctx)
 	writer := &uuidReplacingWriter{
 		HTMLWriter:  htmlWriter,
 		uuidToPath:  uuidToPath,
 		currentPath: fi.Path,
+		root:        ctx.Root,
+		attachIDDir: attachIDDir(ctx),
+		attachDirs:  []string{fileAttachmentDir(doc, attachIDDir(ctx))},
+		images:      images,
+		citations:   newCitationRenderer(fi, ctx, procFiles),
+		timestamps:  doc.GetOption("<") != "nil",
+		macros:      newMacroExpander(doc, fi, ctx, uuidToPath, procFiles),
+		procFiles:   procFiles,
+
+		unpublishedLinks:     ctx.UnpublishedLinks,
+		unpublishedLinkTitle: ctx.UnpublishedLinkTitle,
+		safe:                 htmlSanitizer{enabled: ctx.SafeMode, path: fi.Path, diagnostics: ctx.Diagnostics},
+		diagnostics:          ctx.Diagnostics,
 	}
+	// The sanitizer, citations and macros report diagnostics at the
+	// writer's position.
+	writer.position = newSourcePosition(ctx.Diagnostics, fi.Path)
+	writer.safe.position = writer.position
+	writer.citations.position = writer.position
+	writer.macros.position = writer.position
 	htmlWriter.ExtendingWriter = writer
-	return doc.Write(writer)
+	return writer
 }
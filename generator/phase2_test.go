@@ -12,16 +12,16 @@ func TestSetupTemplates_Embedded(t *testing.T) {
 	tmpDir := MustCreateTempDir(t, "test-templates-")
 	defer CleanupTempDir(tmpDir)
 
-	pageTmpl, tagTmpl, indexTmpl, atomTmpl, modTime, err := SetupTemplates(tmpDir)
+	tmpls, err := SetupTemplates(tmpDir)
 	if err != nil {
 		t.Fatalf("SetupTemplates() error = %v", err)
 	}
 
-	if pageTmpl == nil || tagTmpl == nil || indexTmpl == nil || atomTmpl == nil {
+	if tmpls.Page == nil || tmpls.Tag == nil || tmpls.Index == nil || tmpls.Atom == nil || tmpls.TheIndex == nil || tmpls.Events == nil {
 		t.Error("SetupTemplates() returned nil template(s)")
 	}
 
-	if modTime.IsZero() {
+	if tmpls.ModTime.IsZero() {
 		t.Error("SetupTemplates() returned zero modification time")
 	}
 }
@@ -44,16 +44,16 @@ func TestSetupTemplates_Custom(t *testing.T) {
 	os.WriteFile(filepath.Join(templatesDir, "index-page-template.html"), []byte(indexTmpl), 0644)
 	os.WriteFile(filepath.Join(templatesDir, "atom-template.xml"), []byte("<?xml version=\"1.0\"?>"), 0644)
 
-	page, tag, index, atom, modTime, err := SetupTemplates(tmpDir)
+	tmpls, err := SetupTemplates(tmpDir)
 	if err != nil {
 		t.Fatalf("SetupTemplates() error = %v", err)
 	}
 
-	if page == nil || tag == nil || index == nil || atom == nil {
+	if tmpls.Page == nil || tmpls.Tag == nil || tmpls.Index == nil || tmpls.Atom == nil || tmpls.TheIndex == nil || tmpls.Events == nil {
 		t.Error("SetupTemplates() returned nil template(s)")
 	}
 
-	if modTime.IsZero() {
+	if tmpls.ModTime.IsZero() {
 		t.Error("SetupTemplates() returned zero modification time")
 	}
 }
@@ -68,14 +68,14 @@ func TestSetupTemplates_InvalidCustom(t *testing.T) {
 	// Create invalid template
 	os.WriteFile(filepath.Join(templatesDir, "base-template.html"), []byte("{{.Invalid"), 0644)
 
-	_, _, _, _, _, err := SetupTemplates(tmpDir)
+	_, err := SetupTemplates(tmpDir)
 	if err == nil {
 		t.Error("SetupTemplates() expected error for invalid template, got nil")
 	}
 }
 
 func TestExecuteTemplates_Embedded(t *testing.T) {
-	pageTmpl, tagTmpl, indexTmpl, _, _, err := SetupTemplates("/nonexistent") // Force embedded
+	tmpls, err := SetupTemplates("/nonexistent") // Force embedded
 	if err != nil {
 		t.Fatalf("SetupTemplates() error = %v", err)
 	}
@@ -92,7 +92,7 @@ func TestExecuteTemplates_Embedded(t *testing.T) {
 		}
 
 		var buf bytes.Buffer
-		if err := pageTmpl.ExecuteTemplate(&buf, "page-template.html", data); err != nil {
+		if err := tmpls.Page.ExecuteTemplate(&buf, "page-template.html", data); err != nil {
 			t.Errorf("Page template execution failed: %v", err)
 		}
 
@@ -114,7 +114,7 @@ func TestExecuteTemplates_Embedded(t *testing.T) {
 		}
 
 		var buf bytes.Buffer
-		if err := tagTmpl.ExecuteTemplate(&buf, "tag-page-template.html", data); err != nil {
+		if err := tmpls.Tag.ExecuteTemplate(&buf, "tag-page-template.html", data); err != nil {
 			t.Errorf("Tag template execution failed: %v", err)
 		}
 
@@ -137,7 +137,7 @@ func TestExecuteTemplates_Embedded(t *testing.T) {
 		}
 
 		var buf bytes.Buffer
-		if err := indexTmpl.ExecuteTemplate(&buf, "index-page-template.html", data); err != nil {
+		if err := tmpls.Index.ExecuteTemplate(&buf, "index-page-template.html", data); err != nil {
 			t.Errorf("Index template execution failed: %v", err)
 		}
 
@@ -171,7 +171,7 @@ func TestExecuteTemplates_Custom(t *testing.T) {
 	os.WriteFile(filepath.Join(templatesDir, "index-page-template.html"), []byte(indexContents), 0644)
 	os.WriteFile(filepath.Join(templatesDir, "atom-template.xml"), []byte(atomContents), 0644)
 
-	pageTmpl, tagTmpl, indexTmpl, _, _, err := SetupTemplates(tmpDir)
+	tmpls, err := SetupTemplates(tmpDir)
 	if err != nil {
 		t.Fatalf("SetupTemplates() error = %v", err)
 	}
@@ -188,7 +188,7 @@ func TestExecuteTemplates_Custom(t *testing.T) {
 		}
 
 		var buf bytes.Buffer
-		if err := pageTmpl.ExecuteTemplate(&buf, "page-template.html", data); err != nil {
+		if err := tmpls.Page.ExecuteTemplate(&buf, "page-template.html", data); err != nil {
 			t.Errorf("Custom page template execution failed: %v", err)
 		}
 
@@ -218,7 +218,7 @@ func TestExecuteTemplates_Custom(t *testing.T) {
 		}
 
 		var buf bytes.Buffer
-		if err := tagTmpl.ExecuteTemplate(&buf, "tag-page-template.html", data); err != nil {
+		if err := tmpls.Tag.ExecuteTemplate(&buf, "tag-page-template.html", data); err != nil {
 			t.Errorf("Custom tag template execution failed: %v", err)
 		}
 
@@ -246,7 +246,7 @@ func TestExecuteTemplates_Custom(t *testing.T) {
 		}
 
 		var buf bytes.Buffer
-		if err := indexTmpl.ExecuteTemplate(&buf, "index-page-template.html", data); err != nil {
+		if err := tmpls.Index.ExecuteTemplate(&buf, "index-page-template.html", data); err != nil {
 			t.Errorf("Custom index template execution failed: %v", err)
 		}
 
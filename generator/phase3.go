@@ -6,83 +6,60 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
-	"sort"
-	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/niklasfasching/go-org/org"
 )
 
 // GenerateTagPages creates a tag-*.html page for each unique tag, listing all files
 // bearing that tag. Writes output to ctx.DestDir. Returns a GenerationResult.
+//
+// A tag page lists the titles and previews of its notes, so it is always
+// rendered and only written when it changed.
 func GenerateTagPages(procFiles *ProcessedFiles, ctx BuildContext, tmpl *template.Template) (result GenerationResult) {
 	slog.Debug("Starting Phase 3a: generating tag pages")
 
 	publicDir := ctx.DestDir
 
-	var wg sync.WaitGroup
 	var tagPagesGenerated int64
 	var errors int64
 
-	procFiles.TagMap.Range(func(key, value any) bool {
-		tag, ok := key.(string)
-		if !ok {
-			slog.Warn("Warning: unexpected type in TagMap key", "key", key)
-			return true
+	tags := procFiles.Index.Tags()
+	ctx.Pool.Run(len(tags), func(i int) {
+		tag := tags[i]
+		files := procFiles.Index.FilesWithTag(tag)
+		sortByRecency(files)
+
+		outputPath := filepath.Join(publicDir, "tag-"+tag+".html")
+
+		tagData := TagPageData{
+			Title:        tag,
+			Files:        files,
+			SiteName:     ctx.SiteName,
+			BaseURL:      ctx.BaseURL,
+			DefaultImage: ctx.DefaultImage,
+			Author:       ctx.Author,
+			LicenseName:  ctx.LicenseName,
+			LicenseURL:   ctx.LicenseURL,
+			Data:         procFiles.Data,
 		}
-		files, ok := value.([]FileInfo)
-		if !ok {
-			slog.Warn("Warning: unexpected type in TagMap value", "tag", tag, "value", value)
-			return true
-		}
-
-		wg.Add(1)
-		go func(tag string, files []FileInfo) {
-			defer wg.Done()
-
-			outputPath := filepath.Join(publicDir, "tag-"+tag+".html")
-
-			if !ctx.ForceRebuild {
-				if htmlInfo, err := os.Stat(outputPath); err == nil {
-					if !ctx.TmplModTime.After(htmlInfo.ModTime()) {
-						return
-					}
-				}
-			}
 
-			tagData := TagPageData{
-				Title:        tag,
-				Files:        files,
-				SiteName:     ctx.SiteName,
-				BaseURL:      ctx.BaseURL,
-				DefaultImage: ctx.DefaultImage,
-				Author:       ctx.Author,
-				LicenseName:  ctx.LicenseName,
-				LicenseURL:   ctx.LicenseURL,
-			}
-
-			var outputBuf bytes.Buffer
-			if err := tmpl.ExecuteTemplate(&outputBuf, "tag-page-template.html", tagData); err != nil {
-				slog.Warn("Failed to execute tag template", "tag", tag, "error", err)
-				atomic.AddInt64(&errors, 1)
-				return
-			}
-
-			if err := os.WriteFile(outputPath, outputBuf.Bytes(), 0644); err != nil {
-				slog.Warn("Failed to write tag page", "path", outputPath, "error", err)
-				atomic.AddInt64(&errors, 1)
-			} else {
-				slog.Debug("Generated tag page", "tag", tag, "path", outputPath, "file_count", len(files))
-				atomic.AddInt64(&tagPagesGenerated, 1)
-			}
-		}(tag, files)
+		var outputBuf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&outputBuf, "tag-page-template.html", tagData); err != nil {
+			ctx.Diagnostics.Error("template", "", 0, "failed to execute tag-page-template.html for tag %s: %v", tag, err)
+			atomic.AddInt64(&errors, 1)
+			return
+		}
 
-		return true
+		if wrote, err := writeIfChanged(ctx, outputPath, outputBuf.Bytes()); err != nil {
+			ctx.Diagnostics.Error("output", "", 0, "failed to write %s: %v", outputPath, err)
+			atomic.AddInt64(&errors, 1)
+		} else if wrote {
+			slog.Debug("Generated tag page", "tag", tag, "path", outputPath, "file_count", len(files))
+			atomic.AddInt64(&tagPagesGenerated, 1)
+		}
 	})
 
-	wg.Wait()
-
 	slog.Debug("Phase 3a complete", "tag_pages_generated", tagPagesGenerated, "errors", errors)
 
 	result.TagPagesGenerated = int(tagPagesGenerated)
@@ -92,29 +69,21 @@ func GenerateTagPages(procFiles *ProcessedFiles, ctx BuildContext, tmpl *templat
 
 // GenerateIndexPage builds the site index (index.html) displaying the five most recent
 // files, all tags with file counts, and the sitemap preamble content. Returns a GenerationResult.
+//
+// The index page depends on every published note, including ones that were
+// edited, added or removed since the last build, so it is always rendered and
+// only written when it changed.
 func GenerateIndexPage(procFiles *ProcessedFiles, ctx BuildContext, tmpl *template.Template) (result GenerationResult) {
 	slog.Debug("Starting Phase 3b: generating index page")
 
 	publicDir := ctx.DestDir
 	outputPath := filepath.Join(publicDir, "index.html")
 
-	if !ctx.ForceRebuild {
-		if htmlInfo, err := os.Stat(outputPath); err == nil {
-			if !ctx.TmplModTime.After(htmlInfo.ModTime()) {
-				slog.Debug("Skipping index page: cache valid")
-				result.FilesSkipped = 1
-				return
-			}
-		}
-	}
-
 	recentFiles := make([]FileInfo, 0, 5)
 	if len(procFiles.Files) > 0 {
 		sorted := make([]FileInfo, len(procFiles.Files))
 		copy(sorted, procFiles.Files)
-		sort.Slice(sorted, func(i, j int) bool {
-			return sorted[i].ModTime.After(sorted[j].ModTime)
-		})
+		sortByRecency(sorted)
 		if len(sorted) > 5 {
 			recentFiles = sorted[:5]
 		} else {
@@ -122,27 +91,7 @@ func GenerateIndexPage(procFiles *ProcessedFiles, ctx BuildContext, tmpl *templa
 		}
 	}
 
-	var tags []TagInfo
-	procFiles.TagMap.Range(func(key, value any) bool {
-		tag, ok := key.(string)
-		if !ok {
-			slog.Warn("Warning: unexpected type in TagMap key", "key", key)
-			return true
-		}
-		files, ok := value.([]FileInfo)
-		if !ok {
-			slog.Warn("Warning: unexpected type in TagMap value", "tag", tag, "value", value)
-			return true
-		}
-		tags = append(tags, TagInfo{
-			Name:  tag,
-			Count: len(files),
-		})
-		return true
-	})
-	sort.Slice(tags, func(i, j int) bool {
-		return tags[i].Name < tags[j].Name
-	})
+	tags := procFiles.Index.TagCounts()
 
 	var preambleContent template.HTML
 	preamblePath := filepath.Join(ctx.Root, "sitemap-preamble.org")
@@ -152,10 +101,11 @@ func GenerateIndexPage(procFiles *ProcessedFiles, ctx BuildContext, tmpl *templa
 			"OPTIONS": "toc:nil <:t e:t f:t pri:t todo:t tags:t title:t ealb:nil",
 		}
 		doc := conf.Parse(bytes.NewReader(data), "sitemap-preamble.org")
-		writer := org.NewHTMLWriter()
+		writer := newQueryWriter(procFiles, "sitemap-preamble.org", ctx.SafeMode, ctx.Diagnostics)
 		if htmlContent, err := doc.Write(writer); err == nil {
 			preambleContent = template.HTML(htmlContent)
 		}
+		result.UnsafeStripped = writer.safe.stripped
 	}
 
 	indexData := IndexPageData{
@@ -168,20 +118,27 @@ func GenerateIndexPage(procFiles *ProcessedFiles, ctx BuildContext, tmpl *templa
 		Author:       ctx.Author,
 		LicenseName:  ctx.LicenseName,
 		LicenseURL:   ctx.LicenseURL,
+		Data:         procFiles.Data,
 	}
 
 	var outputBuf bytes.Buffer
 	if err := tmpl.ExecuteTemplate(&outputBuf, "index-page-template.html", indexData); err != nil {
-		slog.Warn("Failed to execute index template", "error", err)
+		ctx.Diagnostics.Error("template", "", 0, "failed to execute index-page-template.html: %v", err)
 		result.Errors = 1
 		return
 	}
 
-	if err := os.WriteFile(outputPath, outputBuf.Bytes(), 0644); err != nil {
-		slog.Warn("Failed to write index page", "error", err)
+	wrote, err := writeIfChanged(ctx, outputPath, outputBuf.Bytes())
+	if err != nil {
+		ctx.Diagnostics.Error("output", "", 0, "failed to write %s: %v", outputPath, err)
 		result.Errors = 1
 		return
 	}
+	if !wrote {
+		slog.Debug("Skipping index page: unchanged")
+		result.FilesSkipped = 1
+		return
+	}
 
 	slog.Debug("Phase 3b complete: generated index page", "path", outputPath, "recent_files", len(recentFiles), "tags", len(tags))
 
@@ -191,35 +148,20 @@ func GenerateIndexPage(procFiles *ProcessedFiles, ctx BuildContext, tmpl *templa
 
 // GenerateAtomFeed creates an Atom feed with the most recent files.
 // Writes output to ctx.DestDir/feed.xml. Returns a GenerationResult.
+//
+// Like the index page, the feed is always rendered and only written when it
+// changed.
 func GenerateAtomFeed(procFiles *ProcessedFiles, ctx BuildContext, tmpl *template.Template) (result GenerationResult) {
 	slog.Debug("Starting Phase 3d: generating Atom feed")
 
 	publicDir := ctx.DestDir
 	outputPath := filepath.Join(publicDir, "feed.xml")
 
-	if !ctx.ForceRebuild {
-		if feedInfo, err := os.Stat(outputPath); err == nil {
-			oldestFileTime := time.Now()
-			for _, fi := range procFiles.Files {
-				if fi.ModTime.Before(oldestFileTime) {
-					oldestFileTime = fi.ModTime
-				}
-			}
-			if !oldestFileTime.After(feedInfo.ModTime()) && !ctx.TmplModTime.After(feedInfo.ModTime()) {
-				slog.Debug("Skipping Atom feed: cache valid")
-				result.FilesSkipped = 1
-				return
-			}
-		}
-	}
-
 	recentFiles := make([]FileInfo, 0, 20)
 	if len(procFiles.Files) > 0 {
 		sorted := make([]FileInfo, len(procFiles.Files))
 		copy(sorted, procFiles.Files)
-		sort.Slice(sorted, func(i, j int) bool {
-			return sorted[i].ModTime.After(sorted[j].ModTime)
-		})
+		sortByRecency(sorted)
 		if len(sorted) > 20 {
 			recentFiles = sorted[:20]
 		} else {
@@ -227,26 +169,38 @@ func GenerateAtomFeed(procFiles *ProcessedFiles, ctx BuildContext, tmpl *templat
 		}
 	}
 
+	// The feed was last updated when its newest entry was.
+	updated := buildTime(ctx)
+	if len(recentFiles) > 0 {
+		updated = recentFiles[0].ModTime
+	}
+
 	feedData := AtomFeedData{
 		SiteName: ctx.SiteName,
 		BaseURL:  ctx.BaseURL,
-		Updated:  time.Now(),
+		Updated:  updated,
 		Files:    recentFiles,
 		Author:   ctx.Author,
 	}
 
 	var outputBuf bytes.Buffer
 	if err := tmpl.ExecuteTemplate(&outputBuf, "atom-template.xml", feedData); err != nil {
-		slog.Warn("Failed to execute Atom template", "error", err)
+		ctx.Diagnostics.Error("template", "", 0, "failed to execute atom-template.xml: %v", err)
 		result.Errors = 1
 		return
 	}
 
-	if err := os.WriteFile(outputPath, outputBuf.Bytes(), 0644); err != nil {
-		slog.Warn("Failed to write Atom feed", "error", err)
+	wrote, err := writeIfChanged(ctx, outputPath, outputBuf.Bytes())
+	if err != nil {
+		ctx.Diagnostics.Error("output", "", 0, "failed to write %s: %v", outputPath, err)
 		result.Errors = 1
 		return
 	}
+	if !wrote {
+		slog.Debug("Skipping Atom feed: unchanged")
+		result.FilesSkipped = 1
+		return
+	}
 
 	slog.Debug("Phase 3d complete: generated Atom feed", "path", outputPath, "entries", len(recentFiles))
 
@@ -269,13 +223,7 @@ func CopyStaticFiles(_ *ProcessedFiles, ctx BuildContext) (result GenerationResu
 			slog.Debug("No static directory found, skipping", "path", staticDir)
 			return
 		}
-		slog.Warn("Error reading static directory", "error", err)
-		result.Errors = 1
-		return
-	}
-
-	if err := os.MkdirAll(publicDir, 0755); err != nil {
-		slog.Warn("Failed to create public directory", "error", err)
+		ctx.Diagnostics.Error("source-read", "static", 0, "failed to read the static directory: %v", err)
 		result.Errors = 1
 		return
 	}
@@ -288,8 +236,8 @@ func CopyStaticFiles(_ *ProcessedFiles, ctx BuildContext) (result GenerationResu
 		srcPath := filepath.Join(staticDir, entry.Name())
 		dstPath := filepath.Join(publicDir, entry.Name())
 
-		if err := copyFile(srcPath, dstPath); err != nil {
-			slog.Warn("Failed to copy file", "name", entry.Name(), "error", err)
+		if err := copyFile(ctx, srcPath, dstPath); err != nil {
+			ctx.Diagnostics.Error("output", filepath.Join("static", entry.Name()), 0, "failed to copy static file: %v", err)
 			result.Errors++
 		} else {
 			slog.Debug("Copied static file", "name", entry.Name())
@@ -299,3 +247,47 @@ func CopyStaticFiles(_ *ProcessedFiles, ctx BuildContext) (result GenerationResu
 	slog.Debug("Phase 3c complete", "files_copied", result.StaticFilesCopied, "errors", result.Errors)
 	return
 }
+
+// CopyAttachments copies every file referenced by an attachment: link into
+// ctx.DestDir, mirroring its location in the source tree so the rewritten
+// links resolve. Attachments whose copy is up to date are skipped.
+func CopyAttachments(procFiles *ProcessedFiles, ctx BuildContext) (result GenerationResult) {
+	slog.Debug("Starting Phase 3e: copying attachments")
+
+	copied := map[string]bool{}
+	for _, fi := range procFiles.Files {
+		for _, relPath := range fi.Attachments {
+			if copied[relPath] {
+				continue
+			}
+			copied[relPath] = true
+
+			srcPath := filepath.Join(ctx.Root, relPath)
+			dstPath := filepath.Join(ctx.DestDir, relPath)
+
+			srcInfo, err := os.Stat(srcPath)
+			if err != nil {
+				ctx.Diagnostics.Error("attachment-missing", fi.Path, ctx.Diagnostics.Line(fi.Path, filepath.Base(relPath)), "missing attachment %s: %v", relPath, err)
+				result.Errors++
+				continue
+			}
+			if !ctx.ForceRebuild {
+				if dstInfo, err := os.Stat(dstPath); err == nil && !srcInfo.ModTime().After(dstInfo.ModTime()) {
+					skipOutput(ctx, dstPath)
+					continue
+				}
+			}
+
+			if err := copyFile(ctx, srcPath, dstPath); err != nil {
+				ctx.Diagnostics.Error("output", relPath, 0, "failed to copy attachment: %v", err)
+				result.Errors++
+			} else {
+				slog.Debug("Copied attachment", "path", relPath)
+				result.AttachmentsCopied++
+			}
+		}
+	}
+
+	slog.Debug("Phase 3e complete", "attachments_copied", result.AttachmentsCopied, "errors", result.Errors)
+	return
+}
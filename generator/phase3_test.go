@@ -3,7 +3,6 @@ package generator
 import (
 	"os"
 	"path/filepath"
-	"sync"
 	"testing"
 )
 
@@ -12,9 +11,8 @@ func TestGenerateAtomFeed_Empty(t *testing.T) {
 	defer CleanupTempDir(tmpDir)
 
 	procFiles := &ProcessedFiles{
-		Files:   []FileInfo{},
-		UuidMap: sync.Map{},
-		TagMap:  sync.Map{},
+		Files: []FileInfo{},
+		Index: NewSiteIndex(nil),
 	}
 
 	ctx := BuildContext{
@@ -24,12 +22,12 @@ func TestGenerateAtomFeed_Empty(t *testing.T) {
 		SiteName:     "Test Site",
 	}
 
-	_, _, _, atomTmpl, _, err := SetupTemplates("/nonexistent")
+	tmpls, err := SetupTemplates("/nonexistent")
 	if err != nil {
 		t.Fatalf("SetupTemplates() error = %v", err)
 	}
 
-	result := GenerateAtomFeed(procFiles, ctx, atomTmpl)
+	result := GenerateAtomFeed(procFiles, ctx, tmpls.Atom)
 
 	if result.Errors != 0 {
 		t.Errorf("GenerateAtomFeed() errors = %v, want 0", result.Errors)
@@ -0,0 +1,320 @@
+package generator
+
+import (
+	"html"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// defaultPrivateTags are the private tags when the config sets none: org's
+// own crypt tag, and private.
+var defaultPrivateTags = []string{"private", "crypt"}
+
+// defaultPrivateProperties are the private properties when the config sets
+// none.
+var defaultPrivateProperties = []string{"PRIVATE"}
+
+// pgpArmorHeader starts the PGP armor org-crypt replaces an entry's body with.
+const pgpArmorHeader = "-----BEGIN PGP MESSAGE-----"
+
+// minPrivateSnippet is the shortest private text the leak check looks for;
+// shorter lines are too likely to appear in public text too.
+const minPrivateSnippet = 16
+
+// privacyRules decide which subtrees of a document are private.
+type privacyRules struct {
+	tags map[string]bool
+	// properties are KEY or KEY=VALUE terms. A bare KEY matches any value
+	// other than nil.
+	properties [][2]string
+
+	diagnostics *Diagnostics
+}
+
+// newPrivacyRules returns the rules for doc: the configured private tags and
+// properties, plus the document's EXCLUDE_TAGS.
+func newPrivacyRules(doc *org.Document, ctx BuildContext) privacyRules {
+	tags, properties := ctx.PrivateTags, ctx.PrivateProperties
+	if tags == nil {
+		tags = defaultPrivateTags
+	}
+	if properties == nil {
+		properties = defaultPrivateProperties
+	}
+	rules := privacyRules{tags: map[string]bool{}, diagnostics: ctx.Diagnostics}
+	for _, tag := range append(slices.Clone(tags), strings.Fields(doc.Get("EXCLUDE_TAGS"))...) {
+		rules.tags[tag] = true
+	}
+	for _, term := range properties {
+		key, value, _ := strings.Cut(term, "=")
+		rules.properties = append(rules.properties, [2]string{strings.ToUpper(strings.TrimSpace(key)), strings.TrimSpace(value)})
+	}
+	return rules
+}
+
+func (r privacyRules) matchesTags(tags []string) bool {
+	for _, tag := range tags {
+		if r.tags[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r privacyRules) matchesProperties(drawer *org.PropertyDrawer) bool {
+	if drawer == nil {
+		return false
+	}
+	for _, prop := range r.properties {
+		value, ok := drawer.Get(prop[0])
+		if !ok || value == "" || value == "nil" {
+			continue
+		}
+		if prop[1] == "" || value == prop[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivate reports whether h, and everything under it, is private. Comment
+// headlines are too, since org never exports them.
+func (r privacyRules) isPrivate(h org.Headline) bool {
+	return h.IsComment || r.matchesTags(h.Tags) || r.matchesProperties(headlineProperties(h))
+}
+
+// fileIsPrivate reports whether a whole file is private, through a private
+// tag in #+FILETAGS: or a private property in its file-level drawer.
+func (r privacyRules) fileIsPrivate(doc *org.Document) bool {
+	if r.matchesTags(strings.FieldsFunc(doc.Get("FILETAGS"), func(c rune) bool { return c == ':' || c == ' ' })) {
+		return true
+	}
+	for _, node := range doc.Nodes {
+		switch n := node.(type) {
+		case org.Headline:
+			return false
+		case org.PropertyDrawer:
+			if r.matchesProperties(&n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prunePrivate removes the private subtrees of doc, and anything else holding
+// PGP armor, from its nodes, outline and named nodes, so that nothing built
+// from doc can show them. It returns the text removed, for the leak check,
+// and the IDs removed, so that links to them can be degraded.
+func prunePrivate(doc *org.Document, rules privacyRules, filePath string) ([]string, []UUID) {
+	var removed []org.Node
+	var prune func(nodes []org.Node) []org.Node
+	prune = func(nodes []org.Node) []org.Node {
+		kept := make([]org.Node, 0, len(nodes))
+		for _, node := range nodes {
+			if h, ok := node.(org.Headline); ok {
+				if rules.isPrivate(h) {
+					removed = append(removed, h)
+					continue
+				}
+				h.Children = prune(h.Children)
+				node = h
+			} else if include, ok := node.(org.Include); ok && include.Resolve != nil {
+				// An included org file, spliced in as a drawer by
+				// expandIncludes, has headlines of its own.
+				resolved := include.Resolve()
+				if drawer, ok := resolved.(org.Drawer); ok {
+					drawer.Children = prune(drawer.Children)
+					resolved = drawer
+				}
+				include.Resolve = func() org.Node { return resolved }
+				node = include
+			} else if strings.Contains(org.String(node), pgpArmorHeader) {
+				// An encrypted entry whose headline lost its crypt tag.
+				rules.diagnostics.Warn("pgp-armor", filePath, rules.diagnostics.Line(filePath, pgpArmorHeader), "removed PGP armor outside an encrypted headline")
+				removed = append(removed, node)
+				continue
+			}
+			kept = append(kept, node)
+		}
+		return kept
+	}
+	doc.Nodes = prune(doc.Nodes)
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	var pruneSections func(sections []*org.Section) []*org.Section
+	pruneSections = func(sections []*org.Section) []*org.Section {
+		kept := make([]*org.Section, 0, len(sections))
+		for _, section := range sections {
+			if section.Headline != nil && rules.isPrivate(*section.Headline) {
+				continue
+			}
+			section.Children = pruneSections(section.Children)
+			kept = append(kept, section)
+		}
+		return kept
+	}
+	if doc.Outline.Section != nil {
+		doc.Outline.Children = pruneSections(doc.Outline.Children)
+	}
+
+	walkOrgNodes(removed, func(node org.Node) bool {
+		if named, ok := node.(org.NodeWithName); ok {
+			delete(doc.NamedNodes, named.Name)
+		}
+		return true
+	})
+	slog.Debug("Removed private subtrees", "path", filePath, "count", len(removed))
+	return privateSnippets(removed), privateIDs(removed)
+}
+
+// privateIDs returns the :ID: of every headline in nodes, and of a file-level
+// property drawer among them.
+func privateIDs(nodes []org.Node) []UUID {
+	var ids []UUID
+	add := func(drawer *org.PropertyDrawer) {
+		if drawer == nil {
+			return
+		}
+		if id, ok := drawer.Get("ID"); ok && id != "" {
+			ids = append(ids, UUID(id))
+		}
+	}
+	walkOrgNodes(nodes, func(node org.Node) bool {
+		switch n := node.(type) {
+		case org.Headline:
+			add(headlineProperties(n))
+		case org.PropertyDrawer:
+			add(&n)
+		}
+		return true
+	})
+	return ids
+}
+
+// linksToPrivate reports whether link is an id: link to a private file or
+// headline, which has no page to link to.
+func (procFiles *ProcessedFiles) linksToPrivate(link org.RegularLink) bool {
+	if procFiles == nil || len(procFiles.privateIDs) == 0 || link.Protocol != "id" {
+		return false
+	}
+	id := UUID(strings.TrimPrefix(link.URL, "id:"))
+	if _, ok := procFiles.Index.Lookup(id); ok {
+		return false
+	}
+	return procFiles.privateIDs[id]
+}
+
+// privateSnippets returns the lines of text in nodes long enough for the leak
+// check: headline titles, paragraph and block lines and table cells. The
+// leak check also uses it on public text, to skip lines that appear in both.
+func privateSnippets(nodes []org.Node) []string {
+	var snippets []string
+	add := func(text string) {
+		for _, line := range strings.Split(text, "\n") {
+			if line = normalizeLeakText(line); len([]rune(line)) >= minPrivateSnippet {
+				snippets = append(snippets, line)
+			}
+		}
+	}
+	walkOrgNodes(nodes, func(node org.Node) bool {
+		switch n := node.(type) {
+		case org.Headline:
+			add(plainText(n.Title))
+		case org.Paragraph:
+			add(plainText(n.Children))
+			return false
+		case org.Block:
+			add(org.String(n.Children...))
+			return false
+		case org.Example:
+			add(org.String(n.Children...))
+			return false
+		case org.Table:
+			for _, row := range n.Rows {
+				for _, column := range row.Columns {
+					add(plainText(column.Children))
+				}
+			}
+			return false
+		}
+		return true
+	})
+	return snippets
+}
+
+var (
+	reLeakTags       = regexp.MustCompile(`<[^>]*>`)
+	reLeakSpace      = regexp.MustCompile(`\s+`)
+	leakTextReplacer = strings.NewReplacer("—", "---", "–", "--", "…", "...", `\`, "")
+)
+
+// normalizeLeakText reduces text to what survives every output format: tags,
+// entities, escapes and typographic dashes are undone and whitespace is
+// collapsed.
+func normalizeLeakText(s string) string {
+	s = html.UnescapeString(reLeakTags.ReplaceAllString(s, " "))
+	return strings.TrimSpace(reLeakSpace.ReplaceAllString(leakTextReplacer.Replace(s), " "))
+}
+
+// leakCheckExtensions are the output files the leak check reads.
+var leakCheckExtensions = map[string]bool{
+	".html": true, ".xml": true, ".ics": true, ".json": true, ".csv": true, ".txt": true,
+}
+
+// CheckPrivateLeaks reads every text file under ctx.DestDir and reports each
+// one containing private text removed in phase 1, which fails the build.
+// Private lines that also appear in a public part of the site are not
+// checked. Leaks usually come from output written before a subtree became
+// private; rebuilding with --force replaces it.
+func CheckPrivateLeaks(procFiles *ProcessedFiles, ctx BuildContext) (result GenerationResult) {
+	slog.Debug("Starting Phase 3l: checking output for private text")
+
+	var public strings.Builder
+	for _, fi := range procFiles.Files {
+		if fi.ParsedOrg != nil {
+			public.WriteString(strings.Join(privateSnippets(fi.ParsedOrg.Nodes), "\n"))
+			public.WriteString("\n")
+		}
+	}
+	publicText := public.String()
+
+	type secret struct{ source, text string }
+	var secrets []secret
+	for _, private := range procFiles.privateText {
+		for _, text := range private.snippets {
+			if !strings.Contains(publicText, text) {
+				secrets = append(secrets, secret{private.path, text})
+			}
+		}
+	}
+	if len(secrets) == 0 {
+		return
+	}
+
+	readOutputFiles(ctx, leakCheckExtensions, func(path string, data []byte) {
+		text := normalizeLeakText(strings.ReplaceAll(string(data), "\r\n ", ""))
+		for _, s := range secrets {
+			if strings.Contains(text, s.text) {
+				// The text itself is not logged: logs are output too.
+				ctx.Diagnostics.Error("private-leak", s.source, 0, "private text found in %s", path)
+				result.PrivateLeaks++
+				break
+			}
+		}
+	})
+	slog.Debug("Phase 3l complete", "secrets", len(secrets), "leaks", result.PrivateLeaks)
+	return
+}
+
+// privateText is the text removed from one source file, as privateSnippets.
+type privateText struct {
+	path     string
+	snippets []string
+}
@@ -0,0 +1,228 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+const privateFixture = `#+title: Journal
+#+exclude_tags: draft
+
+Public introduction to the journal.
+
+* Public section
+:PROPERTIES:
+:ID: 3f2b8c1e-6a4d-4e2f-9b7a-1c2d3e4f5a6b
+:END:
+Published text about gardening.
+** Therapy notes :private:
+:PROPERTIES:
+:ID: 8d7c6b5a-4f3e-4d2c-8b1a-0f9e8d7c6b5a
+:END:
+Nobody should read these therapy notes.
+* Half-written thoughts :draft:
+The draft paragraph is unfinished.
+* Salary negotiation
+:PROPERTIES:
+:PRIVATE: t
+:END:
+Asking for a considerable raise.
+* COMMENT Reminder to self
+A commented-out reminder for later.
+* Passwords :crypt:
+-----BEGIN PGP MESSAGE-----
+hQEMA5ZxJZvVnSsyAQf/encrypted
+-----END PGP MESSAGE-----
+`
+
+func TestPrunePrivate(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-private-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "journal.org", privateFixture)
+	fi, err := processFile("journal.org", BuildContext{Root: tmpDir})
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+
+	var titles []string
+	for _, section := range fi.ParsedOrg.Outline.Children {
+		titles = append(titles, plainText(section.Headline.Title))
+		if len(section.Children) != 0 {
+			t.Errorf("section %q keeps %d private children", plainText(section.Headline.Title), len(section.Children))
+		}
+	}
+	if strings.Join(titles, "|") != "Public section" {
+		t.Errorf("outline = %q, want only the public section", titles)
+	}
+	body := org.String(fi.ParsedOrg.Nodes...)
+	for _, secret := range []string{"therapy notes", "draft paragraph", "considerable raise", "commented-out", "PGP MESSAGE"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("document still contains %q", secret)
+		}
+	}
+	if _, ok := fi.UUIDs["8d7c6b5a-4f3e-4d2c-8b1a-0f9e8d7c6b5a"]; ok {
+		t.Error("UUIDs include the private headline")
+	}
+	index := NewSiteIndex([]FileInfo{*fi})
+	if _, ok := index.Lookup(UUID("8d7c6b5a-4f3e-4d2c-8b1a-0f9e8d7c6b5a")); ok {
+		t.Error("Index includes the private headline")
+	}
+	if _, ok := index.Lookup(UUID("3f2b8c1e-6a4d-4e2f-9b7a-1c2d3e4f5a6b")); !ok {
+		t.Error("Index lacks the public headline")
+	}
+	if !strings.Contains(fi.Preview, "Public introduction") || strings.Contains(fi.Preview, "therapy") {
+		t.Errorf("Preview = %q", fi.Preview)
+	}
+	if !strings.Contains(strings.Join(fi.privateSnippets, "\n"), "Nobody should read these therapy notes.") {
+		t.Errorf("privateSnippets = %q", fi.privateSnippets)
+	}
+}
+
+func TestPrunePrivate_Includes(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-private-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "nested.org", "* Nested secret :private:\nThe nested include is private too.\n")
+	CreateTestOrgFile(tmpDir, "shared.org", "* Shared\nShared public text.\n** Shared secret :private:\nThe included diary is private.\n#+INCLUDE: \"nested.org\"\n")
+	CreateTestOrgFile(tmpDir, "main.org", "#+title: Main\n\nIntroduction.\n\n#+INCLUDE: \"shared.org\"\n")
+	ctx := BuildContext{Root: tmpDir}
+	fi, err := processFile("main.org", ctx)
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, *fi, ctx, nil, nil)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	if !strings.Contains(html, "Shared public text.") {
+		t.Errorf("include was not rendered: %s", html)
+	}
+	for _, secret := range []string{"Shared secret", "included diary", "Nested secret", "nested include"} {
+		if strings.Contains(html, secret) {
+			t.Errorf("HTML contains %q from a private subtree of an include", secret)
+		}
+	}
+	if !strings.Contains(strings.Join(fi.privateSnippets, "\n"), "The included diary is private.") {
+		t.Errorf("privateSnippets = %q", fi.privateSnippets)
+	}
+}
+
+func TestPrivacyRules(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-private-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "journal.org", privateFixture)
+	ctx := BuildContext{Root: tmpDir, PrivateTags: []string{"draft"}, PrivateProperties: []string{"VISIBILITY=hidden"}}
+	fi, err := processFile("journal.org", ctx)
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	body := org.String(fi.ParsedOrg.Nodes...)
+	// The configured rules replace the defaults, but comments, EXCLUDE_TAGS
+	// and PGP armor are always removed.
+	if !strings.Contains(body, "therapy notes") || !strings.Contains(body, "considerable raise") {
+		t.Error("configured rules should replace the default tags and properties")
+	}
+	for _, secret := range []string{"draft paragraph", "commented-out", "PGP MESSAGE"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("document still contains %q", secret)
+		}
+	}
+}
+
+func TestPrivateFiles(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-private-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "public.org", "#+title: Public\n* Heading :go:\nOpen text.\n")
+	CreateTestOrgFile(tmpDir, "tagged.org", "#+title: Tagged\n#+filetags: :private:\n* Heading :go:\nA private file's only paragraph.\n")
+	CreateTestOrgFile(tmpDir, "drawer.org", ":PROPERTIES:\n:ID: c1d2e3f4-a5b6-4c7d-8e9f-0a1b2c3d4e5f\n:PRIVATE: t\n:END:\n#+title: Drawer\n")
+
+	procFiles, result := FindAndProcessOrgFiles(nil, BuildContext{Root: tmpDir})
+	if result.TotalFilesScanned != 3 || len(procFiles.Files) != 1 || procFiles.Files[0].Path != "public.org" {
+		t.Fatalf("Files = %v, result = %+v", procFiles.Files, result)
+	}
+	if files := procFiles.Index.FilesWithTag("go"); len(files) != 1 {
+		t.Errorf("FilesWithTag(go) = %v", files)
+	}
+	if _, ok := procFiles.Index.Lookup(UUID("c1d2e3f4-a5b6-4c7d-8e9f-0a1b2c3d4e5f")); ok {
+		t.Error("Index includes a private file")
+	}
+	if len(procFiles.privateText) != 1 || procFiles.privateText[0].path != "tagged.org" {
+		t.Errorf("privateText = %v", procFiles.privateText)
+	}
+}
+
+func TestLinksToPrivate(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-private-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "journal.org", privateFixture)
+	CreateTestOrgFile(tmpDir, "drawer.org", ":PROPERTIES:\n:ID: c1d2e3f4-a5b6-4c7d-8e9f-0a1b2c3d4e5f\n:PRIVATE: t\n:END:\n#+title: Drawer\n")
+	CreateTestOrgFile(tmpDir, "links.org", `#+title: Links
+See [[id:3f2b8c1e-6a4d-4e2f-9b7a-1c2d3e4f5a6b][the public section]],
+[[id:8d7c6b5a-4f3e-4d2c-8b1a-0f9e8d7c6b5a][my therapy]] and [[id:c1d2e3f4-a5b6-4c7d-8e9f-0a1b2c3d4e5f][a private file]].
+`)
+
+	ctx := BuildContext{Root: tmpDir}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	fi, ok := procFiles.Index.File("links.org")
+	if !ok {
+		t.Fatal("links.org missing from the index")
+	}
+	html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, fi, ctx, procFiles.Index.Locations(), procFiles)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	if !strings.Contains(html, `<a href="journal.html#headline-`) {
+		t.Errorf("public link not resolved:\n%s", html)
+	}
+	for _, want := range []string{"my therapy", "a private file"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML missing link text %q:\n%s", want, html)
+		}
+	}
+	for _, id := range []string{"8d7c6b5a-4f3e-4d2c-8b1a-0f9e8d7c6b5a", "c1d2e3f4-a5b6-4c7d-8e9f-0a1b2c3d4e5f"} {
+		if strings.Contains(html, id) {
+			t.Errorf("HTML publishes the private ID %s:\n%s", id, html)
+		}
+	}
+}
+
+func TestCheckPrivateLeaks(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-private-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "journal.org", privateFixture)
+	CreateTestOrgFile(tmpDir, "quote.org", "#+title: Quote\n\nThe draft paragraph is unfinished.\n")
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public")}
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	os.MkdirAll(ctx.DestDir, 0755)
+	GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+
+	if result := CheckPrivateLeaks(procFiles, ctx); result.PrivateLeaks != 0 {
+		t.Fatalf("clean build has %d leaks", result.PrivateLeaks)
+	}
+
+	// Output left over from before the subtree was private is a leak; text
+	// that is also public elsewhere is not.
+	stale := "<p>Nobody should read these\n<em>therapy</em> notes.</p>"
+	os.WriteFile(filepath.Join(ctx.DestDir, "old.html"), []byte(stale), 0644)
+	if result := CheckPrivateLeaks(procFiles, ctx); result.PrivateLeaks != 1 {
+		t.Errorf("stale output: %d leaks, want 1", result.PrivateLeaks)
+	}
+	data, err := os.ReadFile(filepath.Join(ctx.DestDir, "quote.html"))
+	if err != nil || !strings.Contains(string(data), "draft paragraph") {
+		t.Fatalf("quote.html = %s, %v", data, err)
+	}
+}
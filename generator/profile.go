@@ -0,0 +1,175 @@
+package generator
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PhaseTiming is how long a pipeline phase took.
+type PhaseTiming struct {
+	Name     string
+	Duration time.Duration
+}
+
+// FileTiming is how long a phase spent on one file.
+type FileTiming struct {
+	Phase    string
+	Path     string
+	Duration time.Duration
+}
+
+// Timings records how long each phase, and each file within a phase, took.
+// It is safe for concurrent use, and a nil *Timings records nothing.
+type Timings struct {
+	mu     sync.Mutex
+	phases []PhaseTiming
+	files  []FileTiming
+}
+
+// NewTimings returns an empty Timings.
+func NewTimings() *Timings {
+	return &Timings{}
+}
+
+// Phase records that the phase name took d.
+func (t *Timings) Phase(name string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases = append(t.phases, PhaseTiming{name, d})
+}
+
+// File records that phase spent d on path, which is relative to the source
+// root for sources and to the output directory for generated pages.
+func (t *Timings) File(phase, path string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files = append(t.files, FileTiming{phase, path, d})
+}
+
+// Phases returns the phase timings in the order the phases ran.
+func (t *Timings) Phases() []PhaseTiming {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.phases)
+}
+
+// Slowest returns the n file timings that took longest, slowest first.
+func (t *Timings) Slowest(n int) []FileTiming {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	files := slices.Clone(t.files)
+	t.mu.Unlock()
+	slices.SortFunc(files, func(a, b FileTiming) int {
+		return cmp.Or(cmp.Compare(b.Duration, a.Duration), cmp.Compare(a.Phase, b.Phase), cmp.Compare(a.Path, b.Path))
+	})
+	return files[:min(n, len(files))]
+}
+
+// WriteReport writes the phase timings and the n slowest files to w.
+func (t *Timings) WriteReport(w io.Writer, n int) error {
+	var total time.Duration
+	phases := t.Phases()
+	for _, phase := range phases {
+		total += phase.Duration
+	}
+	if _, err := fmt.Fprintf(w, "Phases (%s):\n", total.Round(time.Millisecond)); err != nil {
+		return err
+	}
+	for _, phase := range phases {
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(phase.Duration) / float64(total)
+		}
+		if _, err := fmt.Fprintf(w, "  %-28s %10s %5.1f%%\n", phase.Name, phase.Duration.Round(time.Microsecond), share); err != nil {
+			return err
+		}
+	}
+	slowest := t.Slowest(n)
+	if len(slowest) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "\nSlowest files:\n"); err != nil {
+		return err
+	}
+	for _, file := range slowest {
+		if _, err := fmt.Fprintf(w, "  %10s  %-12s %s\n", file.Duration.Round(time.Microsecond), file.Phase, file.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slowestFilesReported is how many files a profile's report lists.
+const slowestFilesReported = 20
+
+// Profile writes a CPU profile of a build, then a heap profile and a timing
+// report, to a directory.
+type Profile struct {
+	dir string
+	cpu *os.File
+}
+
+// StartProfile starts profiling the CPU into dir/cpu.pprof, creating dir if
+// needed.
+func StartProfile(dir string) (*Profile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating profile directory: %w", err)
+	}
+	cpu, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating CPU profile: %w", err)
+	}
+	if err := pprof.StartCPUProfile(cpu); err != nil {
+		cpu.Close()
+		return nil, fmt.Errorf("error starting CPU profile: %w", err)
+	}
+	return &Profile{dir: dir, cpu: cpu}, nil
+}
+
+// Stop ends the CPU profile and writes dir/heap.pprof and, from timings,
+// dir/timings.txt.
+func (p *Profile) Stop(timings *Timings) error {
+	pprof.StopCPUProfile()
+	if err := p.cpu.Close(); err != nil {
+		return fmt.Errorf("error writing CPU profile: %w", err)
+	}
+
+	heap, err := os.Create(filepath.Join(p.dir, "heap.pprof"))
+	if err != nil {
+		return fmt.Errorf("error creating heap profile: %w", err)
+	}
+	defer heap.Close()
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(heap); err != nil {
+		return fmt.Errorf("error writing heap profile: %w", err)
+	}
+
+	report, err := os.Create(filepath.Join(p.dir, "timings.txt"))
+	if err != nil {
+		return fmt.Errorf("error creating timing report: %w", err)
+	}
+	defer report.Close()
+	if err := timings.WriteReport(report, slowestFilesReported); err != nil {
+		return fmt.Errorf("error writing timing report: %w", err)
+	}
+	return report.Close()
+}
@@ -0,0 +1,90 @@
+package generator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimings(t *testing.T) {
+	timings := NewTimings()
+	timings.Phase("FindAndProcessOrgFiles", 30*time.Millisecond)
+	timings.Phase("GeneratePages", 10*time.Millisecond)
+	timings.File("parse", "a.org", 2*time.Millisecond)
+	timings.File("parse", "b.org", 5*time.Millisecond)
+	timings.File("render", "a.org", 3*time.Millisecond)
+
+	var slowest []string
+	for _, file := range timings.Slowest(2) {
+		slowest = append(slowest, file.Phase+" "+file.Path)
+	}
+	if fmt.Sprint(slowest) != "[parse b.org render a.org]" {
+		t.Errorf("Slowest(2) = %v", slowest)
+	}
+	if len(timings.Slowest(10)) != 3 {
+		t.Error("Slowest() should cap n at the number of timings")
+	}
+
+	var report strings.Builder
+	if err := timings.WriteReport(&report, 1); err != nil {
+		t.Fatalf("WriteReport() error = %v", err)
+	}
+	for _, want := range []string{"Phases (40ms):", "FindAndProcessOrgFiles", "75.0%", "Slowest files:", "parse        b.org"} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("report is missing %q:\n%s", want, report.String())
+		}
+	}
+
+	var none *Timings
+	none.Phase("x", time.Second)
+	none.File("parse", "a.org", time.Second)
+	if none.Phases() != nil || none.Slowest(1) != nil {
+		t.Error("a nil Timings should record nothing")
+	}
+}
+
+func TestPipelineTimings(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-profile-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: A\nHello.\n")
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public"), Timings: NewTimings()}
+	NewPipeline(ctx).
+		WithFullPhase(FindAndProcessOrgFiles).
+		WithOutputOnlyPhase(func(*ProcessedFiles, BuildContext) GenerationResult { return GenerationResult{} }).Named("Custom").
+		Execute()
+
+	var names []string
+	for _, phase := range ctx.Timings.Phases() {
+		names = append(names, phase.Name)
+	}
+	if fmt.Sprint(names) != "[FindAndProcessOrgFiles Custom]" {
+		t.Errorf("phases = %v", names)
+	}
+	if slowest := ctx.Timings.Slowest(1); len(slowest) != 1 || slowest[0].Path != "a.org" {
+		t.Errorf("Slowest() = %v, want a.org's parse", slowest)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	dir := filepath.Join(MustCreateTempDir(t, "test-profile-"), "profile")
+	defer CleanupTempDir(filepath.Dir(dir))
+
+	profile, err := StartProfile(dir)
+	if err != nil {
+		t.Fatalf("StartProfile() error = %v", err)
+	}
+	timings := NewTimings()
+	timings.Phase("GeneratePages", time.Millisecond)
+	if err := profile.Stop(timings); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	for _, name := range []string{"cpu.pprof", "heap.pprof", "timings.txt"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || info.Size() == 0 {
+			t.Errorf("%s was not written: %v", name, err)
+		}
+	}
+}
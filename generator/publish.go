@@ -0,0 +1,142 @@
+package generator
+
+import (
+	"html"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// Unpublished link styles: as the link's text, or as a span marked as a
+// private note.
+const (
+	UnpublishedLinkText = "text"
+	UnpublishedLinkSpan = "span"
+)
+
+// defaultUnpublishedLinkTitle is the title of unpublished link spans, and the
+// text of unpublished links without a description.
+const defaultUnpublishedLinkTitle = "Private note"
+
+// publishScoped reports whether ctx limits the site to some of its notes.
+func publishScoped(ctx BuildContext) bool {
+	return len(ctx.PublishTags) > 0 || len(ctx.PublishPaths) > 0
+}
+
+// isPublished reports whether fi is in the publish scope: tagged with one of
+// ctx.PublishTags, in its first tagged headline or #+FILETAGS:, or matching
+// one of ctx.PublishPaths. Patterns match like query paths: as a glob, or as
+// a prefix.
+func isPublished(fi FileInfo, ctx BuildContext) bool {
+	if !publishScoped(ctx) || fi.Path == "sitemap-preamble.org" {
+		return true
+	}
+	tags := slices.Clone(fi.Tags)
+	if fi.ParsedOrg != nil {
+		tags = append(tags, strings.FieldsFunc(fi.ParsedOrg.Get("FILETAGS"), func(c rune) bool { return c == ':' || c == ' ' })...)
+	}
+	for _, tag := range ctx.PublishTags {
+		if slices.Contains(tags, tag) {
+			return true
+		}
+	}
+	relPath := filepath.ToSlash(fi.Path)
+	for _, pattern := range ctx.PublishPaths {
+		if ok, _ := path.Match(pattern, relPath); ok || strings.HasPrefix(relPath, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyPublishScope drops the files outside the publish scope from
+// procFiles.Files and Index, recording them in procFiles.Unpublished. The
+// index keeps their IDs, so that id: links to them can be degraded to text
+// rather than left dead, and counts the links that will be.
+func ApplyPublishScope(procFiles *ProcessedFiles, ctx BuildContext) (*ProcessedFiles, GenerationResult) {
+	if !publishScoped(ctx) {
+		return procFiles, GenerationResult{}
+	}
+	slog.Debug("Starting publish scope", "tags", ctx.PublishTags, "paths", ctx.PublishPaths)
+
+	procFiles.Unpublished = map[string]bool{}
+	published := make([]FileInfo, 0, len(procFiles.Files))
+	for _, fi := range procFiles.Files {
+		if isPublished(fi, ctx) {
+			published = append(published, fi)
+		} else {
+			procFiles.Unpublished[fi.Path] = true
+		}
+	}
+	procFiles.Files = published
+	procFiles.Index = procFiles.Index.scoped(published)
+
+	var result GenerationResult
+	for _, fi := range procFiles.Files {
+		if fi.ParsedOrg == nil {
+			continue
+		}
+		walkOrgNodes(fi.ParsedOrg.Nodes, func(node org.Node) bool {
+			if link, ok := node.(org.RegularLink); ok && procFiles.linksToUnpublished(link) {
+				result.LinksDegraded++
+			}
+			return true
+		})
+	}
+	slog.Debug("Publish scope applied", "published", len(procFiles.Files), "unpublished", len(procFiles.Unpublished), "links_degraded", result.LinksDegraded)
+	return procFiles, result
+}
+
+// linksToUnpublished reports whether link is an id: link to a note outside
+// the publish scope.
+func (procFiles *ProcessedFiles) linksToUnpublished(link org.RegularLink) bool {
+	if procFiles == nil || len(procFiles.Unpublished) == 0 || link.Protocol != "id" {
+		return false
+	}
+	location, ok := procFiles.Index.Lookup(UUID(strings.TrimPrefix(link.URL, "id:")))
+	return ok && procFiles.Unpublished[location.FilePath]
+}
+
+// writeUnpublishedLink writes link, which points at an unpublished or private
+// note, as its description alone, or in a span titled
+// ctx.UnpublishedLinkTitle.
+func (w *uuidReplacingWriter) writeUnpublishedLink(link org.RegularLink) {
+	title := w.unpublishedLinkTitle
+	if title == "" {
+		title = defaultUnpublishedLinkTitle
+	}
+	if w.unpublishedLinks == UnpublishedLinkSpan {
+		w.WriteString(`<span class="unpublished-link" title="` + html.EscapeString(title) + `">`)
+	}
+	if link.Description != nil {
+		org.WriteNodes(w, link.Description...)
+	} else {
+		w.WriteString(html.EscapeString(title))
+	}
+	if w.unpublishedLinks == UnpublishedLinkSpan {
+		w.WriteString(`</span>`)
+	}
+}
+
+// publishScopeStale reports whether fi's page, written at htmlModTime, must
+// be rebuilt for the publish scope: it links to an unpublished note, or to a
+// note changed since, which may have joined or left the scope.
+func publishScopeStale(fi FileInfo, procFiles *ProcessedFiles, htmlModTime time.Time) bool {
+	if procFiles == nil || procFiles.Unpublished == nil {
+		return false
+	}
+	for _, target := range procFiles.Index.LinksFrom(fi.Path) {
+		if procFiles.Unpublished[target] {
+			return true
+		}
+		if other, ok := procFiles.Index.File(target); ok && other.fileModTime.After(htmlModTime) {
+			return true
+		}
+	}
+	return false
+}
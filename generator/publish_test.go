@@ -0,0 +1,130 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	publishedID   = "0b1c2d3e-4f50-4a6b-8c7d-9e0f1a2b3c4d"
+	unpublishedID = "5e6f7a8b-9c0d-4e1f-a2b3-c4d5e6f7a8b9"
+)
+
+func createPublishFixture(tmpDir string) {
+	CreateTestDirStructure(tmpDir, []string{"blog", "journal"})
+	CreateTestOrgFile(tmpDir, "tagged.org", "#+title: Tagged\n#+filetags: :publish:\n* Heading :go:\n:PROPERTIES:\n:ID: "+publishedID+"\n:END:\nSee [[id:"+unpublishedID+"][my diary]] and [[id:"+unpublishedID+"]].\n")
+	CreateTestOrgFile(tmpDir, "blog/post.org", "#+title: Post\n* Heading :go:\nLinks to [[id:"+publishedID+"][the tagged note]].\n")
+	CreateTestOrgFile(tmpDir, "journal/diary.org", "#+title: Diary\n* Entry :go:\n:PROPERTIES:\n:ID: "+unpublishedID+"\n:END:\nNot for the site.\n")
+}
+
+func TestApplyPublishScope(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-publish-")
+	defer CleanupTempDir(tmpDir)
+
+	createPublishFixture(tmpDir)
+	ctx := BuildContext{Root: tmpDir, PublishTags: []string{"publish"}, PublishPaths: []string{"blog/"}}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	procFiles, result := ApplyPublishScope(procFiles, ctx)
+
+	var paths []string
+	for _, fi := range procFiles.Files {
+		paths = append(paths, filepath.ToSlash(fi.Path))
+	}
+	if strings.Join(paths, " ") != "blog/post.org tagged.org" {
+		t.Errorf("Files = %v", paths)
+	}
+	if !procFiles.Unpublished[filepath.Join("journal", "diary.org")] {
+		t.Errorf("Unpublished = %v", procFiles.Unpublished)
+	}
+	if files := procFiles.Index.FilesWithTag("go"); len(files) != 2 {
+		t.Errorf("FilesWithTag(go) has %d files, want 2", len(files))
+	}
+	if _, ok := procFiles.Index.Lookup(UUID(unpublishedID)); !ok {
+		t.Error("Index lost the unpublished note's ID")
+	}
+	if result.LinksDegraded != 2 {
+		t.Errorf("LinksDegraded = %d, want 2", result.LinksDegraded)
+	}
+
+	// Without a scope, everything is published.
+	procFiles, _ = FindAndProcessOrgFiles(nil, BuildContext{Root: tmpDir})
+	if procFiles, result = ApplyPublishScope(procFiles, BuildContext{Root: tmpDir}); len(procFiles.Files) != 3 || procFiles.Unpublished != nil || result.LinksDegraded != 0 {
+		t.Errorf("unscoped: %d files, %v, %+v", len(procFiles.Files), procFiles.Unpublished, result)
+	}
+}
+
+func TestUnpublishedLinks(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-publish-")
+	defer CleanupTempDir(tmpDir)
+
+	createPublishFixture(tmpDir)
+	for _, tc := range []struct {
+		ctx  BuildContext
+		want []string
+	}{
+		{BuildContext{}, []string{"See my diary and Private note."}},
+		{BuildContext{UnpublishedLinks: UnpublishedLinkSpan, UnpublishedLinkTitle: "Not published"}, []string{
+			`<span class="unpublished-link" title="Not published">my diary</span>`,
+			`<span class="unpublished-link" title="Not published">Not published</span>`,
+		}},
+	} {
+		ctx := tc.ctx
+		ctx.Root, ctx.PublishTags = tmpDir, []string{"publish"}
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		procFiles, _ = ApplyPublishScope(procFiles, ctx)
+		fi := procFiles.Files[0]
+		html, err := convertOrgToHTMLWithLinkReplacement(fi.ParsedOrg, fi, ctx, nil, procFiles)
+		if err != nil {
+			t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+		}
+		if strings.Contains(html, "diary.html") || strings.Contains(html, unpublishedID) {
+			t.Errorf("%q links to the unpublished note: %s", ctx.UnpublishedLinks, html)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(html, want) {
+				t.Errorf("%q: missing %q in %s", ctx.UnpublishedLinks, want, html)
+			}
+		}
+	}
+}
+
+func TestPublishScopeStale(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-publish-")
+	defer CleanupTempDir(tmpDir)
+
+	createPublishFixture(tmpDir)
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public"), PublishTags: []string{"publish"}, PublishPaths: []string{"blog/"}}
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	build := func() (*ProcessedFiles, GenerationResult) {
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		procFiles, _ = ApplyPublishScope(procFiles, ctx)
+		return procFiles, GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+	}
+	build()
+	if _, err := os.Stat(filepath.Join(ctx.DestDir, "journal", "diary.html")); !os.IsNotExist(err) {
+		t.Error("the unpublished note was written")
+	}
+
+	old := time.Now().Add(-time.Hour)
+	for _, path := range []string{"tagged.org", "blog/post.org"} {
+		os.Chtimes(filepath.Join(tmpDir, path), old, old)
+	}
+	procFiles, _ := build()
+	tagged, post := procFiles.Files[1], procFiles.Files[0]
+	htmlTime := time.Now()
+	if !publishScopeStale(tagged, procFiles, htmlTime) {
+		t.Error("a page linking to an unpublished note should always be rebuilt")
+	}
+	if publishScopeStale(post, procFiles, htmlTime) {
+		t.Error("a page linking to an unchanged published note is not stale")
+	}
+	if !publishScopeStale(post, procFiles, old.Add(-time.Minute)) {
+		t.Error("a page linking to a note changed since it was written is stale")
+	}
+}
@@ -0,0 +1,328 @@
+package generator
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// Query sorts.
+const (
+	QuerySortNewest = "newest"
+	QuerySortOldest = "oldest"
+	QuerySortTitle  = "title"
+	QuerySortPath   = "path"
+)
+
+// Query is the parsed contents of a #+begin_oxen-query block. Pages match
+// when they satisfy every filter; several values for one filter must all
+// match too.
+type Query struct {
+	Tags       []string
+	Paths      []string
+	LinksTo    []UUID
+	Properties [][2]string
+	Sort       string
+	Limit      int
+}
+
+// parseQuery parses a query: whitespace-separated tag:, path:, linksto:,
+// property:KEY=VAL, sort: and limit: terms. Invalid terms are reported
+// together; the valid ones are still returned.
+func parseQuery(src string) (Query, error) {
+	q := Query{Sort: QuerySortNewest}
+	var invalid []string
+	for _, term := range strings.Fields(src) {
+		key, value, ok := strings.Cut(term, ":")
+		if !ok || value == "" {
+			invalid = append(invalid, term)
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "tag":
+			q.Tags = append(q.Tags, value)
+		case "path":
+			q.Paths = append(q.Paths, strings.TrimPrefix(value, "/"))
+		case "linksto":
+			id := UUID(strings.TrimPrefix(value, "id:"))
+			if !isValidUUID(string(id)) {
+				invalid = append(invalid, term)
+				continue
+			}
+			q.LinksTo = append(q.LinksTo, id)
+		case "property":
+			k, v, ok := strings.Cut(value, "=")
+			if !ok || k == "" {
+				invalid = append(invalid, term)
+				continue
+			}
+			q.Properties = append(q.Properties, [2]string{strings.ToUpper(k), v})
+		case "sort":
+			switch value {
+			case QuerySortNewest, QuerySortOldest, QuerySortTitle, QuerySortPath:
+				q.Sort = value
+			default:
+				invalid = append(invalid, term)
+			}
+		case "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				invalid = append(invalid, term)
+				continue
+			}
+			q.Limit = n
+		default:
+			invalid = append(invalid, term)
+		}
+	}
+	if len(invalid) > 0 {
+		return q, fmt.Errorf("invalid query terms: %s", strings.Join(invalid, " "))
+	}
+	return q, nil
+}
+
+// blockQuery returns the query of an oxen-query block. go-org's block names
+// stop at the first non-word character, so #+begin_oxen-query is a block
+// named OXEN with -query as its first parameter.
+func blockQuery(b org.Block) (string, bool) {
+	isQuery := b.Name == "OXEN_QUERY" || b.Name == "OXEN" && len(b.Parameters) > 0 && strings.EqualFold(b.Parameters[0], "-query")
+	if !isQuery {
+		return "", false
+	}
+	return org.String(b.Children...), true
+}
+
+// extractQueriesFromAST returns the queries of the oxen-query blocks in doc,
+// in document order.
+func extractQueriesFromAST(doc *org.Document, filePath string, diagnostics *Diagnostics) []Query {
+	var queries []Query
+	walkOrgNodes(doc.Nodes, func(node org.Node) bool {
+		if b, ok := node.(org.Block); ok {
+			if src, ok := blockQuery(b); ok {
+				q, err := parseQuery(src)
+				if err != nil {
+					diagnostics.Warn("query-invalid", filePath, diagnostics.Line(filePath, strings.TrimSpace(strings.SplitN(src, "\n", 2)[0])), "invalid oxen-query block: %v", err)
+				}
+				queries = append(queries, q)
+				return false
+			}
+		}
+		return true
+	})
+	return queries
+}
+
+// extractPropertiesFromAST collects the values of every property drawer in
+// doc, the file-level drawer and every headline's, by upper-case key.
+func extractPropertiesFromAST(doc *org.Document) map[string][]string {
+	props := map[string][]string{}
+	add := func(drawer *org.PropertyDrawer) {
+		for _, kv := range drawer.Properties {
+			key := strings.ToUpper(kv[0])
+			if !slices.Contains(props[key], kv[1]) {
+				props[key] = append(props[key], kv[1])
+			}
+		}
+	}
+	walkOrgNodes(doc.Nodes, func(node org.Node) bool {
+		switch n := node.(type) {
+		case org.PropertyDrawer:
+			add(&n)
+		case org.Headline:
+			if n.Properties != nil {
+				add(n.Properties)
+			}
+		}
+		return true
+	})
+	if len(props) == 0 {
+		return nil
+	}
+	return props
+}
+
+// matches reports whether fi satisfies every filter of q.
+func (q Query) matches(fi FileInfo) bool {
+	for _, tag := range q.Tags {
+		if !slices.Contains(fi.Tags, tag) {
+			return false
+		}
+	}
+	for _, pattern := range q.Paths {
+		if ok, _ := path.Match(pattern, fi.Path); !ok && !strings.HasPrefix(fi.Path, pattern) {
+			return false
+		}
+	}
+	for _, id := range q.LinksTo {
+		if !slices.Contains(fi.Links, id) {
+			return false
+		}
+	}
+	for _, prop := range q.Properties {
+		if !slices.Contains(fi.Properties[prop[0]], prop[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// run returns the pages matching q, other than the page at self, sorted and
+// limited.
+func (q Query) run(procFiles *ProcessedFiles, self string) []FileInfo {
+	var results []FileInfo
+	for _, fi := range procFiles.Files {
+		if fi.Path != self && fi.Path != "sitemap-preamble.org" && q.matches(fi) {
+			results = append(results, fi)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		switch q.Sort {
+		case QuerySortOldest:
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		case QuerySortTitle:
+			if ta, tb := strings.ToLower(a.Title), strings.ToLower(b.Title); ta != tb {
+				return ta < tb
+			}
+		case QuerySortPath:
+		default:
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.After(b.ModTime)
+			}
+		}
+		return a.Path < b.Path
+	})
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results
+}
+
+// pagesFingerprint identifies a list of pages, such as a query's results,
+// and the parts of them that are rendered, so a page can tell whether its
+// listing of them is stale.
+func pagesFingerprint(pages []FileInfo) string {
+	h := sha1.New()
+	for _, fi := range pages {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d\n", fi.Path, fi.Title, fi.Preview, fi.ModTime.UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// renderQueryResults renders results as a list of links with previews. The
+// fingerprint is kept in a data attribute for queriesStale.
+func renderQueryResults(results []FileInfo) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<ul class=\"oxen-query\" data-query=\"%s\">\n", pagesFingerprint(results))
+	for _, fi := range results {
+		fmt.Fprintf(&b, "<li><a href=\"/%s.html\">%s</a>", html.EscapeString(strings.TrimSuffix(fi.Path, ".org")), html.EscapeString(fi.Title))
+		if fi.Preview != "" {
+			fmt.Fprintf(&b, "\n<p class=\"preview\">%s</p>", html.EscapeString(fi.Preview))
+		}
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</ul>\n")
+	return b.String()
+}
+
+// queriesStale reports whether the listings of fi's queries in the HTML at
+// outputPath no longer match the site: a matching page was added, changed or
+// removed.
+func queriesStale(fi FileInfo, procFiles *ProcessedFiles, outputPath string) bool {
+	if len(fi.Queries) == 0 || procFiles == nil {
+		return false
+	}
+	existing, err := os.ReadFile(outputPath)
+	if err != nil {
+		return true
+	}
+	for _, q := range fi.Queries {
+		if !strings.Contains(string(existing), `data-query="`+pagesFingerprint(q.run(procFiles, fi.Path))+`"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeQueryBlock writes the results of b, if it is an oxen-query block, for
+// the page at self, and reports whether it was one.
+func writeQueryBlock(w *org.HTMLWriter, b org.Block, procFiles *ProcessedFiles, self string) bool {
+	src, ok := blockQuery(b)
+	if !ok {
+		return false
+	}
+	if procFiles != nil {
+		q, _ := parseQuery(src)
+		w.WriteString(renderQueryResults(q.run(procFiles, self)))
+	}
+	return true
+}
+
+// WriteBlock renders oxen-query blocks as the list of pages they match.
+func (w *uuidReplacingWriter) WriteBlock(b org.Block) {
+	if w.safe.stripBlock(b) {
+		return
+	}
+	b = w.safe.sanitizeBlock(b)
+	if !writeQueryBlock(w.HTMLWriter, b, w.procFiles, w.currentPath) {
+		w.HTMLWriter.WriteBlock(b)
+	}
+}
+
+// queryWriter is a plain HTML writer that also renders oxen-query blocks,
+// and applies safe mode, for the sitemap preamble.
+type queryWriter struct {
+	*org.HTMLWriter
+	procFiles *ProcessedFiles
+	path      string
+	safe      htmlSanitizer
+}
+
+func newQueryWriter(procFiles *ProcessedFiles, path string, safeMode bool, diagnostics *Diagnostics) *queryWriter {
+	w := &queryWriter{HTMLWriter: org.NewHTMLWriter(), procFiles: procFiles, path: path}
+	w.safe = htmlSanitizer{enabled: safeMode, path: path, diagnostics: diagnostics, position: newSourcePosition(diagnostics, path)}
+	w.HTMLWriter.ExtendingWriter = w
+	return w
+}
+
+func (w *queryWriter) WriteBlock(b org.Block) {
+	if w.safe.stripBlock(b) {
+		return
+	}
+	b = w.safe.sanitizeBlock(b)
+	if !writeQueryBlock(w.HTMLWriter, b, w.procFiles, w.path) {
+		w.HTMLWriter.WriteBlock(b)
+	}
+}
+
+func (w *queryWriter) WriteInlineBlock(b org.InlineBlock) {
+	if !w.safe.stripInlineBlock(b) {
+		w.HTMLWriter.WriteInlineBlock(b)
+	}
+}
+
+func (w *queryWriter) WriteKeyword(k org.Keyword) {
+	if !w.safe.stripKeyword(k) {
+		w.HTMLWriter.WriteKeyword(k)
+	}
+}
+
+func (w *queryWriter) WriteRegularLink(link org.RegularLink) {
+	w.safe.writeRegularLink(w.HTMLWriter, link)
+}
+
+func (w *queryWriter) WriteNodeWithMeta(n org.NodeWithMeta) {
+	n.Meta = w.safe.sanitizeMeta(htmlSizeAttributes(n.Meta))
+	w.HTMLWriter.WriteNodeWithMeta(n)
+}
@@ -0,0 +1,185 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	q, err := parseQuery("tag:go  path:notes/ property:status=done\nsort:title limit:3 linksto:id:6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	if err != nil {
+		t.Fatalf("parseQuery() error = %v", err)
+	}
+	if len(q.Tags) != 1 || q.Tags[0] != "go" || len(q.Paths) != 1 || q.Paths[0] != "notes/" {
+		t.Errorf("parseQuery() tags/paths = %v %v", q.Tags, q.Paths)
+	}
+	if len(q.Properties) != 1 || q.Properties[0] != [2]string{"STATUS", "done"} {
+		t.Errorf("parseQuery() properties = %v", q.Properties)
+	}
+	if q.Sort != QuerySortTitle || q.Limit != 3 || len(q.LinksTo) != 1 {
+		t.Errorf("parseQuery() = %+v", q)
+	}
+
+	q, err = parseQuery("tag:go sort:random limit:-1 colour:red linksto:nope")
+	if err == nil {
+		t.Fatal("parseQuery() with invalid terms: want error")
+	}
+	for _, term := range []string{"sort:random", "limit:-1", "colour:red", "linksto:nope"} {
+		if !strings.Contains(err.Error(), term) {
+			t.Errorf("error %q does not name %q", err, term)
+		}
+	}
+	if len(q.Tags) != 1 || q.Sort != QuerySortNewest {
+		t.Errorf("parseQuery() valid terms = %+v", q)
+	}
+}
+
+func TestQueryRun(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	id := UUID("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	procFiles := &ProcessedFiles{Files: []FileInfo{
+		{Path: "notes/b.org", Title: "Bravo", Tags: []string{"go"}, ModTime: base.Add(2 * time.Hour)},
+		{Path: "notes/a.org", Title: "alpha", Tags: []string{"go", "web"}, ModTime: base.Add(time.Hour), Links: []UUID{id}},
+		{Path: "posts/c.org", Title: "Charlie", Tags: []string{"go"}, ModTime: base.Add(3 * time.Hour),
+			Properties: map[string][]string{"STATUS": {"done"}}},
+		{Path: "index.org", Title: "Index", Tags: []string{"go"}, ModTime: base},
+		{Path: "sitemap-preamble.org", Tags: []string{"go"}},
+	}}
+	paths := func(results []FileInfo) string {
+		var ps []string
+		for _, fi := range results {
+			ps = append(ps, fi.Path)
+		}
+		return strings.Join(ps, " ")
+	}
+
+	for src, want := range map[string]string{
+		"tag:go":                   "posts/c.org notes/b.org notes/a.org",
+		"tag:go sort:oldest":       "notes/a.org notes/b.org posts/c.org",
+		"tag:go sort:title":        "notes/a.org notes/b.org posts/c.org",
+		"tag:go sort:path limit:2": "notes/a.org notes/b.org",
+		"tag:go tag:web":           "notes/a.org",
+		"path:notes/":              "notes/b.org notes/a.org",
+		"path:posts/*.org":         "posts/c.org",
+		"linksto:" + string(id):    "notes/a.org",
+		"property:status=done":     "posts/c.org",
+		"tag:rust":                 "",
+	} {
+		q, err := parseQuery(src)
+		if err != nil {
+			t.Fatalf("parseQuery(%q) error = %v", src, err)
+		}
+		if got := paths(q.run(procFiles, "index.org")); got != want {
+			t.Errorf("%q matched %q, want %q", src, got, want)
+		}
+	}
+}
+
+func TestQueryBlocks(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-query-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "listing.org", `#+title: Listing
+
+#+begin_oxen-query
+tag:go sort:title
+#+end_oxen-query
+
+#+begin_src go
+fmt.Println("not a query")
+#+end_src
+`)
+	CreateTestOrgFile(tmpDir, "one.org", "#+title: One\n\nFirst page about Go.\n* Go :go:\n")
+	CreateTestOrgFile(tmpDir, "two.org", "#+title: Two\n:PROPERTIES:\n:STATUS: draft\n:END:\n* Notes :go:\nSecond page.\n")
+
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public")}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	var listing FileInfo
+	for _, fi := range procFiles.Files {
+		if fi.Path == "listing.org" {
+			listing = fi
+		}
+		if fi.Path == "two.org" && (len(fi.Properties["STATUS"]) != 1 || fi.Properties["STATUS"][0] != "draft") {
+			t.Errorf("two.org properties = %v", fi.Properties)
+		}
+	}
+	if len(listing.Queries) != 1 {
+		t.Fatalf("listing.org queries = %+v", listing.Queries)
+	}
+
+	html, err := convertOrgToHTMLWithLinkReplacement(listing.ParsedOrg, listing, ctx, nil, procFiles)
+	if err != nil {
+		t.Fatalf("convertOrgToHTMLWithLinkReplacement() error = %v", err)
+	}
+	one := strings.Index(html, `<li><a href="/one.html">One</a>`)
+	two := strings.Index(html, `<li><a href="/two.html">Two</a>`)
+	if one < 0 || two < 0 || one > two {
+		t.Errorf("query results missing or out of order:\n%s", html)
+	}
+	if !strings.Contains(html, `<p class="preview">First page about Go.</p>`) {
+		t.Errorf("query results missing preview:\n%s", html)
+	}
+	if !strings.Contains(html, "not a query") {
+		t.Errorf("source block not rendered:\n%s", html)
+	}
+}
+
+func TestQueriesStale(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-query-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "listing.org", "#+title: Listing\n\n#+begin_oxen-query\ntag:go\n#+end_oxen-query\n")
+	CreateTestOrgFile(tmpDir, "one.org", "#+title: One\n* Go :go:\n")
+	CreateTestOrgFile(tmpDir, "sitemap-preamble.org", "#+begin_oxen-query\ntag:go\n#+end_oxen-query\n")
+
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public")}
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	build := func() *ProcessedFiles {
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		os.MkdirAll(ctx.DestDir, 0755)
+		GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+		GenerateIndexPage(procFiles, ctx, tmpls.Index)
+		return procFiles
+	}
+	check := func(name string, want, unwanted string) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(ctx.DestDir, name))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		if want != "" && !strings.Contains(string(data), want) {
+			t.Errorf("%s missing %q", name, want)
+		}
+		if unwanted != "" && strings.Contains(string(data), unwanted) {
+			t.Errorf("%s still has %q", name, unwanted)
+		}
+	}
+
+	procFiles := build()
+	check("listing.html", `href="/one.html">One<`, "")
+	check("index.html", `href="/one.html">One<`, "")
+	for _, fi := range procFiles.Files {
+		if fi.Path == "listing.org" && queriesStale(fi, procFiles, filepath.Join(ctx.DestDir, "listing.html")) {
+			t.Error("listing.html stale right after a build")
+		}
+	}
+
+	// A new matching page rebuilds the listing, though listing.org is
+	// unchanged.
+	CreateTestOrgFile(tmpDir, "two.org", "#+title: Two\n* Go :go:\n")
+	build()
+	check("listing.html", `href="/two.html">Two<`, "")
+	check("index.html", `href="/two.html">Two<`, "")
+
+	// So does removing one.
+	os.Remove(filepath.Join(tmpDir, "one.org"))
+	build()
+	check("listing.html", "", `href="/one.html"`)
+	check("index.html", "", `href="/one.html"`)
+}
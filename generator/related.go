@@ -0,0 +1,484 @@
+package generator
+
+import (
+	"cmp"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+const (
+	defaultRelatedCount = 5
+	// relatedTermsPerFile caps each file's TF-IDF vector to its highest
+	// weighted terms, which keeps the similarity pass close to linear.
+	relatedTermsPerFile = 64
+	// relatedPostingsPerTerm caps the pages a term can relate a page to, to
+	// those it weighs most in. Common terms would otherwise make every page
+	// a candidate for every other.
+	relatedPostingsPerTerm = 64
+	// relatedMinScore drops pairs with only a trivial overlap.
+	relatedMinScore = 0.05
+)
+
+// defaultRelatedWeights are used for any signal missing from ctx.RelatedWeights.
+var defaultRelatedWeights = map[string]float64{
+	"tags":  1,
+	"links": 1,
+	"text":  1,
+}
+
+// relatedStopWords are skipped when building term vectors.
+var relatedStopWords = func() map[string]bool {
+	words := map[string]bool{}
+	for _, word := range strings.Fields(`about above after again also among and any are because been before
+		being below between both but can could did does doing down during each few for from further had has
+		have having her here hers him his how into its itself just more most much must not now off once only
+		other our ours out over own same she should some such than that the their theirs them then there these
+		they this those through too under until upon very was were what when where which while who whom why
+		will with would you your yours`) {
+		words[word] = true
+	}
+	return words
+}()
+
+// relatedWeight returns the configured weight of a relatedness signal.
+func relatedWeight(ctx BuildContext, signal string) float64 {
+	if w, ok := ctx.RelatedWeights[signal]; ok {
+		return w
+	}
+	return defaultRelatedWeights[signal]
+}
+
+func relatedCount(ctx BuildContext) int {
+	if ctx.RelatedCount != 0 {
+		return ctx.RelatedCount
+	}
+	return defaultRelatedCount
+}
+
+// extractLinksFromAST returns the UUIDs of id: links in doc, in order of
+// first appearance.
+func extractLinksFromAST(doc *org.Document) []UUID {
+	var links []UUID
+	seen := map[UUID]bool{}
+	walkOrgNodes(doc.Nodes, func(node org.Node) bool {
+		if link, ok := node.(org.RegularLink); ok && link.Protocol == "id" {
+			id := UUID(strings.TrimPrefix(link.URL, "id:"))
+			if isValidUUID(string(id)) && !seen[id] {
+				seen[id] = true
+				links = append(links, id)
+			}
+		}
+		return true
+	})
+	return links
+}
+
+// termCounts counts the words of doc's prose, skipping code and example
+// blocks, short words and stop words.
+func termCounts(doc *org.Document) map[string]int {
+	counts := map[string]int{}
+	walkOrgNodes(doc.Nodes, func(node org.Node) bool {
+		switch n := node.(type) {
+		case org.Block:
+			return n.Name != "SRC" && n.Name != "EXAMPLE"
+		case org.Text:
+			for _, word := range strings.FieldsFunc(strings.ToLower(n.Content), func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+			}) {
+				if len(word) >= 3 && !relatedStopWords[word] {
+					counts[word]++
+				}
+			}
+		}
+		return true
+	})
+	return counts
+}
+
+// RelatedCache keeps the words of each page across the builds of a watch
+// session, so that ComputeRelatedPages only counts those of pages that
+// changed. It is safe for concurrent use, and a nil *RelatedCache keeps
+// nothing.
+type RelatedCache struct {
+	mu    sync.Mutex
+	terms map[string]cachedTerms
+}
+
+// cachedTerms are the term counts of a page whose source and includes were
+// last modified at modTime.
+type cachedTerms struct {
+	modTime time.Time
+	counts  map[string]int
+}
+
+func NewRelatedCache() *RelatedCache {
+	return &RelatedCache{terms: map[string]cachedTerms{}}
+}
+
+// termCounts returns the term counts of fi, counting them unless fi and its
+// includes are unchanged since they were last counted.
+func (c *RelatedCache) termCounts(fi FileInfo, root string) map[string]int {
+	if c == nil {
+		return termCounts(fi.ParsedOrg)
+	}
+	var modTime time.Time
+	for _, path := range append([]string{fi.Path}, fi.Includes...) {
+		info, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			return termCounts(fi.ParsedOrg)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	c.mu.Lock()
+	cached, ok := c.terms[fi.Path]
+	c.mu.Unlock()
+	if ok && cached.modTime.Equal(modTime) {
+		return cached.counts
+	}
+	counts := termCounts(fi.ParsedOrg)
+	c.mu.Lock()
+	c.terms[fi.Path] = cachedTerms{modTime, counts}
+	c.mu.Unlock()
+	return counts
+}
+
+// retain drops the pages not in files, which were deleted or unpublished.
+func (c *RelatedCache) retain(files []FileInfo) {
+	if c == nil {
+		return
+	}
+	keep := map[string]bool{}
+	for _, fi := range files {
+		keep[fi.Path] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.terms {
+		if !keep[path] {
+			delete(c.terms, path)
+		}
+	}
+}
+
+// weightedTerm is a term with its normalized TF-IDF weight.
+type weightedTerm struct {
+	term   string
+	weight float64
+}
+
+// tfidfVectors builds a unit-length TF-IDF vector for each document, keeping
+// only its relatedTermsPerFile heaviest terms.
+func tfidfVectors(counts []map[string]int, pool *WorkerPool) [][]weightedTerm {
+	df := map[string]int{}
+	for _, c := range counts {
+		for term := range c {
+			df[term]++
+		}
+	}
+
+	vectors := make([][]weightedTerm, len(counts))
+	n := float64(len(counts))
+	pool.Run(len(counts), func(i int) {
+		vec := make([]weightedTerm, 0, len(counts[i]))
+		for term, tf := range counts[i] {
+			// Terms in every document, or in only one, cannot relate two pages.
+			d := df[term]
+			if d < 2 || float64(d) == n {
+				continue
+			}
+			vec = append(vec, weightedTerm{term, (1 + math.Log(float64(tf))) * math.Log(n/float64(d))})
+		}
+		slices.SortFunc(vec, func(a, b weightedTerm) int {
+			if a.weight != b.weight {
+				return cmp.Compare(b.weight, a.weight)
+			}
+			return strings.Compare(a.term, b.term)
+		})
+		if len(vec) > relatedTermsPerFile {
+			vec = vec[:relatedTermsPerFile]
+		}
+		var norm float64
+		for _, t := range vec {
+			norm += t.weight * t.weight
+		}
+		norm = math.Sqrt(norm)
+		for k := range vec {
+			vec[k].weight /= norm
+		}
+		vectors[i] = vec
+	})
+	return vectors
+}
+
+// ComputeRelatedPages scores every pair of pages on three signals: shared
+// tags, shared link neighbours (linked pages and cited works) and TF-IDF
+// similarity of their text. Each signal is a cosine similarity in [0, 1];
+// they are combined with the configured weights and each page keeps its
+// top-scoring pages in procFiles.Related.
+func ComputeRelatedPages(procFiles *ProcessedFiles, ctx BuildContext) (*ProcessedFiles, GenerationResult) {
+	slog.Debug("Starting related pages phase", "file_count", len(procFiles.Files))
+	start := time.Now()
+
+	procFiles.Related = map[string][]RelatedPage{}
+	limit := relatedCount(ctx)
+	if limit < 0 {
+		return procFiles, GenerationResult{}
+	}
+
+	// Titleless files that other files include are fragments, not pages
+	// anyone would want to be pointed at.
+	included := map[string]bool{}
+	for _, fi := range procFiles.Files {
+		for _, dep := range fi.Includes {
+			included[dep] = true
+		}
+	}
+
+	var files []FileInfo
+	index := map[string]int{}
+	for _, fi := range procFiles.Files {
+		if fi.ParsedOrg == nil || fi.Path == "sitemap-preamble.org" || (fi.Title == "" && included[fi.Path]) {
+			continue
+		}
+		index[fi.Path] = len(files)
+		files = append(files, fi)
+	}
+
+	// Tags, from the site index.
+	tagSets := make([][]int, 0)
+	tagCounts := make([]int, len(files))
+	for _, tag := range procFiles.Index.Tags() {
+		var set []int
+		for _, fi := range procFiles.Index.FilesWithTag(tag) {
+			if i, ok := index[fi.Path]; ok {
+				set = append(set, i)
+				tagCounts[i]++
+			}
+		}
+		tagSets = append(tagSets, set)
+	}
+
+	// Link neighbours: pages linked to or from, and cited works. Two pages
+	// sharing neighbours are co-cited or link to the same places.
+	neighbours := make([]map[string]bool, len(files))
+	direct := make([]map[int]bool, len(files))
+	for i := range files {
+		neighbours[i] = map[string]bool{}
+		direct[i] = map[int]bool{}
+	}
+	for i, fi := range files {
+		for _, target := range procFiles.Index.LinksFrom(fi.Path) {
+			if j, ok := index[target]; ok {
+				neighbours[i]["page:"+files[j].Path] = true
+				neighbours[j]["page:"+fi.Path] = true
+				direct[i][j] = true
+				direct[j][i] = true
+			}
+		}
+		for _, key := range fi.Citations {
+			neighbours[i]["cite:"+key] = true
+		}
+	}
+	neighbourFiles := map[string][]int{}
+	for i, set := range neighbours {
+		for n := range set {
+			neighbourFiles[n] = append(neighbourFiles[n], i)
+		}
+	}
+
+	// Text.
+	counts := make([]map[string]int, len(files))
+	ctx.Pool.Run(len(files), func(i int) {
+		counts[i] = ctx.RelatedCache.termCounts(files[i], ctx.Root)
+	})
+	ctx.RelatedCache.retain(files)
+	vectors := tfidfVectors(counts, ctx.Pool)
+	// Terms are numbered, so that the postings of a page's terms are found
+	// without hashing them.
+	type posting struct {
+		file   int
+		weight float64
+	}
+	type termWeight struct {
+		term   int
+		weight float64
+	}
+	termIDs := map[string]int{}
+	var postings [][]posting
+	fileTerms := make([][]termWeight, len(files))
+	for i, vec := range vectors {
+		for _, t := range vec {
+			id, ok := termIDs[t.term]
+			if !ok {
+				id = len(postings)
+				termIDs[t.term] = id
+				postings = append(postings, nil)
+			}
+			postings[id] = append(postings[id], posting{i, t.weight})
+			fileTerms[i] = append(fileTerms[i], termWeight{id, t.weight})
+		}
+	}
+	for id, list := range postings {
+		if len(list) > relatedPostingsPerTerm {
+			slices.SortStableFunc(list, func(a, b posting) int { return cmp.Compare(b.weight, a.weight) })
+			postings[id] = list[:relatedPostingsPerTerm]
+		}
+	}
+
+	fileTags := make([][]int, len(files))
+	for s, set := range tagSets {
+		for _, i := range set {
+			fileTags[i] = append(fileTags[i], s)
+		}
+	}
+
+	wTags, wLinks, wText := relatedWeight(ctx, "tags"), relatedWeight(ctx, "links"), relatedWeight(ctx, "text")
+	total := wTags + wLinks + wText
+	if total <= 0 {
+		return procFiles, GenerationResult{}
+	}
+
+	// Each page is only scored against the pages it shares a tag, a
+	// neighbour or a term with, which are recorded in a scratch buffer as
+	// they are first touched.
+	type signals struct {
+		tags, links, text float64
+		direct            bool
+	}
+	type scratch struct {
+		signals []signals
+		seen    []bool
+		touched []int
+	}
+	scratches := sync.Pool{New: func() any {
+		return &scratch{signals: make([]signals, len(files)), seen: make([]bool, len(files))}
+	}}
+	related := make([][]RelatedPage, len(files))
+	ctx.Pool.Run(len(files), func(i int) {
+		sc := scratches.Get().(*scratch)
+		defer func() {
+			for _, j := range sc.touched {
+				sc.signals[j], sc.seen[j] = signals{}, false
+			}
+			sc.touched = sc.touched[:0]
+			scratches.Put(sc)
+		}()
+		touch := func(j int) *signals {
+			if !sc.seen[j] {
+				sc.seen[j] = true
+				sc.touched = append(sc.touched, j)
+			}
+			return &sc.signals[j]
+		}
+
+		if wTags != 0 {
+			for _, s := range fileTags[i] {
+				for _, j := range tagSets[s] {
+					touch(j).tags++
+				}
+			}
+		}
+		if wLinks != 0 {
+			for n := range neighbours[i] {
+				for _, j := range neighbourFiles[n] {
+					touch(j).links++
+				}
+			}
+			for j := range direct[i] {
+				touch(j).direct = true
+			}
+		}
+		if wText != 0 {
+			for _, t := range fileTerms[i] {
+				for _, p := range postings[t.term] {
+					touch(p.file).text += t.weight * p.weight
+				}
+			}
+		}
+
+		// Keep the best limit pages, best first, without sorting them all.
+		better := func(a, b RelatedPage) bool {
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+			return a.Path < b.Path
+		}
+		candidates := make([]RelatedPage, 0, limit+1)
+		for _, j := range sc.touched {
+			sig := sc.signals[j]
+			if j == i {
+				continue
+			}
+			if sig.tags > 0 {
+				sig.tags /= math.Sqrt(float64(tagCounts[i] * tagCounts[j]))
+			}
+			if sig.links > 0 {
+				sig.links /= math.Sqrt(float64(len(neighbours[i]) * len(neighbours[j])))
+			}
+			if sig.direct {
+				sig.links = 1
+			}
+			score := (wTags*sig.tags + wLinks*sig.links + wText*sig.text) / total
+			if score < relatedMinScore {
+				continue
+			}
+			page := RelatedPage{Path: files[j].Path, Score: score}
+			if len(candidates) == limit && !better(page, candidates[limit-1]) {
+				continue
+			}
+			page.Title, page.Preview, page.ModTime = files[j].Title, files[j].Preview, files[j].ModTime
+			k := sort.Search(len(candidates), func(k int) bool { return better(page, candidates[k]) })
+			candidates = slices.Insert(candidates, k, page)
+			if len(candidates) > limit {
+				candidates = candidates[:limit]
+			}
+		}
+		related[i] = candidates
+	})
+
+	for i, fi := range files {
+		if len(related[i]) > 0 {
+			procFiles.Related[fi.Path] = related[i]
+		}
+	}
+
+	slog.Debug("Related pages phase complete", "files", len(files), "duration", time.Since(start))
+	return procFiles, GenerationResult{}
+}
+
+// relatedFiles returns pages as the FileInfo fields a related list renders,
+// for fingerprinting.
+func relatedFiles(pages []RelatedPage) []FileInfo {
+	files := make([]FileInfo, len(pages))
+	for i, page := range pages {
+		files[i] = FileInfo{Path: page.Path, Title: page.Title, Preview: page.Preview, ModTime: page.ModTime}
+	}
+	return files
+}
+
+// relatedStale reports whether the related list of fi's page at outputPath,
+// fingerprinted in its data-related attribute, no longer matches fi's
+// related pages: one was added, changed or deleted, or is no longer related.
+func relatedStale(fi FileInfo, procFiles *ProcessedFiles, outputPath string) bool {
+	if procFiles == nil || procFiles.Related == nil {
+		return false
+	}
+	existing, err := os.ReadFile(outputPath)
+	if err != nil {
+		return true
+	}
+	return listingStale(existing, "data-related", relatedFiles(procFiles.Related[fi.Path]))
+}
@@ -0,0 +1,248 @@
+package generator
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func relatedPaths(pages []RelatedPage) []string {
+	var paths []string
+	for _, page := range pages {
+		paths = append(paths, page.Path)
+	}
+	return paths
+}
+
+func TestComputeRelatedPages(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-related-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "hub.org", `#+title: Hub
+* Hub
+:PROPERTIES:
+:ID: 11111111-1111-4111-8111-111111111111
+:END:
+Nothing in common with anyone.
+`)
+	CreateTestOrgFile(tmpDir, "a.org", `#+title: A
+* Gardening :plants:
+Tomatoes and compost. Links to [[id:11111111-1111-4111-8111-111111111111][elsewhere]].
+`)
+	CreateTestOrgFile(tmpDir, "b.org", `#+title: B
+* More gardening :plants:
+Compost makes tomatoes happy. Also [[id:11111111-1111-4111-8111-111111111111][elsewhere]].
+`)
+	CreateTestOrgFile(tmpDir, "c.org", `#+title: C
+* Databases
+Indexes and queries.
+#+begin_src sql
+-- tomatoes compost tomatoes compost
+#+end_src
+`)
+	CreateTestOrgFile(tmpDir, "d.org", `#+title: D
+* Query planning
+Indexes make queries fast.
+`)
+
+	ctx := BuildContext{Root: tmpDir}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	procFiles, _ = ComputeRelatedPages(procFiles, ctx)
+
+	if got := relatedPaths(procFiles.Related["a.org"]); len(got) == 0 || got[0] != "b.org" {
+		t.Errorf("Related[a.org] = %v, want b.org first", got)
+	}
+	if got := relatedPaths(procFiles.Related["hub.org"]); strings.Join(got, ",") != "a.org,b.org" {
+		t.Errorf("Related[hub.org] = %v, want the pages linking to it", got)
+	}
+	if got := relatedPaths(procFiles.Related["c.org"]); strings.Join(got, ",") != "d.org" {
+		t.Errorf("Related[c.org] = %v, want only d.org (code blocks ignored)", got)
+	}
+	for _, page := range procFiles.Related["a.org"] {
+		if page.Score <= 0 || page.Score > 1 {
+			t.Errorf("score %v out of range for %s", page.Score, page.Path)
+		}
+	}
+
+	ctx.RelatedWeights = map[string]float64{"links": 0, "tags": 0}
+	procFiles, _ = ComputeRelatedPages(procFiles, ctx)
+	if got := relatedPaths(procFiles.Related["hub.org"]); len(got) != 0 {
+		t.Errorf("Related[hub.org] = %v with only text weighted, want none", got)
+	}
+
+	ctx.RelatedCount = -1
+	procFiles, _ = ComputeRelatedPages(procFiles, ctx)
+	if len(procFiles.Related) != 0 {
+		t.Errorf("Related = %v with a negative count, want none", procFiles.Related)
+	}
+}
+
+func TestComputeRelatedPages_IncludeFragments(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-related-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestDirStructure(tmpDir, []string{"inc"})
+	CreateTestOrgFile(tmpDir, "inc/part.org", "Tomatoes and compost, compost and tomatoes.\n")
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: A\n* Gardening\n#+INCLUDE: \"inc/part.org\"\n")
+	CreateTestOrgFile(tmpDir, "b.org", "#+title: B\n* More gardening\nCompost makes tomatoes happy.\n")
+	CreateTestOrgFile(tmpDir, "c.org", "#+title: C\n* Databases\nIndexes and queries.\n")
+
+	ctx := BuildContext{Root: tmpDir}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	procFiles, _ = ComputeRelatedPages(procFiles, ctx)
+
+	if got := relatedPaths(procFiles.Related["b.org"]); strings.Join(got, ",") != "a.org" {
+		t.Errorf("Related[b.org] = %v, want only a.org", got)
+	}
+	if got, ok := procFiles.Related[filepath.Join("inc", "part.org")]; ok {
+		t.Errorf("Related[inc/part.org] = %v, want the fragment left out", relatedPaths(got))
+	}
+}
+
+func TestRelatedPagesInTemplate(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-related-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: Alpha\n* One :shared:\nText.\n")
+	CreateTestOrgFile(tmpDir, "b.org", "#+title: Beta\n* Two :shared:\nText.\n")
+
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public")}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	procFiles, _ = ComputeRelatedPages(procFiles, ctx)
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	if result := GenerateHtmlPages(procFiles, ctx, tmpls.Page); result.Errors != 0 {
+		t.Fatalf("GenerateHtmlPages() errors = %d", result.Errors)
+	}
+	data, err := os.ReadFile(filepath.Join(ctx.DestDir, "a.html"))
+	if err != nil {
+		t.Fatalf("Failed to read a.html: %v", err)
+	}
+	html := string(data)
+	if !strings.Contains(html, `<aside class="related" data-related="`) || !strings.Contains(html, `<a href="/b.html">Beta</a>`) {
+		t.Errorf("a.html has no related link to b.html:\n%s", html)
+	}
+}
+
+func TestRelatedStale(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-related-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: Alpha\n* One :shared:\nText.\n")
+	CreateTestOrgFile(tmpDir, "b.org", "#+title: Beta\n* Two :shared:\nText.\n")
+
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public")}
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	build := func() *ProcessedFiles {
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		procFiles, _ = ComputeRelatedPages(procFiles, ctx)
+		GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+		return procFiles
+	}
+
+	outputPath := filepath.Join(ctx.DestDir, "a.html")
+	procFiles := build()
+	for _, fi := range procFiles.Files {
+		if fi.Path == "a.org" && relatedStale(fi, procFiles, outputPath) {
+			t.Error("a.html stale right after a build")
+		}
+	}
+
+	// Deleting the related page rebuilds a.html, though a.org is unchanged.
+	os.Remove(filepath.Join(tmpDir, "b.org"))
+	build()
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Failed to read a.html: %v", err)
+	}
+	if strings.Contains(string(data), `class="related"`) {
+		t.Errorf("a.html still lists the deleted page:\n%s", data)
+	}
+}
+
+func TestRelatedCache(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-related-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: Alpha\n* One\nTomatoes.\n")
+	CreateTestOrgFile(tmpDir, "b.org", "#+title: Beta\n* Two\nCompost.\n")
+	ctx := BuildContext{Root: tmpDir}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	a, b := findFile(t, procFiles, "a.org"), findFile(t, procFiles, "b.org")
+
+	cache := NewRelatedCache()
+	cache.termCounts(a, tmpDir)
+	// An unchanged file isn't counted again, whatever its document says.
+	if got := cache.termCounts(FileInfo{Path: "a.org", ParsedOrg: b.ParsedOrg}, tmpDir); got["tomatoes"] != 1 {
+		t.Errorf("termCounts(unchanged a.org) = %v, want the cached counts", got)
+	}
+
+	// A changed one is.
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(tmpDir, "a.org"), later, later)
+	if got := cache.termCounts(FileInfo{Path: "a.org", ParsedOrg: b.ParsedOrg}, tmpDir); got["compost"] != 1 {
+		t.Errorf("termCounts(changed a.org) = %v, want it counted again", got)
+	}
+
+	cache.retain([]FileInfo{b})
+	if _, ok := cache.terms["a.org"]; ok {
+		t.Error("retain() kept a.org")
+	}
+}
+
+// createVault writes n notes to dir that look like a personal vault: text
+// drawn from a Zipf-distributed vocabulary, a couple of tags each from a
+// few dozen, and a few links to other notes.
+func createVault(b *testing.B, dir string, n int) {
+	b.Helper()
+	rng := rand.New(rand.NewPCG(1, 2))
+	vocabulary := rand.NewZipf(rng, 1.1, 1, 20000)
+	for i := range n {
+		var body strings.Builder
+		fmt.Fprintf(&body, "#+title: Note %d\n* Note :t%d:t%d:\n:PROPERTIES:\n:ID: %08x-0000-4000-8000-000000000000\n:END:\n", i, rng.IntN(40), rng.IntN(40), i)
+		for range 3 {
+			fmt.Fprintf(&body, "See [[id:%08x-0000-4000-8000-000000000000][another]].\n", rng.IntN(n))
+		}
+		for range 300 {
+			fmt.Fprintf(&body, "w%d ", vocabulary.Uint64())
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("note%05d.org", i)), []byte(body.String()), 0644); err != nil {
+			b.Fatalf("Failed to write note: %v", err)
+		}
+	}
+}
+
+func BenchmarkComputeRelatedPages(b *testing.B) {
+	for _, n := range []int{500, 2000, 10000} {
+		tmpDir := b.TempDir()
+		createVault(b, tmpDir, n)
+		ctx := BuildContext{Root: tmpDir}
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+
+		b.Run(fmt.Sprintf("notes=%d", n), func(b *testing.B) {
+			for range b.N {
+				procFiles, _ = ComputeRelatedPages(procFiles, ctx)
+			}
+			if len(procFiles.Related) == 0 {
+				b.Error("no related pages computed")
+			}
+		})
+		// A watch rebuild, where the pages' words are already known.
+		ctx.RelatedCache = NewRelatedCache()
+		ComputeRelatedPages(procFiles, ctx)
+		b.Run(fmt.Sprintf("notes=%d/cached", n), func(b *testing.B) {
+			for range b.N {
+				procFiles, _ = ComputeRelatedPages(procFiles, ctx)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package generator
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RenderCache keeps what rendering a page found that isn't in its output:
+// the diagnostics reported and the number of items safe mode stripped. A
+// build that skips a page because its output is current reports them from
+// here instead of rendering the page again. Entries are keyed by page and by
+// the modification time of the output they were found for, so they go stale
+// with it.
+//
+// It is safe for concurrent use, and a nil *RenderCache keeps nothing.
+type RenderCache struct {
+	path string
+
+	mu    sync.Mutex
+	pages map[string]renderCacheEntry
+	used  map[string]bool
+}
+
+type renderCacheEntry struct {
+	OutputModTime time.Time    `json:"output_mod_time"`
+	Stripped      int          `json:"stripped"`
+	Diagnostics   []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// RenderCachePath returns where the render cache of a build into destDir is
+// kept: in the user's cache directory rather than next to the output, so it
+// is never published.
+func RenderCachePath(destDir string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(destDir))
+	return filepath.Join(dir, "oxen", "render-"+hex.EncodeToString(sum[:])[:16]+".json"), nil
+}
+
+// OpenRenderCache returns the render cache stored at path. A missing or
+// unreadable file gives an empty cache, which only costs a render of every
+// skipped page.
+func OpenRenderCache(path string) *RenderCache {
+	c := &RenderCache{path: path, pages: map[string]renderCacheEntry{}, used: map[string]bool{}}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &c.pages); err != nil {
+			c.pages = map[string]renderCacheEntry{}
+		}
+	}
+	return c
+}
+
+// lookup returns the entry for page if it was stored for its output as last
+// modified at outputModTime.
+func (c *RenderCache) lookup(page string, outputModTime time.Time) (renderCacheEntry, bool) {
+	if c == nil {
+		return renderCacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.pages[page]
+	if !ok || !entry.OutputModTime.Equal(outputModTime) {
+		return renderCacheEntry{}, false
+	}
+	c.used[page] = true
+	return entry, true
+}
+
+// store records what rendering page found, for its output at outputPath.
+func (c *RenderCache) store(page, outputPath string, stripped int, diagnostics []Diagnostic) {
+	if c == nil {
+		return
+	}
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pages[page] = renderCacheEntry{info.ModTime(), stripped, diagnostics}
+	c.used[page] = true
+}
+
+// Save writes the entries of the pages this build rendered or skipped back
+// to the cache file. Pages that are gone, or that failed, are dropped.
+func (c *RenderCache) Save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	pages := map[string]renderCacheEntry{}
+	for page := range c.used {
+		pages[page] = c.pages[page]
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(pages)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0644)
+}
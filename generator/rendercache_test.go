@@ -0,0 +1,81 @@
+package generator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderCache_ReplaysSkippedPages(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-rendercache-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "note.org", `#+title: Note
+
+* Formulas
+Inline $\weird{}$ math.
+* Raw
+#+BEGIN_EXPORT html
+<b>raw</b>
+#+END_EXPORT
+`)
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	cachePath := filepath.Join(t.TempDir(), "render.json")
+	build := func(suppress ...string) ([]string, int) {
+		cache := OpenRenderCache(cachePath)
+		ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public"), SafeMode: true, Diagnostics: NewDiagnostics(tmpDir, suppress), RenderCache: cache}
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		result := GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+		if err := cache.Save(); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+		var got []string
+		for _, diag := range ctx.Diagnostics.Entries() {
+			got = append(got, fmt.Sprintf("%s:%d %s %s", diag.File, diag.Line, diag.Code, diag.Message))
+		}
+		return got, result.UnsafeStripped
+	}
+
+	first, stripped := build()
+	if len(first) != 2 || stripped != 1 {
+		t.Fatalf("first build = %v, %d stripped", first, stripped)
+	}
+
+	// A skipped page reports what the cache holds, not what rendering it
+	// again would find.
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cachePath, []byte(strings.ReplaceAll(string(data), "safe mode stripped", "cached: stripped")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, stripped := build()
+	if fmt.Sprint(got) == fmt.Sprint(first) || !strings.Contains(fmt.Sprint(got), "cached: stripped") || stripped != 1 {
+		t.Errorf("cached build = %v, %d stripped; want the cached diagnostics", got, stripped)
+	}
+
+	// Suppression applies to replayed diagnostics as the build sets it.
+	if got, _ := build("math-fallback"); len(got) != 1 || !strings.Contains(got[0], "unsafe-content") {
+		t.Errorf("cached build suppressing math-fallback = %v", got)
+	}
+
+	// A changed output no longer matches its entry, so the page is rendered
+	// again.
+	outputPath := filepath.Join(tmpDir, "public", "note.html")
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(outputPath, info.ModTime(), info.ModTime().Add(1)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := build(); fmt.Sprint(got) != fmt.Sprint(first) {
+		t.Errorf("build after the output changed = %v, want %v", got, first)
+	}
+}
@@ -0,0 +1,140 @@
+package generator
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// ReportVersion is the version of the BuildReport schema. Fields may be
+// added without changing it; it changes when a field is renamed, removed or
+// changes meaning.
+const ReportVersion = 1
+
+// BuildReport is the machine-readable summary of a build written by
+// --report=json. Lists are never null, so consumers need not check.
+type BuildReport struct {
+	Version     int                `json:"version"`
+	DurationMS  float64            `json:"duration_ms"`
+	Counters    ReportCounters     `json:"counters"`
+	Phases      []ReportPhase      `json:"phases"`
+	Files       ReportFiles        `json:"files"`
+	Diagnostics []ReportDiagnostic `json:"diagnostics"`
+	Tags        []ReportTag        `json:"tags"`
+}
+
+// ReportCounters are the counters of a GenerationResult. FilesGenerated and
+// FilesSkipped count pages, feeds and exports; tag pages, images and copied
+// files have counters of their own. ReportFiles lists every output file.
+type ReportCounters struct {
+	TotalFilesScanned      int  `json:"total_files_scanned"`
+	FilesWithIDs           int  `json:"files_with_ids"`
+	FilesGenerated         int  `json:"files_generated"`
+	FilesSkipped           int  `json:"files_skipped"`
+	TagPagesGenerated      int  `json:"tag_pages_generated"`
+	StaticFilesCopied      int  `json:"static_files_copied"`
+	AttachmentsCopied      int  `json:"attachments_copied"`
+	ImageVariantsGenerated int  `json:"image_variants_generated"`
+	SocialCardsGenerated   int  `json:"social_cards_generated"`
+	PrivateLeaks           int  `json:"private_leaks"`
+	LinksDegraded          int  `json:"links_degraded"`
+	UnsafeStripped         int  `json:"unsafe_stripped"`
+	FeedGenerated          bool `json:"feed_generated"`
+	Errors                 int  `json:"errors"`
+	Warnings               int  `json:"warnings"`
+}
+
+// ReportPhase is how long a pipeline phase took.
+type ReportPhase struct {
+	Name       string  `json:"name"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// ReportFiles lists the output files, relative to the output directory with
+// forward slashes, that the build wrote and that it left as they were.
+type ReportFiles struct {
+	Generated []string `json:"generated"`
+	Skipped   []string `json:"skipped"`
+}
+
+// ReportDiagnostic is a Diagnostic. File is "" for the whole site, and Line
+// is 0 when it is not known.
+type ReportDiagnostic struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Message  string `json:"message"`
+}
+
+// ReportTag is a tag and how many pages have it.
+type ReportTag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NewBuildReport returns the report of a build with result, reading the
+// diagnostics, timings and output files from ctx.
+func NewBuildReport(result GenerationResult, procFiles *ProcessedFiles, ctx BuildContext) BuildReport {
+	report := BuildReport{
+		Version:    ReportVersion,
+		DurationMS: milliseconds(result.Duration()),
+		Counters: ReportCounters{
+			TotalFilesScanned:      result.TotalFilesScanned,
+			FilesWithIDs:           result.FilesWithUUIDs,
+			FilesGenerated:         result.FilesGenerated,
+			FilesSkipped:           result.FilesSkipped,
+			TagPagesGenerated:      result.TagPagesGenerated,
+			StaticFilesCopied:      result.StaticFilesCopied,
+			AttachmentsCopied:      result.AttachmentsCopied,
+			ImageVariantsGenerated: result.ImageVariantsGenerated,
+			SocialCardsGenerated:   result.SocialCardsGenerated,
+			PrivateLeaks:           result.PrivateLeaks,
+			LinksDegraded:          result.LinksDegraded,
+			UnsafeStripped:         result.UnsafeStripped,
+			FeedGenerated:          result.FeedGenerated,
+			Errors:                 result.Errors,
+			Warnings:               ctx.Diagnostics.Count(SeverityWarning),
+		},
+		Phases:      []ReportPhase{},
+		Files:       ReportFiles{Generated: ctx.Outputs.Generated(), Skipped: ctx.Outputs.Skipped()},
+		Diagnostics: []ReportDiagnostic{},
+		Tags:        []ReportTag{},
+	}
+	for _, phase := range ctx.Timings.Phases() {
+		report.Phases = append(report.Phases, ReportPhase{Name: phase.Name, DurationMS: milliseconds(phase.Duration)})
+	}
+	for _, diag := range ctx.Diagnostics.Entries() {
+		report.Diagnostics = append(report.Diagnostics, ReportDiagnostic{
+			Severity: diag.Severity.String(),
+			Code:     diag.Code,
+			File:     diag.File,
+			Line:     diag.Line,
+			Message:  diag.Message,
+		})
+	}
+	if procFiles != nil {
+		for _, tag := range procFiles.Index.TagCounts() {
+			report.Tags = append(report.Tags, ReportTag{Name: tag.Name, Count: tag.Count})
+		}
+	}
+	// Most used first, as in the summary.
+	sort.SliceStable(report.Tags, func(i, j int) bool {
+		return report.Tags[i].Count > report.Tags[j].Count
+	})
+	return report
+}
+
+// milliseconds returns d in milliseconds, the unit of every duration in the
+// report.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// WriteJSON writes the report to w as indented JSON.
+func (r BuildReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,119 @@
+package generator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuildReport(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-report-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: A\n* One :go:\nHello {{{missing}}}.\n")
+	CreateTestOrgFile(tmpDir, "b.org", "#+title: B\n* Two :go:emacs:\nWorld.\n")
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	build := func() BuildReport {
+		ctx := BuildContext{
+			Root:        tmpDir,
+			DestDir:     filepath.Join(tmpDir, "public"),
+			Diagnostics: NewDiagnostics(tmpDir, nil),
+			Timings:     NewTimings(),
+			Outputs:     NewOutputLog(),
+		}
+		procFiles, result := NewPipeline(ctx).
+			WithFullPhase(FindAndProcessOrgFiles).
+			WithOutputOnlyPhase(func(procFiles *ProcessedFiles, ctx BuildContext) GenerationResult {
+				return GenerateHtmlPages(procFiles, ctx, tmpls.Page).Add(GenerateTagPages(procFiles, ctx, tmpls.Tag))
+			}).Named("GeneratePages").
+			Execute()
+		return NewBuildReport(result, procFiles, ctx)
+	}
+
+	first := build()
+	if fmt.Sprint(first.Files.Generated) != "[a.html b.html tag-emacs.html tag-go.html]" || len(first.Files.Skipped) != 0 {
+		t.Errorf("first build files = %+v", first.Files)
+	}
+	if fmt.Sprint(first.Tags) != "[{go 2} {emacs 1}]" {
+		t.Errorf("Tags = %v", first.Tags)
+	}
+	if len(first.Phases) != 2 || first.Phases[1].Name != "GeneratePages" {
+		t.Errorf("Phases = %v", first.Phases)
+	}
+	if first.Counters.Warnings != 1 || len(first.Diagnostics) != 1 || first.Diagnostics[0] != (ReportDiagnostic{"warning", "macro-undefined", "a.org", 3, "undefined macro {{{missing}}}"}) {
+		t.Errorf("Diagnostics = %+v", first.Diagnostics)
+	}
+
+	if first.Counters.FilesGenerated != 2 || first.Counters.FilesSkipped != 0 {
+		t.Errorf("first build counters = %+v", first.Counters)
+	}
+
+	// A rebuild with nothing to do counts the pages as skipped and lists no
+	// generated files.
+	second := build()
+	if len(second.Files.Generated) != 0 || fmt.Sprint(second.Files.Skipped) != "[a.html b.html tag-emacs.html tag-go.html]" {
+		t.Errorf("second build files = %+v", second.Files)
+	}
+	if second.Counters.FilesGenerated != 0 || second.Counters.FilesSkipped != 2 {
+		t.Errorf("second build counters = %+v", second.Counters)
+	}
+
+	var buf bytes.Buffer
+	if err := second.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("report is not JSON: %v", err)
+	}
+	keys := slices.Sorted(maps.Keys(decoded))
+	if fmt.Sprint(keys) != "[counters diagnostics duration_ms files phases tags version]" {
+		t.Errorf("report keys = %v", keys)
+	}
+	if generated, ok := decoded["files"].(map[string]any)["generated"].([]any); !ok || len(generated) != 0 {
+		t.Errorf("files.generated = %#v, want []", decoded["files"].(map[string]any)["generated"])
+	}
+	// A build that reports nothing still has lists, not nulls.
+	if empty := NewBuildReport(GenerationResult{}, nil, BuildContext{}); empty.Diagnostics == nil || empty.Tags == nil || empty.Files.Generated == nil || empty.Phases == nil {
+		t.Errorf("empty report has null lists: %+v", empty)
+	}
+}
+
+func TestWriteSummaryWithoutTerminal(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-report-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: A\n* One :go:\nHello.\n")
+	procFiles, result := FindAndProcessOrgFiles(nil, BuildContext{Root: tmpDir})
+	diagnostics := NewDiagnostics(tmpDir, nil)
+	diagnostics.Warn("no-title", "a.org", 0, "no title")
+
+	var buf bytes.Buffer
+	result.WriteSummary(&buf, procFiles, diagnostics)
+	if strings.Contains(buf.String(), "\x1b[") {
+		t.Errorf("summary written to a buffer has ANSI colours: %q", buf.String())
+	}
+	for _, want := range []string{"Total files scanned:  1", "go (1)", "warning: no title [no-title]"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("summary is missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	f, err := os.Create(filepath.Join(tmpDir, "summary.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if colorTerminal(f) {
+		t.Error("colorTerminal() of a regular file = true")
+	}
+}
@@ -0,0 +1,202 @@
+package generator
+
+import (
+	"bytes"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// SourceDateEpoch returns the time in the SOURCE_DATE_EPOCH environment
+// variable, which reproducible builds use in place of the current time and
+// to clamp file modification times. It returns the zero time if the
+// variable is unset.
+func SourceDateEpoch() (time.Time, error) {
+	value := strings.TrimSpace(os.Getenv("SOURCE_DATE_EPOCH"))
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// buildTime returns the time the build runs at: ctx.SourceDate when set, or
+// else the current time.
+func buildTime(ctx BuildContext) time.Time {
+	if !ctx.SourceDate.IsZero() {
+		return ctx.SourceDate
+	}
+	return time.Now()
+}
+
+// sourceModTime returns the modification time Oxen uses for a source file.
+// With ctx.SourceDate set, it is clamped to it, and in UTC, so that output
+// doesn't depend on when or where the sources were checked out.
+func sourceModTime(ctx BuildContext, modTime time.Time) time.Time {
+	if ctx.SourceDate.IsZero() {
+		return modTime
+	}
+	if modTime.After(ctx.SourceDate) {
+		modTime = ctx.SourceDate
+	}
+	return modTime.UTC()
+}
+
+var (
+	// reHeadlineTimestamp matches a timestamp in a headline's title.
+	reHeadlineTimestamp = regexp.MustCompile(`[<\[]\d{4}-\d{2}-\d{2}[^>\]]*[>\]]`)
+	// reClosed matches the timestamp of a CLOSED: planning line.
+	reClosed = regexp.MustCompile(`CLOSED:\s*(\[[^\]]*\])`)
+)
+
+// pageTime returns the time of the page for doc: its #+DATE:, or else the
+// newest timestamp in a headline's title or CLOSED: line, or else modTime,
+// its file's modification time. Times from the content don't change when
+// the file is checked out or touched, so only pages without one depend on
+// the filesystem. The time is clamped as sourceModTime does.
+func pageTime(ctx BuildContext, doc *org.Document, modTime time.Time) time.Time {
+	if date, ok := parseOrgDate(doc.Get("DATE")); ok {
+		return sourceModTime(ctx, date)
+	}
+	var newest time.Time
+	found := func(s string) {
+		if t, ok := parseOrgDate(s); ok && t.After(newest) {
+			newest = t
+		}
+	}
+	walkOrgNodes(doc.Nodes, func(node org.Node) bool {
+		switch n := node.(type) {
+		case org.Headline:
+			for _, ts := range reHeadlineTimestamp.FindAllString(org.String(n.Title...), -1) {
+				found(ts)
+			}
+		case org.Paragraph:
+			if isPlanningLine(n) {
+				if m := reClosed.FindStringSubmatch(org.String(n.Children...)); m != nil {
+					found(m[1])
+				}
+			}
+			return false
+		}
+		return true
+	})
+	if !newest.IsZero() {
+		return sourceModTime(ctx, newest)
+	}
+	return sourceModTime(ctx, modTime)
+}
+
+// sortByRecency sorts files newest first, and files modified at the same
+// time by path.
+func sortByRecency(files []FileInfo) {
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].ModTime.Equal(files[j].ModTime) {
+			return files[i].ModTime.After(files[j].ModTime)
+		}
+		return files[i].Path < files[j].Path
+	})
+}
+
+// embeddedTemplatesModTime returns when the embedded templates last changed:
+// when the running executable was built. It returns the zero time if that
+// can't be found.
+func embeddedTemplatesModTime() time.Time {
+	exe, err := os.Executable()
+	if err != nil {
+		return time.Time{}
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// OutputDiff lists the files that differ between two output directories, by
+// path relative to them.
+type OutputDiff struct {
+	Changed []string
+	Missing []string // only in the expected directory
+	Extra   []string // only in the actual directory
+}
+
+// Empty reports whether the directories are identical.
+func (d OutputDiff) Empty() bool {
+	return len(d.Changed) == 0 && len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+// DiffOutput compares the files under want and got byte for byte.
+func DiffOutput(want, got string) (OutputDiff, error) {
+	wantFiles, err := listOutputFiles(want)
+	if err != nil {
+		return OutputDiff{}, err
+	}
+	gotFiles, err := listOutputFiles(got)
+	if err != nil {
+		return OutputDiff{}, err
+	}
+
+	return diffOutputFiles(wantFiles, gotFiles, func(rel string) (bool, error) {
+		a, err := os.ReadFile(filepath.Join(want, filepath.FromSlash(rel)))
+		if err != nil {
+			return false, err
+		}
+		b, err := os.ReadFile(filepath.Join(got, filepath.FromSlash(rel)))
+		return bytes.Equal(a, b), err
+	})
+}
+
+// diffOutputFiles compares two sets of output files, calling same for each
+// file in both.
+func diffOutputFiles(want, got map[string]bool, same func(rel string) (bool, error)) (OutputDiff, error) {
+	var diff OutputDiff
+	for _, rel := range slices.Sorted(maps.Keys(want)) {
+		if !got[rel] {
+			diff.Missing = append(diff.Missing, rel)
+			continue
+		}
+		equal, err := same(rel)
+		if err != nil {
+			return OutputDiff{}, err
+		}
+		if !equal {
+			diff.Changed = append(diff.Changed, rel)
+		}
+	}
+	for _, rel := range slices.Sorted(maps.Keys(got)) {
+		if !want[rel] {
+			diff.Extra = append(diff.Extra, rel)
+		}
+	}
+	return diff, nil
+}
+
+// listOutputFiles returns the files under root, by slash-separated path
+// relative to it.
+func listOutputFiles(root string) (map[string]bool, error) {
+	files := map[string]bool{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,225 @@
+package generator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceDateEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	got, err := SourceDateEpoch()
+	if err != nil || !got.Equal(time.Unix(1700000000, 0)) || got.Location() != time.UTC {
+		t.Errorf("SourceDateEpoch() = %v, %v", got, err)
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if _, err := SourceDateEpoch(); err == nil {
+		t.Error("SourceDateEpoch() accepted an invalid value")
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	if got, err := SourceDateEpoch(); err != nil || !got.IsZero() {
+		t.Errorf("unset SourceDateEpoch() = %v, %v", got, err)
+	}
+
+	ctx := BuildContext{SourceDate: time.Unix(1700000000, 0).UTC()}
+	later := time.Unix(1800000000, 0).In(time.FixedZone("X", 3600))
+	earlier := time.Unix(1600000000, 0).In(time.FixedZone("X", 3600))
+	if got := sourceModTime(ctx, later); !got.Equal(ctx.SourceDate) {
+		t.Errorf("sourceModTime(later) = %v, want it clamped", got)
+	}
+	if got := sourceModTime(ctx, earlier); !got.Equal(earlier) || got.Location() != time.UTC {
+		t.Errorf("sourceModTime(earlier) = %v, want it unchanged in UTC", got)
+	}
+	if got := sourceModTime(BuildContext{}, later); got != later {
+		t.Errorf("sourceModTime() without SourceDate = %v", got)
+	}
+}
+
+func TestPageTime(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-reproducible-")
+	defer CleanupTempDir(tmpDir)
+
+	modTime := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name, content string
+		want          time.Time
+	}{
+		{"date", "#+date: <2024-03-05 Tue>\n* Done [2024-05-01 Wed]\n", time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)},
+		{"headlines", "#+title: Log\n* [2024-04-01 Mon 09:30] Entry\n* DONE Task\nCLOSED: [2024-04-02 Tue 18:00]\n* <2024-01-01 Mon> Old\n", time.Date(2024, 4, 2, 18, 0, 0, 0, time.UTC)},
+		{"planned", "#+title: Plans\n* TODO Later\nSCHEDULED: <2024-09-01 Sun>\nBody [2024-09-02 Mon].\n", modTime},
+		{"none", "#+title: Plain\n* Heading\nBody.\n", modTime},
+	} {
+		CreateTestFileWithModTime(tmpDir, tt.name+".org", []byte(tt.content), modTime)
+		fi, err := processFile(tt.name+".org", BuildContext{Root: tmpDir})
+		if err != nil {
+			t.Fatalf("processFile(%s) error = %v", tt.name, err)
+		}
+		if !fi.ModTime.Equal(tt.want) {
+			t.Errorf("%s: ModTime = %v, want %v", tt.name, fi.ModTime, tt.want)
+		}
+	}
+
+	// A page's time is clamped to SOURCE_DATE_EPOCH like file times are.
+	sourceDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fi, err := processFile("date.org", BuildContext{Root: tmpDir, SourceDate: sourceDate})
+	if err != nil || !fi.ModTime.Equal(sourceDate) {
+		t.Errorf("ModTime with SourceDate = %v, %v, want %v", fi.ModTime, err, sourceDate)
+	}
+}
+
+func TestPageTime_Rebuild(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-reproducible-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestFileWithModTime(tmpDir, "note.org", []byte("#+title: Note\n#+date: 2020-01-01\nFirst.\n"), time.Now().Add(-time.Hour))
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public")}
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	build := func() string {
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+		data, err := os.ReadFile(filepath.Join(ctx.DestDir, "note.html"))
+		if err != nil {
+			t.Fatalf("Failed to read note.html: %v", err)
+		}
+		return string(data)
+	}
+	if page := build(); !strings.Contains(page, "January 1, 2020") {
+		t.Errorf("note.html isn't dated from #+DATE:\n%s", page)
+	}
+
+	// The page is still rebuilt when the file changes, though its date doesn't.
+	CreateTestFileWithModTime(tmpDir, "note.org", []byte("#+title: Note\n#+date: 2020-01-01\nSecond.\n"), time.Now().Add(time.Hour))
+	if page := build(); !strings.Contains(page, "Second.") {
+		t.Errorf("note.html not rebuilt after an edit:\n%s", page)
+	}
+}
+
+func TestSortByRecency(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []FileInfo{{Path: "b.org", ModTime: day}, {Path: "old.org", ModTime: day.Add(-time.Hour)}, {Path: "a.org", ModTime: day}}
+	sortByRecency(files)
+	var got []string
+	for _, fi := range files {
+		got = append(got, fi.Path)
+	}
+	if strings.Join(got, " ") != "a.org b.org old.org" {
+		t.Errorf("sortByRecency() = %v", got)
+	}
+}
+
+func TestReproducibleBuild(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-reproducible-")
+	defer CleanupTempDir(tmpDir)
+
+	for i := range 12 {
+		CreateTestOrgFile(tmpDir, fmt.Sprintf("note%02d.org", i), fmt.Sprintf("#+title: Note %d\n* Heading :go:\nBody %d.\n", i, i))
+	}
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	build := func(dest string) {
+		ctx := BuildContext{Root: tmpDir, DestDir: dest, ForceRebuild: true, SourceDate: day}
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		for i, fi := range procFiles.Index.FilesWithTag("go") {
+			if want := fmt.Sprintf("note%02d.org", i); fi.Path != want {
+				t.Fatalf("FilesWithTag(go)[%d] = %s, want %s", i, fi.Path, want)
+			}
+		}
+		os.MkdirAll(dest, 0755)
+		GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+		GenerateTagPages(procFiles, ctx, tmpls.Tag)
+		GenerateIndexPage(procFiles, ctx, tmpls.Index)
+		GenerateAtomFeed(procFiles, ctx, tmpls.Atom)
+	}
+
+	first, second := filepath.Join(tmpDir, "first"), filepath.Join(tmpDir, "second")
+	build(first)
+	// Touching the sources moves them past SourceDate, which clamps them.
+	later := time.Now()
+	for i := range 12 {
+		os.Chtimes(filepath.Join(tmpDir, fmt.Sprintf("note%02d.org", i)), later, later)
+	}
+	build(second)
+
+	diff, err := DiffOutput(first, second)
+	if err != nil || !diff.Empty() {
+		t.Errorf("builds differ: %+v, %v", diff, err)
+	}
+	feed, err := os.ReadFile(filepath.Join(first, "feed.xml"))
+	if err != nil || !strings.Contains(string(feed), "<updated>2024-01-01T00:00:00Z</updated>") {
+		t.Errorf("feed.xml should be updated at SourceDate: %s, %v", feed, err)
+	}
+}
+
+func TestIncrementalBuildMatchesFreshBuild(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-incremental-")
+	defer CleanupTempDir(tmpDir)
+
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		CreateTestFileWithModTime(tmpDir, fmt.Sprintf("note%d.org", i), []byte(fmt.Sprintf("#+title: Note %d\n* Heading :go:\nBody %d.\n", i, i)), day.Add(time.Duration(i)*time.Hour))
+	}
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	build := func(dest string, force bool) {
+		ctx := BuildContext{Root: tmpDir, DestDir: dest, ForceRebuild: force}
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		os.MkdirAll(dest, 0755)
+		GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+		GenerateTagPages(procFiles, ctx, tmpls.Tag)
+		GenerateIndexPage(procFiles, ctx, tmpls.Index)
+		GenerateAtomFeed(procFiles, ctx, tmpls.Atom)
+	}
+
+	site, fresh := filepath.Join(tmpDir, "site"), filepath.Join(tmpDir, "fresh")
+	build(site, false)
+	// An older note is edited, one is added and one is removed, none of
+	// which touches the templates or data.
+	now := time.Now()
+	CreateTestFileWithModTime(tmpDir, "note0.org", []byte("#+title: Note Zero\n* Heading :go:\nEdited.\n"), now)
+	CreateTestFileWithModTime(tmpDir, "note3.org", []byte("#+title: Note 3\n* Heading :go:\nNew.\n"), now)
+	os.Remove(filepath.Join(tmpDir, "note1.org"))
+	build(site, false)
+	build(fresh, true)
+
+	diff, err := DiffOutput(fresh, site)
+	if err != nil {
+		t.Fatalf("DiffOutput() error = %v", err)
+	}
+	if len(diff.Changed) != 0 || len(diff.Missing) != 0 {
+		t.Errorf("incremental build differs from a fresh build: %+v", diff)
+	}
+}
+
+func TestDiffOutput(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-diff-")
+	defer CleanupTempDir(tmpDir)
+
+	want, got := filepath.Join(tmpDir, "want"), filepath.Join(tmpDir, "got")
+	CreateTestDirStructure(tmpDir, []string{"want/sub", "got/sub"})
+	for path, content := range map[string]string{
+		"want/same.html": "same", "got/same.html": "same",
+		"want/sub/changed.html": "old", "got/sub/changed.html": "new",
+		"want/missing.html": "gone",
+		"got/extra.html":    "new file",
+	} {
+		CreateTestOrgFile(tmpDir, path, content)
+	}
+	diff, err := DiffOutput(want, got)
+	if err != nil {
+		t.Fatalf("DiffOutput() error = %v", err)
+	}
+	if fmt.Sprint(diff.Changed, diff.Missing, diff.Extra) != "[sub/changed.html] [missing.html] [extra.html]" {
+		t.Errorf("DiffOutput() = %+v", diff)
+	}
+}
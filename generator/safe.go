@@ -0,0 +1,183 @@
+package generator
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// unsafeURLSchemes are the URL schemes that run code or embed documents when
+// followed, which safe mode removes from links and attributes.
+var unsafeURLSchemes = map[string]bool{"javascript": true, "vbscript": true, "data": true}
+
+// safeHTMLAttributes are the #+ATTR_HTML: attributes kept in safe mode,
+// besides data-* and aria-* ones. href and src are kept only with a safe URL,
+// and style only without url() or expression().
+var safeHTMLAttributes = map[string]bool{
+	"alt": true, "class": true, "dir": true, "height": true, "href": true, "id": true,
+	"lang": true, "loading": true, "rel": true, "src": true, "style": true,
+	"target": true, "title": true, "width": true,
+}
+
+var reRenderedURL = regexp.MustCompile(`\s(?:href|src)="([^"]*)"`)
+
+// The source lines of the items safe mode strips, for their diagnostics.
+var (
+	reExportBlockSource = regexp.MustCompile(`(?i)^\s*#\+begin_export\s+html\b`)
+	reInlineBlockSource = regexp.MustCompile(`(?i)@@html:`)
+	reHTMLKeywordSource = regexp.MustCompile(`(?i)^\s*#\+html:`)
+)
+
+// reSourceText matches the source lines containing text, in any case.
+func reSourceText(text string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)` + regexp.QuoteMeta(text))
+}
+
+// isSafeURL reports whether url, which may be HTML-escaped, has no unsafe
+// scheme. Browsers ignore whitespace and control characters in schemes, so
+// they are dropped first.
+func isSafeURL(url string) bool {
+	url = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, html.UnescapeString(url))
+	scheme, _, ok := strings.Cut(url, ":")
+	if !ok || strings.ContainsAny(scheme, "/?#") {
+		return true
+	}
+	return !unsafeURLSchemes[strings.ToLower(scheme)]
+}
+
+// htmlSanitizer strips raw HTML, unsafe links and unsafe #+ATTR_HTML:
+// attributes from a page when safe mode is on, warning about each item it
+// strips.
+type htmlSanitizer struct {
+	enabled     bool
+	path        string
+	stripped    int
+	diagnostics *Diagnostics
+	position    *sourcePosition
+}
+
+// strip reports item, at the first line that source matches in the headline
+// being written.
+func (s *htmlSanitizer) strip(item, detail string, source *regexp.Regexp) {
+	s.diagnostics.Warn("unsafe-content", s.path, s.position.lineMatching(source), "safe mode stripped %s %s", item, detail)
+	s.stripped++
+}
+
+// stripBlock reports whether b is a raw HTML export block, which it strips.
+func (s *htmlSanitizer) stripBlock(b org.Block) bool {
+	if !s.enabled || b.Name != "EXPORT" || len(b.Parameters) == 0 || !strings.EqualFold(b.Parameters[0], "html") {
+		return false
+	}
+	s.strip("export block", "#+begin_export html", reExportBlockSource)
+	return true
+}
+
+// reSafeSrcLanguage matches the source block languages safe mode keeps. go-org
+// writes the language into a class attribute unescaped.
+var reSafeSrcLanguage = regexp.MustCompile(`^[A-Za-z0-9_+-]+$`)
+
+// sanitizeBlock returns b with, in safe mode, a source block language that
+// could break out of its class attribute replaced by "text".
+func (s *htmlSanitizer) sanitizeBlock(b org.Block) org.Block {
+	if !s.enabled || b.Name != "SRC" || len(b.Parameters) == 0 || reSafeSrcLanguage.MatchString(b.Parameters[0]) {
+		return b
+	}
+	s.strip("source block language", b.Parameters[0], regexp.MustCompile(`(?i)^\s*#\+begin_src\s+`+regexp.QuoteMeta(b.Parameters[0])))
+	b.Parameters = append([]string{"text"}, b.Parameters[1:]...)
+	return b
+}
+
+// stripInlineBlock reports whether b is an @@html:...@@ snippet, which it
+// strips.
+func (s *htmlSanitizer) stripInlineBlock(b org.InlineBlock) bool {
+	if !s.enabled || b.Name != "export" || len(b.Parameters) == 0 || !strings.EqualFold(b.Parameters[0], "html") {
+		return false
+	}
+	s.strip("inline snippet", "@@html:...@@", reInlineBlockSource)
+	return true
+}
+
+// stripKeyword reports whether k is an #+HTML: line, which it strips.
+func (s *htmlSanitizer) stripKeyword(k org.Keyword) bool {
+	if !s.enabled || k.Key != "HTML" {
+		return false
+	}
+	s.strip("keyword", "#+HTML:", reHTMLKeywordSource)
+	return true
+}
+
+// writeRegularLink writes link with w. In safe mode, a link whose href or
+// src has an unsafe scheme is written as its description alone.
+func (s *htmlSanitizer) writeRegularLink(w *org.HTMLWriter, link org.RegularLink) {
+	if !s.enabled {
+		w.WriteRegularLink(link)
+		return
+	}
+	// Render the link on its own, as go-org resolves #+LINK: abbreviations
+	// while writing it.
+	original := w.Builder
+	w.Builder = strings.Builder{}
+	w.WriteRegularLink(link)
+	out := w.String()
+	w.Builder = original
+
+	for _, m := range reRenderedURL.FindAllStringSubmatch(out, -1) {
+		if !isSafeURL(m[1]) {
+			scheme, _, _ := strings.Cut(strings.TrimSpace(html.UnescapeString(m[1])), ":")
+			s.strip("link", scheme+":", reSourceText(strings.TrimSpace(link.URL)))
+			if link.Description != nil {
+				org.WriteNodes(w.WriterWithExtensions(), link.Description...)
+			} else {
+				w.WriteString(html.EscapeString(link.URL))
+			}
+			return
+		}
+	}
+	w.WriteString(out)
+}
+
+// sanitizeMeta returns meta without the #+ATTR_HTML: attributes safe mode
+// doesn't allow.
+func (s *htmlSanitizer) sanitizeMeta(meta org.Metadata) org.Metadata {
+	if !s.enabled {
+		return meta
+	}
+	attributes := make([][]string, 0, len(meta.HTMLAttributes))
+	for _, kvs := range meta.HTMLAttributes {
+		kept := make([]string, 0, len(kvs))
+		for i := 0; i+1 < len(kvs); i += 2 {
+			key, value := strings.ToLower(strings.TrimPrefix(kvs[i], ":")), kvs[i+1]
+			if !s.safeAttribute(key, value) {
+				s.strip("attribute", key, regexp.MustCompile(`(?i)^\s*#\+attr_html:.*:`+regexp.QuoteMeta(key)+`(\s|$)`))
+				continue
+			}
+			kept = append(kept, kvs[i], value)
+		}
+		attributes = append(attributes, kept)
+	}
+	meta.HTMLAttributes = attributes
+	return meta
+}
+
+func (s *htmlSanitizer) safeAttribute(key, value string) bool {
+	switch {
+	case strings.HasPrefix(key, "data-") || strings.HasPrefix(key, "aria-"):
+		return true
+	case !safeHTMLAttributes[key]:
+		return false
+	case key == "href" || key == "src":
+		return isSafeURL(value)
+	case key == "style":
+		lower := strings.ToLower(value)
+		return !strings.Contains(lower, "url(") && !strings.Contains(lower, "expression(")
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package generator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const unsafeFixture = `#+title: Contributed
+#+link: js javascript:%s
+
+#+begin_export html
+<script>alert("block")</script>
+#+end_export
+
+Inline @@html:<b onclick="alert(1)">snippet</b>@@ and a [[javascript:alert(2)][bad link]].
+An [[js:alert(3)][abbreviated link]], a [[https://example.com][good link]] and [[ JavaScript:alert(4)]].
+
+#+HTML: <iframe src="https://evil.example"></iframe>
+
+#+ATTR_HTML: :width 300 :onerror alert(5) :class photo :style background: url(https://evil.example/x)
+[[file:photo.png]]
+`
+
+func TestIsSafeURL(t *testing.T) {
+	for url, want := range map[string]bool{
+		"https://example.com":        true,
+		"notes/page.html#headline-1": true,
+		"mailto:me@example.com":      true,
+		"page.html?q=a:b":            true,
+		"javascript:alert(1)":        false,
+		" JaVaScRiPt:alert(1)":       false,
+		"java\tscript:alert(1)":      false,
+		"&#106;avascript:alert(1)":   false,
+		"vbscript:msgbox":            false,
+		"data:text/html,<script>":    false,
+	} {
+		if got := isSafeURL(url); got != want {
+			t.Errorf("isSafeURL(%q) = %v, want %v", url, got, want)
+		}
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-safe-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "contributed.org", unsafeFixture)
+	for _, safeMode := range []bool{false, true} {
+		ctx := BuildContext{Root: tmpDir, SafeMode: safeMode}
+		fi, err := processFile("contributed.org", ctx)
+		if err != nil {
+			t.Fatalf("processFile() error = %v", err)
+		}
+		writer := newPageWriter(fi.ParsedOrg, *fi, ctx, nil, nil)
+		html, err := fi.ParsedOrg.Write(writer)
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+
+		unsafe := []string{"<script>", "onclick", "<iframe", "onerror", "url("}
+		if !safeMode {
+			if !strings.Contains(html, "<script>") || !strings.Contains(html, `href="javascript:alert(2)"`) {
+				t.Errorf("without safe mode, raw HTML should pass through: %s", html)
+			}
+			if writer.safe.stripped != 0 {
+				t.Errorf("without safe mode, stripped = %d", writer.safe.stripped)
+			}
+			continue
+		}
+		for _, s := range unsafe {
+			if strings.Contains(html, s) {
+				t.Errorf("safe mode kept %q: %s", s, html)
+			}
+		}
+		for _, m := range reRenderedURL.FindAllStringSubmatch(html, -1) {
+			if !isSafeURL(m[1]) {
+				t.Errorf("safe mode kept the URL %q", m[1])
+			}
+		}
+		for _, want := range []string{
+			"a bad link.",
+			"An abbreviated link,",
+			`<a href="https://example.com">good link</a>`,
+			`width="300"`,
+			`class="photo"`,
+		} {
+			if !strings.Contains(html, want) {
+				t.Errorf("safe mode output missing %q: %s", want, html)
+			}
+		}
+		// The export block, snippet, three links, #+HTML: line and two attributes.
+		if writer.safe.stripped != 8 {
+			t.Errorf("stripped = %d, want 8", writer.safe.stripped)
+		}
+	}
+}
+
+func TestSafeMode_SrcLanguage(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-safe-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "contributed.org", `#+title: Contributed
+
+#+begin_src x"><img/src=x/onerror=alert(1)> -n
+payload
+#+end_src
+
+#+begin_src c++
+int main() {}
+#+end_src
+`)
+	ctx := BuildContext{Root: tmpDir, SafeMode: true, Diagnostics: NewDiagnostics(tmpDir, nil)}
+	fi, err := processFile("contributed.org", ctx)
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	writer := newPageWriter(fi.ParsedOrg, *fi, ctx, nil, nil)
+	html, err := fi.ParsedOrg.Write(writer)
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if strings.Contains(html, "<img") || strings.Contains(html, "onerror") {
+		t.Errorf("safe mode kept the source block language: %s", html)
+	}
+	if !strings.Contains(html, "src-text") || !strings.Contains(html, "payload") || !strings.Contains(html, "src-c++") {
+		t.Errorf("safe mode should keep the blocks and safe languages: %s", html)
+	}
+	if writer.safe.stripped != 1 || ctx.Diagnostics.Count(SeverityWarning) != 1 || ctx.Diagnostics.Entries()[0].Code != "unsafe-content" {
+		t.Errorf("stripped = %d, diagnostics = %v", writer.safe.stripped, ctx.Diagnostics.Entries())
+	}
+}
+
+func TestSafeMode_Lines(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-safe-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "contributed.org", `#+title: Contributed
+* One
+#+HTML: <b>one</b>
+* Two
+Text.
+#+html: <b>two</b>
+#+begin_export HTML
+<b>three</b>
+#+end_export
+Text @@html:<i>@@ and [[javascript:alert(1)][a link]].
+#+ATTR_HTML: :class photo :onclick alert(2)
+[[file:photo.png]]
+#+begin_src x"y
+z
+#+end_src
+`)
+	ctx := BuildContext{Root: tmpDir, SafeMode: true, Diagnostics: NewDiagnostics(tmpDir, nil)}
+	fi, err := processFile("contributed.org", ctx)
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+	if _, err := fi.ParsedOrg.Write(newPageWriter(fi.ParsedOrg, *fi, ctx, nil, nil)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	var got []string
+	for _, diag := range ctx.Diagnostics.Entries() {
+		got = append(got, fmt.Sprintf("%d %s", diag.Line, strings.TrimPrefix(diag.Message, "safe mode stripped ")))
+	}
+	want := []string{
+		"3 keyword #+HTML:",
+		"6 keyword #+HTML:",
+		"7 export block #+begin_export html",
+		"10 inline snippet @@html:...@@",
+		"10 link javascript:",
+		"11 attribute onclick",
+		`13 source block language x"y`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diagnostics =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSafeModeSummary(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-safe-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "contributed.org", unsafeFixture)
+	CreateTestOrgFile(tmpDir, "sitemap-preamble.org", "Welcome @@html:<script>x()</script>@@ to the site.\n")
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public"), SafeMode: true}
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	os.MkdirAll(ctx.DestDir, 0755)
+	if result := GenerateHtmlPages(procFiles, ctx, tmpls.Page); result.UnsafeStripped != 8 {
+		t.Errorf("GenerateHtmlPages() stripped %d, want 8", result.UnsafeStripped)
+	}
+	if result := GenerateIndexPage(procFiles, ctx, tmpls.Index); result.UnsafeStripped != 1 {
+		t.Errorf("GenerateIndexPage() stripped %d, want 1", result.UnsafeStripped)
+	}
+	data, err := os.ReadFile(filepath.Join(ctx.DestDir, "index.html"))
+	if err != nil || strings.Contains(string(data), "x()") {
+		t.Errorf("index.html kept the preamble's script: %v", err)
+	}
+}
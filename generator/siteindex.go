@@ -0,0 +1,165 @@
+package generator
+
+import (
+	"maps"
+	"slices"
+)
+
+// SiteIndex maps tags, IDs, id: links and paths to the pages of a site. It
+// is built in one pass once every file is parsed, and not changed after, so
+// it may be read from any goroutine. Files are listed in the order they were
+// given, which is path order.
+type SiteIndex struct {
+	files     []FileInfo
+	paths     map[string]int
+	tags      map[string][]int
+	ids       map[UUID]HeaderLocation
+	links     map[string][]string
+	backlinks map[string][]string
+
+	// duplicates are the IDs NewSiteIndex found on more than one file.
+	duplicates []duplicateID
+}
+
+// duplicateID is an ID in path that kept's headline already has.
+type duplicateID struct {
+	id         UUID
+	path, kept string
+}
+
+// NewSiteIndex indexes files. If two headlines share an ID, the first one in
+// file order keeps it.
+func NewSiteIndex(files []FileInfo) *SiteIndex {
+	ids := map[UUID]HeaderLocation{}
+	var duplicates []duplicateID
+	for _, fi := range files {
+		for _, id := range slices.Sorted(maps.Keys(fi.UUIDs)) {
+			if existing, ok := ids[id]; ok {
+				duplicates = append(duplicates, duplicateID{id: id, path: fi.Path, kept: existing.FilePath})
+				continue
+			}
+			ids[id] = HeaderLocation{FilePath: fi.Path, HeaderIndex: fi.UUIDs[id]}
+		}
+	}
+	idx := newSiteIndex(files, ids)
+	idx.duplicates = duplicates
+	return idx
+}
+
+func newSiteIndex(files []FileInfo, ids map[UUID]HeaderLocation) *SiteIndex {
+	idx := &SiteIndex{
+		files:     files,
+		paths:     make(map[string]int, len(files)),
+		tags:      map[string][]int{},
+		ids:       ids,
+		links:     map[string][]string{},
+		backlinks: map[string][]string{},
+	}
+	for i, fi := range files {
+		idx.paths[fi.Path] = i
+		for _, tag := range fi.Tags {
+			if tagged := idx.tags[tag]; len(tagged) == 0 || tagged[len(tagged)-1] != i {
+				idx.tags[tag] = append(tagged, i)
+			}
+		}
+	}
+	for _, fi := range files {
+		seen := map[string]bool{}
+		for _, id := range fi.Links {
+			location, ok := ids[id]
+			if !ok || location.FilePath == fi.Path || seen[location.FilePath] {
+				continue
+			}
+			seen[location.FilePath] = true
+			idx.links[fi.Path] = append(idx.links[fi.Path], location.FilePath)
+			idx.backlinks[location.FilePath] = append(idx.backlinks[location.FilePath], fi.Path)
+		}
+	}
+	return idx
+}
+
+// scoped returns an index of files, a subset of idx's, that keeps every ID
+// in idx so links to the files left out can still be recognized.
+func (idx *SiteIndex) scoped(files []FileInfo) *SiteIndex {
+	if idx == nil {
+		return NewSiteIndex(files)
+	}
+	return newSiteIndex(files, idx.ids)
+}
+
+// File returns the page at path.
+func (idx *SiteIndex) File(path string) (FileInfo, bool) {
+	if idx == nil {
+		return FileInfo{}, false
+	}
+	i, ok := idx.paths[path]
+	if !ok {
+		return FileInfo{}, false
+	}
+	return idx.files[i], true
+}
+
+// Tags returns every tag, sorted.
+func (idx *SiteIndex) Tags() []string {
+	if idx == nil {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(idx.tags))
+}
+
+// TagCounts returns every tag with its number of pages, sorted by name.
+func (idx *SiteIndex) TagCounts() []TagInfo {
+	var tags []TagInfo
+	for _, tag := range idx.Tags() {
+		tags = append(tags, TagInfo{Name: tag, Count: len(idx.tags[tag])})
+	}
+	return tags
+}
+
+// FilesWithTag returns the pages tagged with tag, in file order. The slice
+// is the caller's to sort or change.
+func (idx *SiteIndex) FilesWithTag(tag string) []FileInfo {
+	if idx == nil {
+		return nil
+	}
+	var files []FileInfo
+	for _, i := range idx.tags[tag] {
+		files = append(files, idx.files[i])
+	}
+	return files
+}
+
+// Lookup returns the headline with ID id.
+func (idx *SiteIndex) Lookup(id UUID) (HeaderLocation, bool) {
+	if idx == nil {
+		return HeaderLocation{}, false
+	}
+	location, ok := idx.ids[id]
+	return location, ok
+}
+
+// Locations returns a copy of the map from every ID to its headline.
+func (idx *SiteIndex) Locations() map[UUID]HeaderLocation {
+	if idx == nil {
+		return map[UUID]HeaderLocation{}
+	}
+	return maps.Clone(idx.ids)
+}
+
+// LinksFrom returns the paths of the other pages path links to with id:
+// links, in order of first link.
+func (idx *SiteIndex) LinksFrom(path string) []string {
+	if idx == nil {
+		return nil
+	}
+	return slices.Clone(idx.links[path])
+}
+
+// LinksTo returns the paths of the pages linking to path with id: links, in
+// file order.
+func (idx *SiteIndex) LinksTo(path string) []string {
+	if idx == nil {
+		return nil
+	}
+	return slices.Clone(idx.backlinks[path])
+}
@@ -0,0 +1,89 @@
+package generator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const (
+	indexIDA = "a1b2c3d4-e5f6-4a7b-8c9d-0e1f2a3b4c5d"
+	indexIDB = "b2c3d4e5-f6a7-4b8c-9d0e-1f2a3b4c5d6e"
+)
+
+func TestSiteIndex(t *testing.T) {
+	files := []FileInfo{
+		{Path: "a.org", Tags: []string{"go", "emacs", "go"}, UUIDs: UUIDMap{indexIDA: 1}, Links: []UUID{indexIDB, indexIDA, indexIDB}},
+		{Path: "b.org", Tags: []string{"go"}, UUIDs: UUIDMap{indexIDB: 2, indexIDA: 3}},
+		{Path: "c.org", Links: []UUID{indexIDA, "f0e1d2c3-b4a5-4968-8776-655443322110"}},
+	}
+	idx := NewSiteIndex(files)
+
+	if got := fmt.Sprint(idx.Tags()); got != "[emacs go]" {
+		t.Errorf("Tags() = %s", got)
+	}
+	if got := fmt.Sprint(idx.TagCounts()); got != "[{emacs 1} {go 2}]" {
+		t.Errorf("TagCounts() = %s", got)
+	}
+	var paths []string
+	for _, fi := range idx.FilesWithTag("go") {
+		paths = append(paths, fi.Path)
+	}
+	if strings.Join(paths, " ") != "a.org b.org" {
+		t.Errorf("FilesWithTag(go) = %v", paths)
+	}
+	if idx.FilesWithTag("missing") != nil {
+		t.Error("FilesWithTag() of an unknown tag should be empty")
+	}
+
+	// The first headline with an ID keeps it.
+	if loc, ok := idx.Lookup(indexIDA); !ok || loc != (HeaderLocation{FilePath: "a.org", HeaderIndex: 1}) {
+		t.Errorf("Lookup(A) = %v, %v", loc, ok)
+	}
+	if loc, _ := idx.Lookup(indexIDB); loc.FilePath != "b.org" {
+		t.Errorf("Lookup(B) = %v", loc)
+	}
+	if locations := idx.Locations(); len(locations) != 2 {
+		t.Errorf("Locations() = %v", locations)
+	}
+
+	// Links to the page itself, repeated links and dangling IDs are dropped.
+	if got := fmt.Sprint(idx.LinksFrom("a.org"), idx.LinksFrom("c.org")); got != "[b.org] [a.org]" {
+		t.Errorf("LinksFrom() = %s", got)
+	}
+	if got := fmt.Sprint(idx.LinksTo("a.org"), idx.LinksTo("b.org")); got != "[c.org] [a.org]" {
+		t.Errorf("LinksTo() = %s", got)
+	}
+	if fi, ok := idx.File("b.org"); !ok || fi.Path != "b.org" {
+		t.Errorf("File(b.org) = %v, %v", fi.Path, ok)
+	}
+
+	scoped := idx.scoped(files[1:])
+	if _, ok := scoped.Lookup(indexIDA); !ok {
+		t.Error("a scoped index should keep the IDs of files left out")
+	}
+	if got := fmt.Sprint(scoped.TagCounts(), scoped.LinksTo("a.org")); got != "[{go 1}] [c.org]" {
+		t.Errorf("scoped index = %s", got)
+	}
+
+	var empty *SiteIndex
+	if _, ok := empty.Lookup(indexIDA); ok || empty.Tags() != nil || len(empty.Locations()) != 0 {
+		t.Error("a nil index should be empty")
+	}
+}
+
+func TestSiteIndexConcurrentTags(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-siteindex-")
+	defer CleanupTempDir(tmpDir)
+
+	const count = 200
+	for i := range count {
+		CreateTestOrgFile(tmpDir, fmt.Sprintf("note%03d.org", i), fmt.Sprintf("#+title: Note %d\n* Heading :shared:\nBody.\n", i))
+	}
+	for range 5 {
+		procFiles, _ := FindAndProcessOrgFiles(nil, BuildContext{Root: tmpDir})
+		if files := procFiles.Index.FilesWithTag("shared"); len(files) != count {
+			t.Fatalf("FilesWithTag(shared) has %d files, want %d", len(files), count)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package generator
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cardOutputDir is the directory under DestDir holding social cards.
+const cardOutputDir = "_cards"
+
+// Social cards are rendered at the size OpenGraph consumers expect.
+const (
+	cardWidth   = 1200
+	cardHeight  = 630
+	cardPadding = 80
+	cardBar     = 16
+)
+
+// Social card layouts.
+const (
+	CardLayoutLeft   = "left"
+	CardLayoutCenter = "center"
+)
+
+// defaultCardColors are the card colours the config does not override.
+var defaultCardColors = map[string]string{
+	"background": "#1f2430",
+	"text":       "#f5f5f5",
+	"accent":     "#f2a65a",
+}
+
+//go:embed fonts/oxen-5x8.txt
+var cardFontData string
+
+// Glyphs of the embedded font are glyphW by glyphH pixels.
+const (
+	glyphW = 5
+	glyphH = 8
+)
+
+// cardFont maps each rune of the embedded font to its rows, top first, with
+// the leftmost pixel in bit glyphW-1.
+var cardFont = sync.OnceValue(func() map[rune][glyphH]uint8 {
+	font := map[rune][glyphH]uint8{}
+	scanner := bufio.NewScanner(strings.NewReader(cardFontData))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "U+") {
+			continue
+		}
+		code, err := strconv.ParseUint(line[2:], 16, 32)
+		if err != nil {
+			panic(fmt.Sprintf("bad glyph header %q in card font", line))
+		}
+		var glyph [glyphH]uint8
+		for row := 0; row < glyphH && scanner.Scan(); row++ {
+			for col, c := range scanner.Text() {
+				if c == '#' {
+					glyph[row] |= 1 << (glyphW - 1 - col)
+				}
+			}
+		}
+		font[rune(code)] = glyph
+	}
+	return font
+})
+
+// cardRuneFallbacks spell typographic characters the font lacks in ASCII.
+var cardRuneFallbacks = map[rune]string{
+	'‘': "'", '’': "'", '“': `"`, '”': `"`, '–': "-", '—': "-", '…': "...", '\u00a0': " ",
+}
+
+// cardText returns s in the runes the font has; anything else becomes "?".
+func cardText(s string) []rune {
+	font := cardFont()
+	var out []rune
+	for _, r := range s {
+		if fallback, ok := cardRuneFallbacks[r]; ok {
+			out = append(out, []rune(fallback)...)
+		} else if _, ok := font[r]; ok {
+			out = append(out, r)
+		} else {
+			out = append(out, '?')
+		}
+	}
+	return out
+}
+
+// cardStyle is the configured look of social cards.
+type cardStyle struct {
+	Layout     string
+	Background color.RGBA
+	Text       color.RGBA
+	Accent     color.RGBA
+}
+
+// socialCardStyle resolves the card layout and colours from the config.
+// Unknown layouts and unparsable colours fall back to the defaults with a
+// warning.
+func socialCardStyle(ctx BuildContext) cardStyle {
+	style := cardStyle{Layout: ctx.SocialCardLayout}
+	switch style.Layout {
+	case CardLayoutLeft, CardLayoutCenter:
+	case "":
+		style.Layout = CardLayoutLeft
+	default:
+		ctx.Diagnostics.Warn("config", "", 0, "unknown social card layout %q, using left", style.Layout)
+		style.Layout = CardLayoutLeft
+	}
+
+	resolve := func(name string) color.RGBA {
+		if value, ok := ctx.SocialCardColors[name]; ok {
+			if c, err := parseHexColor(value); err == nil {
+				return c
+			}
+			ctx.Diagnostics.Warn("config", "", 0, "invalid social card colour %s %q, using the default", name, value)
+		}
+		c, _ := parseHexColor(defaultCardColors[name])
+		return c
+	}
+	style.Background = resolve("background")
+	style.Text = resolve("text")
+	style.Accent = resolve("accent")
+	return style
+}
+
+// parseHexColor parses a #rgb or #rrggbb colour.
+func parseHexColor(s string) (color.RGBA, error) {
+	hexDigits := strings.TrimPrefix(s, "#")
+	if len(hexDigits) == 3 {
+		hexDigits = string([]byte{hexDigits[0], hexDigits[0], hexDigits[1], hexDigits[1], hexDigits[2], hexDigits[2]})
+	}
+	if len(hexDigits) != 6 {
+		return color.RGBA{}, fmt.Errorf("colour %q is not #rgb or #rrggbb", s)
+	}
+	v, err := strconv.ParseUint(hexDigits, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("colour %q is not #rgb or #rrggbb: %w", s, err)
+	}
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
+
+// socialCard is what a page's card shows.
+type socialCard struct {
+	Title    string
+	SiteName string
+	Tags     []string
+}
+
+// hash identifies the rendered card, so unchanged cards are never redrawn.
+func (c socialCard) hash(style cardStyle) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%q\x00%s\x00%v %v %v", cardFontData, c.Title, c.SiteName, c.Tags,
+		style.Layout, style.Background, style.Text, style.Accent)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// wrapCardText breaks text into lines of at most width runes, at spaces
+// where it can.
+func wrapCardText(text []rune, width int) [][]rune {
+	var lines [][]rune
+	for len(text) > width {
+		cut := width
+		for i := width; i > 0; i-- {
+			if text[i] == ' ' {
+				cut = i
+				break
+			}
+		}
+		lines = append(lines, text[:cut])
+		text = text[cut:]
+		for len(text) > 0 && text[0] == ' ' {
+			text = text[1:]
+		}
+	}
+	if len(text) > 0 {
+		lines = append(lines, text)
+	}
+	return lines
+}
+
+// truncateCardText shortens text to width runes, ending in "...".
+func truncateCardText(text []rune, width int) []rune {
+	if len(text) <= width {
+		return text
+	}
+	return append(append([]rune{}, text[:max(0, width-3)]...), '.', '.', '.')
+}
+
+// drawCardText draws text at x, y, the top left of its first glyph, with
+// every font pixel scale pixels square.
+func drawCardText(img draw.Image, text []rune, x, y, scale int, c color.RGBA) {
+	font := cardFont()
+	src := image.NewUniform(c)
+	for i, r := range text {
+		glyph := font[r]
+		gx := x + i*(glyphW+1)*scale
+		for row := 0; row < glyphH; row++ {
+			for col := 0; col < glyphW; col++ {
+				if glyph[row]&(1<<(glyphW-1-col)) != 0 {
+					px := image.Rect(gx+col*scale, y+row*scale, gx+(col+1)*scale, y+(row+1)*scale)
+					draw.Draw(img, px, src, image.Point{}, draw.Src)
+				}
+			}
+		}
+	}
+}
+
+// cardTextWidth is the width in pixels of n runes at scale.
+func cardTextWidth(n, scale int) int {
+	if n == 0 {
+		return 0
+	}
+	return (n*(glyphW+1) - 1) * scale
+}
+
+// renderSocialCard draws c as a cardWidth by cardHeight image: the title as
+// large as fits in up to three lines, the tags in the accent colour below it
+// and the site name at the bottom.
+func renderSocialCard(c socialCard, style cardStyle) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, cardWidth, cardHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(style.Background), image.Point{}, draw.Src)
+
+	left := cardPadding
+	if style.Layout == CardLayoutLeft {
+		draw.Draw(img, image.Rect(0, 0, cardBar, cardHeight), image.NewUniform(style.Accent), image.Point{}, draw.Src)
+		left += cardBar
+	} else {
+		draw.Draw(img, image.Rect(0, cardHeight-cardBar, cardWidth, cardHeight), image.NewUniform(style.Accent), image.Point{}, draw.Src)
+	}
+	textWidth := cardWidth - left - cardPadding
+	columns := func(scale int) int { return (textWidth + scale) / ((glyphW + 1) * scale) }
+	xFor := func(n, scale int) int {
+		if style.Layout == CardLayoutCenter {
+			return (cardWidth - cardTextWidth(n, scale)) / 2
+		}
+		return left
+	}
+
+	const smallScale = 4
+	title := cardText(c.Title)
+	var lines [][]rune
+	scale := 10
+	for ; scale > 5; scale-- {
+		if lines = wrapCardText(title, columns(scale)); len(lines) <= 3 {
+			break
+		}
+	}
+	if lines = wrapCardText(title, columns(scale)); len(lines) > 3 {
+		lines = lines[:3]
+		lines[2] = truncateCardText(append(lines[2], []rune(" ...")...), columns(scale))
+	}
+	lineHeight := (glyphH + 2) * scale
+
+	var tags []rune
+	for _, tag := range c.Tags {
+		tags = append(tags, cardText("#"+tag+"  ")...)
+	}
+	tags = truncateCardText([]rune(strings.TrimSpace(string(tags))), columns(smallScale))
+
+	blockHeight := len(lines) * lineHeight
+	if len(tags) > 0 {
+		blockHeight += (glyphH + 4) * smallScale
+	}
+	y := cardPadding
+	if style.Layout == CardLayoutCenter {
+		y = (cardHeight - blockHeight) / 2
+	}
+	for _, line := range lines {
+		drawCardText(img, line, xFor(len(line), scale), y, scale, style.Text)
+		y += lineHeight
+	}
+	if len(tags) > 0 {
+		drawCardText(img, tags, xFor(len(tags), smallScale), y+smallScale*4, smallScale, style.Accent)
+	}
+
+	site := truncateCardText(cardText(c.SiteName), columns(smallScale))
+	drawCardText(img, site, xFor(len(site), smallScale), cardHeight-cardPadding-glyphH*smallScale, smallScale, style.Text)
+	return img
+}
+
+// GenerateSocialCards renders an OpenGraph card for every page without an
+// image of its own into ctx.DestDir/_cards and records it in
+// procFiles.SocialCards. Cards are named after a hash of what they show and
+// how, so unchanged cards are not redrawn.
+func GenerateSocialCards(procFiles *ProcessedFiles, ctx BuildContext) (*ProcessedFiles, GenerationResult) {
+	var result GenerationResult
+	procFiles.SocialCards = nil
+	if !ctx.SocialCards {
+		return procFiles, result
+	}
+	slog.Debug("Starting social card phase: rendering OpenGraph cards")
+
+	style := socialCardStyle(ctx)
+	procFiles.SocialCards = map[string]string{}
+	type pendingCard struct {
+		path, outputPath string
+		card             socialCard
+	}
+	var pending []pendingCard
+	for _, fi := range procFiles.Files {
+		if fi.Image != "" || fi.Path == "sitemap-preamble.org" {
+			continue
+		}
+		card := socialCard{Title: fi.Title, SiteName: ctx.SiteName, Tags: fi.Tags}
+		relPath := filepath.Join(cardOutputDir, card.hash(style)+".png")
+		procFiles.SocialCards[fi.Path] = relPath
+
+		outputPath := filepath.Join(ctx.DestDir, relPath)
+		if !ctx.ForceRebuild && outputExists(ctx, outputPath) {
+			continue
+		}
+		pending = append(pending, pendingCard{fi.Path, outputPath, card})
+	}
+
+	var generated, errors int64
+	ctx.Pool.Run(len(pending), func(i int) {
+		p := pending[i]
+		start := time.Now()
+		defer func() { ctx.Timings.File("social-card", p.path, time.Since(start)) }()
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, renderSocialCard(p.card, style)); err != nil {
+			ctx.Diagnostics.Error("social-card", p.path, 0, "failed to encode social card: %v", err)
+			atomic.AddInt64(&errors, 1)
+			return
+		}
+		if err := writeOutput(ctx, p.outputPath, buf.Bytes()); err != nil {
+			ctx.Diagnostics.Error("output", p.path, 0, "failed to write social card %s: %v", p.outputPath, err)
+			atomic.AddInt64(&errors, 1)
+			return
+		}
+		atomic.AddInt64(&generated, 1)
+	})
+
+	result.SocialCardsGenerated = int(generated)
+	result.Errors = int(errors)
+	slog.Debug("Social card phase complete", "cards", len(procFiles.SocialCards), "generated", generated)
+	return procFiles, result
+}
+
+// socialCardStale reports whether the HTML at outputPath doesn't use fi's
+// current social card, because the card's title, tags or style changed
+// without the page changing.
+func socialCardStale(fi FileInfo, procFiles *ProcessedFiles, outputPath string) bool {
+	if procFiles == nil || procFiles.SocialCards[fi.Path] == "" {
+		return false
+	}
+	existing, err := os.ReadFile(outputPath)
+	if err != nil {
+		return true
+	}
+	return !bytes.Contains(existing, []byte(filepath.ToSlash(procFiles.SocialCards[fi.Path])))
+}
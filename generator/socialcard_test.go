@@ -0,0 +1,145 @@
+package generator
+
+import (
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCardFont(t *testing.T) {
+	font := cardFont()
+	for r := rune(' '); r <= '~'; r++ {
+		if _, ok := font[r]; !ok {
+			t.Errorf("card font has no glyph for %q", r)
+		}
+	}
+	if got := string(cardText("“Café” – ok…")); got != `"Caf?" - ok...` {
+		t.Errorf("cardText() = %q", got)
+	}
+}
+
+func TestSocialCardStyle(t *testing.T) {
+	style := socialCardStyle(BuildContext{
+		SocialCardLayout: "diagonal",
+		SocialCardColors: map[string]string{"background": "#fff", "text": "#102030", "accent": "orange"},
+	})
+	if style.Layout != CardLayoutLeft {
+		t.Errorf("Layout = %q, want %q for an unknown layout", style.Layout, CardLayoutLeft)
+	}
+	if style.Background != (color.RGBA{255, 255, 255, 255}) || style.Text != (color.RGBA{0x10, 0x20, 0x30, 255}) {
+		t.Errorf("colours = %v, %v", style.Background, style.Text)
+	}
+	if want, _ := parseHexColor(defaultCardColors["accent"]); style.Accent != want {
+		t.Errorf("invalid accent = %v, want default %v", style.Accent, want)
+	}
+}
+
+func TestWrapCardText(t *testing.T) {
+	var got []string
+	for _, line := range wrapCardText([]rune("a long title that wraps"), 10) {
+		got = append(got, string(line))
+	}
+	if strings.Join(got, "|") != "a long|title that|wraps" {
+		t.Errorf("wrapCardText() = %q", got)
+	}
+	if got := string(truncateCardText([]rune("abcdefghij"), 6)); got != "abc..." {
+		t.Errorf("truncateCardText() = %q", got)
+	}
+}
+
+func TestRenderSocialCard(t *testing.T) {
+	for _, layout := range []string{CardLayoutLeft, CardLayoutCenter} {
+		style := socialCardStyle(BuildContext{SocialCardLayout: layout})
+		img := renderSocialCard(socialCard{
+			Title:    strings.Repeat("A very long page title ", 8),
+			SiteName: "Site",
+			Tags:     []string{"go", "org"},
+		}, style)
+		if b := img.Bounds(); b.Dx() != cardWidth || b.Dy() != cardHeight {
+			t.Errorf("%s card is %v", layout, b)
+		}
+		if img.RGBAAt(cardWidth-1, 0) != style.Background {
+			t.Errorf("%s card corner = %v, want background", layout, img.RGBAAt(cardWidth-1, 0))
+		}
+		var text, accent int
+		for y := 0; y < cardHeight; y++ {
+			for x := 0; x < cardWidth; x++ {
+				switch img.RGBAAt(x, y) {
+				case style.Text:
+					text++
+				case style.Accent:
+					accent++
+				}
+			}
+		}
+		if text == 0 || accent == 0 {
+			t.Errorf("%s card has %d text and %d accent pixels", layout, text, accent)
+		}
+	}
+}
+
+func TestGenerateSocialCards(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-cards-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "plain.org", "#+title: Plain\n* Heading :go:\nText.\n")
+	CreateTestOrgFile(tmpDir, "pictured.org", "#+title: Pictured\n#+image: https://cdn.example.com/card.png\n")
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public"), SiteName: "Site", SocialCards: true}
+
+	build := func() (*ProcessedFiles, GenerationResult) {
+		procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+		return GenerateSocialCards(procFiles, ctx)
+	}
+	procFiles, result := build()
+	if result.Errors != 0 || result.SocialCardsGenerated != 1 {
+		t.Fatalf("GenerateSocialCards() = %+v", result)
+	}
+	card := procFiles.SocialCards["plain.org"]
+	if card == "" || procFiles.SocialCards["pictured.org"] != "" {
+		t.Fatalf("SocialCards = %v", procFiles.SocialCards)
+	}
+	f, err := os.Open(filepath.Join(ctx.DestDir, card))
+	if err != nil {
+		t.Fatalf("card not written: %v", err)
+	}
+	cfg, err := png.DecodeConfig(f)
+	f.Close()
+	if err != nil || cfg.Width != cardWidth || cfg.Height != cardHeight {
+		t.Errorf("card is %dx%d, %v", cfg.Width, cfg.Height, err)
+	}
+
+	// Unchanged cards are cached.
+	if procFiles, result = build(); result.SocialCardsGenerated != 0 || procFiles.SocialCards["plain.org"] != card {
+		t.Errorf("rebuild = %+v, %v", result, procFiles.SocialCards)
+	}
+
+	// A new site name is a new card, and the page picks it up though only its
+	// card changed.
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+	ctx.SiteName = "Renamed"
+	procFiles, result = build()
+	newCard := procFiles.SocialCards["plain.org"]
+	if result.SocialCardsGenerated != 1 || newCard == card {
+		t.Fatalf("renamed site: %+v, %q", result, newCard)
+	}
+	GenerateHtmlPages(procFiles, ctx, tmpls.Page)
+	data, err := os.ReadFile(filepath.Join(ctx.DestDir, "plain.html"))
+	if err != nil {
+		t.Fatalf("Failed to read plain.html: %v", err)
+	}
+	if !strings.Contains(string(data), `<meta property="og:image" content="/`+filepath.ToSlash(newCard)+`">`) {
+		t.Errorf("plain.html does not use the new card %s", newCard)
+	}
+
+	ctx.SocialCards = false
+	if procFiles, _ = build(); procFiles.SocialCards != nil {
+		t.Errorf("disabled cards = %v", procFiles.SocialCards)
+	}
+}
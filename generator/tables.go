@@ -0,0 +1,230 @@
+package generator
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// reTableFileName matches the characters not allowed in an exported table's
+// file name.
+var reTableFileName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// extractTablesFromAST returns the tables named with #+NAME:, sorted by name.
+// A table whose first row is followed by a separator line has that row as
+// its header. Separator lines and alignment rows (| <l> | <10> |) are dropped.
+func extractTablesFromAST(doc *org.Document) []DataTable {
+	var tables []DataTable
+	for name, node := range doc.NamedNodes {
+		table, ok := node.(org.Table)
+		if !ok {
+			continue
+		}
+		dt := DataTable{Name: name}
+		for i, row := range table.Rows {
+			if len(row.Columns) == 0 || row.IsSpecial {
+				continue
+			}
+			cells := make([]string, len(row.Columns))
+			for k, column := range row.Columns {
+				cells[k] = plainText(column.Children)
+			}
+			if dt.Header == nil && len(dt.Rows) == 0 && i+1 < len(table.Rows) && len(table.Rows[i+1].Columns) == 0 {
+				dt.Header = cells
+				continue
+			}
+			dt.Rows = append(dt.Rows, cells)
+		}
+		tables = append(tables, dt)
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].Name < tables[j].Name
+	})
+	return tables
+}
+
+// plainText renders inline nodes as text, without markup: links become their
+// description, or their URL if they have none.
+func plainText(nodes []org.Node) string {
+	var b strings.Builder
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case org.Text:
+			b.WriteString(n.Content)
+		case org.RegularLink:
+			if len(n.Description) > 0 {
+				b.WriteString(plainText(n.Description))
+			} else {
+				b.WriteString(n.URL)
+			}
+		case org.Emphasis:
+			b.WriteString(plainText(n.Content))
+		default:
+			b.WriteString(org.String(node))
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Records returns the rows of t as maps from header to cell, for looking
+// cells up by column in templates. Maps have no order, so the Header and
+// Rows keep that of the columns. Tables without a header have no records.
+func (t DataTable) Records() []map[string]string {
+	if t.Header == nil {
+		return nil
+	}
+	records := make([]map[string]string, len(t.Rows))
+	for i, row := range t.Rows {
+		records[i] = map[string]string{}
+		for k, column := range t.Header {
+			if k < len(row) {
+				records[i][column] = row[k]
+			}
+		}
+	}
+	return records
+}
+
+// CSV encodes t as CSV, header first.
+func (t DataTable) CSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if t.Header != nil {
+		w.Write(t.Header)
+	}
+	w.WriteAll(t.Rows)
+	return buf.Bytes(), w.Error()
+}
+
+// tableRecord is a row of a table with a header. It encodes as a JSON
+// object whose keys are in the order of the table's columns.
+type tableRecord struct {
+	header, cells []string
+}
+
+func (r tableRecord) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for k, column := range r.header {
+		if k >= len(r.cells) {
+			break
+		}
+		key, err := json.Marshal(column)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(r.cells[k])
+		if err != nil {
+			return nil, err
+		}
+		if k > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// JSON encodes t as an array of objects keyed by header, in column order, or
+// an array of arrays if t has no header.
+func (t DataTable) JSON() ([]byte, error) {
+	var data any = t.Rows
+	if t.Header != nil {
+		records := make([]tableRecord, len(t.Rows))
+		for i, row := range t.Rows {
+			records[i] = tableRecord{t.Header, row}
+		}
+		data = records
+	} else if t.Rows == nil {
+		data = [][]string{}
+	}
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// tableFileName returns the path, relative to DestDir, of table name of the
+// page at path with extension ext: notes/books.org's reading-list table is
+// exported as notes/books.reading-list.csv.
+func tableFileName(path, name, ext string) string {
+	name = strings.Trim(reTableFileName.ReplaceAllString(name, "-"), "-")
+	return strings.TrimSuffix(path, ".org") + "." + name + ext
+}
+
+// ExportTables writes every named table as CSV and JSON next to its page.
+// Files are only rewritten when their contents change. Returns a
+// GenerationResult.
+func ExportTables(procFiles *ProcessedFiles, ctx BuildContext) (result GenerationResult) {
+	slog.Debug("Starting Phase 3k: exporting named tables")
+
+	count := 0
+	for _, fi := range procFiles.Files {
+		for _, table := range fi.Tables {
+			for _, format := range []struct {
+				ext    string
+				encode func() ([]byte, error)
+			}{{".csv", table.CSV}, {".json", table.JSON}} {
+				data, err := format.encode()
+				if err != nil {
+					ctx.Diagnostics.Error("table", fi.Path, ctx.Diagnostics.Line(fi.Path, table.Name), "failed to encode table %s: %v", table.Name, err)
+					result.Errors++
+					continue
+				}
+				path := filepath.Join(ctx.DestDir, tableFileName(fi.Path, table.Name, format.ext))
+				wrote, err := writeIfChanged(ctx, path, data)
+				if err != nil {
+					ctx.Diagnostics.Error("output", fi.Path, 0, "failed to write %s: %v", path, err)
+					result.Errors++
+				} else if wrote {
+					result.FilesGenerated++
+				} else {
+					result.FilesSkipped++
+				}
+			}
+			count++
+		}
+	}
+
+	slog.Debug("Phase 3k complete", "tables", count)
+	return
+}
+
+// BindTables makes the named tables of procFiles available to tmpls through
+// the table template function: {{with table "books.org" "reading-list"}}.
+// It must be called before the templates are first executed.
+func BindTables(procFiles *ProcessedFiles, tmpls ...*template.Template) {
+	tables := map[string]map[string]DataTable{}
+	for _, fi := range procFiles.Files {
+		for _, table := range fi.Tables {
+			if tables[fi.Path] == nil {
+				tables[fi.Path] = map[string]DataTable{}
+			}
+			tables[fi.Path][table.Name] = table
+		}
+	}
+
+	funcs := template.FuncMap{"table": func(path, name string) (DataTable, error) {
+		table, ok := tables[strings.TrimPrefix(path, "/")][name]
+		if !ok {
+			return DataTable{}, fmt.Errorf("no table %q in %s", name, path)
+		}
+		return table, nil
+	}}
+	for _, tmpl := range tmpls {
+		tmpl.Funcs(funcs)
+	}
+}
@@ -0,0 +1,122 @@
+package generator
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const tablesOrg = `#+title: Books
+
+#+NAME: reading-list
+| Title              | Author | Year |
+|--------------------+--------+------|
+| <l>                |        |      |
+| [[https://example.com/sicp][SICP]] | Abelson, Sussman | 1985 |
+| *Dune*             | Herbert | 1965 |
+
+#+NAME: scores
+| 1 | 2 |
+| 3 | 4 |
+
+| not | named |
+`
+
+func TestExtractTables(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-tables-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "books.org", tablesOrg)
+	fi, err := processFile("books.org", BuildContext{Root: tmpDir})
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+
+	if len(fi.Tables) != 2 || fi.Tables[0].Name != "reading-list" || fi.Tables[1].Name != "scores" {
+		t.Fatalf("Tables = %+v, want reading-list and scores", fi.Tables)
+	}
+	books := fi.Tables[0]
+	if strings.Join(books.Header, ",") != "Title,Author,Year" {
+		t.Errorf("Header = %v", books.Header)
+	}
+	if len(books.Rows) != 2 || books.Rows[0][0] != "SICP" || books.Rows[1][0] != "Dune" {
+		t.Errorf("Rows = %v", books.Rows)
+	}
+	if scores := fi.Tables[1]; scores.Header != nil || len(scores.Rows) != 2 {
+		t.Errorf("scores = %+v, want two rows and no header", scores)
+	}
+}
+
+func TestExportTables(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-tables-")
+	defer CleanupTempDir(tmpDir)
+
+	procFiles := &ProcessedFiles{Files: []FileInfo{{Path: "notes/books.org", Tables: []DataTable{
+		{Name: "reading list", Header: []string{"Title", "Author"}, Rows: [][]string{{"SICP", "Abelson, Sussman"}}},
+		{Name: "scores", Rows: [][]string{{"1", "2"}}},
+	}}}}
+	ctx := BuildContext{DestDir: filepath.Join(tmpDir, "public")}
+
+	if result := ExportTables(procFiles, ctx); result.FilesGenerated != 4 || result.Errors != 0 {
+		t.Fatalf("ExportTables() = %+v", result)
+	}
+	for name, want := range map[string]string{
+		"notes/books.reading-list.csv":  "Title,Author\nSICP,\"Abelson, Sussman\"\n",
+		"notes/books.reading-list.json": "[\n  {\n    \"Title\": \"SICP\",\n    \"Author\": \"Abelson, Sussman\"\n  }\n]\n",
+		"notes/books.scores.json":       "[\n  [\n    \"1\",\n    \"2\"\n  ]\n]\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(ctx.DestDir, name))
+		if err != nil {
+			t.Errorf("Failed to read %s: %v", name, err)
+		} else if string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+
+	if result := ExportTables(procFiles, ctx); result.FilesGenerated != 0 {
+		t.Errorf("ExportTables() rewrote unchanged tables: %+v", result)
+	}
+}
+
+func TestBindTables(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-tables-")
+	defer CleanupTempDir(tmpDir)
+
+	templatesDir := filepath.Join(tmpDir, "templates")
+	os.MkdirAll(templatesDir, 0755)
+	os.WriteFile(filepath.Join(templatesDir, "base-template.html"), []byte(`{{template "content" .}}`), 0644)
+	os.WriteFile(filepath.Join(templatesDir, "page-template.html"), []byte(`{{define "content"}}x{{end}}`), 0644)
+	os.WriteFile(filepath.Join(templatesDir, "tag-page-template.html"), []byte(`{{define "content"}}x{{end}}`), 0644)
+	os.WriteFile(filepath.Join(templatesDir, "index-page-template.html"), []byte(`{{define "content"}}`+
+		`{{range (table "books.org" "reading-list").Records}}<li>{{.Title}} ({{.Year}})</li>{{end}}{{end}}{{template "base-template.html" .}}`), 0644)
+	os.WriteFile(filepath.Join(templatesDir, "atom-template.xml"), []byte(`<feed/>`), 0644)
+	CreateTestOrgFile(tmpDir, "books.org", tablesOrg)
+
+	ctx := BuildContext{Root: tmpDir, DestDir: filepath.Join(tmpDir, "public")}
+	procFiles, _ := FindAndProcessOrgFiles(nil, ctx)
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	missingTmpl := template.Must(template.Must(tmpls.Index.Clone()).Parse(`{{define "content"}}{{table "books.org" "missing"}}{{end}}`))
+	BindTables(procFiles, tmpls.Index, missingTmpl)
+	os.MkdirAll(ctx.DestDir, 0755)
+
+	if result := GenerateIndexPage(procFiles, ctx, tmpls.Index); result.Errors != 0 {
+		t.Fatalf("GenerateIndexPage() errors = %d", result.Errors)
+	}
+	data, err := os.ReadFile(filepath.Join(ctx.DestDir, "index.html"))
+	if err != nil {
+		t.Fatalf("Failed to read index.html: %v", err)
+	}
+	if string(data) != "<li>SICP (1985)</li><li>Dune (1965)</li>" {
+		t.Errorf("index.html = %q", data)
+	}
+
+	var buf strings.Builder
+	if err := missingTmpl.Execute(&buf, nil); err == nil || !strings.Contains(err.Error(), `no table "missing"`) {
+		t.Errorf("Execute() error = %v, want a missing table error", err)
+	}
+}
@@ -0,0 +1,172 @@
+package generator
+
+import (
+	"bytes"
+	"html/template"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/niklasfasching/go-org/org"
+)
+
+// extractIndexEntriesFromAST collects the document's #+INDEX: keywords, each
+// tied to the headline it appears under. Keywords inside excluded headlines
+// are skipped, since they don't appear on the page.
+func extractIndexEntriesFromAST(doc *org.Document) []IndexEntry {
+	var entries []IndexEntry
+
+	var walk func(nodes []org.Node, anchor, heading string)
+	walk = func(nodes []org.Node, anchor, heading string) {
+		for _, node := range nodes {
+			switch n := node.(type) {
+			case org.Headline:
+				if n.IsExcluded(doc) {
+					continue
+				}
+				walk(n.Children, n.ID(), strings.TrimSpace(org.String(n.Title...)))
+			case org.Keyword:
+				if n.Key != "INDEX" {
+					continue
+				}
+				var term []string
+				for _, part := range strings.Split(n.Value, "!") {
+					if part = strings.TrimSpace(part); part != "" {
+						term = append(term, part)
+					}
+				}
+				if len(term) > 0 {
+					entries = append(entries, IndexEntry{Term: term, Anchor: anchor, Heading: heading})
+				}
+			default:
+				walk(orgNodeChildren(node), anchor, heading)
+			}
+		}
+	}
+	walk(doc.Nodes, "", "")
+
+	return entries
+}
+
+// buildIndexLetters merges the index entries of all files into a sorted
+// term hierarchy, grouped by initial letter.
+func buildIndexLetters(files []FileInfo) []IndexLetter {
+	root := &IndexTerm{}
+	for _, fi := range files {
+		for _, entry := range fi.IndexEntries {
+			href := "/" + strings.TrimSuffix(fi.Path, ".org") + ".html"
+			if entry.Anchor != "" {
+				href += "#" + entry.Anchor
+			}
+			term := root
+			for _, name := range entry.Term {
+				term = term.subterm(name)
+			}
+			if !slices.ContainsFunc(term.Locations, func(l IndexLocation) bool { return l.Href == href }) {
+				term.Locations = append(term.Locations, IndexLocation{Href: href, Title: fi.Title, Heading: entry.Heading})
+			}
+		}
+	}
+	root.sort()
+
+	var letters []IndexLetter
+	for _, term := range root.Subterms {
+		letter := "#"
+		if r, _ := utf8.DecodeRuneInString(term.Term); unicode.IsLetter(r) {
+			letter = string(unicode.ToUpper(r))
+		}
+		if len(letters) == 0 || letters[len(letters)-1].Letter != letter {
+			letters = append(letters, IndexLetter{Letter: letter})
+		}
+		letters[len(letters)-1].Terms = append(letters[len(letters)-1].Terms, term)
+	}
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[i].Letter == "#" && letters[j].Letter != "#"
+	})
+	return letters
+}
+
+// subterm returns the subterm called name, adding it if needed.
+func (t *IndexTerm) subterm(name string) *IndexTerm {
+	for i := range t.Subterms {
+		if t.Subterms[i].Term == name {
+			return &t.Subterms[i]
+		}
+	}
+	t.Subterms = append(t.Subterms, IndexTerm{Term: name})
+	return &t.Subterms[len(t.Subterms)-1]
+}
+
+// sort orders subterms case-insensitively and locations by page title,
+// recursively.
+func (t *IndexTerm) sort() {
+	sort.Slice(t.Subterms, func(i, j int) bool {
+		a, b := strings.ToLower(t.Subterms[i].Term), strings.ToLower(t.Subterms[j].Term)
+		if a != b {
+			return a < b
+		}
+		return t.Subterms[i].Term < t.Subterms[j].Term
+	})
+	sort.SliceStable(t.Locations, func(i, j int) bool {
+		return strings.ToLower(t.Locations[i].Title) < strings.ToLower(t.Locations[j].Title)
+	})
+	for i := range t.Subterms {
+		t.Subterms[i].sort()
+	}
+}
+
+// GenerateTheIndex writes theindex.html, an alphabetical back-of-book index
+// of the #+INDEX: terms across the site. Returns a GenerationResult.
+//
+// The index depends on every published note, including ones that were
+// deleted or unpublished since the last build, so it is always rendered and
+// only written when it changed.
+func GenerateTheIndex(procFiles *ProcessedFiles, ctx BuildContext, tmpl *template.Template) (result GenerationResult) {
+	slog.Debug("Starting Phase 3h: generating the index")
+
+	outputPath := filepath.Join(ctx.DestDir, "theindex.html")
+
+	files := make([]FileInfo, len(procFiles.Files))
+	copy(files, procFiles.Files)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	indexData := IndexTermData{
+		Letters:      buildIndexLetters(files),
+		SiteName:     ctx.SiteName,
+		BaseURL:      ctx.BaseURL,
+		DefaultImage: ctx.DefaultImage,
+		Author:       ctx.Author,
+		LicenseName:  ctx.LicenseName,
+		LicenseURL:   ctx.LicenseURL,
+		Data:         procFiles.Data,
+	}
+
+	var outputBuf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&outputBuf, "theindex-template.html", indexData); err != nil {
+		ctx.Diagnostics.Error("template", "", 0, "failed to execute theindex-template.html: %v", err)
+		result.Errors = 1
+		return
+	}
+
+	wrote, err := writeIfChanged(ctx, outputPath, outputBuf.Bytes())
+	if err != nil {
+		ctx.Diagnostics.Error("output", "", 0, "failed to write %s: %v", outputPath, err)
+		result.Errors = 1
+		return
+	}
+	if !wrote {
+		slog.Debug("Skipping the index: unchanged")
+		result.FilesSkipped = 1
+		return
+	}
+
+	slog.Debug("Phase 3h complete: generated the index", "path", outputPath, "letters", len(indexData.Letters))
+	result.FilesGenerated = 1
+	return
+}
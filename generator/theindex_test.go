@@ -0,0 +1,161 @@
+package generator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractIndexEntries(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-theindex-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "notes.org", `#+title: Notes
+#+INDEX: Org mode
+
+* Editors
+:PROPERTIES:
+:CUSTOM_ID: editors
+:END:
+#+INDEX: Emacs!packages!magit
+- a list item
+** Vi
+#+INDEX: vi
+
+* COMMENT Drafts
+#+INDEX: hidden
+`)
+	fi, err := processFile("notes.org", BuildContext{Root: tmpDir})
+	if err != nil {
+		t.Fatalf("processFile() error = %v", err)
+	}
+
+	want := []IndexEntry{
+		{Term: []string{"Org mode"}},
+		{Term: []string{"Emacs", "packages", "magit"}, Anchor: "editors", Heading: "Editors"},
+		{Term: []string{"vi"}, Anchor: "headline-2", Heading: "Vi"},
+	}
+	if len(fi.IndexEntries) != len(want) {
+		t.Fatalf("IndexEntries = %+v, want %+v", fi.IndexEntries, want)
+	}
+	for i, entry := range fi.IndexEntries {
+		if strings.Join(entry.Term, "!") != strings.Join(want[i].Term, "!") || entry.Anchor != want[i].Anchor || entry.Heading != want[i].Heading {
+			t.Errorf("IndexEntries[%d] = %+v, want %+v", i, entry, want[i])
+		}
+	}
+}
+
+func TestBuildIndexLetters(t *testing.T) {
+	files := []FileInfo{
+		{Path: "b.org", Title: "Bee", IndexEntries: []IndexEntry{
+			{Term: []string{"emacs", "packages"}, Anchor: "headline-0"},
+			{Term: []string{"Emacs"}},
+			{Term: []string{"2038 problem"}},
+		}},
+		{Path: "dir/a.org", Title: "Ant", IndexEntries: []IndexEntry{
+			{Term: []string{"Emacs"}, Anchor: "x", Heading: "X"},
+			{Term: []string{"Emacs"}, Anchor: "x", Heading: "X"},
+			{Term: []string{"awk"}},
+		}},
+	}
+
+	letters := buildIndexLetters(files)
+	var got []string
+	for _, letter := range letters {
+		got = append(got, letter.Letter)
+	}
+	if strings.Join(got, "") != "#AE" {
+		t.Fatalf("letters = %v, want [# A E]", got)
+	}
+
+	e := letters[2].Terms
+	if len(e) != 2 || e[0].Term != "Emacs" || e[1].Term != "emacs" {
+		t.Fatalf("E terms = %+v", e)
+	}
+	if len(e[0].Locations) != 2 || e[0].Locations[0].Href != "/dir/a.html#x" || e[0].Locations[1].Href != "/b.html" {
+		t.Errorf("Emacs locations = %+v", e[0].Locations)
+	}
+	if len(e[1].Subterms) != 1 || e[1].Subterms[0].Locations[0].Href != "/b.html#headline-0" {
+		t.Errorf("emacs subterms = %+v", e[1].Subterms)
+	}
+}
+
+func TestGenerateTheIndex(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-theindex-")
+	defer CleanupTempDir(tmpDir)
+
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+
+	procFiles := &ProcessedFiles{Files: []FileInfo{
+		{Path: "a.org", Title: "Ant", IndexEntries: []IndexEntry{
+			{Term: []string{"Lisp", "Scheme"}, Anchor: "headline-2", Heading: "Dialects"},
+		}},
+	}}
+	ctx := BuildContext{DestDir: filepath.Join(tmpDir, "public"), SiteName: "Test"}
+
+	if result := GenerateTheIndex(procFiles, ctx, tmpls.TheIndex); result.FilesGenerated != 1 || result.Errors != 0 {
+		t.Fatalf("GenerateTheIndex() = %+v", result)
+	}
+	data, err := os.ReadFile(filepath.Join(ctx.DestDir, "theindex.html"))
+	if err != nil {
+		t.Fatalf("Failed to read theindex.html: %v", err)
+	}
+	html := string(data)
+	for _, want := range []string{
+		`<a href="#index-L">L</a>`,
+		`<section id="index-L">`,
+		`<span class="index-term">Lisp</span>`,
+		`<span class="index-term">Scheme</span>`,
+		`<a href="/a.html#headline-2">Ant: Dialects</a>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("theindex.html missing %s:\n%s", want, html)
+		}
+	}
+
+	if result := GenerateTheIndex(procFiles, ctx, tmpls.TheIndex); result.FilesSkipped != 1 {
+		t.Errorf("GenerateTheIndex() did not skip an up-to-date index: %+v", result)
+	}
+
+	// Deleting or unpublishing the only note with terms leaves no source
+	// newer than the index, but its terms must still go.
+	if result := GenerateTheIndex(&ProcessedFiles{}, ctx, tmpls.TheIndex); result.FilesGenerated != 1 {
+		t.Errorf("GenerateTheIndex() skipped an index with a removed note: %+v", result)
+	}
+	data, err = os.ReadFile(filepath.Join(ctx.DestDir, "theindex.html"))
+	if err != nil || strings.Contains(string(data), "Lisp") {
+		t.Errorf("theindex.html keeps the removed note's terms: %v", err)
+	}
+}
+
+func TestSetupTemplates_CustomTheIndex(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-theindex-")
+	defer CleanupTempDir(tmpDir)
+
+	templatesDir := filepath.Join(tmpDir, "templates")
+	os.MkdirAll(templatesDir, 0755)
+	os.WriteFile(filepath.Join(templatesDir, "base-template.html"), []byte(`{{template "content" .}}`), 0644)
+	for _, name := range []string{"page-template.html", "tag-page-template.html", "index-page-template.html"} {
+		os.WriteFile(filepath.Join(templatesDir, name), []byte(`{{define "content"}}x{{end}}`), 0644)
+	}
+	os.WriteFile(filepath.Join(templatesDir, "atom-template.xml"), []byte(`<feed/>`), 0644)
+	os.WriteFile(filepath.Join(templatesDir, "theindex-template.html"),
+		[]byte(`{{define "content"}}{{range .Letters}}[{{.Letter}}]{{end}}{{end}}{{template "base-template.html" .}}`), 0644)
+
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	var buf strings.Builder
+	data := IndexTermData{Letters: []IndexLetter{{Letter: "Q"}}}
+	if err := tmpls.TheIndex.ExecuteTemplate(&buf, "theindex-template.html", data); err != nil {
+		t.Fatalf("ExecuteTemplate() error = %v", err)
+	}
+	if buf.String() != "[Q]" {
+		t.Errorf("custom theindex template not used: %q", buf.String())
+	}
+}
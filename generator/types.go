@@ -4,12 +4,18 @@ import (
 	"embed"
 	"fmt"
 	"html/template"
+	"io"
+	"log/slog"
+	"os"
+	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 	"github.com/niklasfasching/go-org/org"
 )
 
@@ -24,6 +30,59 @@ type BuildContext struct {
 	Author       string
 	LicenseName  string
 	LicenseURL   string
+	AttachIDDir  string
+	ImageWidths  []int
+
+	HighlightTheme       string
+	HighlightLineNumbers bool
+
+	Bibliography     []string
+	CitationStyle    string
+	BibliographyPage bool
+
+	RelatedWeights map[string]float64
+	RelatedCount   int
+
+	Macros map[string]string
+
+	SocialCards      bool
+	SocialCardLayout string
+	SocialCardColors map[string]string
+
+	PrivateTags       []string
+	PrivateProperties []string
+
+	PublishTags          []string
+	PublishPaths         []string
+	UnpublishedLinks     string
+	UnpublishedLinkTitle string
+
+	SafeMode bool
+
+	// SourceDate is SOURCE_DATE_EPOCH, for reproducible builds: it stands in
+	// for the current time and clamps source modification times.
+	SourceDate time.Time
+
+	// DryRun, when set, collects the output in memory instead of writing it
+	// to DestDir.
+	DryRun *MemoryOutput
+
+	// Diagnostics collects the problems found during the build.
+	Diagnostics *Diagnostics
+
+	// Pool runs the per-file work of every phase. A nil pool runs one task
+	// per CPU.
+	Pool *WorkerPool
+	// Timings, when set, records how long each phase and file took.
+	Timings *Timings
+	// Outputs, when set, records which output files were generated and
+	// which were skipped.
+	Outputs *OutputLog
+	// RelatedCache, when set, keeps the words of each page between builds.
+	RelatedCache *RelatedCache
+	// RenderCache, when set, keeps the diagnostics of each page rendered so
+	// that they are reported again when the page is skipped.
+	RenderCache *RenderCache
 }
 
 type HeaderLocation struct {
@@ -41,9 +100,43 @@ type HeaderIndex int
 type UUIDMap map[UUID]HeaderIndex
 
 type ProcessedFiles struct {
-	Files   []FileInfo
-	UuidMap sync.Map
-	TagMap  sync.Map
+	Files []FileInfo
+	// Index maps tags, IDs and links to Files.
+	Index  *SiteIndex
+	Images map[string]ImageInfo
+
+	// Bibliographies maps each BibTeX file to its entries by cite key.
+	Bibliographies map[string]map[string]BibEntry
+	// CitedBy maps a cite key to the files that cite it.
+	CitedBy map[string][]FileInfo
+	// ReferencePages maps a cite key to the note whose ROAM_REFS names it.
+	ReferencePages map[string]string
+	// Related maps each file to its most related pages, best first.
+	Related map[string][]RelatedPage
+	// Data holds the parsed data/**/*.json files, nested by directory.
+	Data map[string]any
+	// DataModTime is the latest modification time of the data files.
+	DataModTime time.Time
+	// SocialCards maps each page to its OpenGraph card, relative to DestDir.
+	SocialCards map[string]string
+	// Unpublished holds the files outside the publish scope. Index still
+	// has their IDs.
+	Unpublished map[string]bool
+
+	// privateText is the text phase 1 removed, for the leak check.
+	privateText []privateText
+	// privateIDs are the IDs of the files and headlines phase 1 removed.
+	privateIDs map[UUID]bool
+}
+
+// RelatedPage is a page suggested as related to another, with its combined
+// relatedness score in [0, 1].
+type RelatedPage struct {
+	Path    string
+	Title   string
+	Preview string
+	ModTime time.Time
+	Score   float64
 }
 
 var (
@@ -63,13 +156,91 @@ var (
 var templates embed.FS
 
 type FileInfo struct {
-	Path      string
-	ModTime   time.Time
-	Preview   string
-	Title     string
-	Tags      []string
-	UUIDs     UUIDMap
-	ParsedOrg *org.Document
+	Path string
+	// ModTime is the page's time: from its content where it has one, or
+	// else its file's modification time. See pageTime.
+	ModTime     time.Time
+	Preview     string
+	Title       string
+	Tags        []string
+	UUIDs       UUIDMap
+	Includes    []string
+	Attachments []string
+	Images      []string
+	ParsedOrg   *org.Document
+
+	Citations      []string
+	Bibliographies []string
+	CiteRefs       []string
+	IndexEntries   []IndexEntry
+	Links          []UUID
+	Events         []Event
+	Tables         []DataTable
+	Queries        []Query
+	// Properties holds the values of every property drawer in the file, by
+	// upper-case key.
+	Properties map[string][]string
+
+	// Description, Image and Keywords come from #+DESCRIPTION:, #+IMAGE: and
+	// #+KEYWORDS:. Image falls back to the first image in the file; it is
+	// root-relative, or a URL.
+	Description string
+	Image       string
+	Keywords    []string
+
+	// private marks a file that is private as a whole; privateSnippets and
+	// privateIDs are the text and IDs removed from it. They are unexported to
+	// keep them out of templates.
+	private         bool
+	privateSnippets []string
+	privateIDs      []UUID
+
+	// fileModTime is when the file was last modified, which is what decides
+	// whether its page is rebuilt.
+	fileModTime time.Time
+}
+
+// DataTable is an org table named with #+NAME:. Cells are plain text.
+type DataTable struct {
+	Name   string
+	Header []string
+	Rows   [][]string
+}
+
+// Event is a SCHEDULED:, DEADLINE: or active timestamp in an org file. Times
+// are floating: org timestamps carry no time zone, so they are stored as UTC
+// wall-clock times. Path, Tags and ModTime come from the file the event is
+// in.
+type Event struct {
+	UID     string
+	Kind    string
+	Summary string
+	Start   time.Time
+	End     time.Time
+	AllDay  bool
+	Repeat  string
+	Anchor  string
+	Path    string
+	Tags    []string
+	ModTime time.Time
+}
+
+// Href returns the site-relative URL of the headline holding the event.
+func (e Event) Href() string {
+	href := "/" + strings.TrimSuffix(e.Path, ".org") + ".html"
+	if e.Anchor != "" {
+		href += "#" + e.Anchor
+	}
+	return href
+}
+
+// IndexEntry is one #+INDEX: keyword. Term holds the term and its subterms,
+// split on "!"; Anchor and Heading identify the nearest enclosing headline,
+// and are empty for entries above the first headline.
+type IndexEntry struct {
+	Term    []string
+	Anchor  string
+	Heading string
 }
 
 type PageData struct {
@@ -81,6 +252,31 @@ type PageData struct {
 	Author       string
 	LicenseName  string
 	LicenseURL   string
+	Data         map[string]any
+	CitedBy      []FileInfo
+	Related      []RelatedPage
+	// ImageURL is the absolute URL of the page's og:image.
+	ImageURL    string
+	Breadcrumbs []Breadcrumb
+}
+
+// CitedByFingerprint identifies the CitedBy list, for the page template to
+// write in a data-cited-by attribute so the page is rebuilt when it changes.
+func (p PageData) CitedByFingerprint() string {
+	return pagesFingerprint(p.CitedBy)
+}
+
+// RelatedFingerprint identifies the Related list, for the page template to
+// write in a data-related attribute so the page is rebuilt when it changes.
+func (p PageData) RelatedFingerprint() string {
+	return pagesFingerprint(relatedFiles(p.Related))
+}
+
+// Breadcrumb is one step of the trail from the sitemap to a page. Path is
+// the page's HTML path, relative to the site root.
+type Breadcrumb struct {
+	Name string
+	Path string
 }
 
 type TagPageData struct {
@@ -92,6 +288,54 @@ type TagPageData struct {
 	Author       string
 	LicenseName  string
 	LicenseURL   string
+	Data         map[string]any
+}
+
+// IndexTermData is passed to theindex-template.html.
+type IndexTermData struct {
+	Letters      []IndexLetter
+	SiteName     string
+	BaseURL      string
+	DefaultImage string
+	Author       string
+	LicenseName  string
+	LicenseURL   string
+	Data         map[string]any
+}
+
+// IndexLetter groups the index terms starting with Letter. Terms that don't
+// start with a letter are grouped under "#".
+type IndexLetter struct {
+	Letter string
+	Terms  []IndexTerm
+}
+
+// IndexTerm is an entry in the back-of-book index, with the places it is
+// indexed and its subterms.
+type IndexTerm struct {
+	Term      string
+	Locations []IndexLocation
+	Subterms  []IndexTerm
+}
+
+// IndexLocation is a place where a term is indexed. Href is the
+// site-relative URL, including the headline anchor if any.
+type IndexLocation struct {
+	Href    string
+	Title   string
+	Heading string
+}
+
+// EventsPageData is passed to events-template.html.
+type EventsPageData struct {
+	Upcoming     []Event
+	SiteName     string
+	BaseURL      string
+	DefaultImage string
+	Author       string
+	LicenseName  string
+	LicenseURL   string
+	Data         map[string]any
 }
 
 type TagInfo struct {
@@ -109,6 +353,7 @@ type IndexPageData struct {
 	Author       string
 	LicenseName  string
 	LicenseURL   string
+	Data         map[string]any
 }
 
 type AtomFeedData struct {
@@ -120,85 +365,122 @@ type AtomFeedData struct {
 }
 
 type GenerationResult struct {
-	TotalFilesScanned int
-	FilesWithUUIDs    int
-	FilesGenerated    int
-	FilesSkipped      int
-	TagPagesGenerated int
-	StaticFilesCopied int
-	FeedGenerated     bool
-	Errors            int
-	startTime         time.Time
+	TotalFilesScanned      int
+	FilesWithUUIDs         int
+	FilesGenerated         int
+	FilesSkipped           int
+	TagPagesGenerated      int
+	StaticFilesCopied      int
+	AttachmentsCopied      int
+	ImageVariantsGenerated int
+	SocialCardsGenerated   int
+	PrivateLeaks           int
+	LinksDegraded          int
+	UnsafeStripped         int
+	FeedGenerated          bool
+	Errors                 int
+	startTime              time.Time
 }
 
 func (r GenerationResult) Add(other GenerationResult) GenerationResult {
 	return GenerationResult{
-		TotalFilesScanned: r.TotalFilesScanned + other.TotalFilesScanned,
-		FilesWithUUIDs:    r.FilesWithUUIDs + other.FilesWithUUIDs,
-		FilesGenerated:    r.FilesGenerated + other.FilesGenerated,
-		FilesSkipped:      r.FilesSkipped + other.FilesSkipped,
-		TagPagesGenerated: r.TagPagesGenerated + other.TagPagesGenerated,
-		StaticFilesCopied: r.StaticFilesCopied + other.StaticFilesCopied,
-		Errors:            r.Errors + other.Errors,
+		TotalFilesScanned:      r.TotalFilesScanned + other.TotalFilesScanned,
+		FilesWithUUIDs:         r.FilesWithUUIDs + other.FilesWithUUIDs,
+		FilesGenerated:         r.FilesGenerated + other.FilesGenerated,
+		FilesSkipped:           r.FilesSkipped + other.FilesSkipped,
+		TagPagesGenerated:      r.TagPagesGenerated + other.TagPagesGenerated,
+		StaticFilesCopied:      r.StaticFilesCopied + other.StaticFilesCopied,
+		AttachmentsCopied:      r.AttachmentsCopied + other.AttachmentsCopied,
+		ImageVariantsGenerated: r.ImageVariantsGenerated + other.ImageVariantsGenerated,
+		SocialCardsGenerated:   r.SocialCardsGenerated + other.SocialCardsGenerated,
+		PrivateLeaks:           r.PrivateLeaks + other.PrivateLeaks,
+		LinksDegraded:          r.LinksDegraded + other.LinksDegraded,
+		UnsafeStripped:         r.UnsafeStripped + other.UnsafeStripped,
+		Errors:                 r.Errors + other.Errors,
 	}
 }
 
-func (r GenerationResult) PrintSummary(procFiles *ProcessedFiles) {
-	duration := time.Since(r.startTime)
+// PrintSummary writes the summary of a build to standard output.
+func (r GenerationResult) PrintSummary(procFiles *ProcessedFiles, diagnostics *Diagnostics) {
+	r.WriteSummary(os.Stdout, procFiles, diagnostics)
+}
+
+// WriteSummary writes the summary of a build to w, in colour if w is a
+// terminal.
+func (r GenerationResult) WriteSummary(w io.Writer, procFiles *ProcessedFiles, diagnostics *Diagnostics) {
+	duration := r.Duration()
+	colors := colorTerminal(w)
 
 	type tagCount struct {
 		name  string
 		count int
 	}
 	var tags []tagCount
-	procFiles.TagMap.Range(func(key, value any) bool {
-		if tag, ok := key.(string); ok {
-			if files, ok := value.([]FileInfo); ok {
-				tags = append(tags, tagCount{name: tag, count: len(files)})
-			}
+	for _, tag := range procFiles.Index.TagCounts() {
+		tags = append(tags, tagCount{name: tag.Name, count: tag.Count})
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		if tags[i].count != tags[j].count {
+			return tags[i].count > tags[j].count
 		}
-		return true
-	})
-	sort.Slice(tags, func(i, j int) bool {
-		return tags[i].count > tags[j].count
+		return tags[i].name < tags[j].name
 	})
 
-	pastelMagenta := color.RGB(255, 182, 193).SprintFunc()
-	pastelBlue := color.RGB(173, 216, 230).SprintFunc()
-	pastelGreen := color.RGB(152, 251, 152).SprintFunc()
-	pastelRed := color.RGB(255, 160, 160).SprintFunc()
-	pastelYellow := color.RGB(255, 255, 224).SprintFunc()
-
-	fmt.Printf("\n✨  %s  ✨\n\n", pastelMagenta("Generation Complete!"))
-	fmt.Printf("Total files scanned:  %s\n", pastelBlue(r.TotalFilesScanned))
-	fmt.Printf("Files with UUIDs:     %s\n", pastelBlue(r.FilesWithUUIDs))
-	fmt.Printf("Files generated:      %s\n", pastelGreen(r.FilesGenerated))
-	fmt.Printf("Files skipped:        %s\n", pastelBlue(r.FilesSkipped))
-	fmt.Printf("Tag pages generated:  %s\n", pastelGreen(r.TagPagesGenerated))
-	fmt.Printf("Static files copied:  %s\n", pastelGreen(r.StaticFilesCopied))
+	pastelMagenta := summaryColor(colors, 255, 182, 193)
+	pastelBlue := summaryColor(colors, 173, 216, 230)
+	pastelGreen := summaryColor(colors, 152, 251, 152)
+	pastelRed := summaryColor(colors, 255, 160, 160)
+	pastelYellow := summaryColor(colors, 255, 255, 224)
+
+	fmt.Fprintf(w, "\n✨  %s  ✨\n\n", pastelMagenta("Generation Complete!"))
+	fmt.Fprintf(w, "Total files scanned:  %s\n", pastelBlue(r.TotalFilesScanned))
+	fmt.Fprintf(w, "Files with UUIDs:     %s\n", pastelBlue(r.FilesWithUUIDs))
+	fmt.Fprintf(w, "Files generated:      %s\n", pastelGreen(r.FilesGenerated))
+	fmt.Fprintf(w, "Files skipped:        %s\n", pastelBlue(r.FilesSkipped))
+	fmt.Fprintf(w, "Tag pages generated:  %s\n", pastelGreen(r.TagPagesGenerated))
+	fmt.Fprintf(w, "Static files copied:  %s\n", pastelGreen(r.StaticFilesCopied))
+	if r.AttachmentsCopied > 0 {
+		fmt.Fprintf(w, "Attachments copied:   %s\n", pastelGreen(r.AttachmentsCopied))
+	}
+	if r.ImageVariantsGenerated > 0 {
+		fmt.Fprintf(w, "Image variants:       %s\n", pastelGreen(r.ImageVariantsGenerated))
+	}
+	if r.SocialCardsGenerated > 0 {
+		fmt.Fprintf(w, "Social cards:         %s\n", pastelGreen(r.SocialCardsGenerated))
+	}
+	if r.LinksDegraded > 0 {
+		fmt.Fprintf(w, "Links degraded:       %s\n", pastelYellow(r.LinksDegraded))
+	}
+	if r.UnsafeStripped > 0 {
+		fmt.Fprintf(w, "Unsafe HTML stripped: %s\n", pastelYellow(r.UnsafeStripped))
+	}
 	if r.FeedGenerated {
-		fmt.Printf("Feed generated:       %s\n", pastelGreen("Yes"))
+		fmt.Fprintf(w, "Feed generated:       %s\n", pastelGreen("Yes"))
+	}
+
+	if r.PrivateLeaks > 0 {
+		fmt.Fprintf(w, "Private leaks:        %s\n", pastelRed(r.PrivateLeaks))
 	}
 
 	if r.Errors > 0 {
-		fmt.Printf("Errors:               %s\n", pastelRed(r.Errors))
+		fmt.Fprintf(w, "Errors:               %s\n", pastelRed(r.Errors))
 	} else {
-		fmt.Printf("Errors:               %s\n", pastelGreen(0))
+		fmt.Fprintf(w, "Errors:               %s\n", pastelGreen(0))
 	}
 
-	fmt.Printf("Duration:             %s\n", pastelYellow(duration.Round(time.Millisecond)))
+	fmt.Fprintf(w, "Duration:             %s\n", pastelYellow(duration.Round(time.Millisecond)))
 
 	if len(tags) > 0 {
-		pastelTagColors := []*color.Color{
-			color.RGB(255, 182, 193),
-			color.RGB(221, 160, 221),
-			color.RGB(173, 216, 230),
-			color.RGB(152, 251, 152),
-			color.RGB(255, 228, 181),
-			color.RGB(255, 255, 224),
+		pastelTagColors := []func(a ...any) string{
+			summaryColor(colors, 255, 182, 193),
+			summaryColor(colors, 221, 160, 221),
+			summaryColor(colors, 173, 216, 230),
+			summaryColor(colors, 152, 251, 152),
+			summaryColor(colors, 255, 228, 181),
+			summaryColor(colors, 255, 255, 224),
 		}
 
-		fmt.Printf("\nTags (%d):\n", len(tags))
+		fmt.Fprintf(w, "\nTags (%d):\n", len(tags))
 		for i := 0; i < len(tags); i += 3 {
 			for j := 0; j < 3 && i+j < len(tags); j++ {
 				tc := tags[i+j]
@@ -206,14 +488,63 @@ func (r GenerationResult) PrintSummary(procFiles *ProcessedFiles) {
 				for _, c := range tc.name {
 					hash = (hash*31 + int(c)) % len(pastelTagColors)
 				}
-				colorFunc := pastelTagColors[hash].SprintFunc()
-				fmt.Printf(" %s", colorFunc(fmt.Sprintf("%s (%d)", tc.name, tc.count)))
+				colorFunc := pastelTagColors[hash]
+				fmt.Fprintf(w, " %s", colorFunc(fmt.Sprintf("%s (%d)", tc.name, tc.count)))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if entries := diagnostics.Entries(); len(entries) > 0 {
+		fmt.Fprintf(w, "\nDiagnostics (%d errors, %d warnings):\n", diagnostics.Count(SeverityError), diagnostics.Count(SeverityWarning))
+		for i, diag := range entries {
+			if i == 0 || diag.File != entries[i-1].File {
+				file := diag.File
+				if file == "" {
+					file = "(site)"
+				}
+				fmt.Fprintf(w, "  %s\n", pastelBlue(file))
+			}
+			severity := pastelYellow(diag.Severity)
+			if diag.Severity == SeverityError {
+				severity = pastelRed(diag.Severity)
+			}
+			position := "-"
+			if diag.Line > 0 {
+				position = fmt.Sprint(diag.Line)
 			}
-			fmt.Println()
+			fmt.Fprintf(w, "    %4s  %s: %s [%s]\n", position, severity, diag.Message, diag.Code)
 		}
 	}
 }
 
+// summaryColor returns a function formatting its arguments in the colour
+// r, g, b, or plainly if colors is false.
+func summaryColor(colors bool, r, g, b int) func(a ...any) string {
+	c := color.RGB(r, g, b)
+	if colors {
+		c.EnableColor()
+	} else {
+		c.DisableColor()
+	}
+	return c.SprintFunc()
+}
+
+// colorTerminal reports whether w is a terminal to write colours to. NO_COLOR
+// and TERM=dumb turn colours off.
+func colorTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// Duration returns how long the build has taken since SetStartTime.
+func (r GenerationResult) Duration() time.Duration {
+	return time.Since(r.startTime)
+}
+
 func (r *GenerationResult) SetStartTime(t time.Time) {
 	r.startTime = t
 }
@@ -222,40 +553,63 @@ type Pipeline struct {
 	ctx       BuildContext
 	procFiles *ProcessedFiles
 	result    GenerationResult
-	phases    []func(*Pipeline) (*ProcessedFiles, GenerationResult)
+	phases    []pipelinePhase
+}
+
+type pipelinePhase struct {
+	name string
+	run  func(*Pipeline) (*ProcessedFiles, GenerationResult)
 }
 
 func NewPipeline(ctx BuildContext) *Pipeline {
 	return &Pipeline{
 		ctx:    ctx,
-		phases: []func(*Pipeline) (*ProcessedFiles, GenerationResult){},
+		phases: []pipelinePhase{},
 		result: GenerationResult{},
 	}
 }
 
 // WithFullPhase adds a phase that processes and potentially modifies procFiles
 func (p *Pipeline) WithFullPhase(phase func(*ProcessedFiles, BuildContext) (*ProcessedFiles, GenerationResult)) *Pipeline {
-	p.phases = append(p.phases, func(pl *Pipeline) (*ProcessedFiles, GenerationResult) {
+	p.phases = append(p.phases, pipelinePhase{phaseName(phase), func(pl *Pipeline) (*ProcessedFiles, GenerationResult) {
 		return phase(pl.procFiles, pl.ctx)
-	})
+	}})
 	return p
 }
 
 // WithOutputOnlyPhase wraps a phase that only returns GenerationResult
 func (p *Pipeline) WithOutputOnlyPhase(phase func(*ProcessedFiles, BuildContext) GenerationResult) *Pipeline {
-	p.phases = append(p.phases, func(pl *Pipeline) (*ProcessedFiles, GenerationResult) {
+	p.phases = append(p.phases, pipelinePhase{phaseName(phase), func(pl *Pipeline) (*ProcessedFiles, GenerationResult) {
 		return pl.procFiles, phase(pl.procFiles, pl.ctx)
-	})
+	}})
 	return p
 }
 
+// Named names the phase added last in timings, in place of its function's
+// name. Phases written as function literals need it.
+func (p *Pipeline) Named(name string) *Pipeline {
+	if len(p.phases) > 0 {
+		p.phases[len(p.phases)-1].name = name
+	}
+	return p
+}
+
+// phaseName returns the name of the function phase without its package.
+func phaseName(phase any) string {
+	name := runtime.FuncForPC(reflect.ValueOf(phase).Pointer()).Name()
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
 func (p *Pipeline) Execute() (*ProcessedFiles, GenerationResult) {
 	startTime := time.Now()
 
 	for _, phase := range p.phases {
 		var newResult GenerationResult
-		p.procFiles, newResult = phase(p)
+		phaseStart := time.Now()
+		p.procFiles, newResult = phase.run(p)
 		p.result = p.result.Add(newResult)
+		p.ctx.Timings.Phase(phase.name, time.Since(phaseStart))
+		slog.Debug("Phase complete", "phase", phase.name, "duration", time.Since(phaseStart))
 	}
 
 	p.result.SetStartTime(startTime)
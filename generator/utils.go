@@ -2,14 +2,16 @@ package generator
 
 import (
 	"os"
+
+	"github.com/niklasfasching/go-org/org"
 )
 
-func copyFile(src, dst string) error {
+func copyFile(ctx BuildContext, src, dst string) error {
 	data, err := os.ReadFile(src)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(dst, data, 0644)
+	return writeOutput(ctx, dst, data)
 }
 
 func isValidUUID(s string) bool {
@@ -30,3 +32,75 @@ func isValidUUID(s string) bool {
 func isHexChar(b byte) bool {
 	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
 }
+
+// walkOrgNodes calls fn for each node in nodes and, depth first, for every node
+// nested inside it. Returning false from fn skips the node's descendants.
+func walkOrgNodes(nodes []org.Node, fn func(org.Node) bool) {
+	for _, node := range nodes {
+		if node == nil || !fn(node) {
+			continue
+		}
+		walkOrgNodes(orgNodeChildren(node), fn)
+	}
+}
+
+// orgNodeChildren returns every node directly nested inside node, including
+// inline content such as headline titles, link descriptions and table cells.
+func orgNodeChildren(node org.Node) []org.Node {
+	switch n := node.(type) {
+	case org.Headline:
+		return append(append([]org.Node{}, n.Title...), n.Children...)
+	case org.Paragraph:
+		return n.Children
+	case org.Block:
+		if n.Result != nil {
+			return append(append([]org.Node{}, n.Children...), n.Result)
+		}
+		return n.Children
+	case org.Result:
+		return []org.Node{n.Node}
+	case org.Drawer:
+		return n.Children
+	case org.List:
+		return n.Items
+	case org.ListItem:
+		return n.Children
+	case org.DescriptiveListItem:
+		return append(append([]org.Node{}, n.Term...), n.Details...)
+	case org.Table:
+		var cells []org.Node
+		for _, row := range n.Rows {
+			for _, column := range row.Columns {
+				cells = append(cells, column.Children...)
+			}
+		}
+		return cells
+	case org.NodeWithMeta:
+		return []org.Node{n.Node}
+	case org.NodeWithName:
+		return []org.Node{n.Node}
+	case org.Include:
+		if n.Resolve != nil {
+			return []org.Node{n.Resolve()}
+		}
+	case org.Emphasis:
+		return n.Content
+	case org.RegularLink:
+		return n.Description
+	case org.InlineBlock:
+		return n.Children
+	case org.LatexBlock:
+		return n.Content
+	case org.LatexFragment:
+		return n.Content
+	case org.Example:
+		return n.Children
+	case org.FootnoteDefinition:
+		return n.Children
+	case org.FootnoteLink:
+		if n.Definition != nil {
+			return n.Definition.Children
+		}
+	}
+	return nil
+}
@@ -156,7 +156,7 @@ func TestCopyFile(t *testing.T) {
 		t.Fatalf("Failed to create source file: %v", err)
 	}
 
-	if err := copyFile(sourceFile, destFile); err != nil {
+	if err := copyFile(BuildContext{}, sourceFile, destFile); err != nil {
 		t.Fatalf("copyFile failed: %v", err)
 	}
 
@@ -177,7 +177,7 @@ func TestCopyFile_NonExistentSource(t *testing.T) {
 	sourceFile := filepath.Join(tmpDir, "nonexistent.txt")
 	destFile := filepath.Join(tmpDir, "dest.txt")
 
-	err := copyFile(sourceFile, destFile)
+	err := copyFile(BuildContext{}, sourceFile, destFile)
 	if err == nil {
 		t.Error("Expected error copying non-existent file, got nil")
 	}
@@ -200,7 +200,7 @@ func TestCopyFile_OverwriteExisting(t *testing.T) {
 		t.Fatalf("Failed to create dest file: %v", err)
 	}
 
-	if err := copyFile(sourceFile, destFile); err != nil {
+	if err := copyFile(BuildContext{}, sourceFile, destFile); err != nil {
 		t.Fatalf("copyFile failed: %v", err)
 	}
 
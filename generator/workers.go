@@ -0,0 +1,54 @@
+package generator
+
+import (
+	"runtime"
+	"sync"
+)
+
+// WorkerPool bounds how many files a build works on at once. One pool is
+// shared by every phase, so a build never holds more than its size of
+// goroutines, open files and parsed documents in flight, however many notes
+// there are. Phases run one after another, so they never compete for it.
+type WorkerPool struct {
+	slots chan struct{}
+}
+
+// NewWorkerPool returns a pool running up to jobs tasks at once, or one per
+// CPU if jobs is less than 1.
+func NewWorkerPool(jobs int) *WorkerPool {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	return &WorkerPool{slots: make(chan struct{}, jobs)}
+}
+
+// Size returns how many tasks p runs at once.
+func (p *WorkerPool) Size() int {
+	if p == nil {
+		return runtime.NumCPU()
+	}
+	return cap(p.slots)
+}
+
+// Run calls fn for each i in [0, n), at most p.Size() at a time, and returns
+// once every call has. A goroutine is only started when a slot is free. fn
+// must not call Run itself, as it would wait for a slot its caller holds. A
+// nil pool runs one task per CPU.
+func (p *WorkerPool) Run(n int, fn func(i int)) {
+	if p == nil {
+		p = NewWorkerPool(0)
+	}
+	var wg sync.WaitGroup
+	for i := range n {
+		p.slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-p.slots
+				wg.Done()
+			}()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,58 @@
+package generator
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	pool := NewWorkerPool(3)
+	if pool.Size() != 3 {
+		t.Errorf("Size() = %d, want 3", pool.Size())
+	}
+	var running, peak, done int64
+	pool.Run(50, func(i int) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			p := atomic.LoadInt64(&peak)
+			if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt64(&running, -1)
+		atomic.AddInt64(&done, 1)
+	})
+	if done != 50 {
+		t.Errorf("Run() called fn %d times, want 50", done)
+	}
+	if peak > 3 {
+		t.Errorf("Run() ran %d tasks at once, want at most 3", peak)
+	}
+
+	var none *WorkerPool
+	var count int64
+	none.Run(10, func(int) { atomic.AddInt64(&count, 1) })
+	if count != 10 || NewWorkerPool(0).Size() != none.Size() {
+		t.Errorf("nil pool ran %d tasks with size %d", count, none.Size())
+	}
+}
+
+func TestBuildWithOneJob(t *testing.T) {
+	tmpDir := MustCreateTempDir(t, "test-workers-")
+	defer CleanupTempDir(tmpDir)
+
+	CreateTestOrgFile(tmpDir, "a.org", "#+title: A\n* One :go:\nHello.\n")
+	CreateTestOrgFile(tmpDir, "b.org", "#+title: B\n* Two :go:\nWorld.\n")
+	ctx := BuildContext{Root: tmpDir, DestDir: tmpDir + "/public", ForceRebuild: true, Pool: NewWorkerPool(1)}
+	procFiles, result := FindAndProcessOrgFiles(nil, ctx)
+	tmpls, err := SetupTemplates(tmpDir)
+	if err != nil {
+		t.Fatalf("SetupTemplates() error = %v", err)
+	}
+	result = result.Add(GenerateHtmlPages(procFiles, ctx, tmpls.Page)).Add(GenerateTagPages(procFiles, ctx, tmpls.Tag))
+	if result.FilesGenerated != 2 || result.TagPagesGenerated != 1 || result.Errors != 0 {
+		t.Errorf("build with one job = %+v", result)
+	}
+}
@@ -79,26 +79,22 @@ This is the actual home page.
 		t.Errorf("Expected 3 files with UUIDs, got %d", result1.FilesWithUUIDs)
 	}
 
-	uuid1, _ := procFiles.UuidMap.Load(generator.UUID("550e8400-e29b-41d4-a716-446655440001"))
-	loc1 := uuid1.(generator.HeaderLocation)
+	loc1, _ := procFiles.Index.Lookup(generator.UUID("550e8400-e29b-41d4-a716-446655440001"))
 	if loc1.FilePath != "doc1.org" {
-		t.Errorf("Expected doc1.org for 550e8400-e29b-41d4-a716-446655440001, got %v", uuid1)
+		t.Errorf("Expected doc1.org for 550e8400-e29b-41d4-a716-446655440001, got %v", loc1)
 	}
 
-	uuid2, _ := procFiles.UuidMap.Load(generator.UUID("550e8400-e29b-41d4-a716-446655440002"))
-	loc2 := uuid2.(generator.HeaderLocation)
+	loc2, _ := procFiles.Index.Lookup(generator.UUID("550e8400-e29b-41d4-a716-446655440002"))
 	if loc2.FilePath != "subdir/doc2.org" {
-		t.Errorf("Expected subdir/doc2.org for 550e8400-e29b-41d4-a716-446655440002, got %v", uuid2)
+		t.Errorf("Expected subdir/doc2.org for 550e8400-e29b-41d4-a716-446655440002, got %v", loc2)
 	}
 
-	pageTmpl, tagTmpl, indexTmpl, _, _, err := generator.SetupTemplates(tmpDir)
+	tmpls, err := generator.SetupTemplates(tmpDir)
 	if err != nil {
 		t.Fatalf("SetupTemplates failed: %v", err)
 	}
-	_ = tagTmpl
-	_ = indexTmpl
 
-	result2 := generator.GenerateHtmlPages(procFiles, *ctx, pageTmpl)
+	result2 := generator.GenerateHtmlPages(procFiles, *ctx, tmpls.Page)
 
 	if result2.FilesGenerated != 4 {
 		t.Errorf("Expected 4 files generated, got %d", result2.FilesGenerated)
@@ -198,12 +194,12 @@ Link to [[id:550e8400-e29b-41d4-a716-446655440010][Root]] and [[id:550e8400-e29b
 		t.Errorf("Expected 4 files scanned, got %d", result1.TotalFilesScanned)
 	}
 
-	pageTmpl, _, _, _, _, err := generator.SetupTemplates(tmpDir)
+	tmpls, err := generator.SetupTemplates(tmpDir)
 	if err != nil {
 		t.Fatalf("SetupTemplates failed: %v", err)
 	}
 
-	result2 := generator.GenerateHtmlPages(procFiles, *ctx, pageTmpl)
+	result2 := generator.GenerateHtmlPages(procFiles, *ctx, tmpls.Page)
 	if result2.FilesGenerated != 4 {
 		t.Errorf("Expected 4 files generated, got %d", result2.FilesGenerated)
 	}
@@ -302,12 +298,12 @@ Different link styles:
 		t.Errorf("Expected 4 files with UUIDs, got %d", result1.FilesWithUUIDs)
 	}
 
-	pageTmpl, _, _, _, _, err := generator.SetupTemplates(tmpDir)
+	tmpls, err := generator.SetupTemplates(tmpDir)
 	if err != nil {
 		t.Fatalf("SetupTemplates failed: %v", err)
 	}
 
-	result2 := generator.GenerateHtmlPages(procFiles, *ctx, pageTmpl)
+	result2 := generator.GenerateHtmlPages(procFiles, *ctx, tmpls.Page)
 	if result2.FilesGenerated != 5 {
 		t.Errorf("Expected 5 files generated, got %d", result2.FilesGenerated)
 	}
@@ -492,12 +488,12 @@ Using multiple paragraphs ensures proper preview extraction.`, now)
 
 	procFiles, _ := generator.FindAndProcessOrgFiles(nil, *ctx)
 
-	_, _, _, atomTmpl, _, err := generator.SetupTemplates(tmpDir)
+	tmpls, err := generator.SetupTemplates(tmpDir)
 	if err != nil {
 		t.Fatalf("SetupTemplates failed: %v", err)
 	}
 
-	result := generator.GenerateAtomFeed(procFiles, *ctx, atomTmpl)
+	result := generator.GenerateAtomFeed(procFiles, *ctx, tmpls.Atom)
 	if result.Errors != 0 {
 		t.Errorf("GenerateAtomFeed() errors = %v, want 0", result.Errors)
 	}
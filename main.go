@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 
@@ -18,6 +20,9 @@ import (
 
 var (
 	srv *server.Server
+	// relatedCache carries the words of each page from one build of a
+	// watch session to the next.
+	relatedCache = generator.NewRelatedCache()
 )
 
 const (
@@ -26,13 +31,17 @@ const (
 	watchDebounce = 100 * time.Millisecond
 )
 
-func buildSite(root string, forceRebuild bool, destDir string, cfg *config.Config) error {
+// buildSite builds the site from root into destDir. With dryRun set, every
+// page is rendered into it instead, and nothing is written.
+func buildSite(root string, forceRebuild bool, destDir string, cfg *config.Config, dryRun *generator.MemoryOutput) error {
 	absDestDir, err := filepath.Abs(destDir)
 	if err != nil {
 		return fmt.Errorf("error getting absolute path for destDir: %w", err)
 	}
 
-	if err := os.MkdirAll(absDestDir, 0755); err != nil {
+	if dryRun != nil {
+		forceRebuild = true
+	} else if err := os.MkdirAll(absDestDir, 0755); err != nil {
 		return fmt.Errorf("error creating dest directory: %w", err)
 	}
 
@@ -52,6 +61,20 @@ func buildSite(root string, forceRebuild bool, destDir string, cfg *config.Confi
 		return fmt.Errorf("error getting absolute path: %w", err)
 	}
 
+	sourceDate, err := generator.SourceDateEpoch()
+	if err != nil {
+		return fmt.Errorf("invalid SOURCE_DATE_EPOCH: %w", err)
+	}
+
+	var renderCache *generator.RenderCache
+	if dryRun == nil {
+		if path, err := generator.RenderCachePath(absDestDir); err != nil {
+			slog.Warn("No cache directory for render diagnostics; skipped pages are rendered again", "error", err)
+		} else {
+			renderCache = generator.OpenRenderCache(path)
+		}
+	}
+
 	ctx := generator.BuildContext{
 		Root:         absPath,
 		DestDir:      absDestDir,
@@ -62,32 +85,234 @@ func buildSite(root string, forceRebuild bool, destDir string, cfg *config.Confi
 		Author:       cfg.Author,
 		LicenseName:  cfg.LicenseName,
 		LicenseURL:   cfg.LicenseURL,
+		AttachIDDir:  cfg.AttachIDDir,
+		ImageWidths:  cfg.ImageWidths,
+
+		HighlightTheme:       cfg.HighlightTheme,
+		HighlightLineNumbers: cfg.HighlightLineNumbers,
+
+		Bibliography:     cfg.Bibliography,
+		CitationStyle:    cfg.CitationStyle,
+		BibliographyPage: cfg.BibliographyPage,
+
+		RelatedWeights: cfg.RelatedWeights,
+		RelatedCount:   cfg.RelatedCount,
+
+		Macros: cfg.Macros,
+
+		SocialCards:      cfg.SocialCards == nil || *cfg.SocialCards,
+		SocialCardLayout: cfg.SocialCardLayout,
+		SocialCardColors: cfg.SocialCardColors,
+
+		PrivateTags:       cfg.PrivateTags,
+		PrivateProperties: cfg.PrivateProperties,
+
+		PublishTags:          cfg.PublishTags,
+		PublishPaths:         cfg.PublishPaths,
+		UnpublishedLinks:     cfg.UnpublishedLinks,
+		UnpublishedLinkTitle: cfg.UnpublishedLinkTitle,
+
+		SafeMode: cfg.SafeMode,
+
+		SourceDate: sourceDate,
+
+		DryRun:      dryRun,
+		Diagnostics: generator.NewDiagnostics(absPath, cfg.SuppressDiagnostics),
+		Pool:        generator.NewWorkerPool(jobs),
+		Timings:     generator.NewTimings(),
+		Outputs:     generator.NewOutputLog(),
+
+		RelatedCache: relatedCache,
+		RenderCache:  renderCache,
+	}
+
+	var profile *generator.Profile
+	if profileDir != "" {
+		if profile, err = generator.StartProfile(profileDir); err != nil {
+			return err
+		}
 	}
 
 	startTime := time.Now()
 
 	procFiles, result := generator.NewPipeline(ctx).
 		WithFullPhase(generator.FindAndProcessOrgFiles).
+		WithFullPhase(generator.ApplyPublishScope).
+		WithFullPhase(generator.LoadData).
+		WithFullPhase(generator.ProcessImages).
+		WithFullPhase(generator.GenerateSocialCards).
+		WithFullPhase(generator.ProcessCitations).
+		WithFullPhase(generator.ComputeRelatedPages).
 		WithOutputOnlyPhase(func(procFiles *generator.ProcessedFiles, ctx generator.BuildContext) generator.GenerationResult {
-			pageTmpl, tagTmpl, indexTmpl, atomTmpl, _, err := generator.SetupTemplates(absPath)
+			tmpls, err := generator.SetupTemplates(absPath)
 			if err != nil {
+				ctx.Diagnostics.Error("template", "", 0, "failed to load templates: %v", err)
 				return generator.GenerationResult{Errors: 1}
 			}
-			return generator.GenerateHtmlPages(procFiles, ctx, pageTmpl).Add(
-				generator.GenerateTagPages(procFiles, ctx, tagTmpl)).Add(
-				generator.GenerateIndexPage(procFiles, ctx, indexTmpl)).Add(
-				generator.GenerateAtomFeed(procFiles, ctx, atomTmpl))
-		}).
+			ctx.TmplModTime = tmpls.ModTime
+			generator.BindTables(procFiles, tmpls.Page, tmpls.Tag, tmpls.Index, tmpls.TheIndex, tmpls.Events)
+			return generator.GenerateHtmlPages(procFiles, ctx, tmpls.Page).Add(
+				generator.GenerateTagPages(procFiles, ctx, tmpls.Tag)).Add(
+				generator.GenerateIndexPage(procFiles, ctx, tmpls.Index)).Add(
+				generator.GenerateAtomFeed(procFiles, ctx, tmpls.Atom)).Add(
+				generator.GenerateBibliographyPage(procFiles, ctx, tmpls.Page)).Add(
+				generator.GenerateTheIndex(procFiles, ctx, tmpls.TheIndex)).Add(
+				generator.GenerateEventsPage(procFiles, ctx, tmpls.Events))
+		}).Named("GeneratePages").
 		WithOutputOnlyPhase(generator.CopyStaticFiles).
+		WithOutputOnlyPhase(generator.CopyAttachments).
+		WithOutputOnlyPhase(generator.WriteHighlightStylesheet).
+		WithOutputOnlyPhase(generator.GenerateCalendars).
+		WithOutputOnlyPhase(generator.ExportTables).
+		WithOutputOnlyPhase(generator.CheckPrivateLeaks).
 		Execute()
 
+	if err := renderCache.Save(); err != nil {
+		slog.Warn("Failed to save render diagnostics cache", "error", err)
+	}
+
 	result.SetStartTime(startTime)
-	result.PrintSummary(procFiles)
+	report := generator.NewBuildReport(result, procFiles, ctx)
+	if reportFormat == "json" {
+		if err := report.WriteJSON(os.Stdout); err != nil {
+			return fmt.Errorf("error writing report: %w", err)
+		}
+	} else {
+		result.PrintSummary(procFiles, ctx.Diagnostics)
+	}
+	if reportFile != "" {
+		var buf bytes.Buffer
+		if err := report.WriteJSON(&buf); err != nil {
+			return fmt.Errorf("error encoding report: %w", err)
+		}
+		if err := os.WriteFile(reportFile, buf.Bytes(), 0644); err != nil {
+			return fmt.Errorf("error writing report: %w", err)
+		}
+	}
+
+	if profile != nil {
+		if err := profile.Stop(ctx.Timings); err != nil {
+			return err
+		}
+		if reportFormat != "json" {
+			fmt.Println()
+			ctx.Timings.WriteReport(os.Stdout, 10)
+			fmt.Printf("\nProfile written to %s\n", profileDir)
+		}
+	}
 
-	if srv != nil {
+	if srv != nil && dryRun == nil {
 		srv.NotifyReload()
 	}
 
+	if result.PrivateLeaks > 0 {
+		return fmt.Errorf("private text found in %d output files; rebuild with --force to replace stale output", result.PrivateLeaks)
+	}
+	if strict {
+		// Most errors are also diagnostics, but not all of them.
+		errs := max(ctx.Diagnostics.Count(generator.SeverityError), result.Errors)
+		if n := ctx.Diagnostics.Count(generator.SeverityWarning) + errs; n > 0 {
+			return fmt.Errorf("build reported %d diagnostics with --strict", n)
+		}
+	}
+	return nil
+}
+
+// verifyBuild rebuilds the site from root into a temporary directory and
+// compares the result with destDir, failing if they differ.
+func verifyBuild(root string, destDir string, cfg *config.Config) error {
+	tmpDir, err := os.MkdirTemp("", "oxen-verify-")
+	if err != nil {
+		return fmt.Errorf("error creating verify directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if path, err := generator.RenderCachePath(tmpDir); err == nil {
+		defer os.Remove(path)
+	}
+
+	if err := buildSite(root, true, tmpDir, cfg, nil); err != nil {
+		return err
+	}
+
+	diff, err := generator.DiffOutput(tmpDir, destDir)
+	if err != nil {
+		return fmt.Errorf("error comparing output: %w", err)
+	}
+	for _, path := range diff.Changed {
+		fmt.Printf("changed: %s\n", path)
+	}
+	for _, path := range diff.Missing {
+		fmt.Printf("missing: %s\n", path)
+	}
+	for _, path := range diff.Extra {
+		fmt.Printf("stale:   %s (not produced by a fresh build)\n", path)
+	}
+	if !diff.Empty() {
+		return fmt.Errorf("%s differs from a fresh build in %d files", destDir, len(diff.Changed)+len(diff.Missing)+len(diff.Extra))
+	}
+	fmt.Printf("\n%s matches a fresh build\n", destDir)
+	return nil
+}
+
+// dryRunBuild builds the site from root in memory and reports the files a
+// build would create, modify or delete in destDir, with unified diffs of the
+// modified HTML if showDiff is set. Nothing is written.
+func dryRunBuild(root string, destDir string, cfg *config.Config, showDiff bool) error {
+	output := generator.NewMemoryOutput()
+	if err := buildSite(root, true, destDir, cfg, output); err != nil {
+		return err
+	}
+
+	diff, err := output.Diff(destDir)
+	if err != nil {
+		return fmt.Errorf("error comparing output: %w", err)
+	}
+	fmt.Println()
+	for _, path := range diff.Missing {
+		fmt.Printf("create: %s\n", path)
+	}
+	for _, path := range diff.Changed {
+		fmt.Printf("modify: %s\n", path)
+	}
+	for _, path := range diff.Extra {
+		fmt.Printf("delete: %s (no longer produced)\n", path)
+	}
+	if showDiff {
+		for _, path := range diff.Changed {
+			if filepath.Ext(path) != ".html" {
+				continue
+			}
+			old, err := os.ReadFile(filepath.Join(destDir, filepath.FromSlash(path)))
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", path, err)
+			}
+			updated, _ := output.File(path)
+			fmt.Printf("\n%s", generator.UnifiedDiff("a/"+path, "b/"+path, old, updated))
+		}
+	}
+	fmt.Printf("\nDry run: %d to create, %d to modify, %d to delete; nothing was written to %s\n", len(diff.Missing), len(diff.Changed), len(diff.Extra), destDir)
+	return nil
+}
+
+// checkReportFlags rejects a --report format Oxen doesn't know, and
+// --report=json with modes that print more than the report to standard
+// output.
+func checkReportFlags() error {
+	switch reportFormat {
+	case "text":
+		return nil
+	case "json":
+	default:
+		return fmt.Errorf("unknown --report format %q: use text or json", reportFormat)
+	}
+	switch {
+	case dryRun || showDiff:
+		return fmt.Errorf("--report=json cannot be used with --dry-run; use --report-file instead")
+	case verify:
+		return fmt.Errorf("--report=json cannot be used with --verify; use --report-file instead")
+	case watch:
+		return fmt.Errorf("--report=json cannot be used with --watch; use --report-file instead")
+	}
 	return nil
 }
 
@@ -99,7 +324,7 @@ func runWatchMode(ctx context.Context, root string, forceRebuild bool, destDir s
 	defer watcher.Close()
 
 	fmt.Println("Starting initial build...")
-	if err := buildSite(root, forceRebuild, destDir, cfg); err != nil {
+	if err := buildSite(root, forceRebuild, destDir, cfg, nil); err != nil {
 		slog.Error("Initial build failed", "error", err)
 	}
 
@@ -194,7 +419,7 @@ func runWatchMode(ctx context.Context, root string, forceRebuild bool, destDir s
 			return "s"
 		}(), rebuildCount)
 
-		if err := buildSite(root, forceRebuild, destDir, cfg); err != nil {
+		if err := buildSite(root, forceRebuild, destDir, cfg, nil); err != nil {
 			slog.Error("Build failed", "error", err)
 		}
 		fmt.Printf("\nWatching %s for changes... (Press Ctrl+C to stop)\n", absPath)
@@ -202,12 +427,21 @@ func runWatchMode(ctx context.Context, root string, forceRebuild bool, destDir s
 }
 
 var (
-	dir        string
-	force      bool
-	watch      bool
-	port       int
-	dest       string
-	configJSON string
+	dir          string
+	force        bool
+	watch        bool
+	port         int
+	dest         string
+	configJSON   string
+	configFile   string
+	verify       bool
+	dryRun       bool
+	showDiff     bool
+	strict       bool
+	jobs         int
+	profileDir   string
+	reportFormat string
+	reportFile   string
 )
 
 func main() {
@@ -228,20 +462,34 @@ func main() {
 		Short: "Build the site from <dir>",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			cfg, err := config.LoadConfig(args[0], configJSON)
+			cfg, err := config.LoadConfig(args[0], configFile, configJSON)
 			if err != nil {
 				slog.Error("Failed to load config", "error", err)
 				os.Exit(1)
 			}
+			if err := checkReportFlags(); err != nil {
+				slog.Error("Invalid flags", "error", err)
+				os.Exit(1)
+			}
 
-			if watch {
+			if dryRun || showDiff {
+				if err := dryRunBuild(args[0], dest, cfg, showDiff); err != nil {
+					slog.Error("Dry run failed", "error", err)
+					os.Exit(1)
+				}
+			} else if verify {
+				if err := verifyBuild(args[0], dest, cfg); err != nil {
+					slog.Error("Verification failed", "error", err)
+					os.Exit(1)
+				}
+			} else if watch {
 				ctx := context.Background()
 				if err := runWatchMode(ctx, args[0], force, dest, cfg); err != nil {
 					slog.Error("Watch mode failed", "error", err)
 					os.Exit(1)
 				}
 			} else {
-				if err := buildSite(args[0], force, dest, cfg); err != nil {
+				if err := buildSite(args[0], force, dest, cfg, nil); err != nil {
 					slog.Error("Build failed", "error", err)
 					os.Exit(1)
 				}
@@ -254,7 +502,7 @@ func main() {
 		Short: "Serve the built site",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			cfg, err := config.LoadConfig(args[0], configJSON)
+			cfg, err := config.LoadConfig(args[0], configFile, configJSON)
 			if err != nil {
 				slog.Error("Failed to load config", "error", err)
 				os.Exit(1)
@@ -274,7 +522,7 @@ func main() {
 					os.Exit(1)
 				}
 			} else {
-				if err := buildSite(args[0], force, dest, cfg); err != nil {
+				if err := buildSite(args[0], force, dest, cfg, nil); err != nil {
 					slog.Error("Build failed", "error", err)
 					os.Exit(1)
 				}
@@ -284,6 +532,28 @@ func main() {
 		},
 	}
 
+	var configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration",
+	}
+
+	var configShowCmd = &cobra.Command{
+		Use:   "show <dir>",
+		Short: "Print the effective configuration for <dir> and where each value came from",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			effective, err := config.Load(config.Options{Dir: args[0], File: configFile, JSON: configJSON, Env: os.Environ()})
+			if err != nil {
+				slog.Error("Failed to load config", "error", err)
+				os.Exit(1)
+			}
+			if err := effective.Show(os.Stdout); err != nil {
+				slog.Error("Failed to show config", "error", err)
+				os.Exit(1)
+			}
+		},
+	}
+
 	var lookupCmd = &cobra.Command{
 		Use:   "lookup-id <dir> <id>",
 		Short: "Find the file containing the given ID",
@@ -300,8 +570,7 @@ func main() {
 			}
 			procFiles, _ := generator.FindAndProcessOrgFiles(nil, ctx)
 
-			if path, found := procFiles.UuidMap.Load(args[1]); found {
-				location := path.(generator.HeaderLocation)
+			if location, found := procFiles.Index.Lookup(generator.UUID(args[1])); found {
 				fmt.Printf("ID %s found in: %s (header index: %d)\n", args[1], location.FilePath, location.HeaderIndex)
 			} else {
 				fmt.Printf("ID %s not found\n", args[1])
@@ -312,15 +581,30 @@ func main() {
 	buildCmd.Flags().BoolVarP(&force, "force", "f", false, "force rebuild all files")
 	buildCmd.Flags().BoolVarP(&watch, "watch", "w", false, "watch for changes and rebuild")
 	buildCmd.Flags().StringVar(&dest, "dest", defaultDest, "output directory")
-	buildCmd.Flags().StringVar(&configJSON, "config", "", "JSON config string (overrides .oxen.json)")
+	buildCmd.Flags().StringVar(&configJSON, "config", "", "JSON config string (overrides every other source)")
+	buildCmd.Flags().StringVar(&configFile, "config-file", "", "JSON config file (overrides .oxen.json)")
+	buildCmd.Flags().BoolVar(&verify, "verify", false, "rebuild into a temporary directory and compare with the output directory")
+	buildCmd.Flags().BoolVar(&dryRun, "dry-run", false, "build in memory and list the files that would change, without writing them")
+	buildCmd.Flags().BoolVar(&showDiff, "diff", false, "show unified diffs of changed HTML (implies --dry-run)")
+	buildCmd.Flags().BoolVar(&strict, "strict", false, "fail the build if it reports any warnings or errors")
+	buildCmd.Flags().IntVarP(&jobs, "jobs", "j", runtime.NumCPU(), "number of files to work on at once")
+	buildCmd.Flags().StringVar(&profileDir, "profile", "", "write CPU and heap profiles and a timing report to this directory")
+	buildCmd.Flags().StringVar(&reportFormat, "report", "text", "build report on standard output: text or json")
+	buildCmd.Flags().StringVar(&reportFile, "report-file", "", "also write the JSON build report to this file")
 
 	serveCmd.Flags().BoolVarP(&force, "force", "f", false, "force rebuild all files")
 	serveCmd.Flags().BoolVarP(&watch, "watch", "w", false, "watch for changes and rebuild")
 	serveCmd.Flags().IntVarP(&port, "port", "p", defaultPort, "port to serve on")
 	serveCmd.Flags().StringVar(&dest, "dest", defaultDest, "output directory")
-	serveCmd.Flags().StringVar(&configJSON, "config", "", "JSON config string (overrides .oxen.json)")
+	serveCmd.Flags().StringVar(&configJSON, "config", "", "JSON config string (overrides every other source)")
+	serveCmd.Flags().StringVar(&configFile, "config-file", "", "JSON config file (overrides .oxen.json)")
+	serveCmd.Flags().IntVarP(&jobs, "jobs", "j", runtime.NumCPU(), "number of files to work on at once")
+
+	configShowCmd.Flags().StringVar(&configJSON, "config", "", "JSON config string (overrides every other source)")
+	configShowCmd.Flags().StringVar(&configFile, "config-file", "", "JSON config file (overrides .oxen.json)")
+	configCmd.AddCommand(configShowCmd)
 
-	rootCmd.AddCommand(buildCmd, serveCmd, lookupCmd)
+	rootCmd.AddCommand(buildCmd, serveCmd, configCmd, lookupCmd)
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}